@@ -0,0 +1,153 @@
+/* HTTP access logging for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "io"
+    "log"
+    "net"
+    "time"
+    "net/http"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A ResponseWriter that captures the status and size of a response,
+// whoever writes it (e.g. http.ServeFile())
+type StatusCapturingResponseWriter struct {
+    http.ResponseWriter
+    status int
+    bytes int64
+}
+
+// An access log entry, as written in JSON format
+type AccessLogEntry struct {
+    Time string `json:"time"`
+    RemoteAddr string `json:"remoteAddr"`
+    Method string `json:"method"`
+    Path string `json:"path"`
+    Protocol string `json:"protocol"`
+    Status int `json:"status"`
+    Bytes int64 `json:"bytes"`
+    DurationUs int64 `json:"durationUs"`
+    Referer string `json:"referer,omitempty"`
+    UserAgent string `json:"userAgent,omitempty"`
+    RequestId string `json:"requestId,omitempty"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The access log formats
+const ACCESS_LOG_COMMON string = "common"
+const ACCESS_LOG_COMBINED string = "combined"
+const ACCESS_LOG_JSON string = "json"
+
+// The time format of the common and combined log formats
+const ACCESS_LOG_TIME_FORMAT string = "02/Jan/2006:15:04:05 -0700"
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Capture the status
+func (out *StatusCapturingResponseWriter) WriteHeader(status int) {
+    if out.status == 0 {
+        out.status = status
+    }
+    out.ResponseWriter.WriteHeader(status)
+}
+
+// Capture the size (and the implicit status if there was no WriteHeader())
+func (out *StatusCapturingResponseWriter) Write(data []byte) (int, error) {
+    if out.status == 0 {
+        out.status = http.StatusOK
+    }
+    n, err := out.ResponseWriter.Write(data)
+    out.bytes += int64(n)
+    return n, err
+}
+
+// Pass on a Flush() to the underlying ResponseWriter, if it can
+func (out *StatusCapturingResponseWriter) Flush() {
+    flusher, ok := out.ResponseWriter.(http.Flusher)
+    if ok {
+        flusher.Flush()
+    }
+}
+
+// Return the underlying ResponseWriter, for http.ResponseController
+func (out *StatusCapturingResponseWriter) Unwrap() http.ResponseWriter {
+    return out.ResponseWriter
+}
+
+// Return a quoted string for the common/combined log format, "-" if empty
+func accessLogQuote(value string) string {
+    if value == "" {
+        return "\"-\""
+    }
+    quoted, _ := json.Marshal(value)
+    return string(quoted)
+}
+
+// Wrap an HTTP handler so that each request is written to an access log
+// in the given format; the common and combined formats have the request
+// duration and then the request ID, see requestIdHandler(), appended
+func accessLogHandler(handler http.Handler, output io.Writer, format string) http.Handler {
+    // A Logger serialises writes from concurrent requests
+    logger := log.New(output, "", 0)
+
+    return http.HandlerFunc(func(out http.ResponseWriter, in *http.Request) {
+        start := time.Now()
+        capture := &StatusCapturingResponseWriter{ResponseWriter: out}
+        handler.ServeHTTP(capture, in)
+        if capture.status == 0 {
+            capture.status = http.StatusOK
+        }
+        duration := time.Now().Sub(start)
+        host, _, err := net.SplitHostPort(in.RemoteAddr)
+        if err != nil {
+            host = in.RemoteAddr
+        }
+        switch format {
+            case ACCESS_LOG_JSON:
+                entry, _ := json.Marshal(&AccessLogEntry{Time: start.Format(time.RFC3339Nano),
+                                                         RemoteAddr: host,
+                                                         Method: in.Method,
+                                                         Path: in.URL.RequestURI(),
+                                                         Protocol: in.Proto,
+                                                         Status: capture.status,
+                                                         Bytes: capture.bytes,
+                                                         DurationUs: int64(duration / time.Microsecond),
+                                                         Referer: in.Referer(),
+                                                         UserAgent: in.UserAgent(),
+                                                         RequestId: in.Header.Get(REQUEST_ID_HEADER)})
+                logger.Printf("%s\n", entry)
+            case ACCESS_LOG_COMBINED:
+                logger.Printf("%s - - [%s] \"%s %s %s\" %d %d %s %s %d %s\n", host, start.Format(ACCESS_LOG_TIME_FORMAT),
+                              in.Method, in.URL.RequestURI(), in.Proto, capture.status, capture.bytes,
+                              accessLogQuote(in.Referer()), accessLogQuote(in.UserAgent()), int64(duration / time.Microsecond),
+                              accessLogQuote(in.Header.Get(REQUEST_ID_HEADER)))
+            default:
+                logger.Printf("%s - - [%s] \"%s %s %s\" %d %d %d %s\n", host, start.Format(ACCESS_LOG_TIME_FORMAT),
+                              in.Method, in.URL.RequestURI(), in.Proto, capture.status, capture.bytes,
+                              int64(duration / time.Microsecond), accessLogQuote(in.Header.Get(REQUEST_ID_HEADER)))
+        }
+    })
+}
+
+/* End Of File */
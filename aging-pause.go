@@ -0,0 +1,176 @@
+/* Pausing the deletion of segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+    "net/http"
+    "sync/atomic"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The state of the pause in segment deletion, as served by the admin
+// endpoints and in the statistics
+type AgingPauseState struct {
+    Paused bool `json:"paused"`
+    // When deletion will resume automatically, absent if it won't be
+    Until string `json:"until,omitempty"`
+    // The segments that would have been deleted but are being kept
+    HeldSegments int64 `json:"heldSegments"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL paths of the admin endpoints which pause and resume the
+// deletion of segments; ADMIN_MUTE_FOR_PARAMETER may be given to
+// ADMIN_PAUSE_AGING_PATH in the same way
+const ADMIN_PAUSE_AGING_PATH string = "/admin/pause-aging"
+const ADMIN_RESUME_AGING_PATH string = "/admin/resume-aging"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Whether the deletion of segments is paused and, if non-zero, when it
+// will resume
+var agingPaused bool
+var agingPauseUntil time.Time
+var agingPauseAccess sync.Mutex
+
+// The number of segments being kept because deletion is paused,
+// accessed atomically
+var numSegmentsHeld int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Pause the deletion of segments, resuming it automatically after
+// duration if that is non-zero; segments still age out of the playlists
+func pauseAging(duration time.Duration) {
+    agingPauseAccess.Lock()
+    defer agingPauseAccess.Unlock()
+    agingPaused = true
+    agingPauseUntil = time.Time{}
+    if duration > 0 {
+        agingPauseUntil = time.Now().Add(duration)
+        log.Printf("Deletion of segments PAUSED for %v.\n", duration)
+    } else {
+        log.Printf("Deletion of segments PAUSED.\n")
+    }
+}
+
+// Resume the deletion of segments; those held meanwhile are deleted the
+// next time the segments are aged
+func resumeAging() {
+    agingPauseAccess.Lock()
+    defer agingPauseAccess.Unlock()
+    if agingPaused {
+        log.Printf("Deletion of segments resumed.\n")
+    }
+    agingPaused = false
+    agingPauseUntil = time.Time{}
+}
+
+// Return the state of the pause in segment deletion, resuming deletion
+// if the time has come
+func agingPauseState() AgingPauseState {
+    var state AgingPauseState
+
+    agingPauseAccess.Lock()
+    defer agingPauseAccess.Unlock()
+    if agingPaused && !agingPauseUntil.IsZero() && !time.Now().Before(agingPauseUntil) {
+        log.Printf("Deletion of segments resumed automatically.\n")
+        agingPaused = false
+        agingPauseUntil = time.Time{}
+    }
+    state.Paused = agingPaused
+    if agingPaused && !agingPauseUntil.IsZero() {
+        state.Until = agingPauseUntil.UTC().Format(time.RFC3339)
+    }
+    state.HeldSegments = atomic.LoadInt64(&numSegmentsHeld)
+
+    return state
+}
+
+// Return the number of the removable segments which may be deleted now:
+// all of them unless deletion is paused, in which case only the oldest
+// beyond maxHeld, so that a pause left on cannot fill the disk
+func segmentsToDelete(maxHeld int) int {
+    var removable int
+
+    for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
+        if newElement.Value.(*Mp3AudioFile).removable {
+            removable++
+        }
+    }
+    if !agingPauseState().Paused {
+        atomic.StoreInt64(&numSegmentsHeld, 0)
+        return removable
+    }
+    if removable <= maxHeld {
+        atomic.StoreInt64(&numSegmentsHeld, int64(removable))
+        return 0
+    }
+    log.Printf("Deletion of segments is paused but %d segment(s) are held, more than %d, deleting the oldest %d.\n",
+               removable, maxHeld, removable - maxHeld)
+    atomic.StoreInt64(&numSegmentsHeld, int64(maxHeld))
+    return removable - maxHeld
+}
+
+// Handle POST requests to ADMIN_PAUSE_AGING_PATH and
+// ADMIN_RESUME_AGING_PATH, responding with the resulting AgingPauseState
+func agingPauseHandler(out http.ResponseWriter, in *http.Request) {
+    var duration time.Duration
+    var err error
+
+    if in.Method != "POST" {
+        apiMethodNotAllowed(out, in, "POST")
+        return
+    }
+    if !checkAdminToken(out, in) {
+        return
+    }
+    if in.URL.Path == ADMIN_PAUSE_AGING_PATH {
+        value := in.URL.Query().Get(ADMIN_MUTE_FOR_PARAMETER)
+        if value != "" {
+            duration, err = time.ParseDuration(value)
+            if (err != nil) || (duration <= 0) {
+                apiError(out, in, http.StatusBadRequest, API_ERROR_BAD_REQUEST, "invalid \"" + ADMIN_MUTE_FOR_PARAMETER + "\" duration")
+                return
+            }
+        }
+        log.Printf("Pause of segment deletion requested by %s.\n", in.RemoteAddr)
+        pauseAging(duration)
+    } else {
+        log.Printf("Resumption of segment deletion requested by %s.\n", in.RemoteAddr)
+        resumeAging()
+    }
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    state := agingPauseState()
+    err = json.NewEncoder(out).Encode(&state)
+    if err != nil {
+        log.Printf("Unable to serve segment deletion state (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,121 @@
+/* Tests of pausing the deletion of segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "errors"
+    "testing"
+    "sync/atomic"
+    "encoding/json"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Age segments out of a playlist with deletion paused, checking that
+// they leave the playlist but are kept, no more than the ceiling of
+// them, the oldest going first, then that they are deleted once
+// deletion is resumed through the admin endpoint
+func TestAgingPause(t *testing.T) {
+    var err error
+    dirName := t.TempDir()
+    var store OsFileStore
+    options := AudioOutOptions{PlaylistStore: store, SegmentStore: store, PlaylistWindow: time.Second * 20,
+                               Retention: time.Second * 20, AgingPauseMaxSegments: 2}
+    playlistAccess.Lock()
+    savedPlaylists := playlists
+    playlists = createPlaylists(filepath.Join(dirName, "live" + PLAYLIST_EXTENSION),
+                                PlaylistConfig{Window: options.PlaylistWindow}, nil)
+    playlistAccess.Unlock()
+    mp3FileList.Init()
+    setAdminToken("secret")
+    t.Cleanup(func() {
+        resumeAging()
+        atomic.StoreInt64(&numSegmentsHeld, 0)
+        setAdminToken("")
+        mp3FileList.Init()
+        playlistAccess.Lock()
+        playlists = savedPlaylists
+        playlistAccess.Unlock()
+    })
+    // Three old segments, oldest first, and a new one
+    for x, age := range []time.Duration{time.Minute * 3, time.Minute * 2, time.Minute, 0} {
+        fileName := fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION)
+        err = writeStoreFile(store, filepath.Join(dirName, fileName), []byte("MP3"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        addMp3File(&Mp3AudioFile{fileName: fileName, timestamp: time.Now().Add(-age), duration: time.Second * 5},
+                   options, false)
+    }
+    admin := func(path string) AgingPauseState {
+        var state AgingPauseState
+        response := httptest.NewRecorder()
+        request := httptest.NewRequest("POST", path, nil)
+        request.Header.Set("Authorization", "Bearer secret")
+        agingPauseHandler(response, request)
+        json.NewDecoder(response.Body).Decode(&state)
+        return state
+    }
+    exist := func(expected ...bool) error {
+        for x, exists := range expected {
+            filePath := filepath.Join(dirName, fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION))
+            _, err := os.Stat(filePath)
+            if (err == nil) != exists {
+                return errors.New(fmt.Sprintf("\"%s\" exists %t when it should be %t", filePath, err == nil, exists))
+            }
+        }
+        return nil
+    }
+
+    if !admin(ADMIN_PAUSE_AGING_PATH + "?for=1h").Paused {
+        t.Fatal("deletion of segments not paused")
+    }
+    ageMp3Files(dirName, options, false)
+    err = exist(false, true, true, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, playlist := range playlists {
+        for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
+            if (newElement != mp3FileList.Back()) && newElement.Value.(*Mp3AudioFile).listedIn(playlist) {
+                t.Fatalf("held segment \"%s\" still listed in the playlist",
+                         newElement.Value.(*Mp3AudioFile).fileName)
+            }
+        }
+    }
+    if held := agingPauseState().HeldSegments; held != 2 {
+        t.Fatalf("%d segment(s) held when the ceiling is 2", held)
+    }
+
+    state := admin(ADMIN_RESUME_AGING_PATH)
+    if state.Paused {
+        t.Fatal("deletion of segments not resumed")
+    }
+    ageMp3Files(dirName, options, false)
+    err = exist(false, false, false, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if held := agingPauseState().HeldSegments; held != 0 {
+        t.Fatalf("%d segment(s) still held after deletion resumed", held)
+    }
+}
+
+/* End Of File */
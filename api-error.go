@@ -0,0 +1,112 @@
+/* Structured errors from the API endpoints of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "regexp"
+    "net/http"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The body of an error response from a JSON or admin endpoint
+type ApiError struct {
+    // One of the API_ERROR_ codes, for programs
+    Code string `json:"code"`
+    // What went wrong, for people
+    Message string `json:"message"`
+    // The ID of the request, as written to the access log
+    RequestId string `json:"requestId,omitempty"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The codes of ApiError
+const API_ERROR_BAD_REQUEST string = "bad_request"
+const API_ERROR_UNAUTHORISED string = "unauthorised"
+const API_ERROR_NOT_FOUND string = "not_found"
+const API_ERROR_METHOD_NOT_ALLOWED string = "method_not_allowed"
+const API_ERROR_CONFLICT string = "conflict"
+
+// The header which carries the ID of a request, which the client may
+// set and which is always returned in the response
+const REQUEST_ID_HEADER string = "X-Request-Id"
+
+// The number of random bytes in a request ID made by the server
+const REQUEST_ID_SIZE int = 8
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// What a request ID given by a client must look like to be used
+var requestIdPattern = regexp.MustCompile("^[A-Za-z0-9._-]{1,64}$")
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Wrap an HTTP handler so that every request has an ID, the one given
+// by the client in REQUEST_ID_HEADER if it is sensible, otherwise a new
+// one; the ID is put in the request, for the access log and error
+// responses, and returned in the response
+func requestIdHandler(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(out http.ResponseWriter, in *http.Request) {
+        requestId := in.Header.Get(REQUEST_ID_HEADER)
+        if !requestIdPattern.MatchString(requestId) {
+            id := make([]byte, REQUEST_ID_SIZE)
+            rand.Read(id)
+            requestId = hex.EncodeToString(id)
+            in.Header.Set(REQUEST_ID_HEADER, requestId)
+        }
+        out.Header().Set(REQUEST_ID_HEADER, requestId)
+        handler.ServeHTTP(out, in)
+    })
+}
+
+// Respond to a request to a JSON or admin endpoint with an error
+func apiError(out http.ResponseWriter, in *http.Request, status int, code string, message string) {
+    log.Printf("Responding to \"%s\" from %s with %d (%s).\n", in.URL.Path, in.RemoteAddr, status, message)
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    out.Header().Set("X-Content-Type-Options", "nosniff")
+    out.WriteHeader(status)
+    err := json.NewEncoder(out).Encode(&ApiError{Code: code, Message: message,
+                                                 RequestId: in.Header.Get(REQUEST_ID_HEADER)})
+    if err != nil {
+        log.Printf("Unable to serve error (%s).\n", err.Error())
+    }
+}
+
+// Respond to a request to a JSON or admin endpoint with a method that
+// it does not allow
+func apiMethodNotAllowed(out http.ResponseWriter, in *http.Request, allowed string) {
+    out.Header().Set("Allow", allowed)
+    apiError(out, in, http.StatusMethodNotAllowed, API_ERROR_METHOD_NOT_ALLOWED,
+             "method " + in.Method + " not allowed, only " + allowed)
+}
+
+// Handle requests for admin endpoints that don't exist
+func apiNotFoundHandler(out http.ResponseWriter, in *http.Request) {
+    apiError(out, in, http.StatusNotFound, API_ERROR_NOT_FOUND, "no such endpoint")
+}
+
+/* End Of File */
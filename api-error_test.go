@@ -0,0 +1,68 @@
+/* Tests of api-error.go for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+    "net/http"
+    "encoding/json"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Make requests of the admin endpoints that should fail, through
+// requestIdHandler(), failing if any response is not the
+// expected ApiError carrying the request ID
+func TestApiErrors(t *testing.T) {
+    mux := http.NewServeMux()
+    mux.HandleFunc(ADMIN_MUTE_PATH, muteHandler)
+    mux.HandleFunc(ADMIN_PATH, apiNotFoundHandler)
+    handler := requestIdHandler(mux)
+    setAdminToken("test")
+    t.Cleanup(func() {
+        setAdminToken("")
+    })
+    for _, test := range []struct{method string; path string; token string; requestId string; status int; code string}{
+                           {"GET", ADMIN_MUTE_PATH, "test", "", http.StatusMethodNotAllowed, API_ERROR_METHOD_NOT_ALLOWED},
+                           {"POST", ADMIN_MUTE_PATH, "wrong", "dashboard-1", http.StatusUnauthorized, API_ERROR_UNAUTHORISED},
+                           {"POST", ADMIN_MUTE_PATH + "?" + ADMIN_MUTE_FOR_PARAMETER + "=never", "test", "", http.StatusBadRequest, API_ERROR_BAD_REQUEST},
+                           {"POST", ADMIN_PATH + "nothing", "test", "not a valid ID", http.StatusNotFound, API_ERROR_NOT_FOUND}} {
+        var body ApiError
+        request := httptest.NewRequest(test.method, test.path, nil)
+        request.Header.Set("Authorization", "Bearer " + test.token)
+        if test.requestId != "" {
+            request.Header.Set(REQUEST_ID_HEADER, test.requestId)
+        }
+        response := httptest.NewRecorder()
+        handler.ServeHTTP(response, request)
+        err := json.Unmarshal(response.Body.Bytes(), &body)
+        if err != nil {
+            t.Fatalf("%s %s: response \"%s\" is not JSON (%s)", test.method, test.path,
+                     response.Body.String(), err.Error())
+        }
+        requestId := response.Header().Get(REQUEST_ID_HEADER)
+        if (response.Code != test.status) || (body.Code != test.code) || (body.Message == "") ||
+           (requestId == "") || (body.RequestId != requestId) {
+            t.Fatalf("%s %s: %d %+v, request ID \"%s\", when %d \"%s\" was expected",
+                     test.method, test.path, response.Code, body, requestId, test.status, test.code)
+        }
+        if requestIdPattern.MatchString(test.requestId) && (requestId != test.requestId) {
+            t.Fatalf("request ID \"%s\" replaced with \"%s\"", test.requestId, requestId)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,85 @@
+/* Guard against audio in a format the encoder is not set up for, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync/atomic"
+    "github.com/u-blox/ioc-server/lame"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The format of some PCM audio
+type AudioFormat struct {
+    SampleRate int
+    Channels int
+}
+
+// Keeps audio which is not in the format of the encoder out of it:
+// fed as is, such audio would come out at the wrong pitch and speed
+type AudioFormatGuard struct {
+    // True while the audio is in the wrong format
+    mismatched bool
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The number of datagrams thrown away because their audio was not in
+// the format of the encoder, accessed atomically
+var numFormatMismatches int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the format of the audio an MP3 encoder has been set up for
+func encoderAudioFormat(mp3Writer *lame.LameWriter) AudioFormat {
+    return AudioFormat{mp3Writer.Encoder.InSamplerate(), mp3Writer.Encoder.NumChannels()}
+}
+
+// Check the audio of a datagram against the format of the encoder; if
+// it does not match, the audio is thrown away, so that it is concealed
+// like any other missing audio, rather than being encoded at the wrong
+// pitch and speed; returns true if the audio has started or stopped
+// matching, which is a discontinuity
+func (guard *AudioFormatGuard) Check(datagram *UrtpDatagram, encoder AudioFormat) bool {
+    if datagram.Audio == nil {
+        return false
+    }
+    if datagram.Format != encoder {
+        atomic.AddInt64(&numFormatMismatches, 1)
+        log.Printf("ERROR: datagram %d has audio at %d Hz, %d channel(s) but the MP3 encoder is set up for %d Hz, %d channel(s), throwing the audio away.\n",
+                   datagram.SequenceNumber, datagram.Format.SampleRate, datagram.Format.Channels,
+                   encoder.SampleRate, encoder.Channels)
+        datagram.Audio = nil
+        if !guard.mismatched {
+            guard.mismatched = true
+            return true
+        }
+        return false
+    }
+    if guard.mismatched {
+        log.Printf("Audio is in the format of the MP3 encoder again.\n")
+        guard.mismatched = false
+        return true
+    }
+
+    return false
+}
+
+/* End Of File */
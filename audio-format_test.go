@@ -0,0 +1,54 @@
+/* Tests of guard against audio in a format the encoder is not set up for, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Pass audio in the wrong format through the guard, failing
+// if it is let through or the discontinuities are not where they should be
+func TestAudioFormat(t *testing.T) {
+    var guard AudioFormatGuard
+
+    encoder := AudioFormat{SAMPLING_FREQUENCY, 1}
+    mismatches := atomic.LoadInt64(&numFormatMismatches)
+    samples := make([]int16, SAMPLES_PER_BLOCK)
+    for x, test := range []struct{format AudioFormat; discontinuity bool}{
+                            {encoder, false},
+                            {AudioFormat{SAMPLING_FREQUENCY * 3, 1}, true},
+                            {AudioFormat{SAMPLING_FREQUENCY, 2}, false},
+                            {encoder, true},
+                            {encoder, false}} {
+        datagram := &UrtpDatagram{SequenceNumber: uint16(x), Audio: &samples, Format: test.format}
+        discontinuity := guard.Check(datagram, encoder)
+        if discontinuity != test.discontinuity {
+            t.Fatalf("datagram %d with audio at %+v: discontinuity %t when %t was expected",
+                     x, test.format, discontinuity, test.discontinuity)
+        }
+        if (datagram.Audio == nil) != (test.format != encoder) {
+            t.Fatalf("datagram %d with audio at %+v: audio kept %t", x, test.format, datagram.Audio != nil)
+        }
+    }
+    if atomic.LoadInt64(&numFormatMismatches) - mismatches != 2 {
+        t.Fatalf("%d format mismatch(es) counted when there were 2",
+                 atomic.LoadInt64(&numFormatMismatches) - mismatches)
+    }
+}
+
+/* End Of File */
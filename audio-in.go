@@ -18,6 +18,10 @@ import (
     "os"
     "log"
     "bytes"
+    "time"
+    "sync"
+    "context"
+    "sync/atomic"
 //    "encoding/hex"
 )
 
@@ -27,16 +31,54 @@ import (
 
 // Struct to hold a URTP datagram
 type UrtpDatagram struct {
+    Source          net.Addr
     SequenceNumber  uint16
     Timestamp       uint64
     Audio           *[]int16
+    // The format of Audio, as decoded from its audio coding scheme
+    Format          AudioFormat
+    // True for the first datagram of a new input session, e.g. after a
+    // TCP connection was dropped for longer than the reconnect grace,
+    // from which the timeline starts again
+    NewSession      bool
+}
+
+// Why a sequence of bytes is not a URTP header, see verifyUrtpHeader()
+type UrtpHeaderFault int
+
+// The reassembly of the URTP datagrams in the stream of a TCP
+// connection, which is owned by serveTcpConnection(), and the
+// statistics of the connection
+type UrtpReassembler struct {
+    // The connection, nil if the stream is not from one
+    connection net.Conn
+    // The bytes received that have yet to be reassembled
+    buffer bytes.Buffer
+    // The datagram being reassembled and, until it is complete, its header
+    datagram bytes.Buffer
+    header bytes.Buffer
+    // Where reassembly has got to, one of the URTP_STATE_ values
+    state int
+    byteCount int
+    payloadSize int
+    // The number of bytes scanned since the last complete datagram
+    bytesScanned int
+    // True while hunting for the sync byte of the next datagram after
+    // sync with the stream has been lost
+    huntingSync bool
+    counters TcpConnectionCounters
 }
 
 //--------------------------------------------------------------------
 // Constants
 //--------------------------------------------------------------------
 
-// The duration of a block of incoming audio in ms
+// The duration of a block of incoming audio in ms, which is also the
+// period of the tick of audio processing; it has nothing to do with the
+// MP3 frames (576 samples, 36 ms, at 16 kHz, so 9 frames to every 18
+// blocks): each tick encodes whatever audio there is, the encoder
+// keeps any part of a frame until the next, and the segments are cut
+// and timed in whole frames by SegmentCutter and StreamOffset
 const BLOCK_DURATION_MS int = 20
 
 // The sampling frequency of the incoming audio
@@ -56,7 +98,8 @@ const URTP_SEQUENCE_NUMBER_SIZE int = 2
 const URTP_PAYLOAD_SIZE_SIZE int = 2
 const URTP_HEADER_SIZE int = 14
 const URTP_SAMPLE_SIZE int = 2
-const URTP_DATAGRAM_MAX_SIZE int = URTP_HEADER_SIZE + SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE
+const URTP_MAX_NUM_CHANNELS int = 2
+const URTP_DATAGRAM_MAX_SIZE int = URTP_HEADER_SIZE + SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE * URTP_MAX_NUM_CHANNELS
 
 // Offset to the number of bytes part of the URTP header
 const URTP_NUM_BYTES_AUDIO_OFFSET int = 12
@@ -70,9 +113,31 @@ const (
     PCM_SIGNED_16_BIT = 0
     UNICAM_COMPRESSED_8_BIT = 1
     UNICAM_COMPRESSED_10_BIT = 2
-    MAX_NUM_AUDIO_CODING_SCHEMES = iota
+    PCM_SIGNED_16_BIT_STEREO = 3
 )
 
+// The reserved audio coding scheme of a heartbeat datagram, which has
+// no payload: a client sends these while it has no audio to send so
+// that it is still seen as alive
+const URTP_HEARTBEAT byte = 0x7f
+
+// The most bytes of a TCP stream that may be held for reassembly at
+// once, and the most that may be scanned (e.g. looking for a sync byte)
+// without a complete datagram being found, before the stream is given
+// up on as not URTP
+const TCP_REASSEMBLY_BUFFER_LIMIT int = URTP_DATAGRAM_MAX_SIZE * 4
+const TCP_REASSEMBLY_SCAN_LIMIT int = URTP_DATAGRAM_MAX_SIZE * 4
+
+// The time after which a source that has sent nothing is no longer active
+const SOURCE_ACTIVE_AGE time.Duration = time.Second * 5
+
+// The minimum interval between log messages about rejected sources
+const REJECTED_SOURCE_LOG_INTERVAL time.Duration = time.Second * 10
+
+// The minimum interval between log messages about losing sync with a
+// TCP stream
+const TCP_RESYNC_LOG_INTERVAL time.Duration = time.Second * 10
+
 // URTP reassembly states (needed for TCP reception)
 const (
     URTP_STATE_WAITING_SYNC = iota
@@ -83,21 +148,95 @@ const (
     URTP_STATE_WAITING_PAYLOAD = iota
 )
 
+// The results of verifyUrtpHeader(), URTP_HEADER_OK if the bytes are a
+// URTP header, otherwise why not; NUM_URTP_HEADER_FAULTS must stay last
+const (
+    URTP_HEADER_OK UrtpHeaderFault = iota
+    URTP_HEADER_TOO_SHORT UrtpHeaderFault = iota
+    URTP_HEADER_BAD_SYNC UrtpHeaderFault = iota
+    URTP_HEADER_BAD_CODING_SCHEME UrtpHeaderFault = iota
+    URTP_HEADER_HEARTBEAT_PAYLOAD UrtpHeaderFault = iota
+    URTP_HEADER_OVERSIZED_PAYLOAD UrtpHeaderFault = iota
+    URTP_HEADER_UNDERSIZED_PAYLOAD UrtpHeaderFault = iota
+    NUM_URTP_HEADER_FAULTS = iota
+)
+
 //--------------------------------------------------------------------
 // Variables
 //--------------------------------------------------------------------
 
-// A buffer for TCP data
-var tcpBuffer bytes.Buffer
+// The number of times reassembly of a TCP stream has been given up on
+// because of TCP_REASSEMBLY_BUFFER_LIMIT or TCP_REASSEMBLY_SCAN_LIMIT,
+// accessed atomically
+var numTcpReassemblyResets int64
+
+// The number of times sync with a TCP stream has been lost and the
+// number of bytes thrown away hunting for it again, accessed
+// atomically, and the last time a summary was logged
+var numTcpResyncs int64
+var numTcpResyncBytesDiscarded int64
+var tcpResyncLogTime time.Time
+
+// The TCP connection whose datagrams are wanted, nil if there is none,
+// and the number of times a connection has ended part way through a
+// datagram (accessed atomically); the mutex is held while datagrams
+// are reassembled, so that only those of that connection get through
+var urtpStreamConnection net.Conn
+var urtpStreamAccess sync.Mutex
+var numTcpPartialDatagrams int64
+
+// The number of UDP datagrams thrown away because they did not begin
+// with a URTP header, by UrtpHeaderFault, accessed atomically
+var numUdpDatagramsRejected [NUM_URTP_HEADER_FAULTS]int64
+
+// The networks from which input is accepted (empty means accept all)
+var allowedSources []*net.IPNet
+var allowedSourceAccess sync.Mutex
+
+// Whether stereo input is accepted, by averaging it down to mono
+var downmixToMono bool
+
+// Count of datagrams/connections rejected because of their source,
+// accessed atomically
+var numRejectedSources int64
+
+// The last time a rejected source was logged, in Unix nanoseconds,
+// accessed atomically
+var rejectedSourceLogNanos int64
 
-// A buffer in which to assemble a URTP packet (required for TCP mode) 
-var urtpDatagram bytes.Buffer
+// How long a TCP connection may be gone before a new connection from
+// the same source starts a new session rather than continuing it
+var tcpReconnectGrace time.Duration
 
-// Where we are in reassembling a URTP packet (required for TCP reception)
-var urtpReassemblyState int = URTP_STATE_WAITING_SYNC
-var urtpByteCount int
-var urtpPayloadSize int
-var header bytes.Buffer
+// The connection of the current (or last) TCP session, the IP address
+// of its source, when it closed (zero while it is open) and whether a
+// new session has started that no datagram has yet been marked with
+var tcpSessionConnection net.Conn
+var tcpSessionSource string
+var tcpSessionClosed time.Time
+var tcpSessionAccess sync.Mutex
+var newInputSession int32
+
+// The maximum number of TCP connections open at once (0 for no limit)
+var maxTcpConnections int
+
+// The number of TCP connections open, the most there have been open at
+// once and the number rejected because of maxTcpConnections; access
+// with sync/atomic
+var numTcpConnections int64
+var peakTcpConnections int64
+var numRejectedTcpConnections int64
+
+// The number of heartbeat datagrams received and the time (in Unix
+// nanoseconds) at which the last arrived, accessed atomically
+var numHeartbeats int64
+var lastHeartbeatNanos int64
+
+// The time at which each source last sent a datagram, keyed by address
+var sourceLastSeen = make(map[string]time.Time)
+
+// Mutex to manage access to sourceLastSeen
+var sourceAccess sync.Mutex
 
 //--------------------------------------------------------------------
 // Functions
@@ -118,9 +257,24 @@ func decodePcm(audioDataPcm []byte) *[]int16 {
     return &audio    
 }
 
+// Average interleaved left/right samples down to mono, the half bit
+// of the average being dithered if ditherer is set
+func downmixStereo(stereo *[]int16) *[]int16 {
+    audio := make([]int16, len(*stereo) / 2)
+    
+    for x := range audio {
+        // Sum as int32 so that the average can't overflow
+        sum := int32((*stereo)[x * 2]) + int32((*stereo)[(x * 2) + 1])
+        audio[x] = ditherer.Quantise(float64(sum) / 2)
+    }
+    
+    return &audio
+}
+
 // Decode UNICAM_COMPRESSED_x_BIT_16000_HZ data from a datagram
 // For details of the format, see the client code (ioc-client)
-func decodeUnicam(audioDataUnicam []byte, sampleSizeBits int) *[]int16 {
+// If diagnostics is not nil it is filled in with what was found
+func decodeUnicam(audioDataUnicam []byte, sampleSizeBits int, diagnostics *UnicamDiagnostics) *[]int16 {
     var numBlocks int
     var blockOffset int
     var blockCount int
@@ -179,6 +333,9 @@ func decodeUnicam(audioDataUnicam []byte, sampleSizeBits int) *[]int16 {
         if shift > peakShift {
             peakShift = shift
         }
+        if diagnostics != nil {
+            diagnostics.ShiftHistogram[shift]++
+        }
         
         //log.Printf("UNICAM block %d, shift value %d.\n", blockCount, shift)
         // Shift the values to uncompress them
@@ -200,45 +357,79 @@ func decodeUnicam(audioDataUnicam []byte, sampleSizeBits int) *[]int16 {
         blockCount++
     }
     log.Printf("UNICAM highest shift value was %d.\n", peakShift)
+    if diagnostics != nil {
+        diagnostics.SampleSizeBits = sampleSizeBits
+        diagnostics.Blocks = numBlocks
+        diagnostics.complete(audio)
+    }
     
     return &audio    
 }
 
-// Handle an incoming URTP datagram and send it off for processing
+// Handle an incoming URTP datagram, of any accepted version, and send
+// it off for processing
 // For details of the format, see the client code (ioc-client)
-func handleUrtpDatagram(packet []byte) {
-    log.Printf("Packet of size %d byte(s) received.\n", len(packet))
+func handleUrtpDatagram(packet []byte, source net.Addr) {
+    var layout *UrtpLayout
+    
+    log.Printf("Packet of size %d byte(s) received from %v.\n", len(packet), source)
 //    log.Printf("%s\n", hex.Dump(line[:numBytesIn]))
-    if (len(packet) >= URTP_HEADER_SIZE) {
+    if len(packet) > 0 {
+        layout = urtpLayoutOf(packet[0])
+    }
+    if (layout != nil) && (len(packet) >= layout.HeaderSize) {
         // Populate a URTP datagram with the data
         urtpDatagram := new(UrtpDatagram)
+        urtpDatagram.Source = source
+        if source != nil {
+            sourceAccess.Lock()
+            sourceLastSeen[source.String()] = time.Now()
+            sourceAccess.Unlock()
+        }
+        audioCodingScheme := packet[URTP_AUDIO_CODING_OFFSET]
+        if audioCodingScheme == URTP_HEARTBEAT {
+            // Never audio, whatever follows it
+            if len(packet) == layout.HeaderSize {
+                handleHeartbeat(source)
+            } else {
+                log.Printf("Ignoring heartbeat with %d byte(s) of payload.\n", len(packet) - layout.HeaderSize)
+            }
+            return
+        }
+        urtpDatagram.NewSession = atomic.CompareAndSwapInt32(&newInputSession, 1, 0)
+        if urtpDatagram.NewSession {
+            // The client may be a different one, sending differently
+            endiannessDetector.Reset()
+        }
         log.Printf("URTP header:\n")
-        log.Printf("  sync byte:        0x%x.\n", packet[0])
-        audioCodingScheme := packet[1]
-        urtpDatagram.SequenceNumber = uint16(packet[2]) << 8 + uint16(packet[3])
+        log.Printf("  sync byte:        0x%x (version %d).\n", packet[0], layout.Version)
+        urtpDatagram.SequenceNumber = uint16(packet[URTP_SEQUENCE_NUMBER_OFFSET]) << 8 + uint16(packet[URTP_SEQUENCE_NUMBER_OFFSET + 1])
         log.Printf("  sequence number:  %d.\n", urtpDatagram.SequenceNumber)
-        urtpDatagram.Timestamp = (uint64(packet[4]) << 56) + (uint64(packet[5]) << 48) + (uint64(packet[6]) << 40) + (uint64(packet[7]) << 32) +
-                                 (uint64(packet[8]) << 24) + (uint64(packet[9]) << 16) + (uint64(packet[10]) << 8) + uint64(packet[11])
+        urtpDatagram.Timestamp = layout.Timestamp(packet)
         log.Printf("  timestamp:        %6.3f ms.\n", float64(urtpDatagram.Timestamp) / 1000)
         
-        if (len(packet) > URTP_HEADER_SIZE) {
-            switch (audioCodingScheme) {
-                case PCM_SIGNED_16_BIT:
-                    log.Printf("  audio coding:     PCM_SIGNED_16_BIT.\n")
-                    urtpDatagram.Audio = decodePcm(packet[URTP_HEADER_SIZE:])
-                case UNICAM_COMPRESSED_8_BIT:
-                    log.Printf("  audio coding:     UNICAM_COMPRESSED_8_BIT.\n")
-                    urtpDatagram.Audio = decodeUnicam(packet[URTP_HEADER_SIZE:], 8)
-                case UNICAM_COMPRESSED_10_BIT:
-                    log.Printf("  audio coding:     UNICAM_COMPRESSED_10_BIT.\n")
-                    urtpDatagram.Audio = decodeUnicam(packet[URTP_HEADER_SIZE:], 10)
-                default:
-                    log.Printf("  audio coding:     !unknown!\n")
+        if (len(packet) > layout.HeaderSize) {
+            var diagnostics *UnicamDiagnostics
+            if unicamDiagnosticsEnabled {
+                diagnostics = &UnicamDiagnostics{SequenceNumber: urtpDatagram.SequenceNumber}
+            }
+            decoder := decoders[audioCodingScheme]
+            if decoder != nil {
+                log.Printf("  audio coding:     %s.\n", decoder.Name())
+                urtpDatagram.Audio, urtpDatagram.Format = decoder.Decode(packet[layout.HeaderSize:], diagnostics)
+            } else {
+                // Only let in if unknown coding schemes are to be concealed
+                log.Printf("  audio coding:     !unknown!\n")
+                countUnknownCodingScheme(audioCodingScheme)
+            }
+            if (diagnostics != nil) && (diagnostics.Blocks > 0) {
+                recordUnicamDiagnostics(diagnostics)
             }
         }
         
         if urtpDatagram.Audio != nil {
-            log.Printf("URTP sample(s) %d\n", len(*urtpDatagram.Audio))
+            log.Printf("URTP sample(s) %d, %d Hz, %d channel(s)\n", len(*urtpDatagram.Audio),
+                       urtpDatagram.Format.SampleRate, urtpDatagram.Format.Channels)
         } else {
             log.Printf("Unable to decode audio samples from this datagram.\n")
         }
@@ -248,145 +439,382 @@ func handleUrtpDatagram(packet []byte) {
     }    
 }
 
-// Verify that a sequence of byte represents URTP beader
+// Return true if a byte is an audio coding scheme there is a decoder
+// for, a heartbeat or, if they are concealed, any other scheme
+func validCodingScheme(scheme byte) bool {
+    return knownCodingScheme(scheme) || (scheme == URTP_HEARTBEAT) || concealUnknownCoding
+}
+
+// Record a heartbeat datagram, which keeps the input alive without
+// adding anything to the audio
+func handleHeartbeat(source net.Addr) {
+    count := atomic.AddInt64(&numHeartbeats, 1)
+    atomic.StoreInt64(&lastHeartbeatNanos, time.Now().UnixNano())
+    log.Printf("Heartbeat %d received from %v.\n", count, source)
+}
+
+// Return the time at which the last heartbeat arrived, zero if none has
+func lastHeartbeatTime() time.Time {
+    nanos := atomic.LoadInt64(&lastHeartbeatNanos)
+    if nanos == 0 {
+        return time.Time{}
+    }
+    return time.Unix(0, nanos)
+}
+
+// Return the name of a URTP header fault, as used in the statistics
+func (fault UrtpHeaderFault) String() string {
+    switch fault {
+        case URTP_HEADER_OK:
+            return "ok"
+        case URTP_HEADER_TOO_SHORT:
+            return "tooShort"
+        case URTP_HEADER_BAD_SYNC:
+            return "badSync"
+        case URTP_HEADER_BAD_CODING_SCHEME:
+            return "badCodingScheme"
+        case URTP_HEADER_HEARTBEAT_PAYLOAD:
+            return "heartbeatPayload"
+        case URTP_HEADER_OVERSIZED_PAYLOAD:
+            return "oversizedPayload"
+        case URTP_HEADER_UNDERSIZED_PAYLOAD:
+            return "undersizedPayload"
+    }
+    return fmt.Sprintf("fault%d", int(fault))
+}
+
+// Verify that a sequence of byte represents URTP beader, of any
+// accepted version, returning URTP_HEADER_OK if it does, else why it
+// does not; for a version with no payload size in its header the
+// sequence of bytes must be the whole datagram
 // For details of the format, see the client code (ioc-client)
-func verifyUrtpHeader(header []byte) bool {
-    var isHeader bool
+func verifyUrtpHeader(header []byte) UrtpHeaderFault {
+    var layout *UrtpLayout
+    fault := URTP_HEADER_TOO_SHORT
+    headerSize := URTP_HEADER_SIZE
     
-    if len(header) >= URTP_HEADER_SIZE {
-        if header[0] == SYNC_BYTE {
-            if header[1] < MAX_NUM_AUDIO_CODING_SCHEMES {
-                bytesOfPayload := ((int(header[URTP_NUM_BYTES_AUDIO_OFFSET]) << 8) + (int(header[URTP_NUM_BYTES_AUDIO_OFFSET + 1])))
-                if bytesOfPayload <= URTP_DATAGRAM_MAX_SIZE {
-                    isHeader = true;
+    if len(header) > 0 {
+        layout = urtpLayoutOf(header[0])
+        if layout != nil {
+            headerSize = layout.HeaderSize
+        }
+    }
+    if len(header) >= headerSize {
+        fault = URTP_HEADER_BAD_SYNC
+        if layout != nil {
+            fault = URTP_HEADER_BAD_CODING_SCHEME
+            if validCodingScheme(header[1]) {
+                bytesOfPayload := layout.PayloadSize(header)
+                if (header[1] == URTP_HEARTBEAT) && (bytesOfPayload != 0) {
+                    fault = URTP_HEADER_HEARTBEAT_PAYLOAD
+                    log.Printf("NOT a URTP header %x (a heartbeat cannot have a payload, this has %d byte(s)).\n", header, bytesOfPayload)
                 } else {
-                    log.Printf("NOT a URTP header %x (%d (0x%x, in the last two bytes) is larger than the maximum number of payload bytes (%d)).\n", header,
-                               bytesOfPayload, bytesOfPayload, URTP_DATAGRAM_MAX_SIZE)
+                    fault = checkPayloadLength(header[1], bytesOfPayload)
+                    if fault != URTP_HEADER_OK {
+                        limits := payloadLimitsOf(header[1])
+                        log.Printf("NOT a URTP header %x (%d (0x%x) is outside the %d to %d payload bytes allowed for audio coding scheme 0x%x).\n", header,
+                                   bytesOfPayload, bytesOfPayload, limits.Min, limits.Max, header[1])
+                    }
                 }
             } else {
                 log.Printf("NOT a URTP header %x (0x%x in the second byte is not a valid audio coding scheme).\n", header, header[1])
+                countUnknownCodingScheme(header[1])
             }
         } else {
-            log.Printf("NOT a URTP header %x (0x%x at the start is not a sync byte (%x)).\n", header, header[0], SYNC_BYTE)
+            log.Printf("NOT a URTP header %x (0x%x at the start is not the sync byte of an accepted version of URTP).\n", header, header[0])
         }
     } else {
-        log.Printf("NOT a URTP header %x (must be at least %d bytes long).\n", header, URTP_HEADER_SIZE)
+        log.Printf("NOT a URTP header %x (must be at least %d bytes long).\n", header, headerSize)
     }
     
-    return isHeader
+    return fault
+}
+
+// Count a UDP datagram thrown away because it does not begin with a
+// URTP header
+func countRejectedUdpDatagram(fault UrtpHeaderFault) {
+    if (fault > URTP_HEADER_OK) && (fault < NUM_URTP_HEADER_FAULTS) {
+        atomic.AddInt64(&numUdpDatagramsRejected[fault], 1)
+    }
+}
+
+// Handle a datagram received over UDP, throwing it away, and counting
+// why, if it does not begin with a URTP header
+func handleUdpDatagram(datagram []byte, source *net.UDPAddr) {
+    if !sourceAllowed(source.IP) {
+        return
+    }
+    // For UDP, a single URTP datagram arrives in a single UDP packet
+    fault := verifyUrtpHeader(datagram)
+    if fault == URTP_HEADER_OK {
+        handleUrtpDatagram(datagram, source)
+    } else {
+        countRejectedUdpDatagram(fault)
+    }
+}
+
+// Return the number of UDP datagrams rejected for each URTP header
+// fault, by name, zeroing the counts if reset is true
+func udpDatagramsRejected(reset bool) map[string]int64 {
+    counts := make(map[string]int64)
+    for fault := URTP_HEADER_OK + 1; fault < NUM_URTP_HEADER_FAULTS; fault++ {
+        if reset {
+            counts[fault.String()] = atomic.SwapInt64(&numUdpDatagramsRejected[fault], 0)
+        } else {
+            counts[fault.String()] = atomic.LoadInt64(&numUdpDatagramsRejected[fault])
+        }
+    }
+    return counts
+}
+
+// Throw away bytes of a TCP stream that are not part of a datagram,
+// counting them and, if sync had not already been lost, the resync;
+// a client framing bug shows up here, so a summary is logged, though
+// not so often as to swamp the log
+func (reassembler *UrtpReassembler) discard(count int) {
+    discarded := atomic.AddInt64(&numTcpResyncBytesDiscarded, int64(count))
+    resyncs := atomic.LoadInt64(&numTcpResyncs)
+    if !reassembler.huntingSync {
+        reassembler.huntingSync = true
+        resyncs = atomic.AddInt64(&numTcpResyncs, 1)
+        reassembler.counters.Resynced()
+    }
+    if time.Now().Sub(tcpResyncLogTime) >= TCP_RESYNC_LOG_INTERVAL {
+        tcpResyncLogTime = time.Now()
+        log.Printf("TCP reassembly: lost sync with the stream from %v, hunting for the next datagram (%d resync(s), %d byte(s) discarded so far).\n",
+                   reassembler.source(), resyncs, discarded)
+    }
+}
+
+// Give up on reassembling a stream, starting again and counting it
+func (reassembler *UrtpReassembler) abandon(reason string) {
+    resets := atomic.AddInt64(&numTcpReassemblyResets, 1)
+    log.Printf("TCP reassembly: giving up on the stream from %v, %s (%d time(s) so far).\n", reassembler.source(), reason, resets)
+    reassembler.Reset()
+}
+
+// Return a reassembler for the stream of a connection, which may be nil
+// if the stream is not from one
+func newUrtpReassembler(connection net.Conn) *UrtpReassembler {
+    now := time.Now()
+    return &UrtpReassembler{connection: connection, state: URTP_STATE_WAITING_SYNC,
+                            counters: TcpConnectionCounters{opened: now, lastActivity: now.UnixNano()}}
+}
+
+// Return the address that the stream is from, nil if it is not from a
+// connection
+func (reassembler *UrtpReassembler) source() net.Addr {
+    if reassembler.connection == nil {
+        return nil
+    }
+    return reassembler.connection.RemoteAddr()
 }
 
 // Handle a stream of (e.g. TCP) bytes containing URTP datagrams
 // For details of the format, see the client code (ioc-client)
-func handleUrtpStream(data []byte) {
+// Returns false if the stream does not look like URTP, having exceeded
+// TCP_REASSEMBLY_BUFFER_LIMIT or TCP_REASSEMBLY_SCAN_LIMIT, in which
+// case reassembly has been reset and the connection should be closed
+func (reassembler *UrtpReassembler) Handle(data []byte) bool {
     var err error
     var item byte
     
+    if reassembler.buffer.Len() + len(data) > TCP_REASSEMBLY_BUFFER_LIMIT {
+        reassembler.abandon(fmt.Sprintf("%d byte(s) would be buffered (limit %d)",
+                                        reassembler.buffer.Len() + len(data), TCP_REASSEMBLY_BUFFER_LIMIT))
+        return false
+    }
+    
     // Write all the data to the TCP buffer
-    tcpBuffer.Write(data)
+    reassembler.buffer.Write(data)
     
     log.Printf("TCP reassembly: %d byte(s) received.\n", len(data))
-    for item, err = tcpBuffer.ReadByte(); err == nil; item, err = tcpBuffer.ReadByte() {
-        //log.Printf("TCP reassembly: state %d, byte %d (0x%x).\n", urtpReassemblyState, item, item)
-        switch (urtpReassemblyState) {
+    for item, err = reassembler.buffer.ReadByte(); err == nil; item, err = reassembler.buffer.ReadByte() {
+        reassembler.bytesScanned++
+        if reassembler.bytesScanned > TCP_REASSEMBLY_SCAN_LIMIT {
+            reassembler.abandon(fmt.Sprintf("no complete datagram in %d byte(s)", TCP_REASSEMBLY_SCAN_LIMIT))
+            return false
+        }
+        //log.Printf("TCP reassembly: state %d, byte %d (0x%x).\n", reassembler.state, item, item)
+        switch (reassembler.state) {
             case URTP_STATE_WAITING_SYNC:
-                // Look for the sync byte
-                if item == SYNC_BYTE {
-                    header.WriteByte(item)
-                    urtpReassemblyState = URTP_STATE_WAITING_AUDIO_CODING
+                // Look for the sync byte; only the standard version of
+                // URTP, with a payload size, can be taken from a stream
+                if (item == SYNC_BYTE) && urtpVersionAccepted(URTP_VERSION_STANDARD) {
+                    reassembler.header.WriteByte(item)
+                    reassembler.state = URTP_STATE_WAITING_AUDIO_CODING
                 } else {
                     //log.Printf("TCP reassembly: awaiting initial sync byte but 0x%x isn't one (0x%x).\n", item, SYNC_BYTE)
-                    header.Reset()
-                    urtpReassemblyState = URTP_STATE_WAITING_SYNC
+                    reassembler.discard(1)
+                    reassembler.header.Reset()
+                    reassembler.state = URTP_STATE_WAITING_SYNC
                 }
             case URTP_STATE_WAITING_AUDIO_CODING:
                 // Look for the audio coding scheme and check it
-                if item < MAX_NUM_AUDIO_CODING_SCHEMES {
-                    header.WriteByte(item)
+                if validCodingScheme(item) {
+                    reassembler.header.WriteByte(item)
                     //log.Printf("TCP reassembly: audio coding scheme 0x%x.\n", item)
-                    urtpReassemblyState = URTP_STATE_WAITING_SEQUENCE_NUMBER
+                    reassembler.state = URTP_STATE_WAITING_SEQUENCE_NUMBER
                 } else {
                     log.Printf("TCP reassembly: audio coding scheme in the second byte (0x%0x) is not a valid audio coding scheme.\n", item)
-                    header.Reset()
-                    urtpReassemblyState = URTP_STATE_WAITING_SYNC
+                    countUnknownCodingScheme(item)
+                    reassembler.discard(reassembler.header.Len() + 1)
+                    reassembler.header.Reset()
+                    reassembler.state = URTP_STATE_WAITING_SYNC
                 }
             case URTP_STATE_WAITING_SEQUENCE_NUMBER:
                 // Read in the two-byte sequence number
-                header.WriteByte(item)
-                urtpByteCount++
-                //log.Printf("TCP reassembly: sequence number byte %d is 0x%x.\n", urtpByteCount, item)
-                if urtpByteCount >= URTP_SEQUENCE_NUMBER_SIZE {
-                    urtpByteCount = 0
-                    urtpReassemblyState = URTP_STATE_WAITING_TIMESTAMP
+                reassembler.header.WriteByte(item)
+                reassembler.byteCount++
+                //log.Printf("TCP reassembly: sequence number byte %d is 0x%x.\n", reassembler.byteCount, item)
+                if reassembler.byteCount >= URTP_SEQUENCE_NUMBER_SIZE {
+                    reassembler.byteCount = 0
+                    reassembler.state = URTP_STATE_WAITING_TIMESTAMP
                 }
             case URTP_STATE_WAITING_TIMESTAMP:
                 // Read in the eight-byte timestamp
-                header.WriteByte(item)
-                urtpByteCount++
-                //log.Printf("TCP reassembly: timestamp byte %d is 0x%x.\n", urtpByteCount, item)
-                if urtpByteCount >= URTP_TIMESTAMP_SIZE {
-                    urtpByteCount = 0
-                    urtpReassemblyState = URTP_STATE_WAITING_PAYLOAD_SIZE
+                reassembler.header.WriteByte(item)
+                reassembler.byteCount++
+                //log.Printf("TCP reassembly: timestamp byte %d is 0x%x.\n", reassembler.byteCount, item)
+                if reassembler.byteCount >= URTP_TIMESTAMP_SIZE {
+                    reassembler.byteCount = 0
+                    reassembler.state = URTP_STATE_WAITING_PAYLOAD_SIZE
                 }
             case URTP_STATE_WAITING_PAYLOAD_SIZE:
                 // Read in the two-byte payload size
-                header.WriteByte(item)
-                urtpPayloadSize += int (uint(item) << uint((8 * (URTP_PAYLOAD_SIZE_SIZE - urtpByteCount - 1))))
-                urtpByteCount++
-                if urtpByteCount >= URTP_PAYLOAD_SIZE_SIZE {
+                reassembler.header.WriteByte(item)
+                reassembler.payloadSize += int (uint(item) << uint((8 * (URTP_PAYLOAD_SIZE_SIZE - reassembler.byteCount - 1))))
+                reassembler.byteCount++
+                if reassembler.byteCount >= URTP_PAYLOAD_SIZE_SIZE {
                     // Got the payload size, check it and, if it is OK, write the header
-                    urtpByteCount = 0
-                    //log.Printf("TCP reassembly: URTP payload is %d byte(s).\n", urtpPayloadSize)
-                    if urtpPayloadSize <= URTP_DATAGRAM_MAX_SIZE {
-                        urtpReassemblyState = URTP_STATE_WAITING_PAYLOAD
-                        urtpDatagram.Write(header.Bytes())
-                        if urtpPayloadSize == 0 {
-                            header.Reset()
-                            urtpReassemblyState = URTP_STATE_WAITING_SYNC                
+                    reassembler.byteCount = 0
+                    //log.Printf("TCP reassembly: URTP payload is %d byte(s).\n", reassembler.payloadSize)
+                    if checkPayloadLength(reassembler.header.Bytes()[1], reassembler.payloadSize) == URTP_HEADER_OK {
+                        reassembler.huntingSync = false
+                        reassembler.state = URTP_STATE_WAITING_PAYLOAD
+                        reassembler.datagram.Write(reassembler.header.Bytes())
+                        if reassembler.payloadSize == 0 {
+                            // Nothing more to come (e.g. a heartbeat), handle it now
+                            handleUrtpDatagram(reassembler.datagram.Next(reassembler.datagram.Len()), reassembler.source())
+                            reassembler.counters.Parsed()
+                            reassembler.bytesScanned = 0
+                            reassembler.header.Reset()
+                            reassembler.state = URTP_STATE_WAITING_SYNC                
                         }
                     } else {
-                        log.Printf("TCP reassembly: NOT a URTP header, payload length %d (0x%x, in the last two bytes) is larger than the maximum number of payload bytes (%d)).\n",
-                                   urtpPayloadSize, urtpPayloadSize, URTP_DATAGRAM_MAX_SIZE)
-                        urtpPayloadSize = 0
-                        header.Reset()
-                        urtpReassemblyState = URTP_STATE_WAITING_SYNC
+                        limits := payloadLimitsOf(reassembler.header.Bytes()[1])
+                        log.Printf("TCP reassembly: NOT a URTP header, payload length %d (0x%x, in the last two bytes) is outside the %d to %d bytes allowed for audio coding scheme 0x%x.\n",
+                                   reassembler.payloadSize, reassembler.payloadSize, limits.Min, limits.Max, reassembler.header.Bytes()[1])
+                        reassembler.payloadSize = 0
+                        reassembler.discard(reassembler.header.Len())
+                        reassembler.header.Reset()
+                        reassembler.state = URTP_STATE_WAITING_SYNC
                     }
                 }
             case URTP_STATE_WAITING_PAYLOAD:
                 // Write the one byte we have
-                urtpDatagram.WriteByte(item)
-                if urtpPayloadSize > 0 {
-                    urtpPayloadSize--
+                reassembler.datagram.WriteByte(item)
+                if reassembler.payloadSize > 0 {
+                    reassembler.payloadSize--
                 }
                 // Read in as much of the rest of the payload as possible
-                bytesToRead := tcpBuffer.Len()
-                if bytesToRead > urtpPayloadSize {
-                    bytesToRead = urtpPayloadSize
+                bytesToRead := reassembler.buffer.Len()
+                if bytesToRead > reassembler.payloadSize {
+                    bytesToRead = reassembler.payloadSize
                 }
-                urtpDatagram.Write(tcpBuffer.Next(bytesToRead))
-                urtpPayloadSize -= bytesToRead
-                if urtpPayloadSize == 0 {
+                reassembler.datagram.Write(reassembler.buffer.Next(bytesToRead))
+                reassembler.payloadSize -= bytesToRead
+                reassembler.bytesScanned += bytesToRead
+                if reassembler.payloadSize == 0 {
                     // Got the lot, handle the complete datagram now and reset the state machine
-                    log.Printf("TCP reassembly: URTP packet (%d bytes) fully received.\n", urtpDatagram.Len())
-                    handleUrtpDatagram(urtpDatagram.Next(urtpDatagram.Len()))
-                    header.Reset()
-                    urtpReassemblyState = URTP_STATE_WAITING_SYNC                
+                    log.Printf("TCP reassembly: URTP packet (%d bytes) fully received.\n", reassembler.datagram.Len())
+                    handleUrtpDatagram(reassembler.datagram.Next(reassembler.datagram.Len()), reassembler.source())
+                    reassembler.counters.Parsed()
+                    reassembler.bytesScanned = 0
+                    reassembler.header.Reset()
+                    reassembler.state = URTP_STATE_WAITING_SYNC                
                 } else {
-                    //log.Printf("TCP reassembly: %d byte(s) of payload remaining to be read.\n", urtpPayloadSize)
+                    //log.Printf("TCP reassembly: %d byte(s) of payload remaining to be read.\n", reassembler.payloadSize)
                 }
             default:
-                urtpByteCount = 0
-                urtpPayloadSize = 0
-                header.Reset()
-                urtpReassemblyState = URTP_STATE_WAITING_SYNC                
+                reassembler.byteCount = 0
+                reassembler.payloadSize = 0
+                reassembler.header.Reset()
+                reassembler.state = URTP_STATE_WAITING_SYNC                
         }
     }
+    
+    return true
 }
 
-// Run a UDP server forever
-func udpServer(port string) {
+// Set the list of CIDR networks from which input is accepted; if any
+// is invalid the list is left as it was
+func setAllowedSources(cidrs []string) error {
+    var networks []*net.IPNet
+    
+    for _, cidr := range cidrs {
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return err
+        }
+        networks = append(networks, network)
+    }
+    allowedSourceAccess.Lock()
+    allowedSources = networks
+    allowedSourceAccess.Unlock()
+    
+    return nil
+}
+
+// Return true if input from the given IP address is allowed,
+// counting (and occasionally logging) those that are not
+func sourceAllowed(ip net.IP) bool {
+    allowedSourceAccess.Lock()
+    networks := allowedSources
+    allowedSourceAccess.Unlock()
+    if len(networks) == 0 {
+        return true
+    }
+    for _, network := range networks {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    rejected := atomic.AddInt64(&numRejectedSources, 1)
+    now := time.Now().UnixNano()
+    logged := atomic.LoadInt64(&rejectedSourceLogNanos)
+    // Only the caller that moves the time on logs, should several race
+    if (time.Duration(now - logged) >= REJECTED_SOURCE_LOG_INTERVAL) &&
+       atomic.CompareAndSwapInt64(&rejectedSourceLogNanos, logged, now) {
+        log.Printf("Rejected input from %s, which is not in the allowed source list (%d rejection(s) so far).\n", ip.String(), rejected)
+    }
+    
+    return false
+}
+
+// Return the addresses of the sources that have sent datagrams recently,
+// forgetting about those that have not
+func activeSources() []string {
+    var sources []string
+    
+    sourceAccess.Lock()
+    for source, lastSeen := range sourceLastSeen {
+        if time.Now().Sub(lastSeen) <= SOURCE_ACTIVE_AGE {
+            sources = append(sources, source)
+        } else {
+            delete(sourceLastSeen, source)
+        }
+    }
+    sourceAccess.Unlock()
+    
+    return sources
+}
+
+// Run a UDP server until ctx is cancelled
+func udpServer(ctx context.Context, port string) {
     var numBytesIn int
     var server *net.UDPConn
+    var remoteAddr *net.UDPAddr
     line := make([]byte, URTP_DATAGRAM_MAX_SIZE)
 
     // Set up the server
@@ -396,19 +824,23 @@ func udpServer(port string) {
         server, err = net.ListenUDP("udp", localUdpAddr)
         if err == nil {
             defer server.Close()
+            // Closing the server is what unblocks the read loop
+            go func() {
+                <-ctx.Done()
+                server.Close()
+            }()
             fmt.Printf("UDP server listening for Chuffs on port %s.\n", port)
             err1 := server.SetReadBuffer(URTP_DATAGRAM_MAX_SIZE + IP_HEADER_OVERHEAD)
             if err1 != nil {
                 log.Printf("Unable to set optimal read buffer size (%s).\n", err1.Error())
             }
             // Read UDP packets forever
-            for numBytesIn, _, err = server.ReadFromUDP(line); (err == nil) && (numBytesIn > 0); numBytesIn, _, err = server.ReadFromUDP(line) {
-                // For UDP, a single URTP datagram arrives in a single UDP packet
-                if (numBytesIn >= URTP_HEADER_SIZE) && (verifyUrtpHeader(line[:URTP_HEADER_SIZE])) {
-                    handleUrtpDatagram(line[:numBytesIn])
-                }
+            for numBytesIn, remoteAddr, err = server.ReadFromUDP(line); (err == nil) && (numBytesIn > 0); numBytesIn, remoteAddr, err = server.ReadFromUDP(line) {
+                handleUdpDatagram(line[:numBytesIn], remoteAddr)
             }
-            if err != nil {
+            if ctx.Err() != nil {
+                fmt.Printf("UDP server on port %s stopped.\n", port)
+            } else if err != nil {
                 fmt.Fprintf(os.Stderr, "Error reading from port %v (%s).\n", localUdpAddr, err.Error())
             } else {
                 fmt.Fprintf(os.Stderr, "UDP read on port %v returned when it should not.\n", localUdpAddr)    
@@ -421,23 +853,193 @@ func udpServer(port string) {
     }    
 }
 
-// Run a TCP server forever
-func tcpServer(port string) {
+// Start reassembling URTP datagrams afresh, throwing away any partial
+// datagram
+func (reassembler *UrtpReassembler) Reset() {
+    reassembler.buffer.Reset()
+    reassembler.datagram.Reset()
+    reassembler.header.Reset()
+    reassembler.byteCount = 0
+    reassembler.payloadSize = 0
+    reassembler.bytesScanned = 0
+    reassembler.huntingSync = false
+    reassembler.state = URTP_STATE_WAITING_SYNC
+}
+
+// Return the number of bytes of a partly reassembled datagram, 0 if
+// reassembly is between datagrams
+func (reassembler *UrtpReassembler) PartialBytes() int {
+    if reassembler.state == URTP_STATE_WAITING_PAYLOAD {
+        // The header has been copied into the datagram by now
+        return reassembler.datagram.Len() + reassembler.buffer.Len()
+    }
+    return reassembler.header.Len() + reassembler.buffer.Len()
+}
+
+// Make a TCP connection the one whose datagrams are wanted, replacing
+// any before it
+func startUrtpStream(connection net.Conn) {
+    urtpStreamAccess.Lock()
+    urtpStreamConnection = connection
+    urtpStreamAccess.Unlock()
+}
+
+// Reassemble data read from the stream of a TCP connection, see
+// Handle(); returns false, as for a stream that does not look like
+// URTP, if the connection has been replaced, since its data is no
+// longer wanted, though it is still counted as received on it
+func (reassembler *UrtpReassembler) Feed(data []byte) bool {
+    reassembler.counters.Received(len(data))
+    urtpStreamAccess.Lock()
+    defer urtpStreamAccess.Unlock()
+    if reassembler.connection != urtpStreamConnection {
+        return false
+    }
+    return reassembler.Handle(data)
+}
+
+// Called when a TCP connection closes, whether or not it has been
+// replaced: what is left of a datagram from it is thrown away, and
+// counted
+func (reassembler *UrtpReassembler) End() {
+    reason := "connection replaced"
+    urtpStreamAccess.Lock()
+    if reassembler.connection == urtpStreamConnection {
+        reason = "connection closed"
+        urtpStreamConnection = nil
+    }
+    urtpStreamAccess.Unlock()
+    partial := reassembler.PartialBytes()
+    if partial > 0 {
+        count := atomic.AddInt64(&numTcpPartialDatagrams, 1)
+        log.Printf("TCP reassembly: %s part way through a datagram from %v, discarding %d byte(s) of it (%d such time(s) so far).\n",
+                   reason, reassembler.source(), partial, count)
+    }
+    reassembler.Reset()
+}
+
+// Called when a TCP connection is made, deciding whether it continues
+// the current session: it does if it is from the same source (IP
+// address) and the previous connection is still open (i.e. is being
+// replaced) or closed no longer than tcpReconnectGrace ago; otherwise
+// the timeline will start again from its first datagram
+func tcpSessionOpened(connection net.Conn) {
+    source := connection.RemoteAddr().(*net.TCPAddr).IP.String()
+    tcpSessionAccess.Lock()
+    defer tcpSessionAccess.Unlock()
+    if tcpSessionConnection == nil {
+        log.Printf("TCP session from %s starting.\n", source)
+    } else if (source == tcpSessionSource) &&
+              (tcpSessionClosed.IsZero() || (time.Now().Sub(tcpSessionClosed) <= tcpReconnectGrace)) {
+        log.Printf("TCP session from %s continuing on a new connection.\n", source)
+    } else {
+        log.Printf("New TCP session from %s (previous session from %s), the timeline will start again.\n",
+                   source, tcpSessionSource)
+        atomic.StoreInt32(&newInputSession, 1)
+    }
+    tcpSessionConnection = connection
+    tcpSessionSource = source
+    tcpSessionClosed = time.Time{}
+}
+
+// Called when a TCP connection closes, starting the reconnect grace
+// unless the connection has already been replaced by another
+func tcpSessionEnded(connection net.Conn) {
+    tcpSessionAccess.Lock()
+    if connection == tcpSessionConnection {
+        tcpSessionClosed = time.Now()
+    }
+    tcpSessionAccess.Unlock()
+}
+
+// Count a newly opened TCP connection, keeping track of the peak
+func tcpConnectionOpened() {
+    open := atomic.AddInt64(&numTcpConnections, 1)
+    for peak := atomic.LoadInt64(&peakTcpConnections); open > peak; peak = atomic.LoadInt64(&peakTcpConnections) {
+        if atomic.CompareAndSwapInt64(&peakTcpConnections, peak, open) {
+            break
+        }
+    }
+}
+
+// Return the number of TCP connections open, the peak and the number rejected
+func tcpConnectionCounts() (int64, int64, int64) {
+    return atomic.LoadInt64(&numTcpConnections), atomic.LoadInt64(&peakTcpConnections),
+           atomic.LoadInt64(&numRejectedTcpConnections)
+}
+
+// Return true if another TCP connection may be opened, replacing being
+// the remote address of the connection it would replace, nil if there
+// is none; that connection is counted against maxTcpConnections like
+// any other, so that a connection from elsewhere cannot evict the
+// client which is streaming, unless the new connection is from the same
+// source (IP address): that is the client reconnecting, e.g. after a
+// dropped link that the old connection has yet to notice, and the old
+// connection is about to close
+func tcpConnectionAllowed(remoteAddr net.Addr, replacing net.Addr) bool {
+    open := atomic.LoadInt64(&numTcpConnections)
+    if (replacing != nil) && replacing.(*net.TCPAddr).IP.Equal(remoteAddr.(*net.TCPAddr).IP) {
+        open--
+    }
+    if (maxTcpConnections <= 0) || (open < int64(maxTcpConnections)) {
+        return true
+    }
+    rejected := atomic.AddInt64(&numRejectedTcpConnections, 1)
+    log.Printf("Rejected TCP connection from %s, %d connection(s) already open (maximum %d, %d rejection(s) so far).\n",
+               remoteAddr.String(), open, maxTcpConnections, rejected)
+
+    return false
+}
+
+// Process the datagrams received on a TCP connection until it is
+// closed under us, then tidy up after it
+func serveTcpConnection(server net.Conn) {
+    reassembler := newUrtpReassembler(server)
+    tcpConnectionStatsOpened(reassembler)
+    line := make([]byte, URTP_DATAGRAM_MAX_SIZE)                
+    for numBytesIn, err := server.Read(line); (err == nil) && (numBytesIn > 0); numBytesIn, err = server.Read(line) {
+        if !reassembler.Feed(line[:numBytesIn]) {
+            break
+        }
+    }
+    fmt.Printf("[Connection to %s closed].\n", server.RemoteAddr().String())
+    server.Close()
+    reassembler.End()
+    tcpSessionEnded(server)
+    tcpConnectionStatsClosed(reassembler)
+    atomic.AddInt64(&numTcpConnections, -1)
+}
+
+// Run a TCP server until ctx is cancelled
+func tcpServer(ctx context.Context, port string) {
     var newServer net.Conn
     var currentServer net.Conn
+    var currentAddr net.Addr
     
     listener, err := net.Listen("tcp", ":" + port)
     if err == nil {
         defer listener.Close()
+        // Closing the listener is what unblocks Accept()
+        go func() {
+            <-ctx.Done()
+            listener.Close()
+        }()
         // Listen for a connection
-        for {
+        for ctx.Err() == nil {
             fmt.Printf("TCP server waiting for a [further] Chuff connection on port %s.\n", port)    
             newServer, err = listener.Accept()
-            if err == nil {
+            if (err == nil) && (!sourceAllowed(newServer.RemoteAddr().(*net.TCPAddr).IP) ||
+                                !tcpConnectionAllowed(newServer.RemoteAddr(), currentAddr)) {
+                newServer.Close()
+            } else if err == nil {
+                tcpConnectionOpened()
                 if currentServer != nil {
                     currentServer.Close()
                 }
                 currentServer = newServer
+                currentAddr = currentServer.RemoteAddr()
+                tcpSessionOpened(currentServer)
+                startUrtpStream(currentServer)
                 x, success := currentServer.(*net.TCPConn)
                 if success {
                     err1 := x.SetReadBuffer(30000)
@@ -453,28 +1055,45 @@ func tcpServer(port string) {
                 }
                 // Process datagrams received on the channel in another go routine
                 fmt.Printf("Connection made by %s.\n", currentServer.RemoteAddr().String())
-                go func(server net.Conn) {
-                    // Read packets until the connection is closed under us
-                    line := make([]byte, URTP_DATAGRAM_MAX_SIZE)                
-                    for numBytesIn, err := server.Read(line); (err == nil) && (numBytesIn > 0); numBytesIn, err = server.Read(line) {
-                        handleUrtpStream(line[:numBytesIn])
-                    }
-                    fmt.Printf("[Connection to %s closed].\n", server.RemoteAddr().String())
-                }(currentServer)
-            } else {
+                go serveTcpConnection(currentServer)
+            } else if ctx.Err() == nil {
                 fmt.Fprintf(os.Stderr, "Error accepting connection (%s).\n", err.Error())        
             }
         }
+        if currentServer != nil {
+            currentServer.Close()
+        }
+        fmt.Printf("TCP server on port %s stopped.\n", port)
     } else {
         fmt.Fprintf(os.Stderr, "Unable to listen for TCP connections on port %s (%s).\n", port, err.Error())        
     }
 }
 
-// Run the server that receives the audio of Chuffs; this function should never return
-func operateAudioIn(port string, useTCP bool) {    
-    if useTCP {
-        tcpServer(port)
+// Run the server that receives the audio of Chuffs; if useBoth is true
+// then UDP and TCP are listened for simultaneously, so a client can use
+// either, otherwise useTCP selects which; if downmixMono is true stereo
+// input is accepted and averaged down to mono; no more than
+// maxConnections TCP connections are open at once (0 for no limit);
+// a TCP session continues on a new connection from the same source
+// made within reconnectGrace, see tcpSessionOpened(); if
+// unicamDiagnostics is true the diagnostics of each UNICAM datagram
+// are recorded, see UnicamDiagnostics; unknownCoding is what to do
+// with datagrams of audio coding schemes there is no decoder for, one
+// of the UNKNOWN_CODING_ values; this function returns when ctx is
+// cancelled
+func operateAudioIn(ctx context.Context, port string, useTCP bool, useBoth bool, downmixMono bool,
+                    maxConnections int, reconnectGrace time.Duration, unicamDiagnostics bool, unknownCoding string) {    
+    downmixToMono = downmixMono
+    concealUnknownCoding = unknownCoding == UNKNOWN_CODING_CONCEAL
+    unicamDiagnosticsEnabled = unicamDiagnostics
+    maxTcpConnections = maxConnections
+    tcpReconnectGrace = reconnectGrace
+    if useBoth {
+        go tcpServer(ctx, port)
+        udpServer(ctx, port)
+    } else if useTCP {
+        tcpServer(ctx, port)
     } else {
-        udpServer(port)
+        udpServer(ctx, port)
     }
 }
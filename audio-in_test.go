@@ -0,0 +1,534 @@
+/* Tests of audio-in.go for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "time"
+    "bytes"
+    "errors"
+    "context"
+    "strings"
+    "testing"
+    "math/rand"
+    "sync/atomic"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The numbers of UNICAM blocks in the payloads that decodeUnicam() is
+// benchmarked with, up to a whole datagram's worth
+var benchmarkUnicamBlocks = [...]int{2, 8, SAMPLES_PER_BLOCK / SAMPLES_PER_UNICAM_BLOCK}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a payload of random bytes of the given size; the same sizes
+// always give the same payloads, so runs can be compared
+func benchmarkPayload(size int) []byte {
+    payload := make([]byte, size)
+    rand.New(rand.NewSource(int64(size))).Read(payload)
+    return payload
+}
+
+// Return a UNICAM payload of numBlocks blocks of sampleSizeBits bit
+// samples, a shift value being shared between each pair of blocks
+func benchmarkUnicamPayload(numBlocks int, sampleSizeBits int) []byte {
+    return benchmarkPayload(numBlocks / 2 * (SAMPLES_PER_UNICAM_BLOCK * sampleSizeBits * 2 / 8 + 1))
+}
+
+// Return a URTP datagram with the given coding scheme, sequence number
+// and payload
+func makeUrtpDatagram(scheme byte, sequenceNumber uint16, payload []byte) []byte {
+    datagram := make([]byte, URTP_HEADER_SIZE, URTP_HEADER_SIZE + len(payload))
+    datagram[0] = SYNC_BYTE
+    datagram[1] = scheme
+    datagram[2] = byte(sequenceNumber >> 8)
+    datagram[3] = byte(sequenceNumber)
+    datagram[URTP_NUM_BYTES_AUDIO_OFFSET] = byte(len(payload) >> 8)
+    datagram[URTP_NUM_BYTES_AUDIO_OFFSET + 1] = byte(len(payload))
+    return append(datagram, payload...)
+}
+
+// Check that heartbeats, on their own and amongst audio datagrams
+// over TCP, are counted but never reach the audio pipeline, and that
+// a heartbeat with a payload is not accepted as anything
+func TestHeartbeat(t *testing.T) {
+    channel := make(chan interface{}, 10)
+    savedChannel := ProcessDatagramsChannel
+    ProcessDatagramsChannel = channel
+    t.Cleanup(func() {
+        ProcessDatagramsChannel = savedChannel
+    })
+    heartbeats := atomic.LoadInt64(&numHeartbeats)
+    heartbeat := makeUrtpDatagram(URTP_HEARTBEAT, 1, nil)
+    audio := makeUrtpDatagram(PCM_SIGNED_16_BIT, 2, make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+
+    if verifyUrtpHeader(heartbeat) != URTP_HEADER_OK {
+        t.Fatal("heartbeat header not accepted")
+    }
+    if verifyUrtpHeader(makeUrtpDatagram(URTP_HEARTBEAT, 1, []byte{0, 0})) == URTP_HEADER_OK {
+        t.Fatal("heartbeat header with a payload accepted")
+    }
+    handleUrtpDatagram(heartbeat, nil)
+    handleUrtpDatagram(makeUrtpDatagram(URTP_HEARTBEAT, 1, []byte{0, 0}), nil)
+    newUrtpReassembler(nil).Handle(append(append(append([]byte(nil), heartbeat...), audio...), heartbeat...))
+    if count := atomic.LoadInt64(&numHeartbeats) - heartbeats; count != 3 {
+        t.Fatalf("%d heartbeat(s) counted when 3 were sent", count)
+    }
+    if len(channel) != 1 {
+        t.Fatalf("%d datagram(s) sent for processing when 1 was expected", len(channel))
+    }
+    datagram, isDatagram := (<-channel).(*UrtpDatagram)
+    if !isDatagram || (datagram.SequenceNumber != 2) || (datagram.Audio == nil) || (len(*datagram.Audio) != SAMPLES_PER_BLOCK) {
+        t.Fatal("audio datagram amongst heartbeats not received intact")
+    }
+}
+
+// Feed pathological streams through TCP reassembly: garbage that never
+// syncs, garbage full of sync bytes and a valid header whose payload is
+// trickled in forever, checking that each is given up on and that the
+// reassembly buffers stay bounded throughout
+func TestTcpReassemblyLimits(t *testing.T) {
+    var trickle []byte
+
+    garbage := make([]byte, URTP_DATAGRAM_MAX_SIZE)
+    syncs := bytes.Repeat([]byte{SYNC_BYTE}, URTP_DATAGRAM_MAX_SIZE)
+    // A heartbeat, so that the datagram is dropped rather than queued for processing
+    header := makeUrtpDatagram(URTP_HEARTBEAT, 1, nil)
+    payloadSize := URTP_DATAGRAM_MAX_SIZE
+    header[URTP_NUM_BYTES_AUDIO_OFFSET] = byte(payloadSize >> 8)
+    header[URTP_NUM_BYTES_AUDIO_OFFSET + 1] = byte(payloadSize)
+    trickle = append(trickle, header...)
+    for len(trickle) < URTP_DATAGRAM_MAX_SIZE * 100 {
+        // A sync byte then not the rest of a header, for ever
+        trickle = append(trickle, SYNC_BYTE, 0xff)
+    }
+    for _, stream := range []struct{name string; data []byte}{{"garbage", bytes.Repeat(garbage, 100)},
+                                                              {"sync bytes", bytes.Repeat(syncs, 100)},
+                                                              {"trickle", trickle}} {
+        resets := atomic.LoadInt64(&numTcpReassemblyResets)
+        reassembler := newUrtpReassembler(nil)
+        accepted := true
+        for offset := 0; accepted && (offset < len(stream.data)); offset += URTP_DATAGRAM_MAX_SIZE {
+            end := offset + URTP_DATAGRAM_MAX_SIZE
+            if end > len(stream.data) {
+                end = len(stream.data)
+            }
+            accepted = reassembler.Handle(stream.data[offset:end])
+            if (reassembler.buffer.Cap() > TCP_REASSEMBLY_BUFFER_LIMIT * 2) ||
+               (reassembler.datagram.Cap() > TCP_REASSEMBLY_BUFFER_LIMIT * 2) {
+                t.Fatalf("%s: reassembly buffers grew to %d and %d byte(s)", stream.name,
+                         reassembler.buffer.Cap(), reassembler.datagram.Cap())
+            }
+        }
+        if accepted || (atomic.LoadInt64(&numTcpReassemblyResets) != resets + 1) {
+            t.Fatalf("%s: stream of %d byte(s) not given up on", stream.name, len(stream.data))
+        }
+    }
+    if newUrtpReassembler(nil).Handle(make([]byte, TCP_REASSEMBLY_BUFFER_LIMIT + 1)) {
+        t.Fatal("oversized read not given up on")
+    }
+}
+
+// Feed datagrams through TCP reassembly with stray bytes between them,
+// checking that every datagram is still found and that the resyncs and
+// the bytes thrown away hunting for sync are counted
+func TestTcpResync(t *testing.T) {
+    var stream []byte
+
+    heartbeat := makeUrtpDatagram(URTP_HEARTBEAT, 1, nil)
+    stream = append(stream, heartbeat...)
+    // Garbage, then a sync byte followed by what is not an audio coding scheme
+    stream = append(stream, 0x00, 0x01, 0x02)
+    stream = append(stream, heartbeat...)
+    stream = append(stream, SYNC_BYTE, 0xff)
+    stream = append(stream, heartbeat...)
+    reassembler := newUrtpReassembler(nil)
+    resyncs := atomic.LoadInt64(&numTcpResyncs)
+    discarded := atomic.LoadInt64(&numTcpResyncBytesDiscarded)
+    heartbeats := atomic.LoadInt64(&numHeartbeats)
+    // In two reads, split part way through the stray bytes
+    if !reassembler.Handle(stream[:len(heartbeat) + 2]) || !reassembler.Handle(stream[len(heartbeat) + 2:]) {
+        t.Fatal("stream with stray bytes given up on")
+    }
+    if count := atomic.LoadInt64(&numHeartbeats) - heartbeats; count != 3 {
+        t.Fatalf("%d datagram(s) found among stray bytes when there were 3", count)
+    }
+    if count := atomic.LoadInt64(&numTcpResyncs) - resyncs; count != 2 {
+        t.Fatalf("%d resync(s) counted when there were 2", count)
+    }
+    if count := atomic.LoadInt64(&numTcpResyncBytesDiscarded) - discarded; count != 5 {
+        t.Fatalf("%d byte(s) counted as discarded when 5 were", count)
+    }
+}
+
+// Close connections part way through a datagram, checking that what
+// there is of it is thrown away and counted, and that a connection which
+// follows gets its datagrams through, even if the old connection only
+// finishes closing once the new one has started
+func TestTcpEof(t *testing.T) {
+    heartbeat := makeUrtpDatagram(URTP_HEARTBEAT, 1, nil)
+    audio := makeUrtpDatagram(PCM_SIGNED_16_BIT, 2, make([]byte, 10))
+    heartbeats := atomic.LoadInt64(&numHeartbeats)
+    partials := atomic.LoadInt64(&numTcpPartialDatagrams)
+    first, firstPeer := net.Pipe()
+    defer first.Close()
+    defer firstPeer.Close()
+    second, secondPeer := net.Pipe()
+    defer second.Close()
+    defer secondPeer.Close()
+    t.Cleanup(func() {
+        startUrtpStream(nil)
+    })
+
+    // Ends in the header of a datagram
+    firstReassembler := newUrtpReassembler(first)
+    startUrtpStream(first)
+    firstReassembler.Feed(append(append([]byte(nil), heartbeat...), heartbeat[:5]...))
+    firstReassembler.End()
+    // Ends in the payload of a datagram, but only finishes closing after
+    // the next connection has started, part way through a datagram itself
+    firstReassembler = newUrtpReassembler(first)
+    startUrtpStream(first)
+    firstReassembler.Feed(audio[:len(audio) - 1])
+    secondReassembler := newUrtpReassembler(second)
+    startUrtpStream(second)
+    secondReassembler.Feed(heartbeat[:5])
+    if firstReassembler.Feed(audio[len(audio) - 1:]) {
+        t.Fatal("data from a replaced connection accepted")
+    }
+    firstReassembler.End()
+    secondReassembler.Feed(heartbeat[5:])
+    secondReassembler.End()
+
+    if count := atomic.LoadInt64(&numHeartbeats) - heartbeats; count != 2 {
+        t.Fatalf("%d datagram(s) got through when 2 were whole", count)
+    }
+    if count := atomic.LoadInt64(&numTcpPartialDatagrams) - partials; count != 2 {
+        t.Fatalf("%d partial datagram(s) counted when there were 2", count)
+    }
+    if (firstReassembler.PartialBytes() != 0) || (secondReassembler.PartialBytes() != 0) || (urtpStreamConnection != nil) {
+        t.Fatalf("%d and %d byte(s) of reassembly state left after the connections closed",
+                 firstReassembler.PartialBytes(), secondReassembler.PartialBytes())
+    }
+}
+
+// Check that, with a limit of one TCP connection, a connection from
+// elsewhere is rejected rather than evicting the client that is
+// streaming, while the client itself may reconnect, replacing its
+// connection, and that with no limit any connection is let in
+func TestTcpConnectionLimit(t *testing.T) {
+    client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5065}
+    reconnect := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5066}
+    other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5065}
+    savedMaxTcpConnections := maxTcpConnections
+    savedNumTcpConnections := atomic.LoadInt64(&numTcpConnections)
+    t.Cleanup(func() {
+        maxTcpConnections = savedMaxTcpConnections
+        atomic.StoreInt64(&numTcpConnections, savedNumTcpConnections)
+    })
+
+    maxTcpConnections = 1
+    atomic.StoreInt64(&numTcpConnections, 0)
+    if !tcpConnectionAllowed(client, nil) {
+        t.Fatal("first connection rejected")
+    }
+    atomic.StoreInt64(&numTcpConnections, 1)
+    rejected := atomic.LoadInt64(&numRejectedTcpConnections)
+    if tcpConnectionAllowed(other, client) {
+        t.Fatal("connection from elsewhere allowed to evict the current one")
+    }
+    if count := atomic.LoadInt64(&numRejectedTcpConnections) - rejected; count != 1 {
+        t.Fatalf("%d rejection(s) counted when there was 1", count)
+    }
+    if !tcpConnectionAllowed(reconnect, client) {
+        t.Fatal("client not allowed to reconnect")
+    }
+    // The replaced connection has yet to close, so the limit is still reached
+    atomic.StoreInt64(&numTcpConnections, 2)
+    if tcpConnectionAllowed(other, reconnect) {
+        t.Fatal("connection from elsewhere allowed while the replaced connection closes")
+    }
+    maxTcpConnections = 0
+    if !tcpConnectionAllowed(other, reconnect) {
+        t.Fatal("connection rejected with no limit")
+    }
+}
+
+// Check sources against an allowed network from several goroutines at
+// once, as the UDP and TCP servers do, failing if the wrong sources
+// are let in or the rejections are not all counted
+func TestSourceAllowed(t *testing.T) {
+    var waitGroup sync.WaitGroup
+
+    err := setAllowedSources([]string{"10.0.0.0/8"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        setAllowedSources(nil)
+    })
+    if setAllowedSources([]string{"not a network"}) == nil {
+        t.Fatal("invalid network accepted")
+    }
+    rejected := atomic.LoadInt64(&numRejectedSources)
+    failures := int32(0)
+    for x := 0; x < 10; x++ {
+        waitGroup.Add(1)
+        go func() {
+            defer waitGroup.Done()
+            for y := 0; y < 100; y++ {
+                if !sourceAllowed(net.IPv4(10, 1, 2, 3)) || sourceAllowed(net.IPv4(192, 168, 1, 1)) {
+                    atomic.AddInt32(&failures, 1)
+                }
+            }
+        }()
+    }
+    waitGroup.Wait()
+    if failures > 0 {
+        t.Fatalf("%d source check(s) gave the wrong answer", failures)
+    }
+    if count := atomic.LoadInt64(&numRejectedSources) - rejected; count != 1000 {
+        t.Fatalf("%d rejection(s) counted when there were 1000", count)
+    }
+}
+
+// Return true if a port can't be bound for the given network ("tcp" or
+// "udp") on this machine because something is already listening on it
+func portBound(network string, port string) bool {
+    if network == "udp" {
+        connection, err := net.ListenPacket(network, ":" + port)
+        if err == nil {
+            connection.Close()
+        }
+        return err != nil
+    }
+    listener, err := net.Listen(network, ":" + port)
+    if err == nil {
+        listener.Close()
+    }
+    return err != nil
+}
+
+// Return a port which is free for both TCP and UDP
+func freeInputPort() (string, error) {
+    for x := 0; x < 10; x++ {
+        listener, err := net.Listen("tcp", ":0")
+        if err != nil {
+            return "", err
+        }
+        _, port, _ := net.SplitHostPort(listener.Addr().String())
+        listener.Close()
+        if !portBound("udp", port) {
+            return port, nil
+        }
+    }
+    return "", errors.New("no port free for both TCP and UDP")
+}
+
+// Put back the settings of audio input that operateAudioIn() sets once
+// a test is done
+func restoreAudioInSettings(t *testing.T) {
+    savedDownmix := downmixToMono
+    savedConceal := concealUnknownCoding
+    savedDiagnostics := unicamDiagnosticsEnabled
+    savedMaxConnections := maxTcpConnections
+    savedGrace := tcpReconnectGrace
+    t.Cleanup(func() {
+        downmixToMono = savedDownmix
+        concealUnknownCoding = savedConceal
+        unicamDiagnosticsEnabled = savedDiagnostics
+        maxTcpConnections = savedMaxConnections
+        tcpReconnectGrace = savedGrace
+    })
+}
+
+// Start audio input on a port with operate(), which must return once
+// ctx is cancelled, returning an error if the listeners that come up
+// are not TCP and UDP as given or if they are still up once it is
+// stopped
+func checkInputListeners(operate func(ctx context.Context), port string, tcp bool, udp bool) error {
+    var tcpUp bool
+    var udpUp bool
+
+    ctx, cancel := context.WithCancel(context.Background())
+    stopped := make(chan bool)
+    go func() {
+        operate(ctx)
+        close(stopped)
+    }()
+    // Wait for what should come up, then check that nothing else has
+    for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+        tcpUp, udpUp = portBound("tcp", port), portBound("udp", port)
+        if (tcpUp || !tcp) && (udpUp || !udp) {
+            break
+        }
+    }
+    cancel()
+    if (tcpUp != tcp) || (udpUp != udp) {
+        return errors.New(fmt.Sprintf("listening on TCP %v, UDP %v", tcpUp, udpUp))
+    }
+    select {
+        case <-stopped:
+        case <-time.After(time.Second * 5):
+            return errors.New("input did not stop")
+    }
+    // A TCP server started alongside UDP stops in its own time
+    for deadline := time.Now().Add(time.Second * 5); portBound("tcp", port) || portBound("udp", port); time.Sleep(time.Millisecond * 10) {
+        if time.Now().After(deadline) {
+            return errors.New("still listening once input was stopped")
+        }
+    }
+
+    return nil
+}
+
+// Start audio input on a free port with the default settings, with
+// --tcp and with --udp-and-tcp, failing if the listeners that come up,
+// UDP, TCP or both, are not those asked for, or if they are still up
+// once input is stopped
+func TestInputListeners(t *testing.T) {
+    restoreAudioInSettings(t)
+
+    for _, test := range []struct{name string; useTcp bool; useBoth bool; tcp bool; udp bool}{
+                            {"default", false, false, false, true},
+                            {"--tcp", true, false, true, false},
+                            {"--udp-and-tcp", false, true, true, true}} {
+        port, err := freeInputPort()
+        if err != nil {
+            t.Fatal(err)
+        }
+        err = checkInputListeners(func(ctx context.Context) {
+            operateAudioIn(ctx, port, test.useTcp, test.useBoth, false, 1, 0, false, UNKNOWN_CODING_DROP)
+        }, port, test.tcp, test.udp)
+        if err != nil {
+            t.Fatalf("%s: %s", test.name, err.Error())
+        }
+    }
+}
+
+// Downmix left/right pairs at full scale and of opposite sign, without
+// dither, failing if each does not average to the mono sample expected
+func TestDownmixStereo(t *testing.T) {
+    savedDitherer := ditherer
+    ditherer = nil
+    t.Cleanup(func() {
+        ditherer = savedDitherer
+    })
+
+    stereo := []int16{32767, 32767, -32768, -32768, 1000, -3000}
+    expected := []int16{32767, -32768, -1000}
+    mono := downmixStereo(&stereo)
+    if len(*mono) != len(expected) {
+        t.Fatalf("%d stereo pair(s) downmixed to %d sample(s)", len(expected), len(*mono))
+    }
+    for x, sample := range *mono {
+        if sample != expected[x] {
+            t.Fatalf("left %d, right %d downmixed to %d when %d was expected",
+                     stereo[x * 2], stereo[(x * 2) + 1], sample, expected[x])
+        }
+    }
+}
+
+// Receive a datagram over UDP with each fault in its URTP header,
+// checking that verifyUrtpHeader() gives the fault, that the datagram
+// is thrown away and that it is counted against the fault in the
+// statistics and the metrics, then that a good datagram is let through
+func TestUrtpHeaderFaults(t *testing.T) {
+    source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5065}
+    heartbeat := makeUrtpDatagram(URTP_HEARTBEAT, 1, nil)
+    oversized := makeUrtpDatagram(PCM_SIGNED_16_BIT, 1, nil)
+    oversized[URTP_NUM_BYTES_AUDIO_OFFSET] = 0xFF
+    oversized[URTP_NUM_BYTES_AUDIO_OFFSET + 1] = 0xFF
+    badSync := append([]byte(nil), heartbeat...)
+    badSync[0] = ^SYNC_BYTE
+    savedConceal := concealUnknownCoding
+    concealUnknownCoding = false
+    t.Cleanup(func() {
+        concealUnknownCoding = savedConceal
+    })
+
+    before := udpDatagramsRejected(false)
+    heartbeats := atomic.LoadInt64(&numHeartbeats)
+    for _, test := range []struct{datagram []byte; fault UrtpHeaderFault}{
+                            {heartbeat[:URTP_HEADER_SIZE - 1], URTP_HEADER_TOO_SHORT},
+                            {badSync, URTP_HEADER_BAD_SYNC},
+                            // Not a scheme there is a decoder for
+                            {makeUrtpDatagram(0x7E, 1, nil), URTP_HEADER_BAD_CODING_SCHEME},
+                            {makeUrtpDatagram(URTP_HEARTBEAT, 1, []byte{0, 0}), URTP_HEADER_HEARTBEAT_PAYLOAD},
+                            {oversized, URTP_HEADER_OVERSIZED_PAYLOAD},
+                            {makeUrtpDatagram(PCM_SIGNED_16_BIT, 1, nil), URTP_HEADER_UNDERSIZED_PAYLOAD}} {
+        fault := verifyUrtpHeader(test.datagram)
+        if fault != test.fault {
+            t.Fatalf("header %x found to be %s when it is %s", test.datagram, fault.String(), test.fault.String())
+        }
+        handleUdpDatagram(test.datagram, source)
+    }
+    handleUdpDatagram(heartbeat, source)
+
+    after := udpDatagramsRejected(false)
+    for fault := URTP_HEADER_OK + 1; fault < NUM_URTP_HEADER_FAULTS; fault++ {
+        if count := after[fault.String()] - before[fault.String()]; count != 1 {
+            t.Fatalf("%d datagram(s) counted as %s when there was 1", count, fault.String())
+        }
+    }
+    if count := atomic.LoadInt64(&numHeartbeats) - heartbeats; count != 1 {
+        t.Fatalf("%d datagram(s) let through when 1 was good", count)
+    }
+    response := httptest.NewRecorder()
+    metricsHandler(response, httptest.NewRequest("GET", "/metrics", nil))
+    metric := fmt.Sprintf("ioc_udp_datagrams_rejected_total{reason=\"%s\"} %d\n", URTP_HEADER_BAD_SYNC.String(),
+                          after[URTP_HEADER_BAD_SYNC.String()])
+    if !strings.Contains(response.Body.String(), metric) {
+        t.Fatalf("metrics do not include %s", metric)
+    }
+}
+
+// Benchmark the decoding of a whole datagram's worth of PCM
+func BenchmarkDecodePcm(b *testing.B) {
+    discardLogging(b)
+    payload := benchmarkPayload(SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)
+    b.ReportAllocs()
+    b.SetBytes(int64(len(payload)))
+    for x := 0; x < b.N; x++ {
+        decodePcm(payload)
+    }
+}
+
+// Benchmark the decoding of UNICAM payloads of each sample size and
+// of each of the numbers of blocks in benchmarkUnicamBlocks
+func BenchmarkDecodeUnicam(b *testing.B) {
+    discardLogging(b)
+    for _, sampleSizeBits := range []int{8, 10} {
+        for _, numBlocks := range benchmarkUnicamBlocks {
+            payload := benchmarkUnicamPayload(numBlocks, sampleSizeBits)
+            sampleSizeBits := sampleSizeBits
+            b.Run(fmt.Sprintf("bits=%d/blocks=%d", sampleSizeBits, numBlocks), func(b *testing.B) {
+                b.ReportAllocs()
+                b.SetBytes(int64(len(payload)))
+                for x := 0; x < b.N; x++ {
+                    decodeUnicam(payload, sampleSizeBits, nil)
+                }
+            })
+        }
+    }
+}
+
+/* End Of File */
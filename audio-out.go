@@ -21,12 +21,21 @@ import (
     "log"
     "time"
     "net/http"
+    "crypto/tls"
     "os"
     "path/filepath"
     "bytes"
     "sync"
     "container/list"
     "math"
+    "strings"
+    "html/template"
+    "encoding/json"
+    _ "embed"
+    "context"
+    "sync/atomic"
+    "io"
+    "net/url"
 //    "github.com/gorilla/mux"
 )
 
@@ -40,21 +49,167 @@ type Mp3AudioFile struct {
     title string
     timestamp time.Time
     duration time.Duration
-    usable bool
+    // Whether each playlist, by index, lists the file and the number that
+    // do; the file may only be removed once none do
+    listed []bool
+    references int
     removable bool
+    concealedRatio float64
+    discontinuity bool
+    // The SHA-256 checksum of the file as hex, "" if not calculated
+    checksum string
+    // The IV with which the file is encrypted, nil if it is not
+    iv []byte
+    // The levels of the audio of the file, nil if not metered
+    level *SegmentLevel
+}
+
+// Options for operateAudioOut()
+type AudioOutOptions struct {
+    // If greater than zero, the number of segments in the live playlist
+    // is capped at this, irrespective of their age, as is the number of
+    // segments kept that are listed in no playlist
+    MaxSegments int
+    // Where the playlist and the segments are kept
+    PlaylistStore FileStore
+    SegmentStore FileStore
+    // Passed to updatePlaylistFile()
+    UseGapTag bool
+    // True if the segments can be decoded without those before them,
+    // i.e. the MP3 encoder's bit reservoir is disabled; passed to
+    // updatePlaylistFile()
+    IndependentSegments bool
+    // Put in front of the segment file names in the playlist, already
+    // normalised by normaliseSegmentBaseUrl(), "" for none
+    SegmentBaseUrl string
+    // How long a segment is listed in the live playlist
+    PlaylistWindow time.Duration
+    // Playlists in addition to the live playlist, over the same segments
+    Playlists []PlaylistConfig
+    // The master playlist, listing the playlists as audio renditions,
+    // none if its Name is ""
+    MasterPlaylist MasterPlaylistConfig
+    // How long a segment is kept (on disk or in memory); never less
+    // than the longest window of the playlists
+    Retention time.Duration
+    // If greater than Retention, a segment that has not been fetched by
+    // then is kept until it has been, or until it is this old
+    RetentionUntilFetched time.Duration
+    // The most bytes of segments kept in memory, if SegmentStore is a
+    // MemoryFileStore, 0 to derive it, see setMemorySegmentLimit()
+    MaxMemorySegmentBytes int
+    // The most segments kept, oldest deleted first, while their deletion
+    // is paused through ADMIN_PAUSE_AGING_PATH
+    AgingPauseMaxSegments int
+    // The number of segments there must be before the stream is first
+    // advertised as ready, see countSegmentTowardsReady()
+    ReadySegments int
+    // If not nil, where to write the access log
+    AccessLog io.Writer
+    // The format of the access log, see accessLogHandler()
+    AccessLogFormat string
+    // The bearer token required by the admin endpoints, "" to disable them
+    AdminToken string
+    // The secret with which session tokens are signed, "" if the playlist
+    // and segments are served without them
+    SessionSecret string
+    // If not nil, the key with which segments are encrypted, which is
+    // served at HLS_KEY_PATH (SessionSecret must then be given)
+    HlsKey []byte
+    // Serve segment checksums and the manifest of them
+    Checksums bool
+    // Serve the levels of the segments at LEVELS_PATH
+    SegmentLevels bool
+    // Serve the UNICAM diagnostics at UNICAM_DIAGNOSTICS_PATH
+    UnicamDiagnostics bool
+    // The path under which a reverse proxy makes the server available,
+    // normalised by normaliseBasePath(), "" if it is at the root
+    BasePath string
+    // Generate URLs with the scheme and host given by a reverse proxy
+    // in FORWARDED_PROTO_HEADER and FORWARDED_HOST_HEADER
+    TrustForwarded bool
+    // Serve the segment being encoded as it grows, by range requests,
+    // rather than in chunks, see growingSegmentHandler()
+    GrowingSegments bool
+    // How long a segment request may take to serve, 0 for no limit, see
+    // limitSegmentRequest()
+    SegmentRequestTimeout time.Duration
+    // Keep the segments listed in the last playlist file written while a
+    // playlist file cannot be written, see holdSegments()
+    KeepLastGoodPlaylist bool
+    // The TLS configuration of the HTTP server, nil for Go's defaults
+    TlsConfig *tls.Config
+    // If not nil, closed by operateAudioProcessing() once it has stopped
+    // and its last segment is out; until then, once stopping, segments
+    // are still added, and then the playlists are ended
+    ProcessingDone <-chan struct{}
+}
+
+// Statistics served at STATS_PATH
+type Stats struct {
+    Sources []string `json:"sources"`
+    EncoderErrors int64 `json:"encoderErrors"`
+    StaleDatagrams int64 `json:"staleDatagrams"`
+    Mute MuteState `json:"mute"`
+    AgingPause AgingPauseState `json:"agingPause"`
+    LiveMp3Clients int `json:"liveMp3Clients"`
+    Mp3TapSinksDropped int64 `json:"mp3TapSinksDropped"`
+    ChunkedSegmentClients int `json:"chunkedSegmentClients"`
+    TickLatencyWorstMs float64 `json:"tickLatencyWorstMs"`
+    TickLatencyAverageMs float64 `json:"tickLatencyAverageMs"`
+    FileWriteFailures int64 `json:"fileWriteFailures"`
+    ConcealmentBreaker ConcealmentBreakerState `json:"concealmentBreaker"`
+    TcpConnections int64 `json:"tcpConnections"`
+    TcpConnectionsPeak int64 `json:"tcpConnectionsPeak"`
+    TcpConnectionsRejected int64 `json:"tcpConnectionsRejected"`
+    TcpReassemblyResets int64 `json:"tcpReassemblyResets"`
+    PlaylistWriteFailures int64 `json:"playlistWriteFailures"`
+    StalePlaylists int `json:"stalePlaylists"`
+    SegmentsExpiredUnfetched int64 `json:"segmentsExpiredUnfetched"`
+    TcpResyncs int64 `json:"tcpResyncs"`
+    TcpResyncBytesDiscarded int64 `json:"tcpResyncBytesDiscarded"`
+    TcpPartialDatagrams int64 `json:"tcpPartialDatagrams"`
+    // The open TCP connections, by remote address
+    TcpConnectionsByAddress map[string]TcpConnectionStats `json:"tcpConnectionsByAddress"`
+    SegmentRequestsTimedOut int64 `json:"segmentRequestsTimedOut"`
+    EncoderEffort EncoderEffortState `json:"encoderEffort"`
+    Heartbeats int64 `json:"heartbeats"`
+    SegmentsFailedVerification int64 `json:"segmentsFailedVerification"`
+    FormatMismatches int64 `json:"formatMismatches"`
+    // Segments whose MP3 frames, read back, were not the number cut, see
+    // checkSegmentFrames(); the encoder of the stream is not closed
+    // between segments, so has no padding to check, and these anomalies
+    // are what show an encoder that is skewing the timing instead
+    Mp3FrameAnomalies int64 `json:"mp3FrameAnomalies"`
+    UnknownCodingSchemes int64 `json:"unknownCodingSchemes"`
+    // By UrtpHeaderFault
+    UdpDatagramsRejected map[string]int64 `json:"udpDatagramsRejected"`
+    // An estimate, see listenerCount()
+    Listeners int `json:"listeners"`
 }
 
 //--------------------------------------------------------------------
 // Constants
 //--------------------------------------------------------------------
 
-// The age at which an MP3 file should no longer be used
+// How long to give HTTP requests in progress to complete at shutdown
+const HTTP_SHUTDOWN_TIMEOUT time.Duration = time.Second * 5
+
+// The URL path at which statistics are served
+const STATS_PATH string = "/stats"
+
+// The default age at which an MP3 file should no longer be used
+// (i.e. listed in the playlist)
 const MP3_USABLE_AGE time.Duration = time.Minute * 2
 
-// The age at which an MP3 file can be deleted
+// The default age at which an MP3 file can be deleted
 const MP3_REMOVABLE_AGE time.Duration = time.Minute * 5
 
-// The lag from the newest point in the playlist to the point
+// The fraction of a segment which, if made up of gap-fill, means that
+// the segment is marked as concealed in the playlist
+const MP3_CONCEALED_RATIO float64 = 0.5
+
+// The lag from the newest point in the live playlist to the point
 // where a browser should begin playing from the playlist
 const MAX_PLAY_LAG time.Duration = time.Second * 10
 
@@ -68,18 +223,53 @@ var MediaControlChannel chan<- interface{}
 // List of output MP3 files
 var mp3FileList = list.New()
 
-// Mutex to manage access to the playlist file
+// Mutex to manage access to the playlist files
 var playlistAccess sync.Mutex
 
+// A minimal hls.js-based HTML page, served at the root when the
+// operator has not provided an index.html of their own
+//go:embed player.html
+var playerHtml string
+
+// The template made from playerHtml
+var playerTemplate = template.Must(template.New("player").Parse(playerHtml))
+
+// The origins from which cross-domain requests are allowed, any if empty
+var allowedOrigins []string
+var allowedOriginAccess sync.Mutex
+
 //--------------------------------------------------------------------
 // Functions
 //--------------------------------------------------------------------
 
+// Set the list of origins from which cross-domain requests are allowed,
+// empty to allow any
+func setAllowedOrigins(origins []string) {
+    allowedOriginAccess.Lock()
+    defer allowedOriginAccess.Unlock()
+    allowedOrigins = origins
+}
+
 // Add the cross-domain items to a response
 // The options allowed are taken from:
 // https://metajack.im/2010/01/19/crossdomain-ajax-for-xmpp-http-binding-made-easy/
-func addCrossDomainToResponse(out http.ResponseWriter) {
-    out.Header().Set("Access-Control-Allow-Origin", "*")
+// If there is a list of allowed origins only those are allowed,
+// otherwise any origin is
+func addCrossDomainToResponse(out http.ResponseWriter, in *http.Request) {
+    allowedOriginAccess.Lock()
+    if len(allowedOrigins) == 0 {
+        out.Header().Set("Access-Control-Allow-Origin", "*")
+    } else {
+        out.Header().Add("Vary", "Origin")
+        origin := in.Header.Get("Origin")
+        for _, allowed := range allowedOrigins {
+            if origin == allowed {
+                out.Header().Set("Access-Control-Allow-Origin", origin)
+                break
+            }
+        }
+    }
+    allowedOriginAccess.Unlock()
     out.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
     out.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With")
     out.Header().Set("Access-Control-Max-Age", "86400")
@@ -92,7 +282,7 @@ func filterCrossDomainRequest(out http.ResponseWriter, in *http.Request) bool {
     
     if (in.Method == "OPTIONS") {
         log.Printf("Received OPTIONS request from (%s), allowing it.\n", in.URL)
-        addCrossDomainToResponse(out)
+        addCrossDomainToResponse(out, in)
         out.WriteHeader(http.StatusOK)
         isCrossDomainRequest = true
     }
@@ -100,30 +290,45 @@ func filterCrossDomainRequest(out http.ResponseWriter, in *http.Request) bool {
     return isCrossDomainRequest
 }
 
-// Return a time string in ISO8601 format in the UK timezone
-func ukTimeIso8601(timestamp time.Time) string {
-    location, _ := time.LoadLocation("Europe/London")
-    return timestamp.In(location).Format("2006-01-02T15:04:05.000-07:00")    
-}
-
-// Create/update the playlist file
+// Create/update the file of a playlist, pl
 // See https://en.wikipedia.org/wiki/M3U
 // and, in much more detail, https://tools.ietf.org/html/draft-pantos-http-live-streaming-17#section-4
-func updatePlaylistFile(fileName string, mediaSequenceNumber int) bool {
+// Segments made up mostly of gap-fill are marked with a comment or, if
+// useGapTag is true, with #EXT-X-GAP (which players will skip); if
+// independentSegments is true #EXT-X-INDEPENDENT-SEGMENTS is given; if
+// endList is true the playlist is marked as ended, with #EXT-X-ENDLIST;
+// segmentBaseUrl is put in front of each segment file name
+func updatePlaylistFile(store FileStore, pl *Playlist, useGapTag bool, independentSegments bool, endList bool, segmentBaseUrl string) bool {
     var maxSegmentDuration time.Duration
     var segmentData bytes.Buffer
+    var playlist bytes.Buffer
     var numSegments int
     var totalDuration time.Duration
+    var newestUri string
     
     // Go through all of the MP3 files, assembling the segment
     // list and working out the dynamic header values
     for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
-        if newElement.Value.(*Mp3AudioFile).usable {
+        if newElement.Value.(*Mp3AudioFile).listedIn(pl) {
             numSegments++
+            if newElement.Value.(*Mp3AudioFile).discontinuity {
+                fmt.Fprintf(&segmentData, "#EXT-X-DISCONTINUITY\r\n")
+            }
             fmt.Fprintf(&segmentData, "#EXT-X-PROGRAM-DATE-TIME:%s\r\n", ukTimeIso8601(newElement.Value.(*Mp3AudioFile).timestamp))
+            if newElement.Value.(*Mp3AudioFile).concealedRatio >= MP3_CONCEALED_RATIO {
+                if useGapTag {
+                    fmt.Fprintf(&segmentData, "#EXT-X-GAP\r\n")
+                } else {
+                    fmt.Fprintf(&segmentData, "# Concealed: %d%% of this segment is gap-fill\r\n", int(newElement.Value.(*Mp3AudioFile).concealedRatio * 100))
+                }
+            }
+            if newElement.Value.(*Mp3AudioFile).iv != nil {
+                fmt.Fprintf(&segmentData, "%s\r\n", hlsKeyTag(newElement.Value.(*Mp3AudioFile).iv))
+            }
             fmt.Fprintf(&segmentData, "#EXTINF:%f, %s\r\n", float32(newElement.Value.(*Mp3AudioFile).duration) / float32(time.Second),
                         newElement.Value.(*Mp3AudioFile).title)
-            fmt.Fprintf(&segmentData, "%s\r\n", newElement.Value.(*Mp3AudioFile).fileName)
+            newestUri = segmentUri(segmentBaseUrl, newElement.Value.(*Mp3AudioFile).fileName)
+            fmt.Fprintf(&segmentData, "%s\r\n", newestUri)
             totalDuration += newElement.Value.(*Mp3AudioFile).duration
             if maxSegmentDuration < newElement.Value.(*Mp3AudioFile).duration {
                 maxSegmentDuration = newElement.Value.(*Mp3AudioFile).duration
@@ -131,27 +336,57 @@ func updatePlaylistFile(fileName string, mediaSequenceNumber int) bool {
         }
     }
     
-    // Now lock access to the file and create it
+    // Assemble the playlist: first the fixed header
+    fmt.Fprintf(&playlist, "#EXTM3U\r\n")
+    if useGapTag {
+        // #EXT-X-GAP needs version 8
+        fmt.Fprintf(&playlist, "#EXT-X-VERSION:8\r\n")
+    } else {
+        fmt.Fprintf(&playlist, "#EXT-X-VERSION:3\r\n")
+    }
+    if independentSegments {
+        fmt.Fprintf(&playlist, "#EXT-X-INDEPENDENT-SEGMENTS\r\n")
+    }
+    // Write the dynamic header fields; a playlist with no segments yet
+    // must still have a target duration to be valid, which can only be
+    // that of a full segment
+    if numSegments == 0 {
+        maxSegmentDuration = MAX_MP3_FILE_DURATION
+    }
+    fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\r\n", int(math.Ceil(float64(maxSegmentDuration) / float64(time.Second))))
+    fmt.Fprintf(&playlist, "#EXT-X-MEDIA-SEQUENCE:%d\r\n", pl.mediaSequenceNumber)
+    if numSegments > 0 {
+        if pl.discontinuitySequenceNumber > 0 {
+            fmt.Fprintf(&playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\r\n", pl.discontinuitySequenceNumber)
+        }
+        if (pl.StartOffset > 0) && (totalDuration > pl.StartOffset) {
+            fmt.Fprintf(&playlist, "#EXT-X-START:TIME-OFFSET=-%f\r\n", float32(pl.StartOffset) / float32(time.Second))
+        }
+        // Write the segment list
+        segmentData.WriteTo(&playlist)
+    }
+    if endList {
+        fmt.Fprintf(&playlist, "#EXT-X-ENDLIST\r\n")
+    }
+    
+    // Now lock access to the file and write it
     playlistAccess.Lock()
-    handle, err := os.Create(fileName)
+    err := retryFileWrite(fmt.Sprintf("writing playlist file \"%s\"", pl.fileName), func() error {
+        return writeStoreFile(store, pl.fileName, playlist.Bytes())
+    })
     if err == nil {
-        // Write the fixed header
-        fmt.Fprintf(handle, "#EXTM3U\r\n")
-        fmt.Fprintf(handle, "#EXT-X-VERSION:3\r\n")
-        if numSegments > 0 {
-            // Write the dynamic header fields
-            fmt.Fprintf(handle, "#EXT-X-TARGETDURATION:%d\r\n", int(math.Ceil(float64(maxSegmentDuration) / float64(time.Second))))
-            fmt.Fprintf(handle, "#EXT-X-MEDIA-SEQUENCE:%d\r\n", mediaSequenceNumber)
-            if totalDuration > MAX_PLAY_LAG {
-                fmt.Fprintf(handle, "#EXT-X-START:TIME-OFFSET=-%f\r\n", float32(MAX_PLAY_LAG) / float32(time.Second))
-            }
-            // Write the segment list
-            segmentData.WriteTo(handle)
+        log.Printf("Updated playlist file \"%s\" with %d segment(s).\n", pl.fileName, numSegments)
+        if pl.stale {
+            log.Printf("Playlist file \"%s\" is up to date again.\n", pl.fileName)
         }
-        log.Printf("Updated playlist file \"%s\" with %d segment(s).\n", fileName, numSegments)
-        handle.Close()        
+        pl.newestSegmentUri = newestUri
+        pl.snapshot = playlist.Bytes()
+        pl.stale = false
     } else {
-        log.Printf("Unable to create playlist file \"%s\" (%s).\n", fileName, err.Error())        
+        failures := atomic.AddInt64(&numPlaylistWriteFailures, 1)
+        log.Printf("Unable to write playlist file \"%s\" (%s), the last one written (%d byte(s)) will be served until it can be (%d failure(s) so far).\n",
+                   pl.fileName, err.Error(), len(pl.snapshot), failures)
+        pl.stale = true
     }
     playlistAccess.Unlock()
     
@@ -160,29 +395,121 @@ func updatePlaylistFile(fileName string, mediaSequenceNumber int) bool {
 
 // Home page handler
 func homeHandler (out http.ResponseWriter, in *http.Request, newPath string) {
-    log.Printf("Home handler was asked for \"%s\", redirecting to \"%s\"...\n", in.URL.Path, newPath)
-    http.Redirect(out, in, newPath, http.StatusFound)
+    newUrl := externalUrl(in, newPath)
+    log.Printf("Home handler was asked for \"%s\", redirecting to \"%s\"...\n", in.URL.Path, newUrl)
+    http.Redirect(out, in, newUrl, http.StatusFound)
 }
 
-// Handle a stream request
-func streamHandler(out http.ResponseWriter, in *http.Request) {
+// Return true if the given directory contains an HTML page of its own
+func hasIndexPage(dirName string) bool {
+    _, err := os.Stat(filepath.Join(dirName, "index.html"))
+    return err == nil
+}
+
+// Return the URL at which the playlist file is served
+func playlistUrl(playlistPath string) string {
+    url := filepath.ToSlash(playlistPath)
+    if !strings.HasPrefix(url, "/") {
+        url = "/" + url
+    }
+    return url
+}
+
+// Serve the embedded player page, pointed at the given playlist URL
+func playerHandler(out http.ResponseWriter, in *http.Request, playlistUrl string) {
+    log.Printf("Home handler was asked for \"%s\", serving embedded player page for \"%s\"...\n", in.URL.Path, playlistUrl)
+    out.Header().Set("Content-Type", "text/html; charset=utf-8")
+    out.Header().Set("Cache-Control","no-cache")
+    err := playerTemplate.Execute(out, struct{ PlaylistUrl string }{playlistUrl})
+    if err != nil {
+        log.Printf("Unable to serve embedded player page (%s).\n", err.Error())
+    }
+}
+
+// Handle a stream request, serving the playlist and segments from their
+// stores; if sessionSecret is not empty the playlist and segments are
+// only served to requests carrying a valid session token
+func streamHandler(out http.ResponseWriter, in *http.Request, playlistStore FileStore, segmentStore FileStore, sessionSecret string) {
     var ext string = filepath.Ext(in.URL.Path)
+    var expires time.Time
+    var ok bool
     
     log.Printf("Stream handler was asked for \"%s\"...\n", in.URL.Path)
+    if sessionSecret != "" {
+        // Whatever is asked for, the playlist, a segment or its checksum
+        expires, ok = checkSessionToken(out, in, sessionSecret)
+        if !ok {
+            return
+        }
+    }
     if ext == PLAYLIST_EXTENSION {        
         // Serve the playlist file
         log.Printf("Serving playlist file \"%s\".\n", in.URL.Path)
-        playlistAccess.Lock()
-        http.ServeFile(out, in, in.URL.Path)
-        playlistAccess.Unlock()
         out.Header().Set("Content-Type","application/x-mpegurl")
         out.Header().Set("Cache-Control","no-cache")
+        playlistAccess.Lock()
+        var newestSegmentUri string
+        var playlist []byte
+        // The live playlists are served from the snapshots taken when they
+        // were written, so a reader never sees one part way through being replaced
+        if served := playlistServedAt(in.URL.Path); served != nil {
+            newestSegmentUri = served.newestSegmentUri
+            playlist = served.snapshot
+        }
+        playlistAccess.Unlock()
+        // Hint that the newest segment, which the player is bound to ask for, can be fetched now
+        if newestSegmentUri != "" {
+            newestPath := segmentRequestPath(in.URL.Path, newestSegmentUri)
+            newestLink := newestPath
+            if parsed, err := url.Parse(newestSegmentUri); (err == nil) && parsed.IsAbs() {
+                newestLink = newestSegmentUri
+            } else {
+                newestLink = httpBasePath + newestLink
+            }
+            if sessionSecret != "" {
+                newestLink += "?" + sessionQuery(sessionSecret, newestPath, expires)
+            }
+            out.Header().Set("Link", "<" + newestLink + ">; rel=preload; as=fetch")
+        }
+        // Likewise the segment being encoded, which can be fetched in chunks
+        // or as it grows
+        if chunkedFileName := chunkedSegmentFileName(); chunkedFileName != "" {
+            chunkedPath := segmentRequestPath(in.URL.Path, filepath.ToSlash(chunkedFileName))
+            chunkedLink := httpBasePath + chunkedPath
+            if sessionSecret != "" {
+                chunkedLink += "?" + sessionQuery(sessionSecret, chunkedPath, expires)
+            }
+            out.Header().Add("Link", "<" + chunkedLink + ">; rel=preload; as=fetch")
+        }
+        if sessionSecret != "" {
+            serveSessionPlaylist(out, in, playlistStore, sessionSecret, expires, playlist)
+        } else if playlist != nil {
+            http.ServeContent(out, in, in.URL.Path, time.Time{}, bytes.NewReader(playlist))
+        } else {
+            playlistStore.ServeContent(out, in, in.URL.Path)
+        }
     } else if ext == SEGMENT_EXTENSION {
+        recordSegmentFetch(in, time.Now())
+        if !growingSegmentRanges && chunkedSegmentHandler(out, in) {
+            return
+        }
+        // Anything else is of a known length, so cut off a client that stalls
+        limited, in, served := limitSegmentRequest(out, in)
+        defer served()
+        if growingSegmentRanges && growingSegmentHandler(limited, in) {
+            return
+        }
         // Serve the requested segment
         log.Printf("Serving segment file \"%s\".\n", in.URL.Path)
-        http.ServeFile(out, in, in.URL.Path)
-        out.Header().Set("Content-Type","audio/mpeg")
-        out.Header().Set("Cache-Control","no-cache")
+        limited.Header().Set("Content-Type","audio/mpeg")
+        limited.Header().Set("Cache-Control","no-cache")
+        capture := &StatusCapturingResponseWriter{ResponseWriter: limited}
+        segmentStore.ServeContent(capture, in, in.URL.Path)
+        noteSegmentServed(in.URL.Path, capture.status)
+    } else if ext == CHECKSUM_EXTENSION {
+        // Serve the checksum sidecar of a segment
+        log.Printf("Serving checksum \"%s\".\n", in.URL.Path)
+        serveChecksum(out, in, in.URL.Path)
     } else {
         // Just serve the requested page
         log.Printf("Serving \"%s\".\n", in.URL.Path)
@@ -191,100 +518,391 @@ func streamHandler(out http.ResponseWriter, in *http.Request) {
     }
 }
 
-// Empty the MP3 file list, deleting the files as it goes
-func clearMp3FileList(mp3Dir string) {
-    log.Printf("Clearing MP3 file list...\n")
-    for newElement := newDatagramList.Front(); newElement != nil; newElement = newElement.Next() {
-        filePath := mp3Dir + string(os.PathSeparator) + newElement.Value.(*Mp3AudioFile).fileName        
-        log.Printf("Deleting file \"%s\"...\n", filePath)
-        err:= os.Remove(filePath)
-        if err != nil {
-            log.Printf("Unable to delete \"%s\".\n", filePath)
+// Handle a statistics request
+func statsHandler(out http.ResponseWriter, in *http.Request) {
+    var stats Stats
+    
+    log.Printf("Stats handler was asked for \"%s\"...\n", in.URL.Path)
+    stats.Sources = activeSources()
+    stats.EncoderErrors = atomic.LoadInt64(&numEncoderErrors)
+    stats.StaleDatagrams = atomic.LoadInt64(&numStaleDatagrams)
+    stats.Mute = muteState()
+    stats.LiveMp3Clients = numLiveMp3Subscribers()
+    stats.Mp3TapSinksDropped = atomic.LoadInt64(&numMp3TapSinksDropped)
+    stats.ChunkedSegmentClients = numChunkedSegmentSubscribers()
+    worst, average := tickLatency()
+    stats.TickLatencyWorstMs = float64(worst) / float64(time.Millisecond)
+    stats.TickLatencyAverageMs = float64(average) / float64(time.Millisecond)
+    stats.FileWriteFailures = atomic.LoadInt64(&numFileWriteFailures)
+    stats.ConcealmentBreaker = concealmentState()
+    stats.TcpConnections, stats.TcpConnectionsPeak, stats.TcpConnectionsRejected = tcpConnectionCounts()
+    stats.EncoderEffort = encoderEffortState()
+    stats.Heartbeats = atomic.LoadInt64(&numHeartbeats)
+    stats.TcpReassemblyResets = atomic.LoadInt64(&numTcpReassemblyResets)
+    stats.PlaylistWriteFailures = atomic.LoadInt64(&numPlaylistWriteFailures)
+    stats.StalePlaylists = len(stalePlaylists())
+    stats.SegmentsExpiredUnfetched = atomic.LoadInt64(&numSegmentsExpiredUnfetched)
+    stats.TcpResyncs = atomic.LoadInt64(&numTcpResyncs)
+    stats.TcpResyncBytesDiscarded = atomic.LoadInt64(&numTcpResyncBytesDiscarded)
+    stats.TcpPartialDatagrams = atomic.LoadInt64(&numTcpPartialDatagrams)
+    stats.TcpConnectionsByAddress = tcpConnectionStats()
+    stats.SegmentRequestsTimedOut = atomic.LoadInt64(&numSegmentRequestsTimedOut)
+    stats.SegmentsFailedVerification = atomic.LoadInt64(&numSegmentsFailedVerification)
+    stats.FormatMismatches = atomic.LoadInt64(&numFormatMismatches)
+    stats.Mp3FrameAnomalies = atomic.LoadInt64(&numMp3FrameAnomalies)
+    stats.UnknownCodingSchemes = atomic.LoadInt64(&numUnknownCodingSchemes)
+    stats.UdpDatagramsRejected = udpDatagramsRejected(false)
+    stats.AgingPause = agingPauseState()
+    stats.Listeners = listenerCount(time.Now())
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    err := json.NewEncoder(out).Encode(&stats)
+    if err != nil {
+        log.Printf("Unable to serve statistics (%s).\n", err.Error())
+    }
+}
+
+// Mark an MP3 file as no longer usable in a playlist, i.e. no longer
+// listed in it, moving the playlist on past it
+func retireMp3File(mp3AudioFile *Mp3AudioFile, playlist *Playlist) {
+    mp3AudioFile.listed[playlist.index] = false
+    mp3AudioFile.references--
+    playlist.mediaSequenceNumber++
+    if mp3AudioFile.discontinuity {
+        playlist.discontinuitySequenceNumber++
+    }
+}
+
+// Retire the oldest MP3 files listed in a playlist while it lists more
+// than its MaxSegments, provided that at least its StartOffset (or, if
+// that is zero, MAX_PLAY_LAG) of audio remains listed; returns the
+// number of files retired
+func capPlaylist(playlist *Playlist) int {
+    var numListed int
+    var listedDuration time.Duration
+    var numRetired int
+    
+    minDuration := playlist.StartOffset
+    if minDuration == 0 {
+        minDuration = MAX_PLAY_LAG
+    }
+    for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
+        if newElement.Value.(*Mp3AudioFile).listedIn(playlist) {
+            numListed++
+            listedDuration += newElement.Value.(*Mp3AudioFile).duration
+        }
+    }
+    
+    // The list is in age order, oldest first
+    for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
+        if newElement.Value.(*Mp3AudioFile).listedIn(playlist) {
+            if (numListed > playlist.MaxSegments) && (listedDuration - newElement.Value.(*Mp3AudioFile).duration >= minDuration) {
+                retireMp3File(newElement.Value.(*Mp3AudioFile), playlist)
+                numListed--
+                numRetired++
+                listedDuration -= newElement.Value.(*Mp3AudioFile).duration
+                log.Printf ("MP3 file \"%s\" no longer usable in playlist \"%s\" as there are more than %d segment(s).\n",
+                            newElement.Value.(*Mp3AudioFile).fileName, playlist.Name, playlist.MaxSegments)
+            }
+        }
+    }
+    
+    return numRetired
+}
+
+// Let the oldest MP3 files which are listed in no playlist be removed
+// once there are more than maxSegments of those
+func capUnlistedMp3Files(maxSegments int) {
+    var numUnlisted int
+    
+    for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
+        if (newElement.Value.(*Mp3AudioFile).references == 0) && !newElement.Value.(*Mp3AudioFile).removable {
+            numUnlisted++
         }
-        newDatagramList.Remove(newElement)
     }
+    for newElement := mp3FileList.Front(); (newElement != nil) && (numUnlisted > maxSegments); newElement = newElement.Next() {
+        if (newElement.Value.(*Mp3AudioFile).references == 0) && !newElement.Value.(*Mp3AudioFile).removable {
+            newElement.Value.(*Mp3AudioFile).removable = true
+            numUnlisted--
+            log.Printf ("MP3 file \"%s\" can now be deleted as there are more than %d unusable segment(s).\n",
+                        newElement.Value.(*Mp3AudioFile).fileName, maxSegments)
+        }
+    }
+}
+
+// Update all of the playlist files
+func updatePlaylistFiles(options AudioOutOptions, ended bool) {
+    for _, playlist := range playlists {
+        updatePlaylistFile(options.PlaylistStore, playlist, options.UseGapTag, options.IndependentSegments, ended, options.SegmentBaseUrl)
+    }
+    updateMasterPlaylist(options.PlaylistStore)
+}
+
+// Add a new MP3 file to the list, listing it in every playlist
+func addMp3File(mp3AudioFile *Mp3AudioFile, options AudioOutOptions, ended bool) {
+    mp3AudioFile.listed = make([]bool, len(playlists))
+    for x := range mp3AudioFile.listed {
+        mp3AudioFile.listed[x] = true
+    }
+    mp3AudioFile.references = len(playlists)
+    mp3FileList.PushBack(mp3AudioFile)
+    addRecentSegment(mp3AudioFile.fileName)
+    updatePlaylistFiles(options, ended)
 }
 
-// Start HTTP server for streaming output; this function should never return
-func operateAudioOut(port string, playlistPath string,  oOSDir string) {
+// Retire MP3 files from the playlists when there are too many or they
+// are too old for each, mark those listed in no playlist as removable,
+// if there are too many or they are older than options.Retention, then
+// attempt to delete removable files, unless deletion is paused
+func ageMp3Files(mp3Dir string, options AudioOutOptions, ended bool) {
+    // Try again with any playlist file that could not be written
+    for _, playlist := range stalePlaylists() {
+        updatePlaylistFile(options.PlaylistStore, playlist, options.UseGapTag, options.IndependentSegments, ended, options.SegmentBaseUrl)
+    }
+    // Retire files if there are too many, whatever their age
+    for _, playlist := range playlists {
+        if (playlist.MaxSegments > 0) && (capPlaylist(playlist) > 0) {
+            updatePlaylistFile(options.PlaylistStore, playlist, options.UseGapTag, options.IndependentSegments, ended, options.SegmentBaseUrl)
+        }
+    }
+    if options.MaxSegments > 0 {
+        capUnlistedMp3Files(options.MaxSegments)
+    }
+    var nextElement *list.Element
+    for newElement := mp3FileList.Front(); newElement != nil; newElement = nextElement {
+        nextElement = newElement.Next()
+        mp3AudioFile := newElement.Value.(*Mp3AudioFile)
+        for _, playlist := range playlists {
+            if mp3AudioFile.listedIn(playlist) && (time.Now().Sub(mp3AudioFile.timestamp) > playlist.Window) {
+                retireMp3File(mp3AudioFile, playlist)
+                log.Printf ("MP3 file \"%s\", received at %s, no longer usable in playlist \"%s\" (time now is %s).\n",
+                            mp3AudioFile.fileName, mp3AudioFile.timestamp.String(), playlist.Name, time.Now().String())
+                updatePlaylistFile(options.PlaylistStore, playlist, options.UseGapTag, options.IndependentSegments, ended, options.SegmentBaseUrl)
+            }
+        }
+        filePath := mp3Dir + string(os.PathSeparator) + mp3AudioFile.fileName
+        if (mp3AudioFile.references == 0) && !mp3AudioFile.removable && (time.Now().Sub(mp3AudioFile.timestamp) > options.Retention) &&
+           retentionOver(mp3AudioFile, filePath, options) {
+            mp3AudioFile.removable = true;
+            log.Printf ("MP3 file \"%s\", received at %s, can now been deleted (time now is %s).\n",
+                        mp3AudioFile.fileName, mp3AudioFile.timestamp.String(), time.Now().String())
+        }
+    }
+    if holdSegments(options) {
+        return
+    }
+    // Oldest first, so that if only some may go it is the oldest
+    numToDelete := segmentsToDelete(options.AgingPauseMaxSegments)
+    for newElement := mp3FileList.Front(); (newElement != nil) && (numToDelete > 0); newElement = nextElement {
+        nextElement = newElement.Next()
+        mp3AudioFile := newElement.Value.(*Mp3AudioFile)
+        filePath := mp3Dir + string(os.PathSeparator) + mp3AudioFile.fileName
+        if mp3AudioFile.removable {
+            numToDelete--
+            if options.SegmentStore.Remove(filePath) == nil {
+                log.Printf ("MP3 file \"%s\" successfully deleted and will be removed from the list.\n", filePath)
+                removeChecksum(options.SegmentStore, filePath, mp3AudioFile)
+                forgetSegmentFetched(filePath)
+                if mp3AudioFile.level != nil {
+                    removeSegmentLevel(filePath)
+                }
+                removeEmptySegmentDirs(mp3Dir, filePath)
+                mp3FileList.Remove(newElement)
+            }
+        }
+    }
+}
+
+// Forget the checksum of an MP3 file and delete its sidecar, if it has one
+func removeChecksum(store FileStore, filePath string, mp3AudioFile *Mp3AudioFile) {
+    if mp3AudioFile.checksum != "" {
+        removeSegmentChecksum(filePath)
+        store.Remove(filePath + CHECKSUM_EXTENSION)
+    }
+}
+
+// Delete the directories between a deleted segment file and mp3Dir
+// which are now empty
+func removeEmptySegmentDirs(mp3Dir string, filePath string) {
+    for dirName := filepath.Dir(filePath); (len(dirName) > len(mp3Dir)) && strings.HasPrefix(dirName, mp3Dir); dirName = filepath.Dir(dirName) {
+        if os.Remove(dirName) != nil {
+            break
+        }
+        log.Printf("Deleted empty segment directory \"%s\".\n", dirName)
+    }
+}
+
+// Start HTTP server for streaming output; this function returns
+// when ctx is cancelled, once the playlists have been ended
+func operateAudioOut(ctx context.Context, port string, playlistPath string,  oOSDir string, options AudioOutOptions) {
     var channel = make(chan interface{})
     var err error
     var mp3Dir string
-    var mediaSequenceNumber int
-    var oOS bool = true
+    var maintenance bool
     streamTicker := time.NewTicker(time.Second * 5)
     mux := http.NewServeMux()
     
     MediaControlChannel = channel
     
+    // Set up the playlists, the live playlist starting MAX_PLAY_LAG back
+    playlistAccess.Lock()
+    playlists = createPlaylists(playlistPath, PlaylistConfig{Window: options.PlaylistWindow,
+                                                             MaxSegments: options.MaxSegments,
+                                                             StartOffset: MAX_PLAY_LAG},
+                                options.Playlists)
+    if options.MasterPlaylist.Name != "" {
+        masterPlaylist = createMasterPlaylist(playlistPath, options.MasterPlaylist)
+        log.Printf("Also serving master playlist \"%s\", with %d audio rendition(s) in group \"%s\", at \"%s\".\n",
+                   masterPlaylist.Name, len(masterPlaylist.Renditions), masterPlaylist.GroupId,
+                   playlistUrl(masterPlaylist.fileName))
+    }
+    playlistAccess.Unlock()
+    if options.Retention < longestPlaylistWindow() {
+        options.Retention = longestPlaylistWindow()
+    }
+    log.Printf("Keeping up to %d segment file(s) open.\n", setSegmentCacheSize(longestPlaylistWindow()))
+    growingSegmentRanges = options.GrowingSegments
+    segmentRequestTimeout = options.SegmentRequestTimeout
+    segmentFetchTracking = options.RetentionUntilFetched > options.Retention
+    if segmentFetchTracking {
+        log.Printf("Segments will be kept for up to %s until they have been fetched.\n", options.RetentionUntilFetched.String())
+    }
+    if _, inMemory := options.SegmentStore.(MemoryFileStore); inMemory {
+        window := options.Retention
+        if segmentFetchTracking {
+            window = options.RetentionUntilFetched
+        }
+        limit := setMemorySegmentLimit(window, options.MaxMemorySegmentBytes)
+        if options.MaxMemorySegmentBytes > 0 {
+            log.Printf("Keeping up to %d byte(s) of segments in memory.\n", limit)
+        } else {
+            log.Printf("Keeping up to %d byte(s) of segments in memory, for %s at the bitrate of the encoder.\n",
+                       limit, window.String())
+        }
+    }
+    for _, playlist := range playlists[1:] {
+        log.Printf("Also serving playlist \"%s\", window %s, at \"%s\".\n", playlist.Name,
+                   playlist.Window.String(), playlistUrl(playlist.fileName))
+    }
+    
     // Initialise the linked list of MP3 output files
     mp3FileList.Init()
+    setReadySegments(options.ReadySegments)
+    
+    // Check that there is something to redirect to while out of service,
+    // falling back to the embedded maintenance page if not
+    if oOSDir != "" {
+        err = checkOosDir(oOSDir)
+        if err == nil {
+            log.Printf("Out of service pages will be served from \"%s\".\n", oOSDir)
+        } else {
+            log.Printf("Out of service directory \"%s\" can't be used (%s), the embedded maintenance page will be served instead.\n",
+                       oOSDir, err.Error())
+            oOSDir = ""
+            maintenance = true
+        }
+    }
     
     // Set up the MP3 directory
     mp3Dir = filepath.Dir(playlistPath)
+    // Segments requested under their base URL, if it is elsewhere, are
+    // mapped back to the MP3 directory; a rooted base URL is one that a
+    // client uses, so includes any base path
+    setBasePath(options.BasePath, options.TrustForwarded)
+    segmentBase := internalPath(segmentBasePath(playlistUrl(playlistPath), playlistUrl(mp3Dir), options.SegmentBaseUrl))
+    if segmentBase != "" {
+        log.Printf("Segments are also served under \"%s\".\n", segmentBase)
+    }
     
-    // Create an initial (empty) playlist file    
-    if !updatePlaylistFile(playlistPath, mediaSequenceNumber) {
-        fmt.Fprintf(os.Stderr, "Unable to create playlist file \"%s\" (%s).\n", playlistPath, err.Error())
-        os.Exit(-1)            
+    // Create the initial (empty) playlist files
+    for _, playlist := range playlists {
+        if !updatePlaylistFile(options.PlaylistStore, playlist, options.UseGapTag, options.IndependentSegments, false, options.SegmentBaseUrl) {
+            fmt.Fprintf(os.Stderr, "Unable to create playlist file \"%s\" (see the log for details).\n", playlist.fileName)
+            os.Exit(-1)            
+        }
     }
 
-    // Timed function to perform operations on the stream
+    // Process media control commands and, on each tick, age the MP3
+    // files; both are done here, in the one goroutine, since both change
+    // the list of MP3 files and the playlists; whether the stream is out
+    // of service and whether its playlists are ended are only known here,
+    // the HTTP handlers going by isStreamReady()
+    mediaDone := make(chan struct{})
     go func() {
-        for _ = range streamTicker.C {
-            // Go through the file list and mark old files as unusable, then removable, 
-            // and attempt to delete removable files as we go 
-            for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
-                if (newElement.Value.(*Mp3AudioFile).usable) && (time.Now().Sub(newElement.Value.(*Mp3AudioFile).timestamp) > MP3_USABLE_AGE) {
-                    newElement.Value.(*Mp3AudioFile).usable = false;
-                    mediaSequenceNumber++;
-                    log.Printf ("MP3 file \"%s\", received at %s, no longer usable (time now is %s).\n",
-                                newElement.Value.(*Mp3AudioFile).fileName, newElement.Value.(*Mp3AudioFile).timestamp.String(),
-                                time.Now().String())
-                    updatePlaylistFile(playlistPath, mediaSequenceNumber)
-                }                
-                if (!newElement.Value.(*Mp3AudioFile).usable) && (time.Now().Sub(newElement.Value.(*Mp3AudioFile).timestamp) > MP3_REMOVABLE_AGE) {
-                    newElement.Value.(*Mp3AudioFile).removable = true;
-                    log.Printf ("MP3 file \"%s\", received at %s, can now been deleted (time now is %s).\n",
-                                newElement.Value.(*Mp3AudioFile).fileName, newElement.Value.(*Mp3AudioFile).timestamp.String(),
-                                time.Now().String())
-                }                
-                if newElement.Value.(*Mp3AudioFile).removable {
-                    filePath := mp3Dir + string(os.PathSeparator) + newElement.Value.(*Mp3AudioFile).fileName
-                    if os.Remove(filePath) == nil {
-                        log.Printf ("MP3 file \"%s\" successfully deleted and will be removed from the list.\n", filePath)
-                        mp3FileList.Remove(newElement)
+        var oOS bool = true
+        var ended bool
+        stopping := ctx.Done()
+
+        for running := true; running; {
+            select {
+                case <-stopping:
+                    // Wait for the last segments, if audio processing says
+                    // when they are out
+                    streamTicker.Stop()
+                    stopping = nil
+                    running = options.ProcessingDone != nil
+                case <-options.ProcessingDone:
+                    running = false
+                case <-streamTicker.C:
+                    ageMp3Files(mp3Dir, options, ended)
+                case cmd, ok := <-channel:
+                    // Nothing matches if the channel has been closed
+                    running = ok
+                    switch message := cmd.(type) {
+                        // Handle the media control messages
+                        case *Mp3AudioFile:
+                        {
+                            log.Printf("Adding new MP3 file \"%s\", duration %d millisecond(s), to the FIFO list...\n", message.fileName, int(message.duration / time.Millisecond))
+                            if message.checksum != "" {
+                                addSegmentChecksum(message.fileName, message.checksum)
+                            }
+                            if message.level != nil {
+                                addSegmentLevel(message.fileName, *message.level)
+                            }
+                            ended = false
+                            addMp3File(message, options, ended)
+                            // Until there are enough segments for a client that
+                            // attaches not to give up, keep showing the OOS page
+                            if oOS && countSegmentTowardsReady() {
+                                oOS = false
+                            }
+                            setStreamReady(!oOS)
+                        }
+                        case *ServiceChange:
+                        {
+                            // Mark the playlist as ended, and show the OOS page, while out of service
+                            if message.outOfService {
+                                log.Printf("Stream going out of service.\n")
+                            } else {
+                                log.Printf("Stream going back into service.\n")
+                            }
+                            ended = message.outOfService
+                            oOS = message.outOfService
+                            setStreamReady(!oOS)
+                            updatePlaylistFiles(options, ended)
+                        }
                     }
-                }
-            }
-        }        
-    }()
-    
-    // Process media control commands
-    go func() {
-        for cmd := range channel {
-            switch message := cmd.(type) {
-                // Handle the media control messages
-                case *Mp3AudioFile:
-                {
-                    log.Printf("Adding new MP3 file \"%s\", duration %d millisecond(s), to the FIFO list...\n", message.fileName, int(message.duration / time.Millisecond))
-                    mp3FileList.PushBack(message)
-                    updatePlaylistFile(playlistPath, mediaSequenceNumber)
-                    oOS = false;
-                    // TODO: when to set this to true?
-                }
             }
         }
-        clearMp3FileList(mp3Dir)
+        // End the playlists, keeping the segments they list, so that
+        // players finish what there is rather than wait for more
+        updatePlaylistFiles(options, true)
         fmt.Printf("HTTP streaming channel closed, stopping.\n")
+        close(mediaDone)
     }()
     
     // Set up the HTTP page handlers
     mux.HandleFunc("/", func(out http.ResponseWriter, in *http.Request) {
         if !filterCrossDomainRequest(out, in) {
-            addCrossDomainToResponse(out)
-            if oOS && (oOSDir != ""){
+            addCrossDomainToResponse(out, in)
+            if (segmentBase == "/") && (filepath.Ext(in.URL.Path) == SEGMENT_EXTENSION) {
+                segmentBaseHandler(out, in, segmentBase, mp3Dir, options.SegmentStore, options.SessionSecret)
+            } else if !isStreamReady() && (oOSDir != ""){
                 homeHandler(out, in, oOSDir)
+            } else if !isStreamReady() && maintenance {
+                maintenanceHandler(out, in)
+            } else if (in.URL.Path == "/") && !hasIndexPage(mp3Dir) {
+                playerHandler(out, in, externalUrl(in, playlistUrl(playlistPath)))
             } else {
                 homeHandler(out, in, mp3Dir)
             }
@@ -292,25 +910,139 @@ func operateAudioOut(port string, playlistPath string,  oOSDir string) {
     })
     mux.HandleFunc(mp3Dir + "/", func(out http.ResponseWriter, in *http.Request) {
         if !filterCrossDomainRequest(out, in) {
-            addCrossDomainToResponse(out)
-            streamHandler(out, in)
+            addCrossDomainToResponse(out, in)
+            streamHandler(out, in, options.PlaylistStore, options.SegmentStore, options.SessionSecret)
         }
     })
+    if (segmentBase != "") && (segmentBase != "/") {
+        mux.HandleFunc(segmentBase, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                segmentBaseHandler(out, in, segmentBase, mp3Dir, options.SegmentStore, options.SessionSecret)
+            }
+        })
+    }
+    mux.HandleFunc(READYZ_PATH, readyzHandler)
+    mux.HandleFunc(STATS_PATH, func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            statsHandler(out, in)
+        }
+    })
+    mux.HandleFunc(METRICS_PATH, func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            metricsHandler(out, in)
+        }
+    })
+    if options.HlsKey == nil {
+        // Not when the segments are encrypted, since it would give the audio away
+        mux.HandleFunc(LIVE_MP3_PATH, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                if sessionAllowed(out, in, options.SessionSecret) {
+                    liveMp3Handler(ctx, out, in)
+                }
+            }
+        })
+    } else {
+        mux.HandleFunc(HLS_KEY_PATH, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                hlsKeyHandler(out, in, options.HlsKey, options.SessionSecret)
+            }
+        })
+    }
+    if monitor != nil {
+        mux.HandleFunc(MONITOR_PATH, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                monitorHandler(out, in, monitor, options.SessionSecret)
+            }
+        })
+    }
+    if options.UnicamDiagnostics {
+        mux.HandleFunc(UNICAM_DIAGNOSTICS_PATH, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                unicamDiagnosticsHandler(out, in)
+            }
+        })
+    }
+    if options.SegmentLevels {
+        mux.HandleFunc(LEVELS_PATH, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                levelsHandler(out, in)
+            }
+        })
+    }
+    if options.Checksums {
+        mux.HandleFunc(MANIFEST_PATH, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                if sessionAllowed(out, in, options.SessionSecret) {
+                    manifestHandler(out, in)
+                }
+            }
+        })
+    }
+    if options.AdminToken != "" {
+        setAdminToken(options.AdminToken)
+        adminHandler := func(out http.ResponseWriter, in *http.Request) {
+            muteHandler(out, in)
+        }
+        mux.HandleFunc(ADMIN_MUTE_PATH, adminHandler)
+        mux.HandleFunc(ADMIN_UNMUTE_PATH, adminHandler)
+        mux.HandleFunc(ADMIN_PAUSE_AGING_PATH, agingPauseHandler)
+        mux.HandleFunc(ADMIN_RESUME_AGING_PATH, agingPauseHandler)
+        mux.HandleFunc(ADMIN_RESET_STATS_PATH, resetStatsHandler)
+        mux.HandleFunc(ADMIN_BITRATE_PATH, bitrateHandler)
+        mux.HandleFunc(ADMIN_PATH, apiNotFoundHandler)
+        if options.SessionSecret != "" {
+            mux.HandleFunc(ADMIN_SESSION_PATH, func(out http.ResponseWriter, in *http.Request) {
+                sessionHandler(out, in, options.SessionSecret)
+            })
+        }
+    }
     if oOSDir != "" {
         mux.HandleFunc(oOSDir + "/", func(out http.ResponseWriter, in *http.Request) {
             if !filterCrossDomainRequest(out, in) {
-                addCrossDomainToResponse(out)
-                streamHandler(out, in)
+                addCrossDomainToResponse(out, in)
+                streamHandler(out, in, OsFileStore{}, OsFileStore{}, "")
             }
         })
     }
     
     fmt.Printf("Starting HTTP server for Chuff requests on port %s.\n", port)
     
+    // Shut the HTTP server down when asked to, once the playlists have
+    // been ended
+    server := &http.Server{Addr: ":" + port, Handler: mux, TLSConfig: options.TlsConfig}
+    if options.TlsConfig != nil {
+        logTlsConfig(options.TlsConfig)
+    }
+    if options.BasePath != "" {
+        server.Handler = basePathHandler(server.Handler)
+    }
+    if options.AccessLog != nil {
+        // Outside the base path handler, so that the path is logged as asked for
+        server.Handler = accessLogHandler(server.Handler, options.AccessLog, options.AccessLogFormat)
+    }
+    // Outermost, so that the access log has the request ID
+    server.Handler = requestIdHandler(server.Handler)
+    go func() {
+        <-ctx.Done()
+        <-mediaDone
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+    }()
+    
     // Start the HTTP server (should block)
-    err = http.ListenAndServeTLS(":" + port, "cert.pem", "privkey.pem", mux)
+    err = server.ListenAndServeTLS("cert.pem", "privkey.pem")
     
-    if err != nil {        
+    if (err != nil) && (err != http.ErrServerClosed) {
         fmt.Fprintf(os.Stderr, "Could not start HTTP server (%s).\n", err.Error())
     }
 }
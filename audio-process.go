@@ -18,22 +18,150 @@ import (
     "time"
     "os"
     "path/filepath"
-    "io/ioutil"
-    "container/list"
+    "sync"
+    "context"
+    "sync/atomic"
     "bytes"
     "encoding/binary"
     "errors"
+    "io"
+    "hash"
+    "crypto/sha256"
+    "encoding/hex"
     "github.com/u-blox/ioc-server/lame"
-//    "encoding/hex"
 )
 
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The metadata given to the MP3 encoder and shown in the playlist
+type Mp3Metadata struct {
+    // The track title, also used in the playlist
+    Title string
+    // The artist, "" for none
+    Artist string
+    // The genre, a name or an ID3v1 genre number, "" for none
+    Genre string
+}
+
+// Options for createMp3Writer()
+type Mp3EncoderOptions struct {
+    Metadata Mp3Metadata
+    // If non-zero, the cut-off frequencies of the encoder's lowpass
+    // and highpass filters, else LAME chooses
+    LowpassHz int
+    HighpassHz int
+    // LAME's algorithm quality, 0 (best, slowest) to 9 (fastest), or
+    // MP3_QUALITY_LAME_DEFAULT for LAME to choose
+    Quality int
+    // If non-zero, the (constant) bitrate in kbits/s, else LAME chooses
+    Bitrate int
+    // If non-zero, the sample rate of the MP3, which LAME resamples the
+    // input to, else the MP3 is at SAMPLING_FREQUENCY
+    OutSampleRate int
+    // Leave the bit reservoir enabled, for better quality, at the cost of
+    // segments that cannot be decoded without those before them and that
+    // do not butt up together without gaps
+    BitReservoir bool
+}
+
+// A finished segment waiting to be written out
+type SegmentJob struct {
+    // The encoded MP3 audio
+    audio []byte
+    // The offset of the segment from the start of the stream
+    offset time.Duration
+    // The description of the segment, less the file name and checksum
+    mp3AudioFile *Mp3AudioFile
+    // If not nil, a change of service to pass on instead of a segment
+    serviceChange *ServiceChange
+    // If not nil, the segment the audio has already been written into,
+    // see AudioProcessingOptions.DirectSegments
+    direct *DirectSegment
+    // The sequence number of the segment as a chunked segment
+    sequence int
+}
+
+// Options for operateAudioProcessing()
+type AudioProcessingOptions struct {
+    // The ID3 timestamp mode, see writeTag()
+    Id3TimestampMode string
+    // Where to write segments
+    SegmentStore FileStore
+    // The name of the gap concealment strategy, see createConcealer()
+    Concealment string
+    // If non-zero, the integrated loudness to normalise the audio to
+    TargetLufs float64
+    // If non-zero, datagrams whose timestamp is further than this behind
+    // the playout position are dropped
+    MaxDatagramAge time.Duration
+    // How to set up the MP3 encoder
+    Encoder Mp3EncoderOptions
+    // If non-zero, the amount of silence to put ahead of the audio when
+    // a stream starts, so that players have a buffer straight away
+    Preroll time.Duration
+    // Fill stalls in the input with silence, see UnderrunFiller
+    FillUnderrun bool
+    // If not "", the sub-directory of mp3Dir in which to put segments
+    SegmentDir string
+    // Put segments in a sub-directory per (UTC) day
+    SegmentDateDirs bool
+    // Calculate the SHA-256 checksum of each segment and, for segments
+    // on disk, write it to a sidecar file
+    Checksums bool
+    // Meter the RMS and peak level of the audio of each segment
+    SegmentLevels bool
+    // If non-zero, the fraction of the audio over MaxConcealedWindow
+    // which may be gap-fill before the stream is taken out of service,
+    // see ConcealmentBreaker
+    MaxConcealed float64
+    MaxConcealedWindow time.Duration
+    // If not nil, audio to play on a loop while the input is idle
+    FallbackAudio *FallbackAudio
+    // If not nil, the AES-128 key with which to encrypt each segment
+    HlsKey []byte
+    // Lower the effort of the MP3 encoder while audio processing is
+    // falling behind, see EncoderEffort
+    AdaptiveEffort bool
+    // Decode each segment before it is published, see verifySegment(),
+    // dropping those that fail
+    VerifySegments bool
+    // Serve the segment being encoded in chunks, see chunkedSegmentHandler()
+    ChunkedSegments bool
+    // Serve the segment being encoded as it grows, see growingSegmentHandler()
+    GrowingSegments bool
+    // Write the MP3 audio into the segment files as it is encoded, rather
+    // than keeping each segment in memory until it is finished, see
+    // DirectSegment
+    DirectSegments bool
+    // Fill with silence from startup until the audio begins, see WarmupFiller
+    Warmup bool
+    // What to do with a first datagram which does not carry a whole
+    // block of audio, FIRST_DATAGRAM_PAD or FIRST_DATAGRAM_TRIM
+    FirstDatagram string
+    // If non-zero, the fraction faster than real time (e.g. 0.1) at which
+    // a backlog in the audio buffer may be drained, see CatchUpLimiter
+    CatchUpRate float64
+}
+
 //--------------------------------------------------------------------
 // Constants
 //--------------------------------------------------------------------
 
-// How big the processedDatagramsList can become
+// How big the processedDatagramRing can become
 const NUM_PROCESSED_DATAGRAMS int = 1
 
+// How many datagrams newDatagramRing can hold to begin with (10
+// seconds' worth); if audio processing falls further behind than that
+// it grows
+const NUM_NEW_DATAGRAMS int = 10000 / BLOCK_DURATION_MS
+
+// A datagram this far behind the playout position can't be backlog
+// from a reconnecting client; the client must have restarted its
+// timestamps, so the playout position is re-synchronised to it
+const DATAGRAM_RESYNC_AGE time.Duration = time.Second * 30
+
 // Guard against silly sequence number gaps
 const MAX_GAP_FILL_MILLISECONDS int = 500
 
@@ -43,12 +171,37 @@ const MAX_MP3_FILE_DURATION time.Duration = time.Second * 5
 // The number of samples represented by the MP3 file duration
 const MAX_MP3_FILE_SAMPLES int = int(MAX_MP3_FILE_DURATION / time.Second) * SAMPLING_FREQUENCY
 
-// The track title to use
+// The number of finished segments that may be waiting to be written
+// out before audio processing has to wait for the writing
+const SEGMENT_JOB_QUEUE_LENGTH int = 10
+
+// A tick of audio processing serviced later than this is logged
+const TICK_LATENCY_WARNING time.Duration = time.Millisecond * 100
+
+// The format of the name of a per-day segment sub-directory
+const SEGMENT_DATE_DIR_FORMAT string = "2006-01-02"
+
+// The default track title
 const MP3_TITLE string = "Internet of Chuffs"
 
 // The length of the binary timestamp in the ID3 tag of the MP3 file
 const MP3_ID3_TAG_TIMESTAMP_LEN int = 8
 
+// The timestamp modes for the ID3 tag of the MP3 file: transport writes
+// the offset from the first segment on a 90 kHz basis (as HLS expects),
+// epoch writes the Unix time in milliseconds at the start of the segment
+// and none omits the ID3 tag entirely
+const ID3_TIMESTAMP_TRANSPORT string = "transport"
+const ID3_TIMESTAMP_EPOCH string = "epoch"
+const ID3_TIMESTAMP_NONE string = "none"
+
+// The length of an ID3 header
+const MP3_ID3_HEADER_LEN int = 10
+
+// The sample rate of the MP3 with --itunes-compat, which Apple's tools
+// expect
+const ITUNES_SAMPLE_RATE int = 44100
+
 //--------------------------------------------------------------------
 // Variables
 //--------------------------------------------------------------------
@@ -56,15 +209,53 @@ const MP3_ID3_TAG_TIMESTAMP_LEN int = 8
 // The channel that processes incoming datagrams
 var ProcessDatagramsChannel chan<- interface{}
 
-// The list of new datagrams received
-var newDatagramList = list.New()
+// The FIFO of new datagrams received
+var newDatagramRing = createGrowingDatagramRing(NUM_NEW_DATAGRAMS)
+
+// Mutex to manage access to newDatagramRing
+var newDatagramAccess sync.Mutex
+
+// The total number of MP3 encoding errors, accessed atomically
+var numEncoderErrors int64
+
+// The metadata of what is playing now, which may be changed while running
+var nowPlaying Mp3Metadata
+var nowPlayingAccess sync.Mutex
+
+// The playout position: the datagram timestamp (in microseconds)
+// expected at playoutTime
+var playoutTimestamp uint64
+var playoutTime time.Time
+
+// The total number of datagrams dropped as stale, accessed atomically
+var numStaleDatagrams int64
+
+// The worst and the total latency (both in nanoseconds) with which
+// the ticks of audio processing have been serviced, and the number
+// of ticks serviced, accessed atomically
+var tickLatencyWorst int64
+var tickLatencyTotal int64
+var numTicks int64
+
+// The filler of stalls in the input, nil if they are not filled
+var underrunFiller *UnderrunFiller
+
+// The loudness normaliser, nil if loudness normalisation is off
+var loudnessNormaliser *LoudnessNormaliser
+
+// The strategy used to fill gaps in the audio
+var concealer Concealer = RepeatConcealer{}
 
 // Place to save already processed datagrams in case we need them again
-var processedDatagramList = list.New()
+var processedDatagramRing = createDatagramRing(NUM_PROCESSED_DATAGRAMS)
 
 // An audio buffer to hold raw PCM samples received from the client
 var pcmAudio bytes.Buffer
 
+// The number of samples of gap-fill written to pcmAudio since the
+// last segment was completed
+var concealedSamples int
+
 // Prefix that represents the fixed portion of a "PRIV" ID3 tag to put at the start of a
 // segment file, see https://tools.ietf.org/html/draft-pantos-http-live-streaming-23#section-3.4
 // and http://id3.org/id3v2.3.0#ID3v2_overview
@@ -95,33 +286,90 @@ var id3Prefix string = "ID3\x04\x00\x00\x00\x00\x00\x3fPRIV\x00\x00\x00\x35\x00\
 // Functions
 //--------------------------------------------------------------------
 
-// Open an MP3 file
-func openMp3File(dirName string) *os.File {
-    handle, err := ioutil.TempFile (dirName, "")
-    if err == nil {
-        filePath := handle.Name()
-        handle.Close()
-        if os.Rename(filePath, filePath + SEGMENT_EXTENSION) == nil {
-            handle, err = os.Create(filePath + SEGMENT_EXTENSION)
-            log.Printf("Opened segment file \"%s\" for MP3 output.\n", handle.Name())
-        } else {
-            log.Printf("Unable to rename temporary file \"%s\" to \"%s\".\n", filePath, filePath + SEGMENT_EXTENSION)
+// Return the directory in which a new segment should be put
+func segmentDirectory(mp3Dir string, options AudioProcessingOptions) string {
+    dirName := filepath.Join(mp3Dir, options.SegmentDir)
+    if options.SegmentDateDirs {
+        dirName = filepath.Join(dirName, time.Now().UTC().Format(SEGMENT_DATE_DIR_FORMAT))
+    }
+    return dirName
+}
+
+// Return the name of a segment relative to mp3Dir, as used in the playlist
+func segmentFileName(mp3Dir string, segmentPath string) string {
+    name, err := filepath.Rel(mp3Dir, segmentPath)
+    if err != nil {
+        name = filepath.Base(segmentPath)
+    }
+    return filepath.ToSlash(name)
+}
+
+// Open an MP3 segment in the given directory of a store
+func openMp3Segment(store FileStore, dirName string) StoreFile {
+    var handle StoreFile
+    
+    err := retryFileWrite(fmt.Sprintf("creating a segment file in \"%s\"", dirName), func() error {
+        name, err := newSegmentName(store, dirName)
+        if err == nil {
+            handle, err = store.Create(name)
         }
-    } else {
+        return err
+    })
+    if err != nil {
         log.Printf("Unable to create segment file for MP3 output in directory \"%s\".\n", dirName)
+        return nil
     }
+    log.Printf("Opened segment file \"%s\" for MP3 output.\n", handle.Name())
     
     return handle
 }
 
+// Set the metadata of what is playing now; it is given to the segments
+// that follow and to the MP3 encoder when it is next created
+func setNowPlaying(metadata Mp3Metadata) {
+    nowPlayingAccess.Lock()
+    defer nowPlayingAccess.Unlock()
+    nowPlaying = metadata
+}
+
+// Return the metadata of what is playing now
+func nowPlayingMetadata() Mp3Metadata {
+    nowPlayingAccess.Lock()
+    defer nowPlayingAccess.Unlock()
+    return nowPlaying
+}
+
+// Return the sample rate of the MP3 put out by an encoder with the given
+// options
+func mp3SampleRate(options Mp3EncoderOptions) int {
+    if options.OutSampleRate > 0 {
+        return options.OutSampleRate
+    }
+    return SAMPLING_FREQUENCY
+}
+
+// Create the MP3 writer of the stream, recording its quality and
+// bitrate as those in use
+func createMp3Writer(mp3Audio *bytes.Buffer, options Mp3EncoderOptions) (*lame.LameWriter, int) {
+    mp3Writer, mp3SamplesPerFrame := newMp3Writer(mp3Audio, options)
+    if mp3Writer != nil {
+        atomic.StoreInt64(&mp3EncoderQuality, int64(mp3Writer.Encoder.Quality()))
+        setMp3EncoderBitrate(mp3Writer.Encoder.GetBitrate(), mp3Writer.Encoder.OutSamplerate())
+    }
+    return mp3Writer, mp3SamplesPerFrame
+}
+
 // Create an MP3 writer
-func createMp3Writer(mp3Audio *bytes.Buffer) (*lame.LameWriter, int) {
+func newMp3Writer(mp3Audio *bytes.Buffer, options Mp3EncoderOptions) (*lame.LameWriter, int) {
     var mp3SamplesPerFrame int
     // Initialise the MP3 encoder.  This is equivalent to:
     // lame -V2 -r -s 16000 -m m --bitwidth 16 <input file> <output file>
     mp3Writer := lame.NewWriter(mp3Audio)
     if mp3Writer != nil {
         mp3Writer.Encoder.SetInSamplerate(SAMPLING_FREQUENCY)
+        if options.OutSampleRate > 0 {
+            mp3Writer.Encoder.SetOutSamplerate(options.OutSampleRate)
+        }
         mp3Writer.Encoder.SetNumChannels(1)
         mp3Writer.Encoder.SetMode(lame.MONO)
         // VBR writes tags into the file which makes
@@ -131,14 +379,37 @@ func createMp3Writer(mp3Audio *bytes.Buffer) (*lame.LameWriter, int) {
         mp3Writer.Encoder.SetVBR(lame.VBR_OFF)
         // Disabling the bit reservoir reduces quality
         // but allows consecutive MP3 files to be butted
-        // up together without any gaps
-        mp3Writer.Encoder.DisableReservoir()
-        mp3Writer.Encoder.SetGenre("144") // Thrash metal
+        // up together without any gaps, and to be
+        // decoded independently
+        if !options.BitReservoir {
+            mp3Writer.Encoder.DisableReservoir()
+        }
+        if options.Metadata.Title != "" {
+            mp3Writer.Encoder.SetTitle(options.Metadata.Title)
+        }
+        if options.Metadata.Artist != "" {
+            mp3Writer.Encoder.SetArtist(options.Metadata.Artist)
+        }
+        if options.Metadata.Genre != "" {
+            mp3Writer.Encoder.SetGenre(options.Metadata.Genre)
+        }
+        if options.LowpassHz > 0 {
+            mp3Writer.Encoder.SetLowpassFreq(options.LowpassHz)
+        }
+        if options.HighpassHz > 0 {
+            mp3Writer.Encoder.SetHighpassFreq(options.HighpassHz)
+        }
+        if options.Quality != MP3_QUALITY_LAME_DEFAULT {
+            mp3Writer.Encoder.SetQuality(options.Quality)
+        }
+        if options.Bitrate > 0 {
+            mp3Writer.Encoder.SetBitrate(options.Bitrate)
+        }
         // Note: bit depth defaults to 16
         if mp3Writer.Encoder.InitParams() >= 0 {
             mp3SamplesPerFrame = mp3Writer.Encoder.GetMp3FrameSize()
-            log.Printf("Created MP3 writer, MP3 frame size is %d samples, encoder delay is %d samples.\n",
-                       mp3SamplesPerFrame, mp3Writer.Encoder.GetEncoderDelay())        
+            log.Printf("Created MP3 writer, MP3 frame size is %d samples at %d Hz, encoder delay is %d samples.\n",
+                       mp3SamplesPerFrame, mp3Writer.Encoder.OutSamplerate(), mp3Writer.Encoder.GetEncoderDelay())        
         } else {
             mp3Writer.Close()
             mp3Writer = nil
@@ -151,73 +422,127 @@ func createMp3Writer(mp3Audio *bytes.Buffer) (*lame.LameWriter, int) {
     return mp3Writer, mp3SamplesPerFrame
 }
 
-// Handle a gap of a given number of samples in the input data
-func handleGap(gap int, previousDatagram * UrtpDatagram) {
-    var y int
-    fill := make([]byte, gap * URTP_SAMPLE_SIZE)
-    
+// Return true if a gap of a given number of samples in the input data
+// is too long to be anything but a restart or a reordering of the
+// sequence numbers, in which case it should not be filled
+func isSillyGap(gap int) bool {
+    return gap >= SAMPLING_FREQUENCY * MAX_GAP_FILL_MILLISECONDS / 1000
+}
+
+// Handle a gap of a given number of samples in the input data, between
+// the previous and next datagrams (either of which may be nil)
+func handleGap(gap int, previousDatagram * UrtpDatagram, nextDatagram * UrtpDatagram) {
     log.Printf("Handling a gap of %d samples...\n", gap)
-    if gap < SAMPLING_FREQUENCY * MAX_GAP_FILL_MILLISECONDS / 1000 {
-        // TODO: for now just repeat the last sample we received
-        if (previousDatagram != nil) && (len(*previousDatagram.Audio) > 0) {
-            for w := 0; w < len(fill); w += URTP_SAMPLE_SIZE {
-                x := (*previousDatagram.Audio)[y]
-                for z := 0; z < URTP_SAMPLE_SIZE; z++ {
-                    fill[w + z] = byte(x >> ((uint(z) * 8)))
-                }
-                y++
-                if y >= len(*previousDatagram.Audio) {
-                    y = 0
-                }
-            } 
-        }
+    if !isSillyGap(gap) {
+        fill := concealer.Fill(gap, previousDatagram, nextDatagram)
         log.Printf("Writing %d bytes to the audio buffer...\n", len(fill))
         pcmAudio.Write(fill)
+        concealedSamples += gap
     } else {
         log.Printf("Ignored a silly gap.\n")
     }
 }
 
-// Process a URTP datagram
-func processDatagram(datagram * UrtpDatagram, savedDatagramList * list.List) {
-    
-    var previousDatagram *UrtpDatagram
+// Return true if a datagram's timestamp is more than maxAge behind
+// the playout position, which advances in real time and jumps forward
+// to meet any datagram that is ahead of it
+func isStaleDatagram(datagram * UrtpDatagram, maxAge time.Duration) bool {
+    var expected uint64
     
-    if savedDatagramList.Front() != nil {
-        previousDatagram = savedDatagramList.Front().Value.(*UrtpDatagram)
+    if !playoutTime.IsZero() {
+        expected = playoutTimestamp + uint64(time.Now().Sub(playoutTime) / time.Microsecond)
+    }
+    if playoutTime.IsZero() || (datagram.Timestamp >= expected) ||
+       (expected - datagram.Timestamp > uint64(DATAGRAM_RESYNC_AGE / time.Microsecond)) {
+        if !playoutTime.IsZero() && (datagram.Timestamp < expected) {
+            log.Printf("Datagram timestamp %6.3f ms is way behind the playout position (%6.3f ms), re-synchronising.\n",
+                       float64(datagram.Timestamp) / 1000, float64(expected) / 1000)
+        }
+        playoutTimestamp = datagram.Timestamp
+        playoutTime = time.Now()
+        return false
+    }
+    if expected - datagram.Timestamp > uint64(maxAge / time.Microsecond) {
+        atomic.AddInt64(&numStaleDatagrams, 1)
+        log.Printf("Dropping stale datagram, sequence number %d: timestamp %6.3f ms is more than %d ms behind the playout position (%6.3f ms).\n",
+                   datagram.SequenceNumber, float64(datagram.Timestamp) / 1000, int(maxAge / time.Millisecond), float64(expected) / 1000)
+        return true
     }
     
+    return false
+}
+
+// Process a URTP datagram; nextDatagram is the one that will be
+// processed after it, nil if it has yet to arrive
+func processDatagram(datagram * UrtpDatagram, savedDatagrams * DatagramRing, nextDatagram * UrtpDatagram) {
+    
+    previousDatagram := savedDatagrams.Newest()
+    
     log.Printf("Processing a datagram...\n")
     
-    // Handle the case where we have missed some datagrams
+    // The first datagram sets the base of the timeline, see startTimeline();
+    // there is nothing before it to conceal a gap from
+    first := startTimeline(datagram)
+    if first {
+        previousDatagram = nil
+    } else if !timelineBase.established {
+        return
+    }
+    
+    // Work out the case where we have missed some datagrams
+    gap := 0
     if (previousDatagram != nil) && (datagram.SequenceNumber != previousDatagram.SequenceNumber + 1) {
         log.Printf("Sequence number skip (expected %d, received %d).\n", previousDatagram.SequenceNumber + 1, datagram.SequenceNumber)
-        handleGap(int(datagram.SequenceNumber - previousDatagram.SequenceNumber) * SAMPLES_PER_BLOCK, previousDatagram)
+        gap = int(datagram.SequenceNumber - previousDatagram.SequenceNumber) * SAMPLES_PER_BLOCK
+        if underrunFiller != nil {
+            gap = underrunFiller.Absorb(gap)
+        }
+    }
+    
+    // While muted, ignore the incoming audio but write as much silence as
+    // it (and any gap before it) would have taken, so that timing is kept
+    if isMuted() {
+        silentSamples := SAMPLES_PER_BLOCK
+        if isSillyGap(gap) {
+            log.Printf("Ignored a silly gap.\n")
+        } else {
+            silentSamples += gap
+        }
+        log.Printf("Muted, writing %d sample(s) of silence to the audio buffer...\n", silentSamples)
+        pcmAudio.Write(make([]byte, silentSamples * URTP_SAMPLE_SIZE))
+        return
+    }
+    
+    // Handle the gap
+    if gap > 0 {
+        handleGap(gap, previousDatagram, datagram)
     }
         
         // Copy the received audio into the buffer    
     if datagram.Audio != nil {
-        audioBytes := make([]byte, len(*datagram.Audio) * URTP_SAMPLE_SIZE)
-        for x, y := range *datagram.Audio {
-            for z := 0; z < URTP_SAMPLE_SIZE; z++ {
-                audioBytes[(x * URTP_SAMPLE_SIZE) + z] = byte(y >> ((uint(z) * 8)))
-            } 
-        }
+        audioBytes := samplesToBytes(*datagram.Audio)
         log.Printf("Writing %d bytes to the audio buffer...\n", len(audioBytes))
+        if wavSegmenter != nil {
+            wavSegmenter.Anchor(datagram.Timestamp, first, pcmAudio.Len() / URTP_SAMPLE_SIZE)
+        }
         pcmAudio.Write(audioBytes)
         
-        // If the block is shorter than expected, handle that gap too
-        if len(*datagram.Audio) < SAMPLES_PER_BLOCK {
-            handleGap(SAMPLES_PER_BLOCK - len(*datagram.Audio), previousDatagram)        
+        // If the block is shorter than expected, handle that gap too,
+        // unless it starts a trimmed timeline
+        if (len(*datagram.Audio) < SAMPLES_PER_BLOCK) && !(first && trimFirstDatagram) {
+            handleGap(SAMPLES_PER_BLOCK - len(*datagram.Audio), datagram, nextDatagram)        
         }
     } else {
         // And if the audio is entirely missing, handle that
-        handleGap(SAMPLES_PER_BLOCK, previousDatagram)        
+        handleGap(SAMPLES_PER_BLOCK, previousDatagram, nextDatagram)        
     }
 }
 
-// Encode up to numSamples into the output stream
-func encodeOutput (mp3Writer *lame.LameWriter, pcmHandle *os.File, numSamples int) int {
+// Encode up to numSamples into the output stream, returning the number
+// of samples encoded and any encoding error; if meter is not nil what
+// is encoded is added to it
+func encodeOutput (mp3Writer Mp3Writer, pcmHandle io.Writer, numSamples int, meter *LevelMeter) (int, error) {
+    var encodeErr error
     var err error
     var bytesRead int
     var bytesEncoded int
@@ -225,11 +550,17 @@ func encodeOutput (mp3Writer *lame.LameWriter, pcmHandle *os.File, numSamples in
     
     bytesRead, err = pcmAudio.Read(buffer)
     if bytesRead > 0 {
+        if loudnessNormaliser != nil {
+            loudnessNormaliser.Process(buffer[:bytesRead])
+        }
+        if meter != nil {
+            meter.Add(buffer[:bytesRead])
+        }
         log.Printf("Encoding %d byte(s) into the output...\n", bytesRead)
         if mp3Writer != nil {
-            bytesEncoded, err = mp3Writer.Write(buffer[:bytesRead])
-            if err != nil {
-                log.Printf("Unable to encode MP3.\n")
+            bytesEncoded, encodeErr = mp3Writer.Write(buffer[:bytesRead])
+            if encodeErr != nil {
+                log.Printf("Unable to encode MP3 (%s).\n", encodeErr.Error())
             }
         }
         if pcmHandle != nil {
@@ -240,20 +571,30 @@ func encodeOutput (mp3Writer *lame.LameWriter, pcmHandle *os.File, numSamples in
         }
     }
     
-    return bytesEncoded / URTP_SAMPLE_SIZE
+    return bytesEncoded / URTP_SAMPLE_SIZE, encodeErr
 }
 
 // Write the ID3 tag to the start of an MP3 segment file indicating
-// its time offset from the previous segment file
-func writeTag(mp3Handle *os.File, offset time.Duration) error {
+// its time offset from the previous segment file or, depending on
+// mode, the absolute time at which it starts
+func writeTag(mp3Handle io.Writer, offset time.Duration, start time.Time, mode string) error {
     var timestampBytes bytes.Buffer
     var timestampUint64 uint64 // Must be an uint64 to produce the correct sized timestamp
     
+    if mode == ID3_TIMESTAMP_NONE {
+        return nil
+    }
+    
     // First, write the prefix
-    _, err := mp3Handle.WriteString(id3Prefix)
+    _, err := io.WriteString(mp3Handle, id3Prefix)
     if err == nil {
-        // Then write the binary timestamp offset on a 90 kHz basis
-        timestampUint64 = uint64(float32(offset) / float32(time.Microsecond) * float32(90000) / float32(1000000))
+        if mode == ID3_TIMESTAMP_EPOCH {
+            // Write the binary Unix time in milliseconds
+            timestampUint64 = uint64(start.UnixNano() / int64(time.Millisecond))
+        } else {
+            // Write the binary timestamp offset on a 90 kHz basis
+            timestampUint64 = uint64(float32(offset) / float32(time.Microsecond) * float32(90000) / float32(1000000))
+        }
         err := binary.Write(&timestampBytes, binary.BigEndian, timestampUint64)
         if err == nil {
             if timestampBytes.Len() != MP3_ID3_TAG_TIMESTAMP_LEN {
@@ -270,124 +611,600 @@ func writeTag(mp3Handle *os.File, offset time.Duration) error {
     return err
 }
 
-// Do the processing; this function should never return
-func operateAudioProcessing(pcmHandle *os.File, mp3Dir string) {
+// Record the latency with which a tick of audio processing was
+// serviced, logging it if it is excessive
+func recordTickLatency(latency time.Duration) {
+    if latency > TICK_LATENCY_WARNING {
+        log.Printf("Audio processing tick serviced %v late, audio may be falling behind.\n", latency)
+    }
+    atomic.AddInt64(&tickLatencyTotal, int64(latency))
+    atomic.AddInt64(&numTicks, 1)
+    for {
+        worst := atomic.LoadInt64(&tickLatencyWorst)
+        if (int64(latency) <= worst) || atomic.CompareAndSwapInt64(&tickLatencyWorst, worst, int64(latency)) {
+            break
+        }
+    }
+}
+
+// Return the worst and the average latency with which the ticks of
+// audio processing have been serviced
+func tickLatency() (time.Duration, time.Duration) {
+    var average time.Duration
+
+    ticks := atomic.LoadInt64(&numTicks)
+    if ticks > 0 {
+        average = time.Duration(atomic.LoadInt64(&tickLatencyTotal) / ticks)
+    }
+
+    return time.Duration(atomic.LoadInt64(&tickLatencyWorst)), average
+}
+
+// Let the audio output channel know of a segment that has been written
+// to mp3Handle and closed, writing its checksum file first if segmentHash
+// is not nil
+func publishSegment(mp3Handle StoreFile, mp3AudioFile *Mp3AudioFile, segmentHash hash.Hash, mp3Dir string, options AudioProcessingOptions) {
+    mp3AudioFile.fileName = segmentFileName(mp3Dir, mp3Handle.Name())
+    if segmentHash != nil {
+        mp3AudioFile.checksum = hex.EncodeToString(segmentHash.Sum(nil))
+        err := retryFileWrite(fmt.Sprintf("writing checksum file for \"%s\"", mp3Handle.Name()), func() error {
+            return writeChecksumFile(options.SegmentStore, mp3Handle.Name(), mp3AudioFile.checksum)
+        })
+        if err != nil {
+            log.Printf("Unable to write checksum file for \"%s\" (%s).\n", mp3Handle.Name(), err.Error())
+        }
+    }
+    MediaControlChannel <- mp3AudioFile
+}
+
+// Write a finished segment to mp3Handle, close it and let the audio
+// output channel know of it, then open and return the next segment;
+// if mp3Handle is nil the segment is lost, as it is if it fails
+// verification, in which case mp3Handle is returned for the next
+func writeSegment(mp3Handle StoreFile, job *SegmentJob, mp3Dir string, options AudioProcessingOptions) StoreFile {
+    var segmentWriter io.Writer
+    var segmentHash hash.Hash
+    var err error
+
+    if job.serviceChange != nil {
+        MediaControlChannel <- job.serviceChange
+        return mp3Handle
+    }
+    if mp3Handle != nil {
+        mp3AudioFile := job.mp3AudioFile
+        if options.VerifySegments {
+            err = verifySegment(job.audio, mp3AudioFile.duration, mp3SampleRate(options.Encoder))
+            if err != nil {
+                atomic.AddInt64(&numSegmentsFailedVerification, 1)
+                log.Printf("Segment of %d millisecond(s) failed verification (%s), dropping it.\n",
+                           mp3AudioFile.duration / time.Millisecond, err.Error())
+                segmentVerifyDiscontinuity = true
+                return mp3Handle
+            }
+            if segmentVerifyDiscontinuity {
+                mp3AudioFile.discontinuity = true
+                segmentVerifyDiscontinuity = false
+            }
+        }
+        log.Printf("Writing %d millisecond(s) of MP3 audio to \"%s\".\n",
+                   mp3AudioFile.duration / time.Millisecond, mp3Handle.Name())
+        var segment bytes.Buffer
+        err = writeTag(&segment, job.offset, mp3AudioFile.timestamp.Add(-mp3AudioFile.duration), options.Id3TimestampMode)
+        if err == nil {
+            segment.Write(job.audio)
+            if options.HlsKey != nil {
+                // The whole segment, tag and all, is encrypted
+                var encrypted []byte
+                mp3AudioFile.iv = nextSegmentIv()
+                encrypted, err = encryptSegment(options.HlsKey, mp3AudioFile.iv, segment.Bytes())
+                segment.Reset()
+                segment.Write(encrypted)
+            }
+        }
+        if err == nil {
+            err = retryFileWrite(fmt.Sprintf("writing segment \"%s\"", mp3Handle.Name()), func() error {
+                // If this is a retry, start the file again
+                file, isFile := mp3Handle.(*os.File)
+                if isFile {
+                    err := file.Truncate(0)
+                    if err == nil {
+                        _, err = file.Seek(0, io.SeekStart)
+                    }
+                    if err != nil {
+                        return err
+                    }
+                }
+                segmentWriter = mp3Handle
+                if options.Checksums {
+                    segmentHash = sha256.New()
+                    segmentWriter = io.MultiWriter(mp3Handle, segmentHash)
+                }
+                _, err := segmentWriter.Write(segment.Bytes())
+                return err
+            })
+        }
+        if err == nil {
+            // Closing may be where the file is written, e.g. to an object store
+            err = retryFileWrite(fmt.Sprintf("closing segment \"%s\"", mp3Handle.Name()), mp3Handle.Close)
+        } else {
+            mp3Handle.Close()
+        }
+        log.Printf("Closed MP3 file.\n")
+        if err == nil {
+            publishSegment(mp3Handle, mp3AudioFile, segmentHash, mp3Dir, options)
+        } else {
+            log.Printf("There was an error writing to \"%s\" (%s).\n", mp3Handle.Name(), err.Error())                 
+        }
+    }
+
+    return openMp3Segment(options.SegmentStore, segmentDirectory(mp3Dir, options))
+}
+
+// Start the processing, writing segments to mp3Dir, until ctx is
+// cancelled; returns a channel which is closed once the processing has
+// stopped and the last segment has been written out
+func operateAudioProcessing(ctx context.Context, pcmHandle io.Writer, mp3Dir string, options AudioProcessingOptions) <-chan struct{} {
     var mp3Audio bytes.Buffer
-    var mp3Writer *lame.LameWriter
-    var mp3SamplesPerFrame int
-    var mp3Handle *os.File
+    var streamEncoder = createStreamEncoder(&mp3Audio)
+    var mp3Handle StoreFile
     var err error
     var mp3Duration time.Duration
-    var mp3SamplesToEncode int
+    var segmentCutter SegmentCutter
+    var segmentFrames int
+    var segmentDone bool
     var samplesEncoded int
     var mp3Offset time.Duration
+    var streamOffset StreamOffset
+    var samples int
+    var encoderFaulty bool
+    var discontinuity bool
+    var lastDatagramTime time.Time
+    var segmentEnd time.Time
+    var segmentClock SegmentClock
+    var processStart = time.Now()
+    var mp3Published int
+    var chunkedSequence int
+    var formatGuard AudioFormatGuard
+    var levelMeter *LevelMeter
     var channel = make(chan interface{})
+    var segmentJobs = make(chan *SegmentJob, SEGMENT_JOB_QUEUE_LENGTH)
+    var done = make(chan struct{})
     processTicker := time.NewTicker(time.Duration(BLOCK_DURATION_MS) * time.Millisecond)
     
     ProcessDatagramsChannel = channel
     
-    // Initialise the linked list of datagrams
-    newDatagramList.Init()
+    // Choose how gaps are filled
+    concealer = createConcealer(options.Concealment)
+    trimFirstDatagram = options.FirstDatagram == FIRST_DATAGRAM_TRIM
+    resetTimeline()
+    if concealer == nil {
+        fmt.Fprintf(os.Stderr, "Unknown concealment strategy \"%s\".\n", options.Concealment)
+        os.Exit(-1)
+    }
+    
+    // Set up loudness normalisation
+    loudnessNormaliser = nil
+    if options.TargetLufs != 0 {
+        loudnessNormaliser = createLoudnessNormaliser(options.TargetLufs)
+    }
+    
+    // Set up the concealment circuit breaker
+    var concealmentBreaker *ConcealmentBreaker
+    if options.MaxConcealed > 0 {
+        concealmentBreaker = createConcealmentBreaker(options.MaxConcealed, options.MaxConcealedWindow)
+    }
+    
+    // Set up the adaptive effort of the MP3 encoder
+    var encoderEffort *EncoderEffort
+    if options.AdaptiveEffort {
+        encoderEffort = createEncoderEffort(options.Encoder.Quality)
+    }
+    
+    // Set up the metering of the segments
+    if options.SegmentLevels {
+        levelMeter = new(LevelMeter)
+    }
+    
+    // Set up the filling of stalls
+    underrunFiller = nil
+    if options.FillUnderrun {
+        underrunFiller = new(UnderrunFiller)
+    }
+    
+    // Set up the filling of the time before any audio arrives
+    var warmupFiller *WarmupFiller
+    var audioBegun bool
+    if options.Warmup {
+        log.Printf("Warming up with silence until audio arrives.\n")
+        warmupFiller = new(WarmupFiller)
+    }
+    
+    // Set up the limiting of how fast a backlog of audio is drained
+    var catchUpLimiter *CatchUpLimiter
+    if options.CatchUpRate > 0 {
+        catchUpLimiter = createCatchUpLimiter(options.CatchUpRate)
+    }
+    
+    // Initialise the FIFO of datagrams
+    newDatagramAccess.Lock()
+    newDatagramRing.Clear()
+    newDatagramAccess.Unlock()
 
     // Create the MP3 writer
-    mp3Writer, mp3SamplesPerFrame = createMp3Writer(&mp3Audio)
-    if mp3Writer == nil {
+    setNowPlaying(options.Encoder.Metadata)
+    if !streamEncoder.Create(options.Encoder) {
         fmt.Fprintf(os.Stderr, "Unable to create MP3 writer.\n")
         os.Exit(-1)
     }
     // Encode an exact number of MP3 frames
-    mp3SamplesToEncode = MAX_MP3_FILE_SAMPLES / mp3SamplesPerFrame *  mp3SamplesPerFrame
+    segmentCutter.Reset(streamEncoder.SamplesPerFrame(), mp3SampleRate(options.Encoder))
     
-    // Create the first MP3 output file
-    mp3Handle = openMp3File(mp3Dir)
-    if mp3Handle == nil {
+    // Create the first MP3 output file, which the audio may be encoded
+    // straight into
+    var directSegment *DirectSegment
+    if options.DirectSegments {
+        directSegment = startDirectSegment(mp3Dir, mp3Offset, options)
+    } else {
+        mp3Handle = openMp3Segment(options.SegmentStore, segmentDirectory(mp3Dir, options))
+    }
+    if (mp3Handle == nil) && (directSegment == nil) {
         fmt.Fprintf(os.Stderr, "Unable to create temporary file for MP3 output in directory \"%s\" (permissions?).\n", mp3Dir)
         os.Exit(-1)
     }
     
+    // Serve the first segment in chunks, or as it grows, as it is encoded,
+    // if asked to; either way what has been encoded is kept in a chunked
+    // segment until it is written out
+    keepChunkedSegment := options.ChunkedSegments || options.GrowingSegments
+    if keepChunkedSegment {
+        startChunkedSegment(chunkedSequence, chunkedSegmentTag(mp3Offset, options.Id3TimestampMode))
+        nameChunkedSegment(chunkedSequence, segmentFileName(mp3Dir, mp3Handle.Name()))
+    }
+    
     fmt.Printf("Audio processing channel created and now being serviced.\n")
     
+    // Write finished segments out, away from the timed function below
+    // so that file I/O doesn't hold up the processing of audio; once that
+    // has stopped, and closed the queue, what is left in it is still
+    // written out
+    go func() {
+        for job := range segmentJobs {
+            if job.direct != nil {
+                // Already written, and the next segment already open
+                finishDirectSegment(job, mp3Dir, options)
+            } else {
+                mp3Handle = writeSegment(mp3Handle, job, mp3Dir, options)
+                // The chunked segment is now either published or lost, and
+                // the next segment goes to the file that is now open
+                if keepChunkedSegment && (job.serviceChange == nil) {
+                    endChunkedSegment(job.sequence, job.mp3AudioFile.fileName != "")
+                    if mp3Handle != nil {
+                        nameChunkedSegment(job.sequence + 1, segmentFileName(mp3Dir, mp3Handle.Name()))
+                    }
+                }
+            }
+        }
+        // There is no next segment
+        if mp3Handle != nil {
+            mp3Handle.Close()
+            options.SegmentStore.Remove(mp3Handle.Name())
+        }
+        fmt.Printf("Segment writer finished.\n")
+        close(done)
+    }()
+    
+    // Cut the segment that has been encoded, of the given number of frames
+    // and duration as the segmentCutter has it, and hand it over to be
+    // written out, the stream moving on to the next segment unless this
+    // is the last.  Returns true if the encoder has put out an absurd
+    // number of frames
+    cutSegment := func(segmentFrames int, mp3Duration time.Duration, last bool) bool {
+        // That is the duration of what was fed to the encoder; read back
+        // the frames it has actually put out for the exact duration
+        var exactDuration time.Duration
+        var exactFrames int
+        if options.DirectSegments {
+            // The audio has gone to the file, its frames were counted on the way
+            exactDuration, exactFrames, err = directSegment.Duration()
+        } else {
+            exactDuration, exactFrames, err = mp3AudioDuration(mp3Audio.Bytes())
+        }
+        encoderFault := false
+        if err == nil {
+            // A segment cut short is still short of what the encoder holds back
+            if !last {
+                encoderFault = checkSegmentFrames(segmentFrames, exactFrames)
+            }
+            if exactDuration != mp3Duration {
+                log.Printf("Segment is %d frame(s), %d millisecond(s), where %d frame(s) were estimated.\n",
+                           exactFrames, exactDuration / time.Millisecond, segmentFrames)
+            }
+            segmentFrames = exactFrames
+            mp3Duration = exactDuration
+        } else {
+            log.Printf("Unable to read back the MP3 frames of the segment (%s), using the estimated duration.\n", err.Error())
+        }
+        log.Printf("Finished a segment of %d millisecond(s) of MP3 audio (representing %d samples, %d frame(s)).\n",
+                   mp3Duration / time.Millisecond, samplesEncoded, segmentFrames)
+        // The end of the segment is live now less whatever is still waiting
+        // to be encoded, so that pre-roll is given times in the past, but
+        // counted in audio from the start of the stream so that the times
+        // always go forwards, whatever happens to the wall clock
+        segmentEnd = segmentClock.End(time.Now(), time.Since(processStart), mp3Duration,
+                                      time.Duration(pcmAudio.Len() / URTP_SAMPLE_SIZE) * time.Second / time.Duration(SAMPLING_FREQUENCY))
+        mp3AudioFile := new(Mp3AudioFile)
+        mp3AudioFile.title = nowPlayingMetadata().Title
+        mp3AudioFile.timestamp = segmentEnd
+        mp3AudioFile.duration = mp3Duration
+        mp3AudioFile.removable = false;
+        mp3AudioFile.discontinuity = streamEncoder.TakeDiscontinuity() || discontinuity
+        discontinuity = false
+        if levelMeter != nil {
+            mp3AudioFile.level = levelMeter.Segment()
+        }
+        if samplesEncoded > 0 {
+            mp3AudioFile.concealedRatio = float64(concealedSamples) / float64(samplesEncoded)
+            if mp3AudioFile.concealedRatio > 1 {
+                mp3AudioFile.concealedRatio = 1
+            }
+        }
+        // Hand the segment over to be written out; this only waits
+        // if the writing has fallen a long way behind
+        job := &SegmentJob{audio: append([]byte(nil), mp3Audio.Bytes()...),
+                           offset: mp3Offset,
+                           mp3AudioFile: mp3AudioFile,
+                           sequence: chunkedSequence,
+                           direct: directSegment}
+        if concealmentBreaker != nil {
+            // Pass on any change of service in line with the segments
+            if concealmentBreaker.Add(mp3Duration, mp3AudioFile.concealedRatio) {
+                segmentJobs <- &SegmentJob{serviceChange: &ServiceChange{outOfService: concealmentBreaker.Tripped()}}
+            }
+            // While out of service the segments are thrown away
+            if concealmentBreaker.Tripped() {
+                job = nil
+                discontinuity = true
+            }
+        }
+        // The audio of a segment that could not be opened is lost
+        if options.DirectSegments && (directSegment == nil) {
+            job = nil
+            discontinuity = true
+        }
+        // Nothing of a segment cut short may have come out of the encoder yet
+        if last && (segmentFrames == 0) {
+            job = nil
+        }
+        if job != nil {
+            segmentJobs <- job
+            chunkedSequence++
+        }
+        mp3Audio.Reset()
+        mp3Published = 0
+        mp3Offset = streamOffset.Add(segmentFrames, streamEncoder.SamplesPerFrame(), mp3SampleRate(options.Encoder))
+        // The audio goes straight into the next segment from now on
+        if options.DirectSegments {
+            if job == nil {
+                directSegment.Abandon(options.SegmentStore)
+            }
+            if !last {
+                directSegment = startDirectSegment(mp3Dir, mp3Offset, options)
+            }
+        }
+        // A segment that was thrown away is started again, as far as
+        // its chunked clients are concerned
+        if keepChunkedSegment && !last {
+            startChunkedSegment(chunkedSequence, chunkedSegmentTag(mp3Offset, options.Id3TimestampMode))
+        }
+        samplesEncoded = segmentCutter.Samples()
+        concealedSamples = 0
+        
+        return encoderFault
+    }
+    
+    // Re-create the MP3 writer with options.Encoder, for the given reason,
+    // which is a discontinuity; what has been encoded into the segment
+    // being cut is thrown away and the segment started again, see
+    // restartSegment()
+    recreateEncoder := func(reason string) {
+        log.Printf("Re-creating the MP3 writer %s, discarding %d sample(s).\n", reason, segmentCutter.Samples())
+        if !streamEncoder.Create(options.Encoder) {
+            fmt.Fprintf(os.Stderr, "Unable to re-create MP3 writer.\n")
+            os.Exit(-1)
+        }
+        mp3Audio.Reset()
+        mp3Published = 0
+        mp3Offset = restartSegment(&segmentCutter, &streamOffset, streamEncoder.SamplesPerFrame(), mp3SampleRate(options.Encoder))
+        if options.DirectSegments {
+            directSegment.Abandon(options.SegmentStore)
+            directSegment = startDirectSegment(mp3Dir, mp3Offset, options)
+        }
+        if keepChunkedSegment {
+            startChunkedSegment(chunkedSequence, chunkedSegmentTag(mp3Offset, options.Id3TimestampMode))
+        }
+        samplesEncoded = 0
+        if levelMeter != nil {
+            levelMeter.Segment()
+        }
+    }
+    
     // Timed function that processes received datagrams and feeds the output stream
     go func() {
-        for _ = range processTicker.C {            
-            // Go through the list of newly arrived datagrams, processing them and moving
-            // them to the processed list
-            thingProcessed := false
-            for newElement := newDatagramList.Front(); newElement != nil; newElement = newElement.Next() {
-                processDatagram(newElement.Value.(*UrtpDatagram), processedDatagramList)
-                log.Printf("%d byte(s) in the outgoing audio buffer.\n", pcmAudio.Len())
-                log.Printf("Moving datagram from the new list to the processed list...\n")
-                processedDatagramList.PushFront(newElement.Value)
-                thingProcessed = true
-                newDatagramList.Remove(newElement)
+        for tickTime, ok := waitForTickTime(ctx, processTicker); ok; tickTime, ok = waitForTickTime(ctx, processTicker) {
+            recordTickLatency(time.Now().Sub(tickTime))
+            // Heartbeats from the client keep the input alive as much as audio does
+            if heartbeat := lastHeartbeatTime(); heartbeat.After(lastDatagramTime) {
+                lastDatagramTime = heartbeat
             }
-            if thingProcessed {
-                count := 0
-                for processedElement := processedDatagramList.Front(); processedElement != nil; processedElement = processedElement.Next() {
-                    count++
-                    if count > NUM_PROCESSED_DATAGRAMS {
-                        log.Printf("Removing a datagram from the processed list...\n")
-                        processedDatagramList.Remove(processedElement)
-                        log.Printf("%d datagram(s) now in the processed list.\n", processedDatagramList.Len())
+            if encoderEffort != nil {
+                encoderEffort.Tick(time.Now().Sub(tickTime))
+            }
+            
+            // Go through the FIFO of newly arrived datagrams, processing them and moving
+            // them to the processed history (which only keeps the newest)
+            newDatagramAccess.Lock()
+            datagram := newDatagramRing.Pop()
+            newDatagramAccess.Unlock()
+            for datagram != nil {
+                // A new session has a timeline of its own, so don't try to
+                // conceal the gap to it or judge it against the old playout
+                // position, just mark the discontinuity
+                if datagram.NewSession {
+                    log.Printf("New input session, starting the timeline again.\n")
+                    processedDatagramRing.Clear()
+                    resetTimeline()
+                    playoutTime = time.Time{}
+                    discontinuity = true
+                }
+                if (options.MaxDatagramAge == 0) || !isStaleDatagram(datagram, options.MaxDatagramAge) {
+                    // If the stream is starting (again), give players a buffer
+                    if (options.Preroll > 0) && (time.Now().Sub(lastDatagramTime) >= SOURCE_ACTIVE_AGE) {
+                        prerollSamples := int(options.Preroll * time.Duration(SAMPLING_FREQUENCY) / time.Second)
+                        log.Printf("Stream starting, writing %v (%d samples) of pre-roll silence to the audio buffer.\n",
+                                   options.Preroll, prerollSamples)
+                        pcmAudio.Write(make([]byte, prerollSamples * URTP_SAMPLE_SIZE))
+                    }
+                    lastDatagramTime = time.Now()
+                    audioBegun = true
+                    // Audio the encoder is not set up for is thrown away
+                    if formatGuard.Check(datagram, streamEncoder.Writer().Format()) {
+                        discontinuity = true
                     }
+                    newDatagramAccess.Lock()
+                    nextDatagram := newDatagramRing.Oldest()
+                    newDatagramAccess.Unlock()
+                    processDatagram(datagram, processedDatagramRing, nextDatagram)
+                    log.Printf("%d byte(s) in the outgoing audio buffer.\n", pcmAudio.Len())
+                    log.Printf("Moving datagram from the new FIFO to the processed history...\n")
+                    processedDatagramRing.Push(datagram)
+                }
+                newDatagramAccess.Lock()
+                datagram = newDatagramRing.Pop()
+                newDatagramAccess.Unlock()
+            }
+            
+            // Keep the audio going in real time if the input has stalled
+            if underrunFiller != nil {
+                fill := underrunFiller.Tick(time.Now(), (pcmAudio.Len() == 0) && (time.Now().Sub(lastDatagramTime) < SOURCE_ACTIVE_AGE))
+                if len(fill) > 0 {
+                    pcmAudio.Write(fill)
+                    concealedSamples += len(fill) / URTP_SAMPLE_SIZE
                 }
             }
             
-            // Always have to encode something into the output stream
-            samples := encodeOutput(mp3Writer, pcmHandle, mp3SamplesToEncode)
+            // Until the audio begins, keep the stream going with silence
+            if warmupFiller != nil {
+                pcmAudio.Write(warmupFiller.Tick(time.Now(), audioBegun))
+            }
+            
+            // While the input is idle, play the fallback audio instead
+            if options.FallbackAudio != nil {
+                fill, switched := options.FallbackAudio.Tick(time.Now().Sub(lastDatagramTime) >= SOURCE_ACTIVE_AGE)
+                if switched {
+                    discontinuity = true
+                }
+                if len(fill) > 0 {
+                    pcmAudio.Write(fill)
+                }
+            }
+            
+            // Always have to encode something into the output stream, though
+            // no more than real time allows if a backlog is being limited
+            wanted := segmentCutter.Wanted()
+            if catchUpLimiter != nil {
+                wanted = catchUpLimiter.Allow(wanted)
+            }
+            samples, encoderFaulty = streamEncoder.Encode(pcmHandle, wanted, levelMeter)
+            // Send whatever has just been encoded to the sinks of the MP3 tap
+            // and to the clients of the chunked segment; the latter are not a
+            // sink of the tap since a chunked segment must begin and end in
+            // step with the segments, which a queue would not keep
+            if mp3Audio.Len() > mp3Published {
+                mp3Tap.Write(mp3Audio.Bytes()[mp3Published:])
+                if keepChunkedSegment {
+                    appendChunkedSegment(chunkedSequence, mp3Audio.Bytes()[mp3Published:])
+                }
+                mp3Published = mp3Audio.Len()
+            }
+            // Straight on into the segment file, if that is where it goes, so
+            // that no more than a tick's worth is kept in memory
+            if options.DirectSegments {
+                directSegment.Write(mp3Audio.Bytes())
+                mp3Audio.Reset()
+                mp3Published = 0
+            }
+            if encoderFaulty {
+                // Rather than ship a broken segment, start it again with a new encoder
+                recreateEncoder("after consecutive encoding errors")
+            }
             samplesEncoded += samples
-            mp3SamplesToEncode -= samples
             
-            if mp3SamplesToEncode <= 0 {
-                if mp3Handle != nil {
-                    mp3Duration = time.Duration(samplesEncoded * 1000000 / SAMPLING_FREQUENCY) * time.Microsecond
-                    log.Printf("Writing %d millisecond(s) of MP3 audio (representing %d samples) to \"%s\".\n",
-                               mp3Duration / time.Millisecond, samplesEncoded, mp3Handle.Name())
-                    err = writeTag(mp3Handle, mp3Offset)
-                    if err == nil {
-                        _, err = mp3Audio.WriteTo(mp3Handle)
-                        mp3Handle.Close()
-                        log.Printf("Closed MP3 file.\n")
-                        if err == nil {
-                            // Let the audio output channel know of the new audio file
-                            mp3AudioFile := new(Mp3AudioFile)
-                            mp3AudioFile.fileName = filepath.Base(mp3Handle.Name())
-                            mp3AudioFile.title = MP3_TITLE
-                            mp3AudioFile.timestamp = time.Now()
-                            mp3AudioFile.duration = mp3Duration
-                            mp3AudioFile.usable = true;
-                            mp3AudioFile.removable = false;
-                            MediaControlChannel <- mp3AudioFile
-                        } else {
-                            log.Printf("There was an error writing to \"%s\" (%s).\n", mp3Handle.Name(), err.Error())                 
-                        }
-                    } else {
-                        mp3Handle.Close()
-                        log.Printf("There was an error writing the ID3 tag to \"%s\", closing MP3 file (%s).\n", mp3Handle.Name(), err.Error())                 
+            // Cut the segment at a frame boundary, giving it the exact duration
+            // of its frames, so that the offsets of the segments never drift
+            segmentFrames, mp3Duration, segmentDone = segmentCutter.Add(samples)
+            if segmentDone {
+                encoderFault := cutSegment(segmentFrames, mp3Duration, false)
+                
+                // An encoder that is putting out absurd numbers of frames
+                // would skew the timing of the stream, start again with a new one
+                if encoderFault {
+                    recreateEncoder("putting out absurd numbers of frames")
+                }
+                
+                // Change the effort of the encoder, if need be, now that it is
+                // between segments; what it has yet to encode is lost
+                if encoderEffort != nil {
+                    quality, changed := encoderEffort.Segment()
+                    if changed {
+                        options.Encoder.Quality = quality
+                        recreateEncoder(fmt.Sprintf("with quality %d", quality))
                     }
                 }
-                mp3Offset += mp3Duration
-                mp3Handle = openMp3File(mp3Dir)
-                samplesEncoded = 0
-                mp3SamplesToEncode = MAX_MP3_FILE_SAMPLES / mp3SamplesPerFrame *  mp3SamplesPerFrame
+                
+                // Change the bitrate of the encoder, if asked to through
+                // ADMIN_BITRATE_PATH, now that it is between segments; the
+                // stream changes encoding and what the encoder has yet to
+                // encode is lost, so this is a discontinuity
+                if bitrate, changed := takePendingBitrate(); changed {
+                    options.Encoder.Bitrate = bitrate
+                    recreateEncoder(fmt.Sprintf("at %d kbits/s", bitrate))
+                }
             }
         }
+        
+        // Stopped: hand over what has been encoded of the segment in
+        // progress, cut short, then leave the segment writer to finish
+        segmentFrames, mp3Duration = segmentCutter.Cut()
+        if segmentFrames > 0 {
+            log.Printf("Cutting the last segment short, at %d frame(s).\n", segmentFrames)
+            cutSegment(segmentFrames, mp3Duration, true)
+        } else if options.DirectSegments {
+            directSegment.Abandon(options.SegmentStore)
+        }
+        close(segmentJobs)
     }()
     
     // Process datagrams received on the channel
     go func() {
-        for cmd := range channel {
+        for cmd, ok := waitForCommand(ctx, channel); ok; cmd, ok = waitForCommand(ctx, channel) {
             switch datagram := cmd.(type) {
                 // Handle datagrams, throw everything else away
                 case *UrtpDatagram:
                 {
-                    log.Printf("Adding a new datagram to the FIFO list...\n")
-                    newDatagramList.PushBack(datagram)
+                    log.Printf("Adding a new datagram to the FIFO...\n")
+                    newDatagramAccess.Lock()
+                    if newDatagramRing.Len() == newDatagramRing.Cap() {
+                        log.Printf("Datagram FIFO full, growing it beyond %d datagram(s).\n", newDatagramRing.Cap())
+                    }
+                    newDatagramRing.Push(datagram)
+                    newDatagramAccess.Unlock()
                 }
             }
         }
         fmt.Printf("Audio processing channel closed, stopping.\n")
     }()
+    
+    return done
 }
 
 /* End Of File */
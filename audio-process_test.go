@@ -0,0 +1,237 @@
+/* Tests of datagram processing function for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "io"
+    "os"
+    "log"
+    "time"
+    "bytes"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The first MP3 frame header must appear within this many bytes of the
+// start of the audio or hls.js won't recognise a segment as MP3
+const MP3_FIRST_FRAME_MAX_OFFSET int = 100
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Turn logging off until a benchmark has finished, since it would
+// otherwise be most of what is measured
+func discardLogging(b *testing.B) {
+    log.SetOutput(io.Discard)
+    b.Cleanup(func() {
+        log.SetOutput(os.Stderr)
+    })
+}
+
+// Benchmark processDatagram() with a stream of datagrams, skipping a
+// sequence number every skipEvery datagrams if that is not zero, so that
+// the gap is concealed
+func benchmarkProcessDatagram(b *testing.B, skipEvery int) {
+    var datagrams [2]UrtpDatagram
+
+    discardLogging(b)
+    savedConcealer := concealer
+    savedUnderrunFiller := underrunFiller
+    b.Cleanup(func() {
+        concealer = savedConcealer
+        underrunFiller = savedUnderrunFiller
+        concealedSamples = 0
+        pcmAudio.Reset()
+    })
+    savedDatagrams := createDatagramRing(NUM_PROCESSED_DATAGRAMS)
+    concealer = RepeatConcealer{}
+    underrunFiller = nil
+    for x := range datagrams {
+        datagrams[x].Audio = decodePcm(benchmarkPayload(SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+    }
+    pcmAudio.Reset()
+    sequenceNumber := uint16(0)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for x := 0; x < b.N; x++ {
+        // Two datagrams are enough since the ring only looks at the newest
+        datagram := &datagrams[x % 2]
+        sequenceNumber++
+        if (skipEvery > 0) && (x % skipEvery == 0) {
+            sequenceNumber++
+        }
+        datagram.SequenceNumber = sequenceNumber
+        processDatagram(datagram, savedDatagrams, nil)
+        savedDatagrams.Push(datagram)
+        pcmAudio.Reset()
+    }
+}
+
+// Return the options of the MP3 encoder as main() sets them up with
+// the default command line options
+func testMp3EncoderOptions() Mp3EncoderOptions {
+    return Mp3EncoderOptions{Metadata: Mp3Metadata{Title: "Internet of Chuffs"}, Quality: -1}
+}
+
+// Encode a segment with createMp3Writer() and write it out through
+// writeSegment(), as the segment writer does, in each ID3 timestamp
+// mode, failing if the segment published does not start with an ID3
+// tag holding the timestamp of that mode, or with no tag for
+// ID3_TIMESTAMP_NONE, or has no MP3 frame sync within
+// MP3_FIRST_FRAME_MAX_OFFSET bytes of the end of the tag
+func TestMp3Segment(t *testing.T) {
+    encoderOptions := testMp3EncoderOptions()
+    var mp3Audio bytes.Buffer
+    offset := time.Second * 10
+    start := time.Date(2021, time.March, 4, 5, 6, 7, 890000000, time.UTC)
+    channel := make(chan interface{}, 10)
+    savedChannel := MediaControlChannel
+    MediaControlChannel = channel
+    t.Cleanup(func() {
+        MediaControlChannel = savedChannel
+    })
+    
+    mp3Writer, mp3SamplesPerFrame := createMp3Writer(&mp3Audio, encoderOptions)
+    if mp3Writer == nil {
+        t.Fatal("unable to create MP3 writer")
+    }
+    defer mp3Writer.Close()
+    
+    // Encode a segment's worth of a sawtooth into the MP3 writer
+    numSamples := MAX_MP3_FILE_SAMPLES / mp3SamplesPerFrame * mp3SamplesPerFrame
+    pcm := make([]byte, numSamples * URTP_SAMPLE_SIZE)
+    for x := 0; x < numSamples; x++ {
+        binary.LittleEndian.PutUint16(pcm[x * URTP_SAMPLE_SIZE:], uint16(x * 256))
+    }
+    _, err := mp3Writer.Write(pcm)
+    if err != nil {
+        t.Fatal(err)
+    }
+    duration := mp3FramesDuration(numSamples / mp3SamplesPerFrame, mp3SamplesPerFrame)
+    
+    // The offset on a 90 kHz basis, or the start in Unix milliseconds
+    for _, test := range []struct{mode string; timestamp uint64}{
+                            {ID3_TIMESTAMP_TRANSPORT, uint64(offset / time.Millisecond) * 90},
+                            {ID3_TIMESTAMP_EPOCH, uint64(start.UnixNano() / int64(time.Millisecond))},
+                            {ID3_TIMESTAMP_NONE, 0}} {
+        var tagSize int
+        
+        // Write the segment out just as the segment writer does, the
+        // segment being stamped with the time its audio ends
+        mp3Dir := t.TempDir()
+        options := AudioProcessingOptions{SegmentStore: OsFileStore{}, Id3TimestampMode: test.mode, Encoder: encoderOptions}
+        mp3Handle := openMp3Segment(options.SegmentStore, mp3Dir)
+        if mp3Handle == nil {
+            t.Fatalf("%s: unable to open a segment", test.mode)
+        }
+        job := &SegmentJob{audio: mp3Audio.Bytes(), offset: offset,
+                           mp3AudioFile: &Mp3AudioFile{timestamp: start.Add(duration), duration: duration}}
+        mp3Handle = writeSegment(mp3Handle, job, mp3Dir, options)
+        if mp3Handle != nil {
+            mp3Handle.Close()
+        }
+        if len(channel) != 1 {
+            t.Fatalf("%s: %d segment(s) published when there should be 1", test.mode, len(channel))
+        }
+        mp3AudioFile := (<-channel).(*Mp3AudioFile)
+        segment, err := ioutil.ReadFile(filepath.Join(mp3Dir, mp3AudioFile.fileName))
+        if err != nil {
+            t.Fatal(err)
+        }
+        
+        // Find the end of the ID3 tag from its (7 bits per byte) size,
+        // the timestamp being the last thing in it
+        tagEnd := 0
+        if test.mode != ID3_TIMESTAMP_NONE {
+            if (len(segment) < MP3_ID3_HEADER_LEN) || (string(segment[:3]) != "ID3") {
+                t.Fatalf("%s: segment does not start with an ID3 tag", test.mode)
+            }
+            for _, x := range segment[6:MP3_ID3_HEADER_LEN] {
+                tagSize = (tagSize << 7) + int(x & 0x7f)
+            }
+            tagEnd = MP3_ID3_HEADER_LEN + tagSize
+            if tagEnd != len(id3Prefix) + MP3_ID3_TAG_TIMESTAMP_LEN {
+                t.Fatalf("%s: ID3 tag size is %d bytes when %d bytes were written", test.mode, tagEnd,
+                         len(id3Prefix) + MP3_ID3_TAG_TIMESTAMP_LEN)
+            }
+            timestamp := binary.BigEndian.Uint64(segment[tagEnd - MP3_ID3_TAG_TIMESTAMP_LEN:tagEnd])
+            if timestamp != test.timestamp {
+                t.Fatalf("%s: ID3 timestamp is %d when %d was expected", test.mode, timestamp, test.timestamp)
+            }
+        } else if bytes.HasPrefix(segment, []byte("ID3")) {
+            t.Fatalf("%s: segment starts with an ID3 tag", test.mode)
+        }
+        if !bytes.Equal(segment[tagEnd:], mp3Audio.Bytes()) {
+            t.Fatalf("%s: the MP3 audio of the segment is not that encoded", test.mode)
+        }
+        
+        // Look for the 11 bit MP3 frame sync
+        found := false
+        for x := tagEnd; (x < tagEnd + MP3_FIRST_FRAME_MAX_OFFSET) && (x + 1 < len(segment)) && !found; x++ {
+            if (segment[x] == 0xFF) && (segment[x + 1] & 0xE0 == 0xE0) {
+                log.Printf("Test: %s: first MP3 frame found %d byte(s) after the %d byte ID3 tag.\n", test.mode, x - tagEnd, tagEnd)
+                found = true
+            }
+        }
+        if !found {
+            t.Fatalf("%s: no MP3 frame sync within %d bytes of the end of the ID3 tag", test.mode, MP3_FIRST_FRAME_MAX_OFFSET)
+        }
+    }
+}
+
+// Benchmark the processing of datagrams, without gaps and with one
+// datagram in ten missing
+func BenchmarkProcessDatagram(b *testing.B) {
+    b.Run("gaps=none", func(b *testing.B) {
+        benchmarkProcessDatagram(b, 0)
+    })
+    b.Run("gaps=1in10", func(b *testing.B) {
+        benchmarkProcessDatagram(b, 10)
+    })
+}
+
+// Benchmark the encoding of a whole segment through LAME
+func BenchmarkEncodeSegment(b *testing.B) {
+    var mp3Audio bytes.Buffer
+
+    discardLogging(b)
+    encoderOptions := testMp3EncoderOptions()
+    pcm := make([]byte, MAX_MP3_FILE_SAMPLES * URTP_SAMPLE_SIZE)
+    for x := 0; x < MAX_MP3_FILE_SAMPLES; x++ {
+        binary.LittleEndian.PutUint16(pcm[x * URTP_SAMPLE_SIZE:], uint16(x * 256))
+    }
+    b.ReportAllocs()
+    b.SetBytes(int64(len(pcm)))
+    b.ResetTimer()
+    for x := 0; x < b.N; x++ {
+        mp3Audio.Reset()
+        mp3Writer, _ := createMp3Writer(&mp3Audio, encoderOptions)
+        if mp3Writer == nil {
+            b.Fatal("unable to create MP3 writer")
+        }
+        _, err := mp3Writer.Write(pcm)
+        mp3Writer.Close()
+        if err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,125 @@
+/* Serving from behind a reverse proxy, under a base path, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "path"
+    "errors"
+    "strings"
+    "net/url"
+    "net/http"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The headers in which a reverse proxy passes on the scheme and host
+// that the client asked for
+const FORWARDED_PROTO_HEADER string = "X-Forwarded-Proto"
+const FORWARDED_HOST_HEADER string = "X-Forwarded-Host"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The path under which a reverse proxy makes the server available,
+// normalised by normaliseBasePath(), "" if it is at the root
+var httpBasePath string
+
+// True if FORWARDED_PROTO_HEADER and FORWARDED_HOST_HEADER are to be
+// believed when generating URLs
+var trustForwardedHeaders bool
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Normalise a base path to a leading "/" and no trailing "/", "/" (or
+// "") becoming ""; returns an error if it is not a plain path
+func normaliseBasePath(basePath string) (string, error) {
+    if basePath == "" {
+        return "", nil
+    }
+    parsed, err := url.Parse(basePath)
+    if (err != nil) || (parsed.Scheme != "") || (parsed.Host != "") || (parsed.RawQuery != "") || (parsed.Fragment != "") {
+        return "", errors.New(fmt.Sprintf("\"%s\" is not a plain URL path", basePath))
+    }
+    basePath = path.Clean("/" + basePath)
+    if basePath == "/" {
+        return "", nil
+    }
+    return basePath, nil
+}
+
+// Set how the server is made available by a reverse proxy
+func setBasePath(basePath string, trustForwarded bool) {
+    httpBasePath = basePath
+    trustForwardedHeaders = trustForwarded
+}
+
+// Return the path at which the server sees a request for the given
+// external path, i.e. without the base path, if it has it
+func internalPath(externalPath string) string {
+    if (httpBasePath != "") && ((externalPath == httpBasePath) || strings.HasPrefix(externalPath, httpBasePath + "/")) {
+        externalPath = strings.TrimPrefix(externalPath, httpBasePath)
+        if externalPath == "" {
+            externalPath = "/"
+        }
+    }
+    return externalPath
+}
+
+// Return the URL that a client should use for a path on the server:
+// under the base path and, if the forwarded headers are trusted and the
+// request came with them, absolute, with the scheme and host the client
+// asked for
+func externalUrl(in *http.Request, internal string) string {
+    external := httpBasePath + internal
+    if trustForwardedHeaders {
+        // Behind a chain of proxies the first is the one the client asked
+        host := strings.TrimSpace(strings.Split(in.Header.Get(FORWARDED_HOST_HEADER), ",")[0])
+        if host != "" {
+            scheme := strings.ToLower(strings.TrimSpace(strings.Split(in.Header.Get(FORWARDED_PROTO_HEADER), ",")[0]))
+            if (scheme != "http") && (scheme != "https") {
+                scheme = "http"
+                if in.TLS != nil {
+                    scheme = "https"
+                }
+            }
+            external = scheme + "://" + host + external
+        }
+    }
+    return external
+}
+
+// Wrap an HTTP handler so that requests arriving with the base path,
+// from a proxy which passes the path on as it is, are seen as if it had
+// been stripped; requests from a proxy which strips it are unaffected
+func basePathHandler(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(out http.ResponseWriter, in *http.Request) {
+        internal := internalPath(in.URL.Path)
+        if internal != in.URL.Path {
+            mapped := *in
+            mappedUrl := *in.URL
+            mappedUrl.Path = internal
+            mappedUrl.RawPath = ""
+            mapped.URL = &mappedUrl
+            in = &mapped
+        }
+        handler.ServeHTTP(out, in)
+    })
+}
+
+/* End Of File */
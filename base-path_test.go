@@ -0,0 +1,130 @@
+/* Tests of serving from behind a reverse proxy, under a base path, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "net/url"
+    "strings"
+    "testing"
+    "net/http"
+    "io/ioutil"
+    "encoding/json"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Simulate requests through a reverse proxy serving under a base path,
+// both one that strips the path and one that does not, checking the
+// redirect from the home page, the serving of the playlist and a
+// segment and the URLs given back
+func TestBasePath(t *testing.T) {
+    var err error
+    dirName := t.TempDir()
+    mp3Dir := filepath.ToSlash(dirName)
+    playlistPath := mp3Dir + "/chuffs" + PLAYLIST_EXTENSION
+    segmentPath := mp3Dir + "/a" + SEGMENT_EXTENSION
+    err = ioutil.WriteFile(filepath.FromSlash(segmentPath), []byte("chuff"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    savedPlaylists := playlists
+    playlistAccess.Lock()
+    playlists = []*Playlist{&Playlist{fileName: filepath.FromSlash(playlistPath),
+                                      snapshot: []byte("#EXTM3U\n"),
+                                      newestSegmentUri: "a" + SEGMENT_EXTENSION}}
+    playlistAccess.Unlock()
+    t.Cleanup(func() {
+        playlistAccess.Lock()
+        playlists = savedPlaylists
+        playlistAccess.Unlock()
+        setBasePath("", false)
+        setAdminToken("")
+    })
+    basePath, err := normaliseBasePath("radio/")
+    if err != nil {
+        t.Fatal(err)
+    }
+    setBasePath(basePath, true)
+    setAdminToken("token")
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", func(out http.ResponseWriter, in *http.Request) {
+        homeHandler(out, in, mp3Dir)
+    })
+    mux.HandleFunc(mp3Dir + "/", func(out http.ResponseWriter, in *http.Request) {
+        streamHandler(out, in, OsFileStore{}, OsFileStore{}, "")
+    })
+    mux.HandleFunc(ADMIN_SESSION_PATH, func(out http.ResponseWriter, in *http.Request) {
+        sessionHandler(out, in, "secret")
+    })
+    handler := basePathHandler(mux)
+
+    for _, test := range []struct{path string; forwarded bool; location string}{
+                            {"/radio/", false, "/radio" + mp3Dir},
+                            {"/radio", false, "/radio" + mp3Dir},
+                            {"/", false, "/radio" + mp3Dir},
+                            {"/radio/", true, "https://example.com/radio" + mp3Dir}} {
+        request := httptest.NewRequest("GET", test.path, nil)
+        if test.forwarded {
+            request.Header.Set(FORWARDED_PROTO_HEADER, "https")
+            request.Header.Set(FORWARDED_HOST_HEADER, "example.com, proxy.local")
+        }
+        response := httptest.NewRecorder()
+        handler.ServeHTTP(response, request)
+        if location := response.Header().Get("Location"); (response.Code != http.StatusFound) || (location != test.location) {
+            t.Fatalf("\"%s\" (forwarded %t) redirected with %d to \"%s\" when \"%s\" was expected",
+                     test.path, test.forwarded, response.Code, location, test.location)
+        }
+    }
+
+    for _, prefix := range []string{"/radio", ""} {
+        response := httptest.NewRecorder()
+        handler.ServeHTTP(response, httptest.NewRequest("GET", prefix + playlistPath, nil))
+        link := "<" + "/radio" + segmentPath + ">; rel=preload; as=fetch"
+        if (response.Code != http.StatusOK) || (response.Body.String() != "#EXTM3U\n") || (response.Header().Get("Link") != link) {
+            t.Fatalf("playlist requested at \"%s\" served with %d, Link \"%s\": \"%s\"",
+                     prefix + playlistPath, response.Code, response.Header().Get("Link"), response.Body.String())
+        }
+        response = httptest.NewRecorder()
+        handler.ServeHTTP(response, httptest.NewRequest("GET", prefix + segmentPath, nil))
+        if (response.Code != http.StatusOK) || (response.Body.String() != "chuff") {
+            t.Fatalf("segment requested at \"%s\" served with %d", prefix + segmentPath, response.Code)
+        }
+    }
+
+    // A session asked for at the external path of the playlist is given
+    // back there, signed for the path that the server sees
+    var sessionUrl SessionUrl
+    request := httptest.NewRequest("POST", "/radio" + ADMIN_SESSION_PATH + "?" + ADMIN_SESSION_PATH_PARAMETER + "=" +
+                                   url.QueryEscape("/radio" + playlistPath), nil)
+    request.Header.Set("Authorization", "Bearer token")
+    response := httptest.NewRecorder()
+    handler.ServeHTTP(response, request)
+    err = json.Unmarshal(response.Body.Bytes(), &sessionUrl)
+    if err != nil {
+        t.Fatalf("session requested under the base path answered with %d: %s", response.Code, response.Body.String())
+    }
+    if !strings.HasPrefix(sessionUrl.Url, "/radio" + playlistPath + "?") {
+        t.Fatalf("session URL under the base path given as \"%s\"", sessionUrl.Url)
+    }
+    if _, ok := checkSessionToken(httptest.NewRecorder(), httptest.NewRequest("GET", strings.TrimPrefix(sessionUrl.Url, "/radio"), nil), "secret"); !ok {
+        t.Fatalf("session URL \"%s\" not valid for the path the server sees", sessionUrl.Url)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,170 @@
+/* Changing the MP3 bitrate at runtime for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "strconv"
+    "net/http"
+    "sync/atomic"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The bitrate of the MP3 encoder, as served by ADMIN_BITRATE_PATH
+type BitrateState struct {
+    // The bitrate in use, in kbits/s
+    Bitrate int `json:"bitrate"`
+    // The bitrate that will be used from the next segment, absent if
+    // no change is pending
+    Pending int `json:"pending,omitempty"`
+    // The bitrates that may be set, in kbits/s, which depend on the
+    // sample rate of the MP3
+    Allowed []int `json:"allowed"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL path of the admin endpoint that reports and sets the bitrate
+const ADMIN_BITRATE_PATH string = "/admin/bitrate"
+
+// The query parameter of a PUT to ADMIN_BITRATE_PATH giving the new
+// bitrate in kbits/s, e.g. ?kbps=64
+const ADMIN_BITRATE_KBPS_PARAMETER string = "kbps"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The bitrate, in kbits/s, and the sample rate of the MP3 encoder in
+// use, accessed atomically
+var mp3EncoderBitrate int64
+var mp3EncoderSampleRate int64
+
+// The bitrate to change to at the next segment, 0 if none
+var pendingBitrate int
+var pendingBitrateAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the bitrates, in kbits/s, that LAME can encode at a sample rate:
+// those of MPEG-1 for 32 kHz and above, else those of MPEG-2/2.5
+func allowedMp3Bitrates(sampleRate int) []int {
+    table := mp3BitratesMpeg2[1:]
+    if sampleRate >= mp3SampleRatesMpeg1[len(mp3SampleRatesMpeg1) - 1] {
+        table = mp3BitratesMpeg1[1:]
+    }
+    return append([]int(nil), table...)
+}
+
+// Record the bitrate and sample rate of a newly created MP3 encoder
+func setMp3EncoderBitrate(bitrate int, sampleRate int) {
+    atomic.StoreInt64(&mp3EncoderBitrate, int64(bitrate))
+    atomic.StoreInt64(&mp3EncoderSampleRate, int64(sampleRate))
+}
+
+// Return the state of the bitrate of the MP3 encoder
+func bitrateState() BitrateState {
+    sampleRate := int(atomic.LoadInt64(&mp3EncoderSampleRate))
+    if sampleRate == 0 {
+        sampleRate = SAMPLING_FREQUENCY
+    }
+    pendingBitrateAccess.Lock()
+    defer pendingBitrateAccess.Unlock()
+    return BitrateState{Bitrate: int(atomic.LoadInt64(&mp3EncoderBitrate)), Pending: pendingBitrate,
+                        Allowed: allowedMp3Bitrates(sampleRate)}
+}
+
+// Ask for the bitrate to be changed at the next segment, returning
+// false if a different change is already waiting for it
+func requestBitrate(bitrate int) bool {
+    pendingBitrateAccess.Lock()
+    defer pendingBitrateAccess.Unlock()
+    if (pendingBitrate != 0) && (pendingBitrate != bitrate) {
+        return false
+    }
+    if bitrate == int(atomic.LoadInt64(&mp3EncoderBitrate)) {
+        // Back to, or staying at, what is in use
+        pendingBitrate = 0
+    } else {
+        pendingBitrate = bitrate
+    }
+    return true
+}
+
+// Called between segments, returning the bitrate to change to and true
+// if a change is pending, which is then no longer pending
+func takePendingBitrate() (int, bool) {
+    pendingBitrateAccess.Lock()
+    defer pendingBitrateAccess.Unlock()
+    bitrate := pendingBitrate
+    pendingBitrate = 0
+    return bitrate, bitrate != 0
+}
+
+// Handle requests to ADMIN_BITRATE_PATH: GET responds with the
+// BitrateState, PUT with ?kbps=<bitrate> asks for the bitrate to be
+// changed, which happens when the segment being encoded is finished, so
+// a second, different, change before then is refused
+func bitrateHandler(out http.ResponseWriter, in *http.Request) {
+    status := http.StatusOK
+
+    if (in.Method != "GET") && (in.Method != "PUT") {
+        apiMethodNotAllowed(out, in, "GET, PUT")
+        return
+    }
+    if !checkAdminToken(out, in) {
+        return
+    }
+    if in.Method == "PUT" {
+        state := bitrateState()
+        bitrate, err := strconv.Atoi(in.URL.Query().Get(ADMIN_BITRATE_KBPS_PARAMETER))
+        allowed := false
+        for _, value := range state.Allowed {
+            allowed = allowed || (bitrate == value)
+        }
+        if (err != nil) || !allowed {
+            apiError(out, in, http.StatusBadRequest, API_ERROR_BAD_REQUEST,
+                     fmt.Sprintf("invalid \"%s\" bitrate, must be one of %v", ADMIN_BITRATE_KBPS_PARAMETER, state.Allowed))
+            return
+        }
+        if !requestBitrate(bitrate) {
+            apiError(out, in, http.StatusConflict, API_ERROR_CONFLICT,
+                     fmt.Sprintf("a change to %d kbits/s is already waiting for the next segment", state.Pending))
+            return
+        }
+        log.Printf("Bitrate of %d kbits/s requested by %s.\n", bitrate, in.RemoteAddr)
+        if bitrate != state.Bitrate {
+            status = http.StatusAccepted
+        }
+    }
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    out.WriteHeader(status)
+    state := bitrateState()
+    err := json.NewEncoder(out).Encode(&state)
+    if err != nil {
+        log.Printf("Unable to serve bitrate state (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
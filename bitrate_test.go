@@ -0,0 +1,100 @@
+/* Tests of changing the MP3 bitrate at runtime for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "testing"
+    "net/http"
+    "sync/atomic"
+    "encoding/json"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Ask for a change of bitrate through the admin endpoint, checking that
+// an invalid bitrate and a second change before the next segment are
+// refused, then create an encoder with the pending bitrate, as is done
+// between segments, and check that it encodes at that bitrate
+func TestBitrate(t *testing.T) {
+    encoderOptions := testMp3EncoderOptions()
+    var mp3Audio bytes.Buffer
+    var state BitrateState
+
+    setAdminToken("test")
+    t.Cleanup(func() {
+        setAdminToken("")
+    })
+    savedBitrate := atomic.LoadInt64(&mp3EncoderBitrate)
+    savedSampleRate := atomic.LoadInt64(&mp3EncoderSampleRate)
+    t.Cleanup(func() {
+        takePendingBitrate()
+        setMp3EncoderBitrate(int(savedBitrate), int(savedSampleRate))
+    })
+    setMp3EncoderBitrate(64, mp3SampleRate(encoderOptions))
+    admin := func(method string, query string) int {
+        response := httptest.NewRecorder()
+        request := httptest.NewRequest(method, ADMIN_BITRATE_PATH + query, nil)
+        request.Header.Set("Authorization", "Bearer test")
+        bitrateHandler(response, request)
+        if response.Code < http.StatusBadRequest {
+            json.NewDecoder(response.Body).Decode(&state)
+        }
+        return response.Code
+    }
+    for _, test := range []struct{method string; query string; status int; pending int}{
+                           {"GET", "", http.StatusOK, 0},
+                           {"POST", "", http.StatusMethodNotAllowed, 0},
+                           {"PUT", "?kbps=65", http.StatusBadRequest, 0},
+                           {"PUT", "?kbps=fast", http.StatusBadRequest, 0},
+                           {"PUT", "?kbps=64", http.StatusOK, 0},
+                           {"PUT", "?kbps=32", http.StatusAccepted, 32},
+                           {"PUT", "?kbps=32", http.StatusAccepted, 32},
+                           {"PUT", "?kbps=48", http.StatusConflict, 32}} {
+        state = BitrateState{}
+        status := admin(test.method, test.query)
+        if status != test.status {
+            t.Fatalf("%s %s%s responded %d, not %d", test.method, ADMIN_BITRATE_PATH, test.query,
+                     status, test.status)
+        }
+        if (status < http.StatusBadRequest) && ((state.Bitrate != 64) || (state.Pending != test.pending)) {
+            t.Fatalf("%s %s%s gave bitrate state %+v, not 64 pending %d", test.method, ADMIN_BITRATE_PATH,
+                     test.query, state, test.pending)
+        }
+    }
+
+    bitrate, changed := takePendingBitrate()
+    if !changed || (bitrate != 32) || (bitrateState().Pending != 0) {
+        t.Fatalf("pending bitrate taken as %d (%t), not 32", bitrate, changed)
+    }
+    encoderOptions.Bitrate = bitrate
+    mp3Writer, samplesPerFrame := createMp3Writer(&mp3Audio, encoderOptions)
+    if mp3Writer == nil {
+        t.Fatal("unable to create MP3 writer")
+    }
+    defer mp3Writer.Close()
+    _, err := mp3Writer.Write(make([]byte, samplesPerFrame * 4 * URTP_SAMPLE_SIZE))
+    if err != nil {
+        t.Fatal(err)
+    }
+    header, ok := parseMp3FrameHeader(mp3Audio.Bytes())
+    if !ok || (header.bitrate != 32) || (bitrateState().Bitrate != 32) {
+        t.Fatalf("encoded at %d kbits/s (frame found %t), served as %d kbits/s, when 32 was asked for",
+                 header.bitrate, ok, bitrateState().Bitrate)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,58 @@
+/* Limiting the rate at which the audio buffer is drained, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Limits how much of the audio buffer is encoded on each tick of audio
+// processing to a block of real-time audio plus a catch-up allowance, so
+// that after a burst of datagrams (e.g. the flush of a client's jitter
+// buffer) the output closes in on real time rather than galloping ahead
+// of it in a single segment
+type CatchUpLimiter struct {
+    // The samples that may be drained on each tick
+    perTick float64
+    // The fraction of a sample carried over from the previous tick
+    credit float64
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a catch-up limiter which drains up to rate (e.g. 0.1 for 10%)
+// faster than real time
+func createCatchUpLimiter(rate float64) *CatchUpLimiter {
+    return &CatchUpLimiter{perTick: float64(SAMPLES_PER_BLOCK) * (1 + rate)}
+}
+
+// Called on each tick of audio processing with the number of samples
+// wanted, returning the number that may be drained; allowance that is
+// not used (because the buffer holds less) is not saved up for later,
+// else a burst after a quiet spell would be drained all at once
+func (limiter *CatchUpLimiter) Allow(wanted int) int {
+    limiter.credit += limiter.perTick
+    allowed := int(limiter.credit)
+    limiter.credit -= float64(allowed)
+    if allowed > wanted {
+        allowed = wanted
+    }
+    return allowed
+}
+
+/* End Of File */
@@ -0,0 +1,57 @@
+/* Tests of limiting the rate at which the audio buffer is drained, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Feed a block of audio per tick, after a burst of several blocks, into
+// the audio buffer, checking that no tick drains more than the catch-up
+// limit allows and that the backlog of the burst is worked off in the
+// time the catch-up rate implies
+func TestCatchUp(t *testing.T) {
+    var drained bytes.Buffer
+    const rate float64 = 0.1
+    const burstBlocks int = 5
+
+    pcmAudio.Reset()
+    t.Cleanup(func() {
+        pcmAudio.Reset()
+    })
+    limiter := createCatchUpLimiter(rate)
+    limit := int(float64(SAMPLES_PER_BLOCK) * (1 + rate)) + 1
+    pcmAudio.Write(make([]byte, burstBlocks * SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+    // The backlog is worked off at rate blocks per tick
+    ticks := int(float64(burstBlocks) / rate) + 2
+    for x := 0; x < ticks; x++ {
+        pcmAudio.Write(make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+        drained.Reset()
+        encodeOutput(nil, &drained, limiter.Allow(pcmAudio.Len() / URTP_SAMPLE_SIZE), nil)
+        if drained.Len() / URTP_SAMPLE_SIZE > limit {
+            t.Fatalf("tick %d drained %d sample(s) when the limit is %d",
+                     x, drained.Len() / URTP_SAMPLE_SIZE, limit)
+        }
+    }
+    if pcmAudio.Len() / URTP_SAMPLE_SIZE >= SAMPLES_PER_BLOCK {
+        t.Fatalf("%d sample(s) of a burst of %d still buffered after %d tick(s)",
+                 pcmAudio.Len() / URTP_SAMPLE_SIZE, burstBlocks * SAMPLES_PER_BLOCK, ticks)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,132 @@
+/* Segment checksums for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "path/filepath"
+    "sync"
+    "strings"
+    "container/list"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The checksum of a segment, as listed at MANIFEST_PATH
+type SegmentChecksum struct {
+    Name string `json:"name"`
+    Sha256 string `json:"sha256"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The file extension of a checksum sidecar, added to that of the segment
+const CHECKSUM_EXTENSION string = ".sha256"
+
+// The URL path at which the manifest of segment checksums is served
+const MANIFEST_PATH string = "/manifest"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The checksums of the segments, oldest first
+var segmentChecksumList = list.New()
+
+// Mutex to manage access to the segment checksums
+var segmentChecksumAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the contents of a checksum sidecar, in the format of sha256sum
+func checksumSidecar(name string, sha256 string) string {
+    return fmt.Sprintf("%s  %s\n", sha256, filepath.Base(name))
+}
+
+// Write a checksum sidecar next to a segment in a store
+func writeChecksumFile(store FileStore, segmentPath string, sha256 string) error {
+    return writeStoreFile(store, segmentPath + CHECKSUM_EXTENSION, []byte(checksumSidecar(segmentPath, sha256)))
+}
+
+// Add the checksum of a segment
+func addSegmentChecksum(name string, sha256 string) {
+    segmentChecksumAccess.Lock()
+    defer segmentChecksumAccess.Unlock()
+    segmentChecksumList.PushBack(&SegmentChecksum{Name: filepath.Base(name), Sha256: sha256})
+}
+
+// Remove the checksum of a segment
+func removeSegmentChecksum(name string) {
+    segmentChecksumAccess.Lock()
+    defer segmentChecksumAccess.Unlock()
+    name = filepath.Base(name)
+    for element := segmentChecksumList.Front(); element != nil; element = element.Next() {
+        if element.Value.(*SegmentChecksum).Name == name {
+            segmentChecksumList.Remove(element)
+            break
+        }
+    }
+}
+
+// Serve the checksum sidecar of a segment, given the path of the sidecar
+func serveChecksum(out http.ResponseWriter, in *http.Request, sidecarPath string) {
+    var sha256 string
+
+    name := filepath.Base(strings.TrimSuffix(sidecarPath, CHECKSUM_EXTENSION))
+    segmentChecksumAccess.Lock()
+    for element := segmentChecksumList.Front(); element != nil; element = element.Next() {
+        if element.Value.(*SegmentChecksum).Name == name {
+            sha256 = element.Value.(*SegmentChecksum).Sha256
+            break
+        }
+    }
+    segmentChecksumAccess.Unlock()
+    if sha256 != "" {
+        out.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        out.Header().Set("Cache-Control","no-cache")
+        fmt.Fprint(out, checksumSidecar(name, sha256))
+    } else {
+        log.Printf("No checksum for segment \"%s\".\n", name)
+        http.NotFound(out, in)
+    }
+}
+
+// Serve the manifest of segment checksums
+func manifestHandler(out http.ResponseWriter, in *http.Request) {
+    var manifest []SegmentChecksum
+
+    log.Printf("Manifest handler was asked for \"%s\"...\n", in.URL.Path)
+    segmentChecksumAccess.Lock()
+    manifest = make([]SegmentChecksum, 0, segmentChecksumList.Len())
+    for element := segmentChecksumList.Front(); element != nil; element = element.Next() {
+        manifest = append(manifest, *element.Value.(*SegmentChecksum))
+    }
+    segmentChecksumAccess.Unlock()
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    err := json.NewEncoder(out).Encode(manifest)
+    if err != nil {
+        log.Printf("Unable to serve manifest (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,231 @@
+/* Gap concealment strategies for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Something that can fill a gap in the audio; prev is the datagram
+// before the gap and next the datagram after it, either of which may
+// be nil (or have no audio) if it is not known.  The fill is returned
+// as bytes, ready to be written to pcmAudio.
+type Concealer interface {
+    Fill(gapSamples int, prev *UrtpDatagram, next *UrtpDatagram) []byte
+}
+
+// Fill with silence
+type SilenceConcealer struct{}
+
+// Fill by repeating the audio of the previous datagram
+type RepeatConcealer struct{}
+
+// Fill by holding the last sample of the previous datagram
+type HoldConcealer struct{}
+
+// Fill by interpolating linearly from the last sample of the previous
+// datagram to the first sample of the next
+type InterpolateConcealer struct{}
+
+// Fill by repeating the last pitch period of the previous datagram,
+// found by waveform similarity, overlap-adding at the joins
+type OverlapAddConcealer struct{}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The names of the concealment strategies
+const CONCEAL_SILENCE string = "silence"
+const CONCEAL_REPEAT string = "repeat"
+const CONCEAL_HOLD string = "hold"
+const CONCEAL_INTERPOLATE string = "interpolate"
+const CONCEAL_OVERLAP_ADD string = "overlap-add"
+
+// The range of pitch periods searched by the OverlapAddConcealer
+// (2.5 to 15 ms)
+const CONCEAL_MIN_PERIOD int = SAMPLING_FREQUENCY / 400
+const CONCEAL_MAX_PERIOD int = SAMPLING_FREQUENCY * 15 / 1000
+
+// The number of samples cross-faded at each join by the OverlapAddConcealer
+const CONCEAL_OVERLAP int = SAMPLING_FREQUENCY / 1000
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a concealer from its name, nil if the name is not known
+func createConcealer(name string) Concealer {
+    switch name {
+        case CONCEAL_SILENCE:
+            return SilenceConcealer{}
+        case CONCEAL_REPEAT:
+            return RepeatConcealer{}
+        case CONCEAL_HOLD:
+            return HoldConcealer{}
+        case CONCEAL_INTERPOLATE:
+            return InterpolateConcealer{}
+        case CONCEAL_OVERLAP_ADD:
+            return OverlapAddConcealer{}
+    }
+    return nil
+}
+
+// Convert samples to the bytes written to pcmAudio
+func samplesToBytes(samples []int16) []byte {
+    audioBytes := make([]byte, len(samples) * URTP_SAMPLE_SIZE)
+
+    for x, y := range samples {
+        for z := 0; z < URTP_SAMPLE_SIZE; z++ {
+            audioBytes[(x * URTP_SAMPLE_SIZE) + z] = byte(y >> ((uint(z) * 8)))
+        }
+    }
+
+    return audioBytes
+}
+
+// Return the audio of a datagram, nil if there is none
+func datagramAudio(datagram *UrtpDatagram) []int16 {
+    if (datagram != nil) && (datagram.Audio != nil) {
+        return *datagram.Audio
+    }
+    return nil
+}
+
+// Fill with silence
+func (SilenceConcealer) Fill(gapSamples int, prev *UrtpDatagram, next *UrtpDatagram) []byte {
+    return make([]byte, gapSamples * URTP_SAMPLE_SIZE)
+}
+
+// Fill by repeating the audio of the previous datagram
+func (RepeatConcealer) Fill(gapSamples int, prev *UrtpDatagram, next *UrtpDatagram) []byte {
+    fill := make([]int16, gapSamples)
+    audio := datagramAudio(prev)
+
+    if len(audio) > 0 {
+        for x := range fill {
+            fill[x] = audio[x % len(audio)]
+        }
+    }
+
+    return samplesToBytes(fill)
+}
+
+// Fill by holding the last sample of the previous datagram
+func (HoldConcealer) Fill(gapSamples int, prev *UrtpDatagram, next *UrtpDatagram) []byte {
+    fill := make([]int16, gapSamples)
+    audio := datagramAudio(prev)
+
+    if len(audio) > 0 {
+        for x := range fill {
+            fill[x] = audio[len(audio) - 1]
+        }
+    }
+
+    return samplesToBytes(fill)
+}
+
+// Fill by interpolating linearly from the last sample of the previous
+// datagram to the first sample of the next, holding whichever end is
+// known if only one is and falling back to silence if neither is
+func (InterpolateConcealer) Fill(gapSamples int, prev *UrtpDatagram, next *UrtpDatagram) []byte {
+    var start int
+    var end int
+    fill := make([]int16, gapSamples)
+    prevAudio := datagramAudio(prev)
+    nextAudio := datagramAudio(next)
+
+    if (len(prevAudio) == 0) && (len(nextAudio) == 0) {
+        return samplesToBytes(fill)
+    }
+    if len(prevAudio) > 0 {
+        start = int(prevAudio[len(prevAudio) - 1])
+        end = start
+    }
+    if len(nextAudio) > 0 {
+        end = int(nextAudio[0])
+        if len(prevAudio) == 0 {
+            start = end
+        }
+    }
+    for x := range fill {
+        fill[x] = int16(start + ((end - start) * (x + 1) / (gapSamples + 1)))
+    }
+
+    return samplesToBytes(fill)
+}
+
+// Fill by repeating the last pitch period of the previous datagram,
+// cross-fading over CONCEAL_OVERLAP samples at each join so that
+// there are no clicks
+func (OverlapAddConcealer) Fill(gapSamples int, prev *UrtpDatagram, next *UrtpDatagram) []byte {
+    fill := make([]int16, gapSamples)
+    audio := datagramAudio(prev)
+
+    if len(audio) < CONCEAL_MIN_PERIOD * 2 {
+        return RepeatConcealer{}.Fill(gapSamples, prev, next)
+    }
+
+    // Find the period, P, for which the last P samples best match the P before
+    // them, using normalised correlation
+    period := CONCEAL_MIN_PERIOD
+    bestScore := -2.0
+    for p := CONCEAL_MIN_PERIOD; (p <= CONCEAL_MAX_PERIOD) && (p * 2 <= len(audio)); p++ {
+        var correlation float64
+        var energyA float64
+        var energyB float64
+        for x := len(audio) - p; x < len(audio); x++ {
+            a := float64(audio[x])
+            b := float64(audio[x - p])
+            correlation += a * b
+            energyA += a * a
+            energyB += b * b
+        }
+        if (energyA > 0) && (energyB > 0) {
+            score := correlation / math.Sqrt(energyA * energyB)
+            if score > bestScore {
+                bestScore = score
+                period = p
+            }
+        }
+    }
+
+    // Repeat the last period, fading each repeat in over the tail of the last
+    cycle := audio[len(audio) - period:]
+    overlap := CONCEAL_OVERLAP
+    if overlap > period / 2 {
+        overlap = period / 2
+    }
+    last := audio[len(audio) - 1]
+    for x := range fill {
+        sample := cycle[x % period]
+        position := x % period
+        if (x >= period) && (position < overlap) {
+            // Cross-fade from the end of the previous repeat
+            tail := int(cycle[period - overlap + position])
+            sample = int16((int(sample) * position + tail * (overlap - position)) / overlap)
+        } else if (x < period) && (position < overlap) {
+            // Cross-fade from the real audio into the first repeat
+            sample = int16((int(sample) * position + int(last) * (overlap - position)) / overlap)
+        }
+        fill[x] = sample
+    }
+
+    return samplesToBytes(fill)
+}
+
+/* End Of File */
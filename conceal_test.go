@@ -0,0 +1,133 @@
+/* Tests of gap concealment strategies for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "testing"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A gap to conceal, the audio either side of it (nil if there is no
+// datagram) and the fill expected
+type ConcealTest struct {
+    name string
+    concealer Concealer
+    gapSamples int
+    prev []int16
+    next []int16
+    fill []int16
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The audio of the datagram before a gap, sawtooths rising by 10 a
+// sample that repeat every 40 samples, the shortest period that the
+// OverlapAddConcealer looks for, and every 73 samples
+var concealSawtooth40 = sawtooth(SAMPLES_PER_BLOCK, 40)
+var concealSawtooth73 = sawtooth(SAMPLES_PER_BLOCK, 73)
+
+// The gaps to conceal: the OverlapAddConcealer fills fade from the last
+// sample before the gap (390 and 270) into the repeated period over
+// CONCEAL_OVERLAP (16) samples, then from the tail of each repeat into
+// the next
+var concealTests = []ConcealTest{
+    {"silence", SilenceConcealer{}, 4, []int16{1, 2, 3}, []int16{4, 5}, []int16{0, 0, 0, 0}},
+    {"silence, no audio", SilenceConcealer{}, 2, nil, nil, []int16{0, 0}},
+    {"repeat", RepeatConcealer{}, 5, []int16{1, -2, 3}, []int16{4}, []int16{1, -2, 3, 1, -2}},
+    {"repeat, no previous audio", RepeatConcealer{}, 3, nil, []int16{4}, []int16{0, 0, 0}},
+    {"hold", HoldConcealer{}, 3, []int16{1, 2, -7}, []int16{4}, []int16{-7, -7, -7}},
+    {"hold, no previous audio", HoldConcealer{}, 2, nil, []int16{4}, []int16{0, 0}},
+    {"interpolate, rising", InterpolateConcealer{}, 3, []int16{9, 0}, []int16{400, 9}, []int16{100, 200, 300}},
+    {"interpolate, falling", InterpolateConcealer{}, 3, []int16{400}, []int16{0}, []int16{300, 200, 100}},
+    {"interpolate, previous only", InterpolateConcealer{}, 3, []int16{9, 50}, nil, []int16{50, 50, 50}},
+    {"interpolate, next only", InterpolateConcealer{}, 3, nil, []int16{-80, 9}, []int16{-80, -80, -80}},
+    {"interpolate, neither", InterpolateConcealer{}, 3, nil, nil, []int16{0, 0, 0}},
+    // Too little audio to find a period in, so it is repeated
+    {"overlap-add, short", OverlapAddConcealer{}, 5, []int16{1, 2, 3}, nil, []int16{1, 2, 3, 1, 2}},
+    {"overlap-add, period 40", OverlapAddConcealer{}, 96, concealSawtooth40, nil, []int16{
+        390, 366, 343, 322, 302, 283, 266, 250, 235, 221, 208, 197, 187, 178, 171, 165,
+        160, 170, 180, 190, 200, 210, 220, 230, 240, 250, 260, 270, 280, 290, 300, 310,
+        320, 330, 340, 350, 360, 370, 380, 390, 240, 235, 230, 225, 220, 215, 210, 205,
+        200, 195, 190, 185, 180, 175, 170, 165, 160, 170, 180, 190, 200, 210, 220, 230,
+        240, 250, 260, 270, 280, 290, 300, 310, 320, 330, 340, 350, 360, 370, 380, 390,
+        240, 235, 230, 225, 220, 215, 210, 205, 200, 195, 190, 185, 180, 175, 170, 165}},
+    {"overlap-add, period 73", OverlapAddConcealer{}, 90, concealSawtooth73, nil, []int16{
+        270, 271, 273, 277, 282, 288, 296, 305, 315, 326, 338, 352, 367, 383, 401, 420,
+        440, 450, 460, 470, 480, 490, 500, 510, 520, 530, 540, 550, 560, 570, 580, 590,
+        600, 610, 620, 630, 640, 650, 660, 670, 680, 690, 700, 710, 720, 0, 10, 20,
+        30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 150, 160, 170, 180,
+        190, 200, 210, 220, 230, 240, 250, 260, 270, 120, 140, 160, 180, 200, 220, 240,
+        260, 280, 300, 320, 340, 360, 380, 400, 420, 440}}}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return numSamples of a sawtooth rising by 10 a sample from 0 and
+// repeating every period samples
+func sawtooth(numSamples int, period int) []int16 {
+    samples := make([]int16, numSamples)
+    for x := range samples {
+        samples[x] = int16((x % period) * 10)
+    }
+    return samples
+}
+
+// Return a datagram carrying the given audio, nil if there is none
+func concealTestDatagram(audio []int16) *UrtpDatagram {
+    if audio == nil {
+        return nil
+    }
+    return &UrtpDatagram{Audio: &audio}
+}
+
+// Return the samples in bytes written to pcmAudio, see samplesToBytes()
+func bytesToSamples(audio []byte) []int16 {
+    samples := make([]int16, len(audio) / URTP_SAMPLE_SIZE)
+    for x := range samples {
+        samples[x] = int16(binary.LittleEndian.Uint16(audio[x * URTP_SAMPLE_SIZE:]))
+    }
+    return samples
+}
+
+// Fill each gap of concealTests with its concealer, failing if the
+// fill is not exactly that expected
+func TestConcealers(t *testing.T) {
+    for _, test := range concealTests {
+        fill := test.concealer.Fill(test.gapSamples, concealTestDatagram(test.prev), concealTestDatagram(test.next))
+        if !bytes.Equal(fill, samplesToBytes(test.fill)) {
+            t.Fatalf("%s: filled with %v when %v was expected", test.name, bytesToSamples(fill), test.fill)
+        }
+    }
+}
+
+// Check that each strategy can be created by its name
+func TestCreateConcealer(t *testing.T) {
+    for _, name := range []string{CONCEAL_SILENCE, CONCEAL_REPEAT, CONCEAL_HOLD, CONCEAL_INTERPOLATE, CONCEAL_OVERLAP_ADD} {
+        if createConcealer(name) == nil {
+            t.Fatalf("no concealer called \"%s\"", name)
+        }
+    }
+    if createConcealer("nothing") != nil {
+        t.Fatal("concealer created from an unknown name")
+    }
+}
+
+/* End Of File */
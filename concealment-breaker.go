@@ -0,0 +1,128 @@
+/* Circuit breaker on concealment for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The concealment of one segment, as remembered by a ConcealmentBreaker
+type ConcealmentRecord struct {
+    duration time.Duration
+    concealed time.Duration
+}
+
+// Takes the stream out of service when, over a window of the most
+// recent segments, more than a given fraction of the audio is gap-fill,
+// putting it back into service once the fraction has fallen to half that
+type ConcealmentBreaker struct {
+    maxFraction float64
+    window time.Duration
+    records []ConcealmentRecord
+    tripped bool
+}
+
+// The state of the concealment circuit breaker, as served in Stats
+type ConcealmentBreakerState struct {
+    Enabled bool `json:"enabled"`
+    Tripped bool `json:"tripped"`
+    // The fraction of the audio in the window that is gap-fill
+    ConcealedFraction float64 `json:"concealedFraction"`
+}
+
+// A change in service, passed to the audio output
+type ServiceChange struct {
+    outOfService bool
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The state of the concealment circuit breaker
+var concealmentBreakerState ConcealmentBreakerState
+var concealmentBreakerAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a concealment circuit breaker
+func createConcealmentBreaker(maxFraction float64, window time.Duration) *ConcealmentBreaker {
+    concealmentBreakerAccess.Lock()
+    concealmentBreakerState = ConcealmentBreakerState{Enabled: true}
+    concealmentBreakerAccess.Unlock()
+    return &ConcealmentBreaker{maxFraction: maxFraction, window: window}
+}
+
+// Add a segment of the given duration and concealed ratio, returning
+// true if the breaker has tripped or recovered as a result
+func (breaker *ConcealmentBreaker) Add(duration time.Duration, concealedRatio float64) bool {
+    var total time.Duration
+    var concealed time.Duration
+    var changed bool
+
+    breaker.records = append(breaker.records, ConcealmentRecord{duration: duration,
+                                                                concealed: time.Duration(float64(duration) * concealedRatio)})
+    // Drop the records which are no longer needed to cover the window
+    for _, record := range breaker.records {
+        total += record.duration
+        concealed += record.concealed
+    }
+    for (len(breaker.records) > 1) && (total - breaker.records[0].duration >= breaker.window) {
+        total -= breaker.records[0].duration
+        concealed -= breaker.records[0].concealed
+        breaker.records = breaker.records[1:]
+    }
+    fraction := float64(concealed) / float64(total)
+
+    // Only judge once there is a whole window to judge by
+    if total >= breaker.window {
+        if !breaker.tripped && (fraction > breaker.maxFraction) {
+            log.Printf("%d%% of the last %v of audio is gap-fill, more than the %d%% allowed: going OUT OF SERVICE.\n",
+                       int(fraction * 100), total, int(breaker.maxFraction * 100))
+            breaker.tripped = true
+            changed = true
+        } else if breaker.tripped && (fraction <= breaker.maxFraction / 2) {
+            log.Printf("%d%% of the last %v of audio is gap-fill, back in service.\n", int(fraction * 100), total)
+            breaker.tripped = false
+            changed = true
+        }
+    }
+    concealmentBreakerAccess.Lock()
+    concealmentBreakerState.Tripped = breaker.tripped
+    concealmentBreakerState.ConcealedFraction = fraction
+    concealmentBreakerAccess.Unlock()
+
+    return changed
+}
+
+// Return true if the breaker has tripped
+func (breaker *ConcealmentBreaker) Tripped() bool {
+    return breaker.tripped
+}
+
+// Return the state of the concealment circuit breaker
+func concealmentState() ConcealmentBreakerState {
+    concealmentBreakerAccess.Lock()
+    defer concealmentBreakerAccess.Unlock()
+    return concealmentBreakerState
+}
+
+/* End Of File */
@@ -0,0 +1,132 @@
+/* Fixed-capacity ring buffer of URTP datagrams for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A FIFO of datagrams which, when full, overwrites the oldest or, if
+// it grows, doubles in size; it allocates nothing otherwise
+type DatagramRing struct {
+    datagrams []*UrtpDatagram
+    oldest int
+    count int
+    grows bool
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a ring buffer that can hold capacity datagrams
+func createDatagramRing(capacity int) *DatagramRing {
+    ring := new(DatagramRing)
+    ring.datagrams = make([]*UrtpDatagram, capacity)
+    return ring
+}
+
+// Create a ring buffer that can hold capacity datagrams to begin with
+// and which, rather than overwrite the oldest when full, grows
+func createGrowingDatagramRing(capacity int) *DatagramRing {
+    ring := createDatagramRing(capacity)
+    ring.grows = true
+    return ring
+}
+
+// Double the size of the ring, the oldest datagram moving to the start
+func (ring *DatagramRing) grow() {
+    datagrams := make([]*UrtpDatagram, len(ring.datagrams) * 2)
+    for x := 0; x < ring.count; x++ {
+        datagrams[x] = ring.datagrams[(ring.oldest + x) % len(ring.datagrams)]
+    }
+    ring.datagrams = datagrams
+    ring.oldest = 0
+}
+
+// Add a datagram as the newest in the ring, returning the oldest
+// datagram if it had to be overwritten to make room, else nil
+func (ring *DatagramRing) Push(datagram *UrtpDatagram) *UrtpDatagram {
+    var overwritten *UrtpDatagram
+
+    if ring.grows && (ring.count == len(ring.datagrams)) {
+        ring.grow()
+    }
+    if ring.count < len(ring.datagrams) {
+        ring.datagrams[(ring.oldest + ring.count) % len(ring.datagrams)] = datagram
+        ring.count++
+    } else {
+        overwritten = ring.datagrams[ring.oldest]
+        ring.datagrams[ring.oldest] = datagram
+        ring.oldest = (ring.oldest + 1) % len(ring.datagrams)
+    }
+
+    return overwritten
+}
+
+// Remove and return the oldest datagram in the ring, nil if it is empty
+func (ring *DatagramRing) Pop() *UrtpDatagram {
+    var datagram *UrtpDatagram
+
+    if ring.count > 0 {
+        datagram = ring.datagrams[ring.oldest]
+        ring.datagrams[ring.oldest] = nil
+        ring.oldest = (ring.oldest + 1) % len(ring.datagrams)
+        ring.count--
+    }
+
+    return datagram
+}
+
+// Return the oldest datagram in the ring without removing it, nil if it is empty
+func (ring *DatagramRing) Oldest() *UrtpDatagram {
+    var datagram *UrtpDatagram
+
+    if ring.count > 0 {
+        datagram = ring.datagrams[ring.oldest]
+    }
+
+    return datagram
+}
+
+// Return the newest datagram in the ring, nil if it is empty
+func (ring *DatagramRing) Newest() *UrtpDatagram {
+    var datagram *UrtpDatagram
+
+    if ring.count > 0 {
+        datagram = ring.datagrams[(ring.oldest + ring.count - 1) % len(ring.datagrams)]
+    }
+
+    return datagram
+}
+
+// Return the number of datagrams in the ring
+func (ring *DatagramRing) Len() int {
+    return ring.count
+}
+
+// Return the number of datagrams the ring can hold without overwriting
+// or growing
+func (ring *DatagramRing) Cap() int {
+    return len(ring.datagrams)
+}
+
+// Empty the ring
+func (ring *DatagramRing) Clear() {
+    for ring.count > 0 {
+        ring.Pop()
+    }
+    ring.oldest = 0
+}
+
+/* End Of File */
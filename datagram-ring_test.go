@@ -0,0 +1,211 @@
+/* Tests of the ring buffer of URTP datagrams for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "errors"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The capacity of the ring in TestDatagramRing()
+const TEST_RING_CAPACITY int = 4
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a datagram with the given sequence number
+func ringTestDatagram(sequenceNumber int) *UrtpDatagram {
+    return &UrtpDatagram{SequenceNumber: uint16(sequenceNumber)}
+}
+
+// Check the number of datagrams in a ring and the sequence numbers of
+// its oldest and newest, returning an error if they are not as expected
+func checkRing(ring *DatagramRing, count int, oldest int, newest int) error {
+    if ring.Len() != count {
+        return errors.New(fmt.Sprintf("ring holds %d datagram(s) when it should hold %d", ring.Len(), count))
+    }
+    if count == 0 {
+        if (ring.Oldest() != nil) || (ring.Newest() != nil) {
+            return errors.New("empty ring has an oldest or newest datagram")
+        }
+        return nil
+    }
+    if (ring.Oldest() == nil) || (int(ring.Oldest().SequenceNumber) != oldest) {
+        return errors.New(fmt.Sprintf("oldest datagram is %+v when it should be %d", ring.Oldest(), oldest))
+    }
+    if (ring.Newest() == nil) || (int(ring.Newest().SequenceNumber) != newest) {
+        return errors.New(fmt.Sprintf("newest datagram is %+v when it should be %d", ring.Newest(), newest))
+    }
+
+    return nil
+}
+
+// Fill a ring, overflow it, so that it overwrites the oldest, then
+// push and pop around it several times, so that it wraps, failing if
+// the datagrams do not come out oldest first or if Oldest(), Newest()
+// and Len() do not follow them, then check that Clear() empties it
+// and that none of this allocates
+func TestDatagramRing(t *testing.T) {
+    ring := createDatagramRing(TEST_RING_CAPACITY)
+    if err := checkRing(ring, 0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    if ring.Pop() != nil {
+        t.Fatal("empty ring popped a datagram")
+    }
+
+    for x := 0; x < TEST_RING_CAPACITY; x++ {
+        if ring.Push(ringTestDatagram(x)) != nil {
+            t.Fatalf("datagram %d overwrote one in a ring of %d", x, TEST_RING_CAPACITY)
+        }
+        if err := checkRing(ring, x + 1, 0, x); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Full, so each push overwrites the oldest
+    for x := TEST_RING_CAPACITY; x < TEST_RING_CAPACITY * 2 + 1; x++ {
+        overwritten := ring.Push(ringTestDatagram(x))
+        if (overwritten == nil) || (int(overwritten.SequenceNumber) != x - TEST_RING_CAPACITY) {
+            t.Fatalf("pushing datagram %d to a full ring overwrote %+v", x, overwritten)
+        }
+        if err := checkRing(ring, TEST_RING_CAPACITY, x - TEST_RING_CAPACITY + 1, x); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Pop one, push one, round and round
+    next := TEST_RING_CAPACITY + 1
+    pushed := TEST_RING_CAPACITY * 2 + 1
+    for x := 0; x < TEST_RING_CAPACITY * 3; x++ {
+        datagram := ring.Pop()
+        if (datagram == nil) || (int(datagram.SequenceNumber) != next) {
+            t.Fatalf("popped %+v when datagram %d was expected", datagram, next)
+        }
+        next++
+        if err := checkRing(ring, TEST_RING_CAPACITY - 1, next, pushed - 1); err != nil {
+            t.Fatal(err)
+        }
+        if ring.Push(ringTestDatagram(pushed)) != nil {
+            t.Fatalf("datagram %d overwrote one in a ring that was not full", pushed)
+        }
+        pushed++
+        if err := checkRing(ring, TEST_RING_CAPACITY, next, pushed - 1); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Drain it
+    for ring.Len() > 0 {
+        datagram := ring.Pop()
+        if (datagram == nil) || (int(datagram.SequenceNumber) != next) {
+            t.Fatalf("popped %+v when datagram %d was expected", datagram, next)
+        }
+        next++
+    }
+    if next != pushed {
+        t.Fatalf("popped up to datagram %d when %d were pushed", next, pushed)
+    }
+    if err := checkRing(ring, 0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    // Clear a part-full ring and start again
+    ring.Push(ringTestDatagram(1))
+    ring.Push(ringTestDatagram(2))
+    ring.Clear()
+    if err := checkRing(ring, 0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    ring.Push(ringTestDatagram(3))
+    if err := checkRing(ring, 1, 3, 3); err != nil {
+        t.Fatal(err)
+    }
+
+    // Once created, it allocates nothing
+    datagram := ringTestDatagram(4)
+    if allocations := testing.AllocsPerRun(100, func() {
+        ring.Push(datagram)
+        ring.Pop()
+    }); allocations > 0 {
+        t.Fatalf("pushing and popping a datagram made %v allocation(s)", allocations)
+    }
+}
+
+// Wrap a growing ring round, then overflow it, failing if a datagram
+// is overwritten, if the datagrams do not come out oldest first or if
+// Oldest(), Newest() and Len() do not follow them, then check that,
+// once grown, it allocates nothing
+func TestGrowingDatagramRing(t *testing.T) {
+    ring := createGrowingDatagramRing(TEST_RING_CAPACITY)
+
+    // Start part way round, so that it has wrapped when it fills
+    ring.Push(ringTestDatagram(0))
+    ring.Push(ringTestDatagram(1))
+    ring.Pop()
+    ring.Pop()
+    for x := 0; x < TEST_RING_CAPACITY * 3; x++ {
+        if overwritten := ring.Push(ringTestDatagram(x)); overwritten != nil {
+            t.Fatalf("pushing datagram %d overwrote %+v", x, overwritten)
+        }
+        if err := checkRing(ring, x + 1, 0, x); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if ring.Cap() < TEST_RING_CAPACITY * 3 {
+        t.Fatalf("ring holding %d datagram(s) has a capacity of %d", ring.Len(), ring.Cap())
+    }
+    for x := 0; x < TEST_RING_CAPACITY * 3; x++ {
+        datagram := ring.Pop()
+        if (datagram == nil) || (int(datagram.SequenceNumber) != x) {
+            t.Fatalf("popped %+v when datagram %d was expected", datagram, x)
+        }
+    }
+    if err := checkRing(ring, 0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    // Once grown, it allocates nothing
+    datagram := ringTestDatagram(4)
+    if allocations := testing.AllocsPerRun(100, func() {
+        ring.Push(datagram)
+        ring.Pop()
+    }); allocations > 0 {
+        t.Fatalf("pushing and popping a datagram made %v allocation(s)", allocations)
+    }
+}
+
+// Benchmark pushing datagrams into a growing ring of NUM_NEW_DATAGRAMS
+// and popping them out again, as the FIFO of new datagrams is used,
+// which should allocate nothing
+func BenchmarkDatagramRing(b *testing.B) {
+    ring := createGrowingDatagramRing(NUM_NEW_DATAGRAMS)
+    datagram := ringTestDatagram(0)
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for x := 0; x < b.N; x++ {
+        ring.Push(datagram)
+        if ring.Len() >= NUM_NEW_DATAGRAMS / 2 {
+            ring.Pop()
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,220 @@
+/* Decoders of the audio coding schemes of URTP for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "errors"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Decodes the payload of the datagrams of one audio coding scheme
+type Decoder interface {
+    // The name of the audio coding scheme, for the log
+    Name() string
+    // Decode a payload, returning the audio and its format, nil if the
+    // payload cannot be decoded; if diagnostics is not nil it may be
+    // filled in with what was found, see UnicamDiagnostics
+    Decode(payload []byte, diagnostics *UnicamDiagnostics) (*[]int16, AudioFormat)
+}
+
+// The decoders of the audio coding schemes of the original clients
+type PcmDecoder struct{}
+type StereoPcmDecoder struct{}
+type UnicamDecoder struct {
+    sampleSizeBits int
+}
+
+// The lengths, in bytes, that the payload of a datagram of an audio
+// coding scheme may have; anything else is not let near the decoder
+type PayloadLimits struct {
+    Min int
+    Max int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// What to do with a datagram of an audio coding scheme that there is no
+// decoder for: drop it, as not being URTP, or take it in as a gap
+const UNKNOWN_CODING_DROP string = "drop"
+const UNKNOWN_CODING_CONCEAL string = "conceal"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The decoders, by audio coding scheme; a new scheme is added with
+// registerDecoder()
+var decoders = map[byte]Decoder{
+    PCM_SIGNED_16_BIT: PcmDecoder{},
+    UNICAM_COMPRESSED_8_BIT: UnicamDecoder{8},
+    UNICAM_COMPRESSED_10_BIT: UnicamDecoder{10},
+    PCM_SIGNED_16_BIT_STEREO: StereoPcmDecoder{},
+}
+
+// The payload lengths allowed, by audio coding scheme, see
+// payloadLimitsOf(): PCM must carry at least one sample and UNICAM at
+// least a pair of blocks, since the shift values of a pair share a byte
+// and the decoder works through whole pairs; changed with
+// setPayloadLimits()
+var payloadLimits = map[byte]PayloadLimits{
+    PCM_SIGNED_16_BIT: {URTP_SAMPLE_SIZE, URTP_DATAGRAM_MAX_SIZE},
+    UNICAM_COMPRESSED_8_BIT: {unicamBlockPairSize(8), URTP_DATAGRAM_MAX_SIZE},
+    UNICAM_COMPRESSED_10_BIT: {unicamBlockPairSize(10), URTP_DATAGRAM_MAX_SIZE},
+    PCM_SIGNED_16_BIT_STEREO: {URTP_SAMPLE_SIZE * 2, URTP_DATAGRAM_MAX_SIZE},
+}
+
+// True if datagrams of unknown audio coding schemes are taken in and
+// concealed, see UNKNOWN_CODING_CONCEAL, rather than dropped
+var concealUnknownCoding bool
+
+// The number of datagrams (or, over TCP, would-be datagrams) of unknown
+// audio coding schemes, accessed atomically
+var numUnknownCodingSchemes int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+func (PcmDecoder) Name() string {
+    return "PCM_SIGNED_16_BIT"
+}
+
+func (PcmDecoder) Decode(payload []byte, diagnostics *UnicamDiagnostics) (*[]int16, AudioFormat) {
+    audio := decodePcm(payload)
+    endiannessDetector.Check(audio, 1)
+    return audio, AudioFormat{SAMPLING_FREQUENCY, 1}
+}
+
+func (StereoPcmDecoder) Name() string {
+    return "PCM_SIGNED_16_BIT_STEREO"
+}
+
+// Stereo is only decoded if it is to be downmixed, as the MP3 encoder
+// is mono
+func (StereoPcmDecoder) Decode(payload []byte, diagnostics *UnicamDiagnostics) (*[]int16, AudioFormat) {
+    if !downmixToMono {
+        log.Printf("Stereo audio is only supported with mono downmix.\n")
+        return nil, AudioFormat{SAMPLING_FREQUENCY, 2}
+    }
+    stereo := decodePcm(payload)
+    endiannessDetector.Check(stereo, 2)
+    return downmixStereo(stereo), AudioFormat{SAMPLING_FREQUENCY, 1}
+}
+
+func (decoder UnicamDecoder) Name() string {
+    return fmt.Sprintf("UNICAM_COMPRESSED_%d_BIT", decoder.sampleSizeBits)
+}
+
+func (decoder UnicamDecoder) Decode(payload []byte, diagnostics *UnicamDiagnostics) (*[]int16, AudioFormat) {
+    return decodeUnicam(payload, decoder.sampleSizeBits, diagnostics), AudioFormat{SAMPLING_FREQUENCY, 1}
+}
+
+// Add the decoder of an audio coding scheme, replacing any there was;
+// a nil decoder removes the scheme; decoders are looked up without
+// locking, so this must be done before operateAudioIn() is called
+func registerDecoder(scheme byte, decoder Decoder) {
+    if decoder == nil {
+        delete(decoders, scheme)
+    } else {
+        decoders[scheme] = decoder
+    }
+}
+
+// Return the size of a pair of UNICAM blocks of the given sample size
+func unicamBlockPairSize(sampleSizeBits int) int {
+    return SAMPLES_PER_UNICAM_BLOCK * sampleSizeBits * 2 / 8 + 1
+}
+
+// Set the payload lengths allowed for an audio coding scheme; like
+// registerDecoder(), this must be done before operateAudioIn() is called
+func setPayloadLimits(scheme byte, limits PayloadLimits) {
+    payloadLimits[scheme] = limits
+}
+
+// Return the payload lengths allowed for an audio coding scheme; a
+// scheme without limits of its own (e.g. a heartbeat or a registered
+// scheme) may have anything up to URTP_DATAGRAM_MAX_SIZE
+func payloadLimitsOf(scheme byte) PayloadLimits {
+    limits, found := payloadLimits[scheme]
+    if !found {
+        limits = PayloadLimits{0, URTP_DATAGRAM_MAX_SIZE}
+    }
+    return limits
+}
+
+// Check the length of the payload of a datagram against what its audio
+// coding scheme allows, returning URTP_HEADER_OK if it is allowed
+func checkPayloadLength(scheme byte, length int) UrtpHeaderFault {
+    limits := payloadLimitsOf(scheme)
+    if length < limits.Min {
+        return URTP_HEADER_UNDERSIZED_PAYLOAD
+    }
+    if length > limits.Max {
+        return URTP_HEADER_OVERSIZED_PAYLOAD
+    }
+    return URTP_HEADER_OK
+}
+
+// Parse the payload limits given on the command line, each of the form
+// <scheme>:<min>:<max>, e.g. 1:33:660, returning them by scheme
+func parsePayloadLimits(specs []string) (map[byte]PayloadLimits, error) {
+    parsed := make(map[byte]PayloadLimits)
+    for _, spec := range specs {
+        fields := strings.Split(spec, ":")
+        if len(fields) != 3 {
+            return nil, errors.New(fmt.Sprintf("\"%s\": must be <scheme>:<min>:<max>", spec))
+        }
+        scheme, err := strconv.ParseUint(fields[0], 0, 8)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("\"%s\": \"%s\" is not an audio coding scheme", spec, fields[0]))
+        }
+        min, err := strconv.Atoi(fields[1])
+        if err == nil {
+            var max int
+            max, err = strconv.Atoi(fields[2])
+            if (err == nil) && ((min < 0) || (max < min) || (max > URTP_DATAGRAM_MAX_SIZE)) {
+                err = errors.New(fmt.Sprintf("need 0 <= min <= max <= %d", URTP_DATAGRAM_MAX_SIZE))
+            }
+            parsed[byte(scheme)] = PayloadLimits{min, max}
+        }
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("\"%s\": invalid lengths (%s)", spec, err.Error()))
+        }
+    }
+
+    return parsed, nil
+}
+
+// Return true if there is a decoder for an audio coding scheme
+func knownCodingScheme(scheme byte) bool {
+    _, known := decoders[scheme]
+    return known
+}
+
+// Count a datagram of an audio coding scheme there is no decoder for
+func countUnknownCodingScheme(scheme byte) {
+    count := atomic.AddInt64(&numUnknownCodingSchemes, 1)
+    log.Printf("No decoder for audio coding scheme 0x%x (%d datagram(s) of unknown coding schemes so far).\n", scheme, count)
+}
+
+/* End Of File */
@@ -0,0 +1,158 @@
+/* Tests of decoders of the audio coding schemes of URTP for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Decode datagrams through a newly registered decoder, then check that,
+// once it is removed, its datagrams are dropped or concealed, as asked,
+// and counted
+func TestDecoders(t *testing.T) {
+    const scheme byte = 0x10
+    channel := make(chan interface{}, 10)
+    savedChannel := ProcessDatagramsChannel
+    ProcessDatagramsChannel = channel
+    t.Cleanup(func() {
+        ProcessDatagramsChannel = savedChannel
+        concealUnknownCoding = false
+        registerDecoder(scheme, nil)
+    })
+    datagram := makeUrtpDatagram(scheme, 1, make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+
+    // The decoders of the original clients all decode to what the encoder
+    // is set up for, given a downmix
+    savedDownmix := downmixToMono
+    downmixToMono = true
+    for codingScheme, decoder := range decoders {
+        payload := make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)
+        if unicam, isUnicam := decoder.(UnicamDecoder); isUnicam {
+            // A pair of blocks and their shift values
+            payload = make([]byte, SAMPLES_PER_UNICAM_BLOCK * unicam.sampleSizeBits * 2 / 8 + 1)
+        }
+        audio, format := decoder.Decode(payload, nil)
+        if (audio == nil) || (format != (AudioFormat{SAMPLING_FREQUENCY, 1})) {
+            downmixToMono = savedDownmix
+            t.Fatalf("audio coding scheme %d (%s) decodes to %+v", codingScheme, decoder.Name(), format)
+        }
+    }
+    downmixToMono = savedDownmix
+
+    registerDecoder(scheme, PcmDecoder{})
+    if verifyUrtpHeader(datagram) != URTP_HEADER_OK {
+        t.Fatal("header of a registered audio coding scheme not accepted")
+    }
+    handleUrtpDatagram(datagram, nil)
+    received, _ := (<-channel).(*UrtpDatagram)
+    if (received == nil) || (received.Audio == nil) || (len(*received.Audio) != SAMPLES_PER_BLOCK) {
+        t.Fatal("datagram of a registered audio coding scheme not decoded")
+    }
+
+    registerDecoder(scheme, nil)
+    unknown := atomic.LoadInt64(&numUnknownCodingSchemes)
+    concealUnknownCoding = false
+    if verifyUrtpHeader(datagram) == URTP_HEADER_OK {
+        t.Fatal("header of an unknown audio coding scheme accepted when they are dropped")
+    }
+    concealUnknownCoding = true
+    if verifyUrtpHeader(datagram) != URTP_HEADER_OK {
+        t.Fatal("header of an unknown audio coding scheme not accepted when they are concealed")
+    }
+    handleUrtpDatagram(datagram, nil)
+    received, _ = (<-channel).(*UrtpDatagram)
+    if (received == nil) || (received.SequenceNumber != 1) || (received.Audio != nil) {
+        t.Fatal("datagram of an unknown audio coding scheme not taken in as a gap")
+    }
+    if count := atomic.LoadInt64(&numUnknownCodingSchemes) - unknown; count != 2 {
+        t.Fatalf("%d datagram(s) of unknown audio coding schemes counted when there were 2", count)
+    }
+}
+
+// Check payload lengths at the limits of PCM and UNICAM, given in URTP
+// headers and through TCP reassembly, checking that only those within
+// the limits get through, then that the limits can be changed
+func TestPayloadLimits(t *testing.T) {
+    channel := make(chan interface{}, 10)
+    savedChannel := ProcessDatagramsChannel
+    ProcessDatagramsChannel = channel
+    savedLimits := payloadLimitsOf(PCM_SIGNED_16_BIT)
+    t.Cleanup(func() {
+        ProcessDatagramsChannel = savedChannel
+        setPayloadLimits(PCM_SIGNED_16_BIT, savedLimits)
+    })
+    audio := makeUrtpDatagram(PCM_SIGNED_16_BIT, 1, make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+
+    for _, test := range []struct{scheme byte; length int; fault UrtpHeaderFault}{
+                            {PCM_SIGNED_16_BIT, 0, URTP_HEADER_UNDERSIZED_PAYLOAD},
+                            {PCM_SIGNED_16_BIT, URTP_SAMPLE_SIZE - 1, URTP_HEADER_UNDERSIZED_PAYLOAD},
+                            {PCM_SIGNED_16_BIT, URTP_SAMPLE_SIZE, URTP_HEADER_OK},
+                            {PCM_SIGNED_16_BIT, URTP_DATAGRAM_MAX_SIZE, URTP_HEADER_OK},
+                            {PCM_SIGNED_16_BIT, URTP_DATAGRAM_MAX_SIZE + 1, URTP_HEADER_OVERSIZED_PAYLOAD},
+                            {PCM_SIGNED_16_BIT_STEREO, URTP_SAMPLE_SIZE, URTP_HEADER_UNDERSIZED_PAYLOAD},
+                            {PCM_SIGNED_16_BIT_STEREO, URTP_SAMPLE_SIZE * 2, URTP_HEADER_OK},
+                            {UNICAM_COMPRESSED_8_BIT, 0, URTP_HEADER_UNDERSIZED_PAYLOAD},
+                            {UNICAM_COMPRESSED_8_BIT, unicamBlockPairSize(8) - 1, URTP_HEADER_UNDERSIZED_PAYLOAD},
+                            {UNICAM_COMPRESSED_8_BIT, unicamBlockPairSize(8), URTP_HEADER_OK},
+                            {UNICAM_COMPRESSED_8_BIT, URTP_DATAGRAM_MAX_SIZE + 1, URTP_HEADER_OVERSIZED_PAYLOAD},
+                            {UNICAM_COMPRESSED_10_BIT, unicamBlockPairSize(10) - 1, URTP_HEADER_UNDERSIZED_PAYLOAD},
+                            {UNICAM_COMPRESSED_10_BIT, unicamBlockPairSize(10), URTP_HEADER_OK},
+                            {URTP_HEARTBEAT, 0, URTP_HEADER_OK}} {
+        datagram := makeUrtpDatagram(test.scheme, 1, make([]byte, test.length))
+        fault := verifyUrtpHeader(datagram)
+        if fault != test.fault {
+            t.Fatalf("%d byte payload of audio coding scheme %d found to be %s when it is %s",
+                     test.length, test.scheme, fault.String(), test.fault.String())
+        }
+        if (test.scheme == URTP_HEARTBEAT) || (test.length > URTP_DATAGRAM_MAX_SIZE) {
+            continue
+        }
+        // Through TCP, followed by a good datagram which must always get through
+        newUrtpReassembler(nil).Handle(append(datagram, audio...))
+        expected := 1
+        if fault == URTP_HEADER_OK {
+            expected = 2
+        }
+        if len(channel) != expected {
+            t.Fatalf("%d datagram(s) got through TCP reassembly with a %d byte payload of audio coding scheme %d when %d should have",
+                     len(channel), test.length, test.scheme, expected)
+        }
+        for len(channel) > 0 {
+            <-channel
+        }
+    }
+
+    limits, err := parsePayloadLimits([]string{fmt.Sprintf("%d:%d:%d", PCM_SIGNED_16_BIT, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE,
+                                                           SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, bad := range []string{"0:2", "x:2:4", "0:4:2", fmt.Sprintf("0:0:%d", URTP_DATAGRAM_MAX_SIZE + 1)} {
+        if _, err := parsePayloadLimits([]string{bad}); err == nil {
+            t.Fatalf("payload limits \"%s\" accepted", bad)
+        }
+    }
+    setPayloadLimits(PCM_SIGNED_16_BIT, limits[PCM_SIGNED_16_BIT])
+    if (verifyUrtpHeader(audio) != URTP_HEADER_OK) ||
+       (verifyUrtpHeader(makeUrtpDatagram(PCM_SIGNED_16_BIT, 1, make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE - 2))) != URTP_HEADER_UNDERSIZED_PAYLOAD) {
+        t.Fatal("changed payload limits not applied")
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,135 @@
+/* Encoding straight into the segment files for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "hash"
+    "time"
+    "bytes"
+    "errors"
+    "crypto/sha256"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A segment which the MP3 audio is written into as it is encoded,
+// rather than being kept in memory until the segment is finished; the
+// ID3 tag is written when the segment is started, so it comes before the
+// audio, and the audio is written exactly as it comes out of the encoder,
+// so the first frame follows the tag as closely as it otherwise would
+type DirectSegment struct {
+    handle StoreFile
+    // The checksum of what has been written, nil if not wanted
+    hash hash.Hash
+    // The frames written, for the exact duration of the segment
+    frames Mp3FrameCounter
+    // The first error in writing the file, after which nothing more is
+    // written to it and the segment is dropped
+    err error
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Open the next segment, at the given offset from the start of the
+// stream, and write its ID3 tag, returning nil if it cannot be opened,
+// in which case its audio is lost
+func startDirectSegment(mp3Dir string, offset time.Duration, options AudioProcessingOptions) *DirectSegment {
+    var tag bytes.Buffer
+
+    handle := openMp3Segment(options.SegmentStore, segmentDirectory(mp3Dir, options))
+    if handle == nil {
+        return nil
+    }
+    segment := &DirectSegment{handle: handle}
+    if options.Checksums {
+        segment.hash = sha256.New()
+    }
+    segment.err = writeTag(&tag, offset, time.Time{}, options.Id3TimestampMode)
+    if segment.err == nil {
+        segment.writeFile(tag.Bytes())
+    }
+    return segment
+}
+
+// Write to the file of a segment, unless an earlier write has failed
+func (segment *DirectSegment) writeFile(data []byte) {
+    if segment.err != nil {
+        return
+    }
+    _, segment.err = segment.handle.Write(data)
+    if segment.err != nil {
+        log.Printf("Unable to write to segment \"%s\" (%s), it will be dropped.\n", segment.handle.Name(), segment.err.Error())
+    } else if segment.hash != nil {
+        segment.hash.Write(data)
+    }
+}
+
+// Write newly encoded MP3 audio to a segment; if the segment could not
+// be opened (segment is nil) the audio is lost
+func (segment *DirectSegment) Write(data []byte) {
+    if (segment == nil) || (len(data) == 0) {
+        return
+    }
+    segment.frames.Write(data)
+    segment.writeFile(data)
+}
+
+// Return the exact duration of the audio written to a segment and its
+// number of frames, read back from the frames as they were written
+func (segment *DirectSegment) Duration() (time.Duration, int, error) {
+    if segment == nil {
+        return 0, 0, errors.New("segment could not be opened")
+    }
+    return segment.frames.Duration()
+}
+
+// Throw a segment away, e.g. because what has been encoded into it is
+// not to be published after all
+func (segment *DirectSegment) Abandon(store FileStore) {
+    if segment == nil {
+        return
+    }
+    log.Printf("Abandoning segment \"%s\".\n", segment.handle.Name())
+    segment.handle.Close()
+    err := store.Remove(segment.handle.Name())
+    if err != nil {
+        log.Printf("Unable to remove abandoned segment \"%s\" (%s).\n", segment.handle.Name(), err.Error())
+    }
+}
+
+// Close the file of a finished segment and let the audio output channel
+// know of it; the segment is dropped if it could not be written
+func finishDirectSegment(job *SegmentJob, mp3Dir string, options AudioProcessingOptions) {
+    segment := job.direct
+    if segment.err != nil {
+        segment.Abandon(options.SegmentStore)
+        return
+    }
+    log.Printf("Closing segment \"%s\", %d millisecond(s) of MP3 audio.\n", segment.handle.Name(),
+               job.mp3AudioFile.duration / time.Millisecond)
+    // Closing may be where the file is written, e.g. to an object store
+    err := retryFileWrite(fmt.Sprintf("closing segment \"%s\"", segment.handle.Name()), segment.handle.Close)
+    if err != nil {
+        log.Printf("There was an error writing to \"%s\" (%s).\n", segment.handle.Name(), err.Error())
+        return
+    }
+    publishSegment(segment.handle, job.mp3AudioFile, segment.hash, mp3Dir, options)
+}
+
+/* End Of File */
@@ -0,0 +1,99 @@
+/* Tests of encoding straight into the segment files for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "time"
+    "bytes"
+    "testing"
+    "io/ioutil"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Encode hand-made frames into a segment a few bytes at a time, checking
+// that the file is the ID3 tag followed by exactly the frames, that their
+// duration is read back and that the segment is published with its
+// checksum, then check that an abandoned segment is removed
+func TestDirectSegments(t *testing.T) {
+    var tag bytes.Buffer
+    var audio []byte
+
+    var err error
+    dirName := t.TempDir()
+    channel := make(chan interface{}, 1)
+    savedChannel := MediaControlChannel
+    MediaControlChannel = channel
+    t.Cleanup(func() {
+        MediaControlChannel = savedChannel
+    })
+    options := AudioProcessingOptions{SegmentStore: OsFileStore{}, Id3TimestampMode: ID3_TIMESTAMP_TRANSPORT,
+                                      Checksums: true}
+
+    // MPEG-2 layer III, 32 kbits/s, 16 kHz, mono, as in TestMp3Durations()
+    frame := make([]byte, 144)
+    copy(frame, []byte{0xFF, 0xF3, 0x48, 0xC0})
+    for x := 0; x < 10; x++ {
+        audio = append(audio, frame...)
+    }
+    segment := startDirectSegment(dirName, time.Second, options)
+    if segment == nil {
+        t.Fatal("unable to start a segment")
+    }
+    for offset := 0; offset < len(audio); offset += 100 {
+        end := offset + 100
+        if end > len(audio) {
+            end = len(audio)
+        }
+        segment.Write(audio[offset:end])
+    }
+    duration, frames, err := segment.Duration()
+    if (err != nil) || (frames != 10) || (duration != 10 * 576 * time.Second / 16000) {
+        t.Fatalf("frames written to the segment read back as %d frame(s), %v (%v)", frames, duration, err)
+    }
+    finishDirectSegment(&SegmentJob{mp3AudioFile: &Mp3AudioFile{duration: duration}, direct: segment}, dirName, options)
+    var published *Mp3AudioFile
+    select {
+        case message := <-channel:
+            published, _ = message.(*Mp3AudioFile)
+        default:
+    }
+    if (published == nil) || (published.checksum == "") {
+        t.Fatal("segment not published with its checksum")
+    }
+    contents, err := ioutil.ReadFile(segment.handle.Name())
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeTag(&tag, time.Second, time.Time{}, options.Id3TimestampMode)
+    if !bytes.Equal(contents, append(tag.Bytes(), audio...)) {
+        t.Fatalf("segment of %d byte(s) is not the %d byte ID3 tag followed by the %d byte(s) of audio",
+                 len(contents), tag.Len(), len(audio))
+    }
+
+    segment = startDirectSegment(dirName, time.Second, options)
+    if segment == nil {
+        t.Fatal("unable to start a segment")
+    }
+    segment.Write(audio)
+    segment.Abandon(options.SegmentStore)
+    _, err = os.Stat(segment.handle.Name())
+    if !os.IsNotExist(err) {
+        t.Fatal("abandoned segment not removed")
+    }
+}
+
+/* End Of File */
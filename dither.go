@@ -0,0 +1,70 @@
+/* Dithering when requantising samples for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+    "sync"
+    "math/rand"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A source of triangular probability density function (TPDF) dither:
+// the difference of two independent uniform random values, spanning
+// plus or minus one least significant bit, which makes the error in
+// requantising a sample independent of the sample, so that low-level
+// detail becomes noise rather than distortion
+type Ditherer struct {
+    random *rand.Rand
+    // The ditherer is shared by the input and the processing of audio
+    access sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The ditherer used wherever samples are requantised to 16 bits, nil
+// if they are not dithered
+var ditherer *Ditherer
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a ditherer, seeding its random numbers with seed
+func createDitherer(seed int64) *Ditherer {
+    return &Ditherer{random: rand.New(rand.NewSource(seed))}
+}
+
+// Return the next value of dither, in least significant bits
+func (dither *Ditherer) Next() float64 {
+    dither.access.Lock()
+    defer dither.access.Unlock()
+    return dither.random.Float64() - dither.random.Float64()
+}
+
+// Requantise a sample to 16 bits, clamping it; if dither is nil the
+// sample is truncated, as it always used to be, else TPDF dither is
+// added and it is rounded
+func (dither *Ditherer) Quantise(sample float64) int16 {
+    if dither != nil {
+        sample = math.Floor(sample + dither.Next() + 0.5)
+    }
+    return int16(math.Max(math.Min(sample, math.MaxInt16), math.MinInt16))
+}
+
+/* End Of File */
@@ -0,0 +1,92 @@
+/* Tests of dithering when requantising samples for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of values of dither drawn by TestDither()
+const TEST_DITHER_VALUES int = 1000000
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the mean and variance of a set of values
+func meanAndVariance(values []float64) (float64, float64) {
+    var sum float64
+    var sumOfSquares float64
+
+    for _, value := range values {
+        sum += value
+    }
+    mean := sum / float64(len(values))
+    for _, value := range values {
+        sumOfSquares += (value - mean) * (value - mean)
+    }
+
+    return mean, sumOfSquares / float64(len(values))
+}
+
+// Draw dither and check that it has the statistics of TPDF dither of one
+// least significant bit: zero mean, a variance of 1/6, no value beyond
+// one bit and three quarters of them within half a bit; then requantise
+// low-level constant signals with it, checking that the error has zero
+// mean and a variance of 1/4 (that of the dither plus that of rounding)
+// whatever the signal, where truncation gives an error that depends on
+// the signal and no variance at all
+func TestDither(t *testing.T) {
+    dither := createDitherer(1)
+    values := make([]float64, TEST_DITHER_VALUES)
+    within := 0
+    for x := range values {
+        values[x] = dither.Next()
+        if math.Abs(values[x]) >= 1 {
+            t.Fatalf("dither value %f is a bit or more", values[x])
+        }
+        if math.Abs(values[x]) < 0.5 {
+            within++
+        }
+    }
+    mean, variance := meanAndVariance(values)
+    fraction := float64(within) / float64(len(values))
+    log.Printf("Test: dither has mean %f, variance %f, %f of values within half a bit.\n", mean, variance, fraction)
+    if (math.Abs(mean) > 0.002) || (math.Abs(variance - 1.0 / 6) > 0.002) || (math.Abs(fraction - 0.75) > 0.002) {
+        t.Fatalf("dither has mean %f, variance %f and %f of values within half a bit, not 0, 1/6 and 3/4",
+                 mean, variance, fraction)
+    }
+
+    for _, signal := range []float64{0, 0.3, 0.5, -0.7} {
+        for x := range values {
+            values[x] = float64(dither.Quantise(signal)) - signal
+        }
+        mean, variance = meanAndVariance(values)
+        if (math.Abs(mean) > 0.002) || (math.Abs(variance - 0.25) > 0.003) {
+            t.Fatalf("error in requantising %f with dither has mean %f and variance %f, not 0 and 1/4",
+                     signal, mean, variance)
+        }
+        var none *Ditherer
+        if none.Quantise(signal) != int16(signal) {
+            t.Fatalf("%f requantised without dither to %d, not truncated", signal, none.Quantise(signal))
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,25 @@
+//go:build embed_tzdata
+
+/* Embedding the time zone database for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+// Built with -tags embed_tzdata, the time zone database is embedded in
+// the binary (adding about 450 kbytes), so that PLAYLIST_TIME_ZONE can
+// be loaded on a host, e.g. a minimal container, which has none
+
+package main
+
+import (
+    _ "time/tzdata"
+)
+
+/* End Of File */
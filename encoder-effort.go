@@ -0,0 +1,156 @@
+/* Adaptive MP3 encoder effort for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Lowers the effort the MP3 encoder puts in (LAME's algorithm quality)
+// when the ticks of audio processing are persistently late, e.g. on a
+// busy shared host, and raises it again once they are back on time;
+// the effort is only changed between segments
+type EncoderEffort struct {
+    // The LAME qualities of each level of effort, the first being the
+    // configured quality (MP3_QUALITY_LAME_DEFAULT for LAME's choice)
+    qualities []int
+    level int
+    // The ticks, and the late ones, in the current segment
+    ticks int
+    lateTicks int
+    // The number of segments in a row without a late tick
+    calmSegments int
+}
+
+// The effort of the MP3 encoder, as served in Stats
+type EncoderEffortState struct {
+    // 0 for full effort, higher for less
+    Level int `json:"level"`
+    // The LAME algorithm quality in use, 0 (best) to 9 (fastest)
+    Quality int `json:"quality"`
+    // The number of times the effort has been lowered
+    Reductions int64 `json:"reductions"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// A tick serviced later than this is late
+const ENCODER_EFFORT_LATE_TICK time.Duration = time.Duration(BLOCK_DURATION_MS) * time.Millisecond
+
+// The fraction of the ticks of a segment which, if late, means that the
+// effort is lowered for the next segment
+const ENCODER_EFFORT_LATE_RATIO float64 = 0.1
+
+// The number of segments in a row without a late tick after which the
+// effort is raised again
+const ENCODER_EFFORT_CALM_SEGMENTS int = 6
+
+// The quality that LAME chooses if it is not told, for comparison with
+// the reduced qualities
+const LAME_DEFAULT_QUALITY int = 3
+
+// The value of Mp3EncoderOptions.Quality that leaves the choice to LAME
+const MP3_QUALITY_LAME_DEFAULT int = -1
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The LAME qualities to fall back to, in order, where they are lower
+// than the configured quality
+var encoderEffortReducedQualities = []int{5, 7, 9}
+
+// The current effort level, the LAME quality in use and the number of
+// reductions in effort, accessed atomically
+var encoderEffortLevel int64
+var mp3EncoderQuality int64
+var numEncoderEffortReductions int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create an adaptive encoder effort starting from the configured LAME
+// quality (MP3_QUALITY_LAME_DEFAULT for LAME's choice)
+func createEncoderEffort(quality int) *EncoderEffort {
+    effort := &EncoderEffort{qualities: []int{quality}}
+    base := quality
+    if base == MP3_QUALITY_LAME_DEFAULT {
+        base = LAME_DEFAULT_QUALITY
+    }
+    for _, reduced := range encoderEffortReducedQualities {
+        if reduced > base {
+            effort.qualities = append(effort.qualities, reduced)
+        }
+    }
+    atomic.StoreInt64(&encoderEffortLevel, 0)
+
+    return effort
+}
+
+// Count a tick of audio processing, serviced with the given latency
+func (effort *EncoderEffort) Tick(latency time.Duration) {
+    effort.ticks++
+    if latency > ENCODER_EFFORT_LATE_TICK {
+        effort.lateTicks++
+    }
+}
+
+// Called at the end of each segment, returning the LAME quality for the
+// next segment and true if it has changed
+func (effort *EncoderEffort) Segment() (int, bool) {
+    level := effort.level
+    if (effort.ticks > 0) && (float64(effort.lateTicks) / float64(effort.ticks) >= ENCODER_EFFORT_LATE_RATIO) {
+        effort.calmSegments = 0
+        if level < len(effort.qualities) - 1 {
+            level++
+            atomic.AddInt64(&numEncoderEffortReductions, 1)
+            log.Printf("%d of %d audio processing tick(s) late in the last segment, lowering MP3 encoder effort to level %d (quality %d).\n",
+                       effort.lateTicks, effort.ticks, level, effort.qualities[level])
+        }
+    } else if effort.lateTicks == 0 {
+        effort.calmSegments++
+        if (effort.calmSegments >= ENCODER_EFFORT_CALM_SEGMENTS) && (level > 0) {
+            effort.calmSegments = 0
+            level--
+            log.Printf("Audio processing back on time, raising MP3 encoder effort to level %d (quality %d).\n",
+                       level, effort.qualities[level])
+        }
+    } else {
+        effort.calmSegments = 0
+    }
+    effort.ticks = 0
+    effort.lateTicks = 0
+    changed := level != effort.level
+    effort.level = level
+    atomic.StoreInt64(&encoderEffortLevel, int64(level))
+
+    return effort.qualities[level], changed
+}
+
+// Return the effort of the MP3 encoder, for Stats
+func encoderEffortState() EncoderEffortState {
+    return EncoderEffortState{Level: int(atomic.LoadInt64(&encoderEffortLevel)),
+                              Quality: int(atomic.LoadInt64(&mp3EncoderQuality)),
+                              Reductions: atomic.LoadInt64(&numEncoderEffortReductions)}
+}
+
+/* End Of File */
@@ -0,0 +1,138 @@
+/* Detection of byte-swapped PCM for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "math/bits"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Works out, over the first few datagrams of PCM audio of a session,
+// whether the client has sent its samples little-endian, rather than
+// big-endian as URTP has them, which plays as loud static.  Audio
+// changes little from one sample to the next, most of its energy being
+// at low frequencies, whereas with the bytes swapped the low byte of
+// each sample becomes the high byte and the samples jump about at
+// random; so if the samples with their bytes swapped back change far
+// less from one to the next than the samples as sent, it is the latter
+// that are byte-swapped.  The decision is logged and, if the detector
+// is set to correct, the samples are swapped back from then on
+type EndiannessDetector struct {
+    correct bool
+    // The number of datagrams, with something other than silence in
+    // them, looked at so far
+    datagrams int
+    // The sums of the squared differences between successive samples
+    // of each channel, as sent and with their bytes swapped
+    asSent float64
+    swapped float64
+    decided bool
+    byteSwapped bool
+    // Datagrams may arrive on more than one connection at once
+    access sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of datagrams, not counting silent ones, looked at before
+// deciding whether the samples are byte-swapped
+const ENDIANNESS_DETECTION_DATAGRAMS int = 10
+
+// How many times more the samples as sent must change from one to the
+// next than those with their bytes swapped to be taken as byte-swapped;
+// for noise-like audio the two are much the same, so it is left alone
+const ENDIANNESS_DETECTION_RATIO float64 = 8
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The detector that the PCM decoders pass their samples through
+var endiannessDetector = createEndiannessDetector(false)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create an endianness detector which, if correct is true, swaps back
+// the bytes of samples that it has decided are byte-swapped, otherwise
+// just warns of them
+func createEndiannessDetector(correct bool) *EndiannessDetector {
+    return &EndiannessDetector{correct: correct}
+}
+
+// Return a sample with its bytes swapped
+func swapSampleBytes(sample int16) int16 {
+    return int16(bits.ReverseBytes16(uint16(sample)))
+}
+
+// Start again, for a new input session, which may be from a different
+// client
+func (detector *EndiannessDetector) Reset() {
+    detector.access.Lock()
+    defer detector.access.Unlock()
+    detector.datagrams = 0
+    detector.asSent = 0
+    detector.swapped = 0
+    detector.decided = false
+    detector.byteSwapped = false
+}
+
+// Look at the decoded samples of a datagram, with the given number of
+// channels interleaved, until it has been decided whether they are
+// byte-swapped, swapping back their bytes, in place, if they have been
+// and the detector corrects
+func (detector *EndiannessDetector) Check(audio *[]int16, channels int) {
+    detector.access.Lock()
+    defer detector.access.Unlock()
+    if !detector.decided && (audio != nil) {
+        var asSent float64
+        var swapped float64
+        for x := channels; x < len(*audio); x++ {
+            difference := float64((*audio)[x]) - float64((*audio)[x - channels])
+            asSent += difference * difference
+            difference = float64(swapSampleBytes((*audio)[x])) - float64(swapSampleBytes((*audio)[x - channels]))
+            swapped += difference * difference
+        }
+        if asSent + swapped > 0 {
+            detector.asSent += asSent
+            detector.swapped += swapped
+            detector.datagrams++
+        }
+        if detector.datagrams >= ENDIANNESS_DETECTION_DATAGRAMS {
+            detector.decided = true
+            detector.byteSwapped = detector.swapped * ENDIANNESS_DETECTION_RATIO < detector.asSent
+            if detector.byteSwapped {
+                if detector.correct {
+                    log.Printf("PCM samples look byte-swapped (sent little-endian?), swapping them back from now on.\n")
+                } else {
+                    log.Printf("WARNING: PCM samples look byte-swapped (sent little-endian?) and will sound like static; use --detect-endianness to swap them back.\n")
+                }
+            }
+        }
+    }
+    if detector.byteSwapped && detector.correct && (audio != nil) {
+        for x, sample := range *audio {
+            (*audio)[x] = swapSampleBytes(sample)
+        }
+    }
+}
+
+/* End Of File */
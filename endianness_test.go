@@ -0,0 +1,102 @@
+/* Tests of detection of byte-swapped PCM for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+    "testing"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The frequency and amplitude of the tone sent in TestEndianness()
+const TEST_ENDIANNESS_HZ float64 = 440
+
+const TEST_ENDIANNESS_AMPLITUDE float64 = 8000
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return true if it has been decided that the samples are byte-swapped
+func (detector *EndiannessDetector) ByteSwapped() bool {
+    detector.access.Lock()
+    defer detector.access.Unlock()
+    return detector.byteSwapped
+}
+
+// Send a tone through the PCM decoder big-endian, as it should be, then
+// little-endian, checking that only the latter is taken as byte-swapped,
+// that it is only swapped back if the detector corrects and then into
+// the tone as sent, and that silence decides nothing
+func TestEndianness(t *testing.T) {
+    savedDetector := endiannessDetector
+    t.Cleanup(func() {
+        endiannessDetector = savedDetector
+    })
+    // A datagram of the tone, starting at the given datagram
+    tone := func(datagram int, littleEndian bool) ([]byte, []int16) {
+        payload := make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)
+        samples := make([]int16, SAMPLES_PER_BLOCK)
+        for x := range samples {
+            phase := 2 * math.Pi * TEST_ENDIANNESS_HZ * float64(datagram * SAMPLES_PER_BLOCK + x) / float64(SAMPLING_FREQUENCY)
+            samples[x] = int16(TEST_ENDIANNESS_AMPLITUDE * math.Sin(phase))
+            if littleEndian {
+                binary.LittleEndian.PutUint16(payload[x * URTP_SAMPLE_SIZE:], uint16(samples[x]))
+            } else {
+                binary.BigEndian.PutUint16(payload[x * URTP_SAMPLE_SIZE:], uint16(samples[x]))
+            }
+        }
+        return payload, samples
+    }
+
+    for _, test := range []struct{littleEndian bool; correct bool}{{false, false}, {false, true}, {true, false}, {true, true}} {
+        endiannessDetector = createEndiannessDetector(test.correct)
+        silence := make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)
+        for x := 0; x < ENDIANNESS_DETECTION_DATAGRAMS * 2; x++ {
+            PcmDecoder{}.Decode(silence, nil)
+        }
+        if endiannessDetector.ByteSwapped() || endiannessDetector.decided {
+            t.Fatal("decided on the endianness of silence")
+        }
+        for x := 0; x <= ENDIANNESS_DETECTION_DATAGRAMS; x++ {
+            payload, samples := tone(x, test.littleEndian)
+            audio, _ := PcmDecoder{}.Decode(payload, nil)
+            if x < ENDIANNESS_DETECTION_DATAGRAMS {
+                continue
+            }
+            if endiannessDetector.ByteSwapped() != test.littleEndian {
+                t.Fatalf("tone sent little-endian %t taken as byte-swapped %t", test.littleEndian,
+                         endiannessDetector.ByteSwapped())
+            }
+            for y, sample := range samples {
+                if test.littleEndian && !test.correct {
+                    sample = swapSampleBytes(sample)
+                }
+                if (*audio)[y] != sample {
+                    t.Fatalf("sample %d decoded as %d, not %d (little-endian %t, correcting %t)",
+                             y, (*audio)[y], sample, test.littleEndian, test.correct)
+                }
+            }
+        }
+        endiannessDetector.Reset()
+        if endiannessDetector.ByteSwapped() {
+            t.Fatal("still byte-swapped after a reset")
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,146 @@
+/* Options from environment variables for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "errors"
+    "reflect"
+    "strconv"
+    "strings"
+    "github.com/jessevdk/go-flags"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// What the name of the environment variable of an option starts with,
+// the rest being its long name (or, for the positional arguments, its
+// name) in upper case with - replaced by _, e.g. IOC_MAX_SEGMENTS
+const ENV_OPTION_PREFIX string = "IOC_"
+
+// What separates the values of an option that may be given more than
+// once in its environment variable
+const ENV_OPTION_DELIMITER string = ","
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the name of the environment variable of an option
+func envOptionName(name string) string {
+    return ENV_OPTION_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Return the options set in environment variables as command-line
+// arguments, to go in front of those actually given so that those
+// override them; an option that may be given more than once is given as
+// values separated by ENV_OPTION_DELIMITER, which are left out if the
+// option is given on the command line (as parsed by commandLine) so
+// that they are replaced rather than added to, and a switch is given as
+// true or false
+func envOptionArgs(commandLine *flags.Parser) ([]string, error) {
+    var args []string
+
+    fields := reflect.TypeOf(Options{})
+    for x := 0; x < fields.NumField(); x++ {
+        name := fields.Field(x).Tag.Get("long")
+        if name == "" {
+            continue
+        }
+        value, ok := os.LookupEnv(envOptionName(name))
+        if !ok {
+            continue
+        }
+        switch fields.Field(x).Type.Kind() {
+            case reflect.Bool:
+                on, err := strconv.ParseBool(value)
+                if err != nil {
+                    return nil, errors.New(fmt.Sprintf("%s must be true or false, not \"%s\"", envOptionName(name), value))
+                }
+                if on {
+                    args = append(args, "--" + name)
+                }
+            case reflect.Slice:
+                if commandLine.FindOptionByLongName(name).IsSet() {
+                    continue
+                }
+                for _, value := range strings.Split(value, ENV_OPTION_DELIMITER) {
+                    args = append(args, "--" + name + "=" + value)
+                }
+            default:
+                args = append(args, "--" + name + "=" + value)
+        }
+    }
+
+    return args, nil
+}
+
+// Return the values of the positional arguments set in the
+// environment, by name
+func envPositionalArgs() map[string]string {
+    args := make(map[string]string)
+    fields := reflect.TypeOf(Options{}.Required)
+    for x := 0; x < fields.NumField(); x++ {
+        name := fields.Field(x).Tag.Get("positional-arg-name")
+        value, ok := os.LookupEnv(envOptionName(name))
+        if ok {
+            args[name] = value
+        }
+    }
+    return args
+}
+
+// Create a parser of the options; if any positional argument is set in
+// the environment then the positional arguments are not required on the
+// command line, see fillEnvPositionalArgs()
+func createOptionsParser(options *Options) *flags.Parser {
+    parser := flags.NewParser(options, flags.Default)
+    if len(envPositionalArgs()) > 0 {
+        parser.Command.ArgsRequired = false
+    }
+    return parser
+}
+
+// Fill in the positional arguments not given on the command line from
+// the environment, returning an error naming any that are still missing
+func fillEnvPositionalArgs(options *Options) error {
+    var missing []string
+
+    envArgs := envPositionalArgs()
+    if len(envArgs) == 0 {
+        // Required on the command line, which go-flags has checked
+        return nil
+    }
+    fields := reflect.ValueOf(&options.Required).Elem()
+    for x := 0; x < fields.NumField(); x++ {
+        name := fields.Type().Field(x).Tag.Get("positional-arg-name")
+        if fields.Field(x).String() == "" {
+            fields.Field(x).SetString(envArgs[name])
+        }
+        if fields.Field(x).String() == "" {
+            missing = append(missing, fmt.Sprintf("`%s` (or %s)", name, envOptionName(name)))
+        }
+    }
+    if len(missing) > 0 {
+        err := errors.New(fmt.Sprintf("the required argument(s) %s were not provided", strings.Join(missing, ", ")))
+        fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+        return err
+    }
+
+    return nil
+}
+
+/* End Of File */
@@ -0,0 +1,79 @@
+/* Tests of options from environment variables for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "reflect"
+    "os"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Give options in a configuration file, the environment and on the
+// command line, checking that each overrides the one before, that a
+// list from the environment replaces that from the file and that the
+// positional arguments may come from the environment, the command line
+// still taking precedence
+func TestEnvOptions(t *testing.T) {
+    var options Options
+
+    var err error
+    dirName := t.TempDir()
+    configFile := filepath.Join(dirName, "ioc.ini")
+    err = ioutil.WriteFile(configFile, []byte("[Application Options]\ntitle = File\nartist = File\ngenre = File\n" +
+                                              "allow-source = 10.0.0.0/8\nmax-segments = 7\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    environment := map[string]string{"CONFIG": configFile, "ARTIST": "Env", "GENRE": "Env", "TCP": "true", "CLEAR": "false",
+                                     "ALLOW_SOURCE": "192.168.0.0/16,172.16.0.0/12", "INPUT_PORT": "5065",
+                                     "OUTPUT_PORT": "8080", "PLAYLISTPATH": "/tmp/env.m3u8"}
+    for name, value := range environment {
+        saved, wasSet := os.LookupEnv(ENV_OPTION_PREFIX + name)
+        os.Setenv(ENV_OPTION_PREFIX + name, value)
+        if wasSet {
+            defer os.Setenv(ENV_OPTION_PREFIX + name, saved)
+        } else {
+            defer os.Unsetenv(ENV_OPTION_PREFIX + name)
+        }
+    }
+
+    err = parseOptionArgs(&options, []string{"--genre", "Flag"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if (options.Title != "File") || (options.Artist != "Env") || (options.Genre != "Flag") || !options.UseTcp ||
+       (options.MaxSegments != 7) || !reflect.DeepEqual(options.AllowSource, []string{"192.168.0.0/16", "172.16.0.0/12"}) {
+        t.Fatalf("title \"%s\", artist \"%s\", genre \"%s\", TCP %t, max segments %d, allowed sources %v not as the precedence of flags, environment and file would have them",
+                 options.Title, options.Artist, options.Genre, options.UseTcp, options.MaxSegments,
+                 options.AllowSource)
+    }
+    if (options.Required.In != "5065") || (options.Required.Out != "8080") || (options.Required.PlaylistPath != "/tmp/env.m3u8") {
+        t.Fatalf("positional arguments %+v not taken from the environment", options.Required)
+    }
+    options = Options{}
+    err = parseOptionArgs(&options, []string{"1234", "8443"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if (options.Required.In != "1234") || (options.Required.Out != "8443") || (options.Required.PlaylistPath != "/tmp/env.m3u8") {
+        t.Fatalf("positional arguments %+v not taken from the command line first", options.Required)
+    }
+}
+
+/* End Of File */
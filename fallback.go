@@ -0,0 +1,135 @@
+/* Fallback audio for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "errors"
+    "io/ioutil"
+    "github.com/u-blox/ioc-server/lame"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Pre-recorded audio, e.g. hold music or a station ident, played on a
+// loop in place of the live audio while there is no input
+type FallbackAudio struct {
+    // The audio, as mono PCM at SAMPLING_FREQUENCY, ready for pcmAudio
+    pcm []byte
+    // Where the loop has got to in pcm
+    position int
+    // True while the fallback audio is being played
+    playing bool
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Load fallback audio from an MP3 file, mixing it down to mono and
+// resampling it to SAMPLING_FREQUENCY if necessary
+func loadFallbackAudio(fileName string) (*FallbackAudio, error) {
+    var samples []int16
+
+    mp3, err := ioutil.ReadFile(fileName)
+    if err != nil {
+        return nil, err
+    }
+    decoded, err := lame.Decode(mp3)
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("Fallback audio \"%s\" is %d sample(s) at %d Hz, %d channel(s).\n",
+               fileName, len(decoded.Left), decoded.SampleRate, decoded.Channels)
+    samples = decoded.Left
+    if len(decoded.Right) == len(decoded.Left) {
+        samples = make([]int16, len(decoded.Left))
+        for x := range samples {
+            samples[x] = int16((int(decoded.Left[x]) + int(decoded.Right[x])) / 2)
+        }
+    }
+    if decoded.SampleRate != SAMPLING_FREQUENCY {
+        samples = resample(samples, decoded.SampleRate, SAMPLING_FREQUENCY)
+    }
+    if len(samples) == 0 {
+        return nil, errors.New("too short to play")
+    }
+
+    return &FallbackAudio{pcm: samplesToBytes(samples)}, nil
+}
+
+// Resample audio by linear interpolation; this is not band-limited but
+// is good enough for hold music
+func resample(samples []int16, fromRate int, toRate int) []int16 {
+    resampled := make([]int16, int(int64(len(samples)) * int64(toRate) / int64(fromRate)))
+
+    for x := range resampled {
+        position := float64(x) * float64(fromRate) / float64(toRate)
+        y := int(position)
+        fraction := position - float64(y)
+        sample := float64(samples[y])
+        if y + 1 < len(samples) {
+            sample += (float64(samples[y + 1]) - sample) * fraction
+        }
+        resampled[x] = int16(sample)
+    }
+
+    return resampled
+}
+
+// Return the next given number of samples of the fallback audio,
+// going back to the start of the loop as necessary
+func (fallback *FallbackAudio) Next(numSamples int) []byte {
+    audio := make([]byte, 0, numSamples * URTP_SAMPLE_SIZE)
+
+    for len(audio) < cap(audio) {
+        length := cap(audio) - len(audio)
+        if length > len(fallback.pcm) - fallback.position {
+            length = len(fallback.pcm) - fallback.position
+        }
+        audio = append(audio, fallback.pcm[fallback.position:fallback.position + length]...)
+        fallback.position += length
+        if fallback.position >= len(fallback.pcm) {
+            fallback.position = 0
+        }
+    }
+
+    return audio
+}
+
+// Called on each tick of audio processing with whether the input is
+// idle, returning the fallback audio (if any) to be written to the audio
+// buffer and whether the audio has switched to or from the fallback
+func (fallback *FallbackAudio) Tick(idle bool) ([]byte, bool) {
+    var switched bool
+
+    if idle != fallback.playing {
+        if idle {
+            log.Printf("Input idle, switching to the fallback audio.\n")
+            fallback.position = 0
+        } else {
+            log.Printf("Input active, switching back to the live audio.\n")
+        }
+        fallback.playing = idle
+        switched = true
+    }
+    if idle {
+        return fallback.Next(SAMPLES_PER_BLOCK), switched
+    }
+
+    return nil, switched
+}
+
+/* End Of File */
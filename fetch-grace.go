@@ -0,0 +1,85 @@
+/* Keeping segments until they have been fetched, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+    "net/http"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// True if the segments that have been served are being noted, for
+// AudioOutOptions.RetentionUntilFetched
+var segmentFetchTracking bool
+
+// The URL paths of the segments that have been served at least once
+var fetchedSegments = make(map[string]bool)
+var fetchedSegmentAccess sync.Mutex
+
+// The number of segments deleted at AudioOutOptions.RetentionUntilFetched
+// without ever having been fetched, accessed atomically
+var numSegmentsExpiredUnfetched int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Note that a segment has been served, given the status of the response:
+// a redirect (e.g. to an object store) or a not modified counts, since
+// the client has what it needs
+func noteSegmentServed(urlPath string, status int) {
+    if segmentFetchTracking && (status > 0) && (status < http.StatusBadRequest) {
+        fetchedSegmentAccess.Lock()
+        fetchedSegments[urlPath] = true
+        fetchedSegmentAccess.Unlock()
+    }
+}
+
+// Return true if the segment at a file path has been served
+func segmentFetched(filePath string) bool {
+    fetchedSegmentAccess.Lock()
+    defer fetchedSegmentAccess.Unlock()
+    return fetchedSegments[playlistUrl(filePath)]
+}
+
+// Forget whether the segment at a file path has been served
+func forgetSegmentFetched(filePath string) {
+    fetchedSegmentAccess.Lock()
+    delete(fetchedSegments, playlistUrl(filePath))
+    fetchedSegmentAccess.Unlock()
+}
+
+// Return true if a segment, listed in no playlist and past the retention
+// time, may be deleted: always, unless the segments are to be kept until
+// they have been fetched, in which case only if it has been or it has
+// reached options.RetentionUntilFetched
+func retentionOver(mp3AudioFile *Mp3AudioFile, filePath string, options AudioOutOptions) bool {
+    if (options.RetentionUntilFetched <= options.Retention) || segmentFetched(filePath) {
+        return true
+    }
+    if time.Now().Sub(mp3AudioFile.timestamp) > options.RetentionUntilFetched {
+        expired := atomic.AddInt64(&numSegmentsExpiredUnfetched, 1)
+        log.Printf("MP3 file \"%s\" was never fetched but has reached %s (%d such segment(s) so far).\n",
+                   filePath, options.RetentionUntilFetched.String(), expired)
+        return true
+    }
+    return false
+}
+
+/* End Of File */
@@ -0,0 +1,102 @@
+/* Tests of keeping segments until they have been fetched, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "errors"
+    "testing"
+    "sync/atomic"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Age segments past the retention time, one of which has been fetched,
+// checking that only it and one past the longest it may be kept waiting
+// are deleted, then that the other goes once it has been fetched too
+func TestFetchGrace(t *testing.T) {
+    var err error
+    dirName := t.TempDir()
+    var store OsFileStore
+    options := AudioOutOptions{PlaylistStore: store, SegmentStore: store, PlaylistWindow: time.Second * 20,
+                               Retention: time.Second * 20, RetentionUntilFetched: time.Minute}
+    playlistAccess.Lock()
+    savedPlaylists := playlists
+    playlists = createPlaylists(filepath.Join(dirName, "live" + PLAYLIST_EXTENSION),
+                                PlaylistConfig{Window: options.PlaylistWindow}, nil)
+    playlistAccess.Unlock()
+    mp3FileList.Init()
+    segmentFetchTracking = true
+    t.Cleanup(func() {
+        segmentFetchTracking = false
+        mp3FileList.Init()
+        playlistAccess.Lock()
+        playlists = savedPlaylists
+        playlistAccess.Unlock()
+    })
+    // Two segments 30 seconds old and one two minutes old
+    for x, age := range []time.Duration{time.Second * 30, time.Second * 30, time.Minute * 2} {
+        fileName := fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION)
+        err = writeStoreFile(store, filepath.Join(dirName, fileName), []byte("MP3"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        addMp3File(&Mp3AudioFile{fileName: fileName, timestamp: time.Now().Add(-age), duration: time.Second * 5},
+                   options, false)
+    }
+    fetch := func(fileName string) {
+        filePath := filepath.Join(dirName, fileName)
+        streamHandler(httptest.NewRecorder(), httptest.NewRequest("GET", playlistUrl(filePath), nil), store, store, "")
+    }
+    exist := func(expected ...bool) error {
+        for x, exists := range expected {
+            filePath := filepath.Join(dirName, fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION))
+            _, err := os.Stat(filePath)
+            if (err == nil) != exists {
+                return errors.New(fmt.Sprintf("\"%s\" exists %t when it should be %t", filePath, err == nil, exists))
+            }
+        }
+        return nil
+    }
+
+    fetch("1" + SEGMENT_EXTENSION)
+    expired := atomic.LoadInt64(&numSegmentsExpiredUnfetched)
+    ageMp3Files(dirName, options, false)
+    err = exist(true, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if atomic.LoadInt64(&numSegmentsExpiredUnfetched) != expired + 1 {
+        t.Fatal("segment deleted without being fetched not counted")
+    }
+    fetch("0" + SEGMENT_EXTENSION)
+    ageMp3Files(dirName, options, false)
+    err = exist(false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    fetchedSegmentAccess.Lock()
+    remembered := len(fetchedSegments)
+    fetchedSegmentAccess.Unlock()
+    if remembered != 0 {
+        t.Fatalf("%d deleted segment(s) still remembered as fetched", remembered)
+    }
+}
+
+/* End Of File */
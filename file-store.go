@@ -0,0 +1,225 @@
+/* Storage of the playlist and segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "io"
+    "io/ioutil"
+    "time"
+    "bytes"
+    "net/http"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A file being written to a FileStore
+type StoreFile interface {
+    io.WriteCloser
+    Name() string
+}
+
+// Somewhere to keep the playlist and segments; names are paths, which
+// are also the URL paths at which the files are served
+type FileStore interface {
+    // Create a file, replacing any file of the same name; the file
+    // appears in the store once it has been closed
+    Create(name string) (StoreFile, error)
+    // Open a file for reading
+    Open(name string) (io.ReadCloser, error)
+    // Remove a file
+    Remove(name string) error
+    // Serve a file in response to an HTTP request
+    ServeContent(out http.ResponseWriter, in *http.Request, name string)
+}
+
+// A FileStore that can choose a unique name for a new segment
+type SegmentNamer interface {
+    SegmentName(dirName string) (string, error)
+}
+
+// The FileStore of the local filesystem
+type OsFileStore struct{}
+
+// A file on disk which is written under a temporary name and renamed
+// over the file it replaces when it is closed, so that a reader never
+// sees it part way through being written
+type AtomicFile struct {
+    *os.File
+    name string
+}
+
+// The FileStore of in-memory segments
+type MemoryFileStore struct{}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a unique name for a new segment in the given directory of a store
+func newSegmentName(store FileStore, dirName string) (string, error) {
+    namer, ok := store.(SegmentNamer)
+    if ok {
+        return namer.SegmentName(dirName)
+    }
+    return filepath.Join(dirName, fmt.Sprintf("%d%s", time.Now().UnixNano(), SEGMENT_EXTENSION)), nil
+}
+
+// Read a whole file from a store
+func readStoreFile(store FileStore, name string) ([]byte, error) {
+    var contents bytes.Buffer
+
+    handle, err := store.Open(name)
+    if err == nil {
+        _, err = contents.ReadFrom(handle)
+        handle.Close()
+    }
+    return contents.Bytes(), err
+}
+
+// Write a whole file to a store
+func writeStoreFile(store FileStore, name string, data []byte) error {
+    handle, err := store.Create(name)
+    if err == nil {
+        _, err = handle.Write(data)
+        err1 := handle.Close()
+        if err == nil {
+            err = err1
+        }
+    }
+    return err
+}
+
+// Reserve a unique segment file name in a directory by creating the
+// (empty) file, creating the directory first if necessary
+func (OsFileStore) SegmentName(dirName string) (string, error) {
+    return reserveSegmentName(dirName, os.Rename)
+}
+
+// Reserve a unique segment file name in a directory, see
+// OsFileStore.SegmentName(), giving the temporary file that reserves it
+// the segment extension with rename(); if that fails the temporary file
+// is removed, so that nothing is left behind for the failed segment
+func reserveSegmentName(dirName string, rename func(string, string) error) (string, error) {
+    err := os.MkdirAll(dirName, 0755)
+    if err != nil {
+        return "", err
+    }
+    handle, err := ioutil.TempFile(dirName, "")
+    if err != nil {
+        return "", err
+    }
+    filePath := handle.Name()
+    handle.Close()
+    err = rename(filePath, filePath + SEGMENT_EXTENSION)
+    if err != nil {
+        log.Printf("Unable to rename temporary file \"%s\" to \"%s\".\n", filePath, filePath + SEGMENT_EXTENSION)
+        os.Remove(filePath)
+        return "", err
+    }
+    return filePath + SEGMENT_EXTENSION, nil
+}
+
+// Create a file on disk; segments, which always have new names, are
+// written in place while other files (e.g. the playlist) are replaced
+// atomically, see AtomicFile
+func (OsFileStore) Create(name string) (StoreFile, error) {
+    if filepath.Ext(name) != SEGMENT_EXTENSION {
+        handle, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name) + ".*.tmp")
+        if err != nil {
+            return nil, err
+        }
+        return &AtomicFile{File: handle, name: name}, nil
+    }
+    handle, err := os.Create(name)
+    if err != nil {
+        // Careful not to return a nil *os.File as a non-nil interface
+        return nil, err
+    }
+    return handle, nil
+}
+
+// Return the name of the file an AtomicFile will replace
+func (file *AtomicFile) Name() string {
+    return file.name
+}
+
+// Close an AtomicFile, renaming it over the file it replaces; on Windows
+// this fails while the file being replaced is open elsewhere, so the
+// caller should be prepared to retry
+func (file *AtomicFile) Close() error {
+    err := file.File.Close()
+    if err == nil {
+        err = os.Rename(file.File.Name(), file.name)
+    }
+    if err != nil {
+        os.Remove(file.File.Name())
+    }
+    return err
+}
+
+// Open a file on disk
+func (OsFileStore) Open(name string) (io.ReadCloser, error) {
+    return os.Open(name)
+}
+
+// Remove a file from disk, dropping it from the segment cache first
+func (OsFileStore) Remove(name string) error {
+    uncacheSegment(name)
+    return os.Remove(name)
+}
+
+// Serve a file from disk, segments through the segment cache
+func (OsFileStore) ServeContent(out http.ResponseWriter, in *http.Request, name string) {
+    if filepath.Ext(name) == SEGMENT_EXTENSION {
+        serveCachedSegment(out, in, name)
+    } else {
+        http.ServeFile(out, in, name)
+    }
+}
+
+// Create a segment in memory
+func (MemoryFileStore) Create(name string) (StoreFile, error) {
+    log.Printf("Opened in-memory segment \"%s\" for MP3 output.\n", name)
+    return &MemorySegment{name: name}, nil
+}
+
+// Open a segment in memory
+func (MemoryFileStore) Open(name string) (io.ReadCloser, error) {
+    memorySegmentAccess.Lock()
+    data, found := memorySegments[filepath.Base(name)]
+    memorySegmentAccess.Unlock()
+    if !found {
+        return nil, os.ErrNotExist
+    }
+    return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Remove a segment from memory; it may already have been dropped under
+// memory pressure, which is not an error
+func (MemoryFileStore) Remove(name string) error {
+    removeMemorySegment(name)
+    return nil
+}
+
+// Serve a segment from memory
+func (MemoryFileStore) ServeContent(out http.ResponseWriter, in *http.Request, name string) {
+    serveMemorySegment(out, in, name)
+}
+
+/* End Of File */
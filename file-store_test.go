@@ -0,0 +1,196 @@
+/* Tests of storage of the playlist and segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "bytes"
+    "errors"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The FileStore of the local filesystem, except that the given number
+// of renames, when reserving a segment name, fail
+type RenameFailingFileStore struct {
+    OsFileStore
+    failures int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of readers, and the number of updates, in TestPlaylistSwap()
+const TEST_PLAYLIST_READERS int = 4
+
+const TEST_PLAYLIST_UPDATES int = 500
+
+// The line with which the playlists written by TestPlaylistSwap() end
+const TEST_PLAYLIST_END string = "#EXT-X-ENDLIST\r\n"
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Replace a playlist in a tight loop while readers read it, failing
+// if a reader ever sees anything other than a whole playlist
+func TestPlaylistSwap(t *testing.T) {
+    var store OsFileStore
+    var waitGroup sync.WaitGroup
+    var readErr error
+    var readErrAccess sync.Mutex
+
+    var err error
+    dirName := t.TempDir()
+    fileName := filepath.Join(dirName, "test" + PLAYLIST_EXTENSION)
+    playlist := func(update int) []byte {
+        var contents bytes.Buffer
+        fmt.Fprintf(&contents, "#EXTM3U\r\n#EXT-X-MEDIA-SEQUENCE:%d\r\n", update)
+        // Vary the length so that a partial read would show
+        for x := 0; x < update % 50; x++ {
+            fmt.Fprintf(&contents, "#EXTINF:4.968000, Test\r\n%d%s\r\n", x, SEGMENT_EXTENSION)
+        }
+        contents.WriteString(TEST_PLAYLIST_END)
+        return contents.Bytes()
+    }
+    err = writeStoreFile(store, fileName, playlist(0))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    done := make(chan struct{})
+    for x := 0; x < TEST_PLAYLIST_READERS; x++ {
+        waitGroup.Add(1)
+        go func() {
+            defer waitGroup.Done()
+            for {
+                select {
+                    case <-done:
+                        return
+                    default:
+                }
+                contents, err := ioutil.ReadFile(fileName)
+                if (err == nil) && (!bytes.HasPrefix(contents, []byte("#EXTM3U\r\n")) ||
+                                    !bytes.HasSuffix(contents, []byte(TEST_PLAYLIST_END))) {
+                    err = errors.New(fmt.Sprintf("read a partial playlist of %d byte(s)", len(contents)))
+                }
+                if err != nil {
+                    readErrAccess.Lock()
+                    readErr = err
+                    readErrAccess.Unlock()
+                    return
+                }
+            }
+        }()
+    }
+    for update := 1; (update <= TEST_PLAYLIST_UPDATES) && (err == nil); update++ {
+        err = retryFileWrite("writing test playlist", func() error {
+            return writeStoreFile(store, fileName, playlist(update))
+        })
+    }
+    close(done)
+    waitGroup.Wait()
+    if err == nil {
+        err = readErr
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Reserve a segment name, failing the rename if there are failures left
+func (store *RenameFailingFileStore) SegmentName(dirName string) (string, error) {
+    return reserveSegmentName(dirName, func(from string, to string) error {
+        if store.failures > 0 {
+            store.failures--
+            return errors.New("simulated rename failure")
+        }
+        return os.Rename(from, to)
+    })
+}
+
+// Return the names of the files in a directory
+func fileNamesIn(dirName string) ([]string, error) {
+    var names []string
+
+    entries, err := os.ReadDir(dirName)
+    for _, entry := range entries {
+        names = append(names, entry.Name())
+    }
+    return names, err
+}
+
+// Write segments to a store whose renames fail every time a segment is
+// opened, then recover, failing if a segment is published that is not
+// on disk, if the segment that could not be opened is published, or if
+// anything is left behind for it
+func TestSegmentRenameFailure(t *testing.T) {
+    channel := make(chan interface{}, 10)
+    savedChannel := MediaControlChannel
+    MediaControlChannel = channel
+    t.Cleanup(func() {
+        MediaControlChannel = savedChannel
+    })
+    mp3Dir := t.TempDir()
+    store := &RenameFailingFileStore{failures: FILE_WRITE_ATTEMPTS}
+    options := AudioProcessingOptions{SegmentStore: store, Id3TimestampMode: ID3_TIMESTAMP_NONE}
+    newJob := func() *SegmentJob {
+        return &SegmentJob{audio: []byte("MP3"), mp3AudioFile: &Mp3AudioFile{timestamp: time.Now(), duration: time.Second}}
+    }
+
+    // Every attempt to open the first segment fails
+    mp3Handle := openMp3Segment(store, mp3Dir)
+    if mp3Handle != nil {
+        t.Fatalf("segment \"%s\" opened when every rename failed", mp3Handle.Name())
+    }
+    if names, err := fileNamesIn(mp3Dir); (err != nil) || (len(names) > 0) {
+        t.Fatalf("%v left behind by the segment that could not be opened (%v)", names, err)
+    }
+
+    // So its audio is lost, the next segment being opened now that renames work
+    mp3Handle = writeSegment(mp3Handle, newJob(), mp3Dir, options)
+    if mp3Handle == nil {
+        t.Fatal("segment not opened once renames work")
+    }
+    if len(channel) > 0 {
+        t.Fatalf("segment that could not be opened published as %+v", <-channel)
+    }
+    mp3Handle = writeSegment(mp3Handle, newJob(), mp3Dir, options)
+    if mp3Handle == nil {
+        t.Fatal("segment not opened after the last")
+    }
+    mp3Handle.Close()
+    if len(channel) != 1 {
+        t.Fatalf("%d segment(s) published when there should be 1", len(channel))
+    }
+    mp3AudioFile := (<-channel).(*Mp3AudioFile)
+    contents, err := ioutil.ReadFile(filepath.Join(mp3Dir, mp3AudioFile.fileName))
+    if (err != nil) || (string(contents) != "MP3") {
+        t.Fatalf("segment published as \"%s\" is not on disk as written (%v)", mp3AudioFile.fileName, err)
+    }
+    // Which, with the segment opened after it, is all there is
+    if names, err := fileNamesIn(mp3Dir); (err != nil) || (len(names) != 2) {
+        t.Fatalf("%v on disk when there should be two segments (%v)", names, err)
+    }
+}
+
+/* End Of File */
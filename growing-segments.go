@@ -0,0 +1,72 @@
+/* Serving the segment being encoded as it grows for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "net/http"
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// True if the segment being encoded is served as it grows, see
+// growingSegmentHandler()
+var growingSegmentRanges bool
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the entity tag of a growing segment; it stays the same as the
+// segment grows, since the bytes already there never change, and only
+// changes if the segment is started again
+func growingSegmentEtag(sequence int, generation int) string {
+    return fmt.Sprintf("\"growing-%d-%d\"", sequence, generation)
+}
+
+// If the request is for the segment being encoded (or one waiting to be
+// written out), serve what there is of it so far, returning true; range
+// requests fetch the tail as it grows, one beyond what there is yet being
+// refused as unsatisfiable, and a request without a range gets the
+// segment so far with its length.  What is served is exactly what will be
+// written, so bytes once served never change; if the segment is started
+// again (e.g. after an encoder fault) its entity tag changes, so that a
+// client using If-Range is given the whole of the new segment rather than
+// a tail that does not fit what it already has.  Once the segment has been
+// published it is served like any other, without the entity tag.  Returns
+// false if the request is not for such a segment
+func growingSegmentHandler(out http.ResponseWriter, in *http.Request) bool {
+    chunkedSegmentAccess.Lock()
+    sequence, segment := chunkedSegmentAt(in.URL.Path)
+    if segment == nil {
+        chunkedSegmentAccess.Unlock()
+        return false
+    }
+    data := append([]byte(nil), segment.data...)
+    etag := growingSegmentEtag(sequence, segment.generation)
+    chunkedSegmentAccess.Unlock()
+    log.Printf("Serving growing segment \"%s\", %d byte(s) so far, to %s.\n", in.URL.Path, len(data), in.RemoteAddr)
+    out.Header().Set("Content-Type","audio/mpeg")
+    // Not to be cached, it will be longer next time
+    out.Header().Set("Cache-Control","no-store")
+    out.Header().Set("ETag", etag)
+    http.ServeContent(out, in, in.URL.Path, time.Time{}, bytes.NewReader(data))
+    return true
+}
+
+/* End Of File */
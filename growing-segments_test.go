@@ -0,0 +1,89 @@
+/* Tests of serving the segment being encoded as it grows for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Fetch a segment as it grows, by ranges, checking that each range gets
+// the new tail, that a range beyond the end is refused, that a client
+// whose segment is started again is given the whole of the new one and
+// that a published segment is left to be served normally
+func TestGrowingSegments(t *testing.T) {
+    fetch := func(byteRange string, ifRange string) *httptest.ResponseRecorder {
+        response := httptest.NewRecorder()
+        request := httptest.NewRequest("GET", "/hls/0.ts", nil)
+        if byteRange != "" {
+            request.Header.Set("Range", byteRange)
+        }
+        if ifRange != "" {
+            request.Header.Set("If-Range", ifRange)
+        }
+        if !growingSegmentHandler(response, request) {
+            response.Code = 0
+        }
+        return response
+    }
+
+    chunkedSegmentAccess.Lock()
+    chunkedSegments = make(map[int]*ChunkedSegment)
+    chunkedSegmentAccess.Unlock()
+    t.Cleanup(func() {
+        chunkedSegmentAccess.Lock()
+        chunkedSegments = make(map[int]*ChunkedSegment)
+        chunkedSegmentAccess.Unlock()
+    })
+
+    startChunkedSegment(0, []byte("ID3"))
+    nameChunkedSegment(0, "0.ts")
+    appendChunkedSegment(0, []byte("one"))
+    response := fetch("", "")
+    etag := response.Header().Get("ETag")
+    if (response.Code != http.StatusOK) || (response.Body.String() != "ID3one") || (etag == "") {
+        t.Fatalf("growing segment served as %d \"%s\", entity tag %s", response.Code,
+                 response.Body.String(), etag)
+    }
+    appendChunkedSegment(0, []byte("two"))
+    response = fetch("bytes=6-", etag)
+    if (response.Code != http.StatusPartialContent) || (response.Body.String() != "two") {
+        t.Fatalf("tail of growing segment served as %d \"%s\"", response.Code, response.Body.String())
+    }
+    response = fetch("bytes=9-", etag)
+    if response.Code != http.StatusRequestedRangeNotSatisfiable {
+        t.Fatalf("range beyond the end of growing segment served as %d \"%s\"", response.Code,
+                 response.Body.String())
+    }
+
+    // Started again, the bytes already served no longer fit
+    startChunkedSegment(0, []byte("ID3"))
+    appendChunkedSegment(0, []byte("new"))
+    response = fetch("bytes=6-", etag)
+    if (response.Code != http.StatusOK) || (response.Body.String() != "ID3new") {
+        t.Fatalf("growing segment that was started again served as %d \"%s\" to a client of the old one",
+                 response.Code, response.Body.String())
+    }
+
+    endChunkedSegment(0, true)
+    if fetch("", "").Code != 0 {
+        t.Fatal("published segment served as a growing segment")
+    }
+}
+
+/* End Of File */
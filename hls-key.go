@@ -0,0 +1,111 @@
+/* HLS AES-128 segment encryption for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "errors"
+    "net/http"
+    "io/ioutil"
+    "crypto/aes"
+    "crypto/cipher"
+    "encoding/hex"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL path at which the segment key is served, as given in the
+// URI attribute of #EXT-X-KEY
+const HLS_KEY_PATH string = "/hls.key"
+
+// The size of an AES-128 key and of the IV
+const HLS_KEY_SIZE int = 16
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The first half of every IV, the time at which this server started,
+// so that IVs are not repeated across restarts with the same key
+var hlsIvEpoch = uint64(time.Now().Unix())
+
+// The number of segments encrypted, the second half of the IV; only
+// touched by the segment writer
+var numEncryptedSegments uint64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Load an AES-128 key from a file of 16 raw bytes, e.g. as made by
+// "openssl rand 16 > hls.key"
+func loadHlsKey(fileName string) ([]byte, error) {
+    key, err := ioutil.ReadFile(fileName)
+    if err != nil {
+        return nil, err
+    }
+    if len(key) != HLS_KEY_SIZE {
+        return nil, errors.New(fmt.Sprintf("key is %d byte(s) long when it should be %d", len(key), HLS_KEY_SIZE))
+    }
+    return key, nil
+}
+
+// Return the IV of the next segment to be encrypted
+func nextSegmentIv() []byte {
+    iv := make([]byte, HLS_KEY_SIZE)
+    binary.BigEndian.PutUint64(iv, hlsIvEpoch)
+    binary.BigEndian.PutUint64(iv[8:], numEncryptedSegments)
+    numEncryptedSegments++
+    return iv
+}
+
+// Encrypt a whole segment with AES-128-CBC, PKCS7 padded, as HLS requires
+func encryptSegment(key []byte, iv []byte, segment []byte) ([]byte, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    padding := aes.BlockSize - len(segment) % aes.BlockSize
+    encrypted := make([]byte, len(segment) + padding)
+    copy(encrypted, segment)
+    copy(encrypted[len(segment):], bytes.Repeat([]byte{byte(padding)}, padding))
+    cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+    return encrypted, nil
+}
+
+// Return the #EXT-X-KEY tag for a segment encrypted with the given IV
+func hlsKeyTag(iv []byte) string {
+    return fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=\"%s\",IV=0x%s", HLS_KEY_PATH, hex.EncodeToString(iv))
+}
+
+// Handle a request for the segment key; the key is only served to
+// requests carrying a valid session token, see checkSessionToken()
+func hlsKeyHandler(out http.ResponseWriter, in *http.Request, key []byte, sessionSecret string) {
+    _, ok := checkSessionToken(out, in, sessionSecret)
+    if !ok {
+        return
+    }
+    log.Printf("Serving segment key to %s.\n", in.RemoteAddr)
+    out.Header().Set("Content-Type", "application/octet-stream")
+    out.Header().Set("Cache-Control", "private, no-store")
+    out.Write(key)
+}
+
+/* End Of File */
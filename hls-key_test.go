@@ -0,0 +1,80 @@
+/* Tests of HLS AES-128 segment encryption for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "testing"
+    "crypto/aes"
+    "encoding/hex"
+    "crypto/cipher"
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// A NIST SP 800-38A (F.2.1) CBC-AES128 test vector, against which
+// TestHlsEncryption() checks the encryption
+var testHlsKey, _ = hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+
+var testHlsIv, _ = hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+
+var testHlsPlaintext, _ = hex.DecodeString("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51")
+
+var testHlsCiphertext, _ = hex.DecodeString("7649abac8119b246cee98e9b12e9197d5086cb9b507219ee95db113a917678b2")
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check the encryption against the NIST test vector, then encrypt an
+// awkwardly sized segment and decrypt it again independently, failing
+// if anything does not match
+func TestHlsEncryption(t *testing.T) {
+    encrypted, err := encryptSegment(testHlsKey, testHlsIv, testHlsPlaintext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Two whole blocks in gives a whole block of padding on the end
+    if !bytes.Equal(encrypted[:len(testHlsCiphertext)], testHlsCiphertext) ||
+       (len(encrypted) != len(testHlsPlaintext) + aes.BlockSize) {
+        t.Fatalf("encryption gave %x when %x... was expected", encrypted, testHlsCiphertext)
+    }
+
+    segment := bytes.Repeat([]byte("ID3 and MP3 "), 1001)
+    iv := nextSegmentIv()
+    encrypted, err = encryptSegment(testHlsKey, iv, segment)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(encrypted) % aes.BlockSize != 0 {
+        t.Fatalf("encrypted segment of %d byte(s) is not a whole number of blocks", len(encrypted))
+    }
+    block, _ := aes.NewCipher(testHlsKey)
+    decrypted := make([]byte, len(encrypted))
+    cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+    padding := int(decrypted[len(decrypted) - 1])
+    if (padding < 1) || (padding > aes.BlockSize) ||
+       !bytes.Equal(decrypted[len(decrypted) - padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+        t.Fatalf("invalid padding (%d) on decrypted segment", padding)
+    }
+    if !bytes.Equal(decrypted[:len(decrypted) - padding], segment) {
+        t.Fatal("decrypted segment does not match the original")
+    }
+    if bytes.Equal(nextSegmentIv(), iv) {
+        t.Fatal("IV repeated for the next segment")
+    }
+}
+
+/* End Of File */
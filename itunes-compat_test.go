@@ -0,0 +1,117 @@
+/* Tests of segments for Apple's tools (--itunes-compat) for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "errors"
+    "testing"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of samples in an MPEG-1 layer III frame, as a segment
+// for Apple's tools is made of
+const MP3_MPEG1_SAMPLES_PER_FRAME int = 1152
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check a segment against what Apple's mediastreamvalidator expects of
+// a packed audio segment: an ID3 tag carrying the transport stream
+// timestamp in a PRIV frame, straight after which come nothing but
+// whole MPEG-1 layer III frames at ITUNES_SAMPLE_RATE; returns an error
+// describing the first problem found
+func checkItunesSegment(segment []byte) error {
+    if !bytes.HasPrefix(segment, []byte(id3Prefix)) {
+        return errors.New("segment does not start with an ID3 tag carrying the transport stream timestamp")
+    }
+    tagEnd := len(id3Prefix) + MP3_ID3_TAG_TIMESTAMP_LEN
+    if len(segment) <= tagEnd {
+        return errors.New("segment has no audio")
+    }
+    frames := 0
+    for offset := tagEnd; offset < len(segment); frames++ {
+        header, ok := parseMp3FrameHeader(segment[offset:])
+        if !ok {
+            return errors.New(fmt.Sprintf("no MP3 frame header at offset %d, after %d frame(s)", offset, frames))
+        }
+        if !header.mpeg1 || (header.sampleRate != ITUNES_SAMPLE_RATE) || (header.samples != MP3_MPEG1_SAMPLES_PER_FRAME) {
+            return errors.New(fmt.Sprintf("MP3 frame %d is of %d sample(s) at %d Hz, MPEG-1 %t, when MPEG-1 frames of %d sample(s) at %d Hz are expected",
+                                          frames, header.samples, header.sampleRate, header.mpeg1,
+                                          MP3_MPEG1_SAMPLES_PER_FRAME, ITUNES_SAMPLE_RATE))
+        }
+        if offset + header.size > len(segment) {
+            return errors.New(fmt.Sprintf("MP3 frame %d is cut short", frames))
+        }
+        offset += header.size
+    }
+
+    return nil
+}
+
+// Check that the segments are cut at whole numbers of 44.1 kHz frames,
+// which are not a whole number of input samples, without drifting, then
+// encode a segment with --itunes-compat and check it against what
+// Apple's tools expect, and that one encoded without it is refused
+func TestItunesCompat(t *testing.T) {
+    encoderOptions := testMp3EncoderOptions()
+    err := checkSegmentCutter(MP3_MPEG1_SAMPLES_PER_FRAME, ITUNES_SAMPLE_RATE)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, outSampleRate := range []int{ITUNES_SAMPLE_RATE, SAMPLING_FREQUENCY} {
+        var mp3Audio bytes.Buffer
+        var segment bytes.Buffer
+
+        encoderOptions.OutSampleRate = outSampleRate
+        mp3Writer, samplesPerFrame := createMp3Writer(&mp3Audio, encoderOptions)
+        if mp3Writer == nil {
+            t.Fatal("unable to create MP3 writer")
+        }
+        // A segment's worth of a sawtooth
+        var cutter SegmentCutter
+        cutter.Reset(samplesPerFrame, mp3SampleRate(encoderOptions))
+        numSamples := cutter.Wanted()
+        pcm := make([]byte, numSamples * URTP_SAMPLE_SIZE)
+        for x := 0; x < numSamples; x++ {
+            binary.LittleEndian.PutUint16(pcm[x * URTP_SAMPLE_SIZE:], uint16(x * 256))
+        }
+        _, err = mp3Writer.Write(pcm)
+        mp3Writer.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        writeTag(&segment, time.Second, time.Time{}, ID3_TIMESTAMP_TRANSPORT)
+        mp3Audio.WriteTo(&segment)
+        err = checkItunesSegment(segment.Bytes())
+        if outSampleRate == ITUNES_SAMPLE_RATE {
+            if err != nil {
+                t.Fatalf("segment encoded for Apple's tools does not conform (%s)", err.Error())
+            }
+            log.Printf("Test: %d byte segment encoded at %d Hz conforms.\n", segment.Len(), outSampleRate)
+        } else if err == nil {
+            t.Fatalf("segment encoded at %d Hz taken to conform", outSampleRate)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,75 @@
+package lame
+
+/*
+#include "lame/lame.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// The amount of MP3 data given to the decoder at a time
+const DECODE_CHUNK_SIZE = 4096
+
+// The size of the PCM buffers given to the decoder, per channel, which
+// is more than a single MP3 frame can decode to
+const DECODE_PCM_BUFFER_SIZE = 8192
+
+// Decoded is the PCM audio decoded from an MP3 stream
+type Decoded struct {
+	SampleRate int
+	Channels   int
+	// The samples of the left (or only) channel and, if there are two
+	// channels, the right channel
+	Left  []int16
+	Right []int16
+}
+
+// Decode decodes a whole MP3 stream, e.g. the contents of a file
+func Decode(mp3 []byte) (*Decoded, error) {
+	var mp3Data C.mp3data_struct
+
+	if len(mp3) == 0 {
+		return nil, fmt.Errorf("no MP3 data")
+	}
+	hip := C.hip_decode_init()
+	if hip == nil {
+		return nil, fmt.Errorf("hip_decode_init() failed")
+	}
+	defer C.hip_decode_exit(hip)
+
+	decoded := &Decoded{}
+	pcmLeft := make([]int16, DECODE_PCM_BUFFER_SIZE)
+	pcmRight := make([]int16, DECODE_PCM_BUFFER_SIZE)
+	cLeft := (*C.short)(unsafe.Pointer(&pcmLeft[0]))
+	cRight := (*C.short)(unsafe.Pointer(&pcmRight[0]))
+	for offset := 0; offset < len(mp3); offset += DECODE_CHUNK_SIZE {
+		end := offset + DECODE_CHUNK_SIZE
+		if end > len(mp3) {
+			end = len(mp3)
+		}
+		cMp3 := (*C.uchar)(unsafe.Pointer(&mp3[offset]))
+		// Give the decoder the chunk then keep asking it for frames
+		// until it needs more data
+		samples := C.hip_decode1_headers(hip, cMp3, C.size_t(end-offset), cLeft, cRight, &mp3Data)
+		for samples > 0 {
+			decoded.Left = append(decoded.Left, pcmLeft[:samples]...)
+			if mp3Data.stereo == 2 {
+				decoded.Right = append(decoded.Right, pcmRight[:samples]...)
+			}
+			samples = C.hip_decode1_headers(hip, cMp3, 0, cLeft, cRight, &mp3Data)
+		}
+		if samples < 0 {
+			return nil, fmt.Errorf("hip_decode1_headers() failed (%d)", int(samples))
+		}
+	}
+	if mp3Data.header_parsed == 0 || len(decoded.Left) == 0 {
+		return nil, fmt.Errorf("no MP3 frames found")
+	}
+	decoded.SampleRate = int(mp3Data.samplerate)
+	decoded.Channels = int(mp3Data.stereo)
+
+	return decoded, nil
+}
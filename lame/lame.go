@@ -7,6 +7,7 @@ package lame
 import "C"
 
 import (
+	"fmt"
 	"runtime"
 	"unsafe"
 )
@@ -54,6 +55,10 @@ func (e *Encoder) SetInSamplerate(sampleRate int) {
 	C.lame_set_in_samplerate(e.handle, C.int(sampleRate))
 }
 
+func (e *Encoder) SetOutSamplerate(sampleRate int) {
+	C.lame_set_out_samplerate(e.handle, C.int(sampleRate))
+}
+
 func (e *Encoder) SetBitrate(bitRate int) {
 	C.lame_set_brate(e.handle, C.int(bitRate))
 }
@@ -79,10 +84,26 @@ func (e *Encoder) SetQuality(quality int) {
 	 C.lame_set_quality(e.handle, C.int(quality))
 }
 
+func (e *Encoder) SetLowpassFreq(frequency int) {
+	C.lame_set_lowpassfreq(e.handle, C.int(frequency))
+}
+
+func (e *Encoder) SetHighpassFreq(frequency int) {
+	C.lame_set_highpassfreq(e.handle, C.int(frequency))
+}
+
 func (e *Encoder) SetGenre(genre string) {
 	C.id3tag_set_genre(e.handle, C.CString(genre))
 }
 
+func (e *Encoder) SetTitle(title string) {
+	C.id3tag_set_title(e.handle, C.CString(title))
+}
+
+func (e *Encoder) SetArtist(artist string) {
+	C.id3tag_set_artist(e.handle, C.CString(artist))
+}
+
 func (e *Encoder) InitParams() int {
 	retcode := C.lame_init_params(e.handle)
 	return int(retcode)
@@ -146,14 +167,26 @@ func (e *Encoder) InSamplerate() int {
 	return int(sr)
 }
 
+func (e *Encoder) OutSamplerate() int {
+	sr := C.lame_get_out_samplerate(e.handle)
+	return int(sr)
+}
+
 func (e *Encoder) Encode(buf []byte) []byte {
+	out, _ := e.EncodeChecked(buf)
+	return out
+}
+
+// EncodeChecked is Encode but returns an error, rather than
+// no output, if libmp3lame fails
+func (e *Encoder) EncodeChecked(buf []byte) ([]byte, error) {
 
 	if len(e.remainder) > 0 {
 		buf = append(e.remainder, buf...)
 	}
 
 	if len(buf) == 0 {
-		return make([]byte, 0)
+		return make([]byte, 0), nil
 	}
 
 	blockAlign := BIT_DEPTH / 8 * e.NumChannels()
@@ -181,7 +214,10 @@ func (e *Encoder) Encode(buf []byte) []byte {
 		cOut,
 		C.int(estimatedSize),
 	))
-	return out[0:bytesOut]
+	if bytesOut < 0 {
+		return make([]byte, 0), fmt.Errorf("lame_encode_buffer() failed (%d)", int(bytesOut))
+	}
+	return out[0:bytesOut], nil
 
 }
 
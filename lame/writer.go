@@ -16,7 +16,10 @@ func NewWriter(out io.Writer) *LameWriter {
 }
 
 func (lw *LameWriter) Write(p []byte) (int, error) {
-	out := lw.Encoder.Encode(p)
+	out, err := lw.Encoder.EncodeChecked(p)
+	if err != nil {
+		return 0, err
+	}
 	lw.EncodedChunkSize = len(out)
 
 	if lw.EncodedChunkSize > 0 {
@@ -0,0 +1,72 @@
+/* Serving the last good playlist when a playlist file cannot be written, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A file store on disk in which files cannot be created while failing
+// points to true, to simulate a filesystem hiccup
+type FailingFileStore struct {
+    OsFileStore
+    failing *bool
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The number of times a playlist file could not be written, after
+// retrying, accessed atomically
+var numPlaylistWriteFailures int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+func (store FailingFileStore) Create(name string) (StoreFile, error) {
+    if *store.failing {
+        return nil, errors.New("simulated filesystem failure")
+    }
+    return store.OsFileStore.Create(name)
+}
+
+// Return the playlists whose files could not be written last time, and
+// which are being served from their last good snapshots
+func stalePlaylists() []*Playlist {
+    var stale []*Playlist
+
+    playlistAccess.Lock()
+    defer playlistAccess.Unlock()
+    for _, playlist := range playlists {
+        if playlist.stale {
+            stale = append(stale, playlist)
+        }
+    }
+    return stale
+}
+
+// Return true if segments which would otherwise be deleted are to be
+// kept because a playlist is being served from its last good snapshot,
+// which may still list them; a listener working through that playlist
+// would otherwise find its segments gone
+func holdSegments(options AudioOutOptions) bool {
+    return options.KeepLastGoodPlaylist && (len(stalePlaylists()) > 0)
+}
+
+/* End Of File */
@@ -0,0 +1,97 @@
+/* Tests of serving the last good playlist when a playlist file cannot be written, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "strings"
+    "testing"
+    "sync/atomic"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Make writing the playlist file fail as a segment ages out of it,
+// checking that the last good playlist continues to be served, and the
+// segment kept, until the playlist file can be written again
+func TestLastGoodPlaylist(t *testing.T) {
+    var failing bool
+
+    var err error
+    dirName := t.TempDir()
+    store := FailingFileStore{failing: &failing}
+    options := AudioOutOptions{PlaylistStore: store, SegmentStore: store, PlaylistWindow: time.Second * 20,
+                               KeepLastGoodPlaylist: true}
+    playlistAccess.Lock()
+    savedPlaylists := playlists
+    playlists = createPlaylists(filepath.Join(dirName, "live" + PLAYLIST_EXTENSION),
+                                PlaylistConfig{Window: options.PlaylistWindow}, nil)
+    playlistAccess.Unlock()
+    mp3FileList.Init()
+    t.Cleanup(func() {
+        mp3FileList.Init()
+        playlistAccess.Lock()
+        playlists = savedPlaylists
+        playlistAccess.Unlock()
+    })
+    for x, age := range []time.Duration{time.Second * 30, time.Second * 5} {
+        fileName := fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION)
+        err = writeStoreFile(store, filepath.Join(dirName, fileName), []byte("MP3"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        addMp3File(&Mp3AudioFile{fileName: fileName, timestamp: time.Now().Add(-age), duration: time.Second * 5},
+                   options, false)
+    }
+    served := func() string {
+        response := httptest.NewRecorder()
+        streamHandler(response, httptest.NewRequest("GET", playlistUrl(playlists[0].fileName), nil), store, store, "")
+        return response.Body.String()
+    }
+    exists := func() bool {
+        _, err := os.Stat(filepath.Join(dirName, "0" + SEGMENT_EXTENSION))
+        return err == nil
+    }
+
+    // The oldest segment ages out, and can go at once, but the playlist
+    // file cannot be written
+    failing = true
+    failures := atomic.LoadInt64(&numPlaylistWriteFailures)
+    ageMp3Files(dirName, options, false)
+    if atomic.LoadInt64(&numPlaylistWriteFailures) != failures + 1 {
+        t.Fatal("failure to write the playlist file not counted")
+    }
+    if len(stalePlaylists()) != 1 {
+        t.Fatal("playlist not marked as stale when its file could not be written")
+    }
+    if !strings.Contains(served(), "\r\n0" + SEGMENT_EXTENSION + "\r\n") || !exists() {
+        t.Fatalf("last good playlist not served, or its segments not kept, when the playlist file could not be written:\n%s",
+                 served())
+    }
+
+    // The filesystem recovers
+    failing = false
+    ageMp3Files(dirName, options, false)
+    if (len(stalePlaylists()) != 0) || strings.Contains(served(), "\r\n0" + SEGMENT_EXTENSION + "\r\n") || exists() {
+        t.Fatalf("playlist not brought up to date, or its old segment not deleted, once the playlist file could be written:\n%s",
+                 served())
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,129 @@
+/* Estimation of the number of listeners of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "time"
+    "strings"
+    "net/http"
+    "sync/atomic"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// A listener is someone who has fetched one of the newest
+// LISTENER_RECENT_SEGMENTS segments within the last LISTENER_WINDOW
+const LISTENER_RECENT_SEGMENTS int = 3
+const LISTENER_WINDOW time.Duration = time.Second * 30
+
+// The URL path at which metrics are served in the Prometheus text format
+const METRICS_PATH string = "/metrics"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The file names of the newest segments, newest last, as given in
+// Mp3AudioFile; protected by playlistAccess
+var recentSegmentNames []string
+
+// When each listener, see listenerId(), last fetched a recent segment
+var listenerLastSeen = make(map[string]time.Time)
+var listenerAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Note a new segment, which pushes the oldest out of the recent segments
+func addRecentSegment(fileName string) {
+    playlistAccess.Lock()
+    recentSegmentNames = append(recentSegmentNames, fileName)
+    if len(recentSegmentNames) > LISTENER_RECENT_SEGMENTS {
+        recentSegmentNames = recentSegmentNames[len(recentSegmentNames) - LISTENER_RECENT_SEGMENTS:]
+    }
+    playlistAccess.Unlock()
+}
+
+// Return true if a URL path is that of one of the recent segments
+func isRecentSegment(urlPath string) bool {
+    playlistAccess.Lock()
+    defer playlistAccess.Unlock()
+    for _, fileName := range recentSegmentNames {
+        if strings.HasSuffix(urlPath, "/" + filepath.ToSlash(fileName)) {
+            return true
+        }
+    }
+    return false
+}
+
+// Return who is making a request, as best as can be told: the client IP
+// address and user agent, which separates most listeners behind the same
+// NAT, and the expiry of the session token, if there is one, since every
+// URL handed to a session shares it
+func listenerId(in *http.Request) string {
+    host, _, err := net.SplitHostPort(in.RemoteAddr)
+    if err != nil {
+        host = in.RemoteAddr
+    }
+    return host + " " + in.UserAgent() + " " + in.URL.Query().Get(SESSION_EXPIRES_PARAMETER)
+}
+
+// Note the fetch of a segment, counting whoever made it as a listener if
+// the segment is a recent one
+func recordSegmentFetch(in *http.Request, now time.Time) {
+    if isRecentSegment(in.URL.Path) {
+        listenerAccess.Lock()
+        listenerLastSeen[listenerId(in)] = now
+        listenerAccess.Unlock()
+    }
+}
+
+// Return the estimated number of listeners, forgetting those that have
+// not fetched a recent segment within LISTENER_WINDOW
+func listenerCount(now time.Time) int {
+    listenerAccess.Lock()
+    defer listenerAccess.Unlock()
+    for id, lastSeen := range listenerLastSeen {
+        if now.Sub(lastSeen) > LISTENER_WINDOW {
+            delete(listenerLastSeen, id)
+        }
+    }
+    return len(listenerLastSeen)
+}
+
+// Handle a request for metrics, in the Prometheus text format
+func metricsHandler(out http.ResponseWriter, in *http.Request) {
+    log.Printf("Metrics handler was asked for \"%s\"...\n", in.URL.Path)
+    out.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    out.Header().Set("Cache-Control","no-cache")
+    fmt.Fprintf(out, "# HELP ioc_listeners Estimated number of listeners, those who fetched one of the newest %d segments in the last %s.\n",
+                LISTENER_RECENT_SEGMENTS, LISTENER_WINDOW.String())
+    fmt.Fprintf(out, "# TYPE ioc_listeners gauge\n")
+    fmt.Fprintf(out, "ioc_listeners %d\n", listenerCount(time.Now()))
+    fmt.Fprintf(out, "# HELP ioc_udp_datagrams_rejected_total UDP datagrams thrown away because they did not begin with a URTP header, by reason.\n")
+    fmt.Fprintf(out, "# TYPE ioc_udp_datagrams_rejected_total counter\n")
+    for fault := URTP_HEADER_OK + 1; fault < NUM_URTP_HEADER_FAULTS; fault++ {
+        fmt.Fprintf(out, "ioc_udp_datagrams_rejected_total{reason=\"%s\"} %d\n", fault.String(),
+                    atomic.LoadInt64(&numUdpDatagramsRejected[fault]))
+    }
+}
+
+/* End Of File */
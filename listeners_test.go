@@ -0,0 +1,62 @@
+/* Tests of listeners.go for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Fetch recent and old segments as several clients, failing
+// if the wrong number of listeners is counted or they are not forgotten
+// once they stop fetching
+func TestListeners(t *testing.T) {
+    now := time.Now()
+    playlistAccess.Lock()
+    recentSegmentNames = nil
+    playlistAccess.Unlock()
+    listenerAccess.Lock()
+    listenerLastSeen = make(map[string]time.Time)
+    listenerAccess.Unlock()
+    for _, fileName := range []string{"a.ts", "b.ts", "segments/c.ts", "segments/d.ts"} {
+        addRecentSegment(fileName)
+    }
+    for _, fetch := range []struct{remoteAddr string; userAgent string; path string}{
+                            {"192.0.2.1:1000", "player", "/hls/segments/d.ts"},
+                            {"192.0.2.1:1001", "player", "/hls/segments/c.ts"},
+                            // Two listeners behind one NAT
+                            {"192.0.2.2:1000", "player", "/hls/b.ts?expires=100&token=x"},
+                            {"192.0.2.2:1001", "player", "/hls/b.ts?expires=200&token=y"},
+                            // Only fetching an old segment
+                            {"192.0.2.3:1000", "player", "/hls/a.ts"}} {
+        request := httptest.NewRequest("GET", fetch.path, nil)
+        request.RemoteAddr = fetch.remoteAddr
+        request.Header.Set("User-Agent", fetch.userAgent)
+        recordSegmentFetch(request, now)
+    }
+    count := listenerCount(now)
+    if count != 3 {
+        t.Fatalf("%d listener(s) counted when there were 3", count)
+    }
+    count = listenerCount(now.Add(LISTENER_WINDOW + time.Second))
+    if count != 0 {
+        t.Fatalf("%d listener(s) still counted after they stopped fetching", count)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,91 @@
+/* Continuous MP3 stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "context"
+    "net/http"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL path of the continuous MP3 stream
+const LIVE_MP3_PATH string = "/live.mp3"
+
+// The number of chunks of encoded MP3 that may be queued for a client
+// before it is dropped; a chunk is encoded every BLOCK_DURATION_MS
+// so this is around five seconds
+const LIVE_MP3_QUEUE_LENGTH int = 5000 / BLOCK_DURATION_MS
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the number of clients of the continuous MP3 stream
+func numLiveMp3Subscribers() int {
+    return mp3Tap.Count(LIVE_MP3_PATH)
+}
+
+// Serve the continuous MP3 stream, from the live edge, until the
+// client goes away, falls behind or ctx is cancelled
+func liveMp3Handler(ctx context.Context, out http.ResponseWriter, in *http.Request) {
+    log.Printf("Continuous MP3 stream requested by %s.\n", in.RemoteAddr)
+    serveMp3Tap(ctx, out, in, mp3Tap, LIVE_MP3_PATH)
+}
+
+// Serve what comes out of an MP3 tap, as a sink of the given name, from
+// the live edge, until the client goes away, falls behind or ctx is
+// cancelled
+func serveMp3Tap(ctx context.Context, out http.ResponseWriter, in *http.Request, tap *Mp3Tap, name string) {
+    controller := http.NewResponseController(out)
+    // This response lasts as long as the client wants it to
+    err := controller.SetWriteDeadline(time.Time{})
+    if err != nil {
+        log.Printf("Unable to remove the write deadline for the continuous MP3 stream (%s).\n", err.Error())
+    }
+    out.Header().Set("Content-Type", "audio/mpeg")
+    out.Header().Set("Cache-Control", "no-cache, no-store")
+    out.WriteHeader(http.StatusOK)
+    controller.Flush()
+
+    // The client is a sink of the MP3 tap, dropped if it falls too far behind
+    subscriber := tap.Subscribe(name, LIVE_MP3_QUEUE_LENGTH)
+    defer tap.Unsubscribe(subscriber)
+    for {
+        select {
+            case chunk, ok := <-subscriber.data:
+                if !ok {
+                    return
+                }
+                _, err = out.Write(chunk)
+                if err == nil {
+                    err = controller.Flush()
+                }
+                if err != nil {
+                    log.Printf("Continuous MP3 stream \"%s\" to %s ended (%s).\n", name, in.RemoteAddr, err.Error())
+                    return
+                }
+            case <-in.Context().Done():
+                log.Printf("Continuous MP3 stream \"%s\" to %s ended by the client.\n", name, in.RemoteAddr)
+                return
+            case <-ctx.Done():
+                return
+        }
+    }
+}
+
+/* End Of File */
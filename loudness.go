@@ -0,0 +1,264 @@
+/* Loudness normalisation (EBU R128) for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+// The loudness measurement follows ITU-R BS.1770-4 (as used by EBU R128):
+// K-weighting, 400 ms blocks with 75% overlap, an absolute gate at -70 LUFS
+// and a relative gate 10 LU below the ungated loudness.  The K-weighting
+// filter coefficients are calculated for SAMPLING_FREQUENCY in the same way
+// as libebur128 does.
+
+package main
+
+import (
+    "log"
+    "math"
+    "time"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A biquad filter
+type Biquad struct {
+    b0, b1, b2 float64
+    a1, a2 float64
+    z1, z2 float64
+}
+
+// A loudness meter, measuring integrated loudness over a sliding window
+type LoudnessMeter struct {
+    shelf Biquad
+    highPass Biquad
+    subBlockSum float64
+    subBlockCount int
+    subBlocks []float64
+    blocks []float64
+}
+
+// A loudness normaliser, which adjusts the gain slowly to bring the
+// integrated loudness to a target and limits the peaks
+type LoudnessNormaliser struct {
+    targetLufs float64
+    inputMeter LoudnessMeter
+    outputMeter LoudnessMeter
+    gainDb float64
+    limiterGain float64
+    lastLogTime time.Time
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The hop between loudness measurements: 100 ms, a quarter of a block
+const LOUDNESS_SUB_BLOCK_SAMPLES int = SAMPLING_FREQUENCY / 10
+
+// The number of sub-blocks in a 400 ms block
+const LOUDNESS_SUB_BLOCKS_PER_BLOCK int = 4
+
+// The sliding window over which integrated loudness is measured
+const LOUDNESS_WINDOW time.Duration = time.Second * 10
+
+// The number of blocks in LOUDNESS_WINDOW
+const LOUDNESS_WINDOW_BLOCKS int = int(LOUDNESS_WINDOW / (time.Millisecond * 100))
+
+// The absolute and relative gates
+const LOUDNESS_ABSOLUTE_GATE_LUFS float64 = -70
+const LOUDNESS_RELATIVE_GATE_LU float64 = -10
+
+// The largest gain, up or down, that will be applied
+const LOUDNESS_MAX_GAIN_DB float64 = 20
+
+// The fraction of the way the gain moves towards its target each
+// sub-block, giving a time constant of around five seconds
+const LOUDNESS_GAIN_SMOOTHING float64 = 0.02
+
+// The peak limiter ceiling; the limiter works on sample peaks so this
+// leaves headroom for the inter-sample (true) peaks between them
+const LOUDNESS_CEILING_DBFS float64 = -1
+
+// The per-sample recovery rate of the limiter after it has acted
+const LOUDNESS_LIMITER_RELEASE float64 = 0.0005
+
+// How often the achieved loudness is logged
+const LOUDNESS_LOG_INTERVAL time.Duration = time.Second * 30
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Filter a sample with a biquad (transposed direct form II)
+func (filter *Biquad) Filter(x float64) float64 {
+    y := filter.b0 * x + filter.z1
+    filter.z1 = filter.b1 * x - filter.a1 * y + filter.z2
+    filter.z2 = filter.b2 * x - filter.a2 * y
+    return y
+}
+
+// Initialise a loudness meter with the K-weighting filters
+func (meter *LoudnessMeter) Init() {
+    fs := float64(SAMPLING_FREQUENCY)
+
+    // Stage 1: the high shelf modelling the acoustic effect of the head
+    f0 := 1681.974450955533
+    g := 3.999843853973347
+    q := 0.7071752369554196
+    k := math.Tan(math.Pi * f0 / fs)
+    vh := math.Pow(10, g / 20)
+    vb := math.Pow(vh, 0.4996667741545416)
+    a0 := 1 + k / q + k * k
+    meter.shelf = Biquad{b0: (vh + vb * k / q + k * k) / a0,
+                         b1: 2 * (k * k - vh) / a0,
+                         b2: (vh - vb * k / q + k * k) / a0,
+                         a1: 2 * (k * k - 1) / a0,
+                         a2: (1 - k / q + k * k) / a0}
+
+    // Stage 2: the RLB high-pass filter
+    f0 = 38.13547087602444
+    q = 0.5003270373238773
+    k = math.Tan(math.Pi * f0 / fs)
+    a0 = 1 + k / q + k * k
+    meter.highPass = Biquad{b0: 1, b1: -2, b2: 1,
+                            a1: 2 * (k * k - 1) / a0,
+                            a2: (1 - k / q + k * k) / a0}
+
+    meter.subBlockSum = 0
+    meter.subBlockCount = 0
+    meter.subBlocks = nil
+    meter.blocks = nil
+}
+
+// Add a sample to a loudness meter, returning true if a new
+// block measurement was completed
+func (meter *LoudnessMeter) Add(sample float64) bool {
+    y := meter.highPass.Filter(meter.shelf.Filter(sample / 32768))
+    meter.subBlockSum += y * y
+    meter.subBlockCount++
+    if meter.subBlockCount < LOUDNESS_SUB_BLOCK_SAMPLES {
+        return false
+    }
+
+    // A sub-block is complete; once there are enough of them, they make a block
+    meter.subBlocks = append(meter.subBlocks, meter.subBlockSum / float64(meter.subBlockCount))
+    meter.subBlockSum = 0
+    meter.subBlockCount = 0
+    if len(meter.subBlocks) > LOUDNESS_SUB_BLOCKS_PER_BLOCK {
+        meter.subBlocks = meter.subBlocks[1:]
+    }
+    if len(meter.subBlocks) < LOUDNESS_SUB_BLOCKS_PER_BLOCK {
+        return false
+    }
+    power := 0.0
+    for _, x := range meter.subBlocks {
+        power += x
+    }
+    meter.blocks = append(meter.blocks, power / float64(LOUDNESS_SUB_BLOCKS_PER_BLOCK))
+    if len(meter.blocks) > LOUDNESS_WINDOW_BLOCKS {
+        meter.blocks = meter.blocks[1:]
+    }
+
+    return true
+}
+
+// Convert mean square power to loudness
+func powerToLufs(power float64) float64 {
+    return -0.691 + 10 * math.Log10(power)
+}
+
+// Return the gated integrated loudness over the window, false if there
+// is nothing above the absolute gate
+func (meter *LoudnessMeter) Integrated() (float64, bool) {
+    var sum float64
+    var count int
+
+    for _, power := range meter.blocks {
+        if (power > 0) && (powerToLufs(power) > LOUDNESS_ABSOLUTE_GATE_LUFS) {
+            sum += power
+            count++
+        }
+    }
+    if count == 0 {
+        return 0, false
+    }
+    relativeGate := powerToLufs(sum / float64(count)) + LOUDNESS_RELATIVE_GATE_LU
+    sum = 0
+    count = 0
+    for _, power := range meter.blocks {
+        if (power > 0) && (powerToLufs(power) > LOUDNESS_ABSOLUTE_GATE_LUFS) && (powerToLufs(power) > relativeGate) {
+            sum += power
+            count++
+        }
+    }
+    if count == 0 {
+        return 0, false
+    }
+
+    return powerToLufs(sum / float64(count)), true
+}
+
+// Create a loudness normaliser for the given target
+func createLoudnessNormaliser(targetLufs float64) *LoudnessNormaliser {
+    normaliser := &LoudnessNormaliser{targetLufs: targetLufs, limiterGain: 1, lastLogTime: time.Now()}
+    normaliser.inputMeter.Init()
+    normaliser.outputMeter.Init()
+    return normaliser
+}
+
+// Normalise a buffer of 16-bit little-endian PCM in place, dithering
+// the result if ditherer is set
+func (normaliser *LoudnessNormaliser) Process(pcm []byte) {
+    ceiling := math.Pow(10, LOUDNESS_CEILING_DBFS / 20) * 32767
+    gain := math.Pow(10, normaliser.gainDb / 20)
+
+    for x := 0; x + URTP_SAMPLE_SIZE <= len(pcm); x += URTP_SAMPLE_SIZE {
+        sample := float64(int16(binary.LittleEndian.Uint16(pcm[x:])))
+        if normaliser.inputMeter.Add(sample) {
+            // Move the gain slowly towards that which would hit the target
+            loudness, valid := normaliser.inputMeter.Integrated()
+            if valid {
+                targetGainDb := normaliser.targetLufs - loudness
+                if targetGainDb > LOUDNESS_MAX_GAIN_DB {
+                    targetGainDb = LOUDNESS_MAX_GAIN_DB
+                } else if targetGainDb < -LOUDNESS_MAX_GAIN_DB {
+                    targetGainDb = -LOUDNESS_MAX_GAIN_DB
+                }
+                normaliser.gainDb += (targetGainDb - normaliser.gainDb) * LOUDNESS_GAIN_SMOOTHING
+                gain = math.Pow(10, normaliser.gainDb / 20)
+            }
+        }
+
+        // Apply the gain, limiting the peaks
+        output := sample * gain
+        if math.Abs(output * normaliser.limiterGain) > ceiling {
+            normaliser.limiterGain = ceiling / math.Abs(output)
+        }
+        output *= normaliser.limiterGain
+        normaliser.limiterGain += (1 - normaliser.limiterGain) * LOUDNESS_LIMITER_RELEASE
+        binary.LittleEndian.PutUint16(pcm[x:], uint16(ditherer.Quantise(output)))
+        normaliser.outputMeter.Add(output)
+    }
+
+    if time.Now().Sub(normaliser.lastLogTime) >= LOUDNESS_LOG_INTERVAL {
+        normaliser.lastLogTime = time.Now()
+        loudness, valid := normaliser.outputMeter.Integrated()
+        if valid {
+            log.Printf("Loudness: integrated %.1f LUFS over the last %v (target %.1f LUFS), gain %.1f dB.\n",
+                       loudness, LOUDNESS_WINDOW, normaliser.targetLufs, normaliser.gainDb)
+        } else {
+            log.Printf("Loudness: nothing above the %.0f LUFS gate over the last %v.\n", LOUDNESS_ABSOLUTE_GATE_LUFS, LOUDNESS_WINDOW)
+        }
+    }
+}
+
+/* End Of File */
@@ -18,7 +18,12 @@ import (
     "log"
     "path/filepath"
     "strings"
-    "github.com/jessevdk/go-flags"
+    "strconv"
+    "time"
+    "context"
+    "os/signal"
+    "syscall"
+    "io"
 //    "encoding/hex"
 )
 
@@ -30,6 +35,109 @@ import (
 // (lame.sourceforge.net) is employed to produce
 // an MP3 stream that is streamed out over HTTP.
 
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Command-line items
+type Options struct {
+    Required struct {
+        In string `positional-arg-name:"input-port" description:"the input port for incoming raw PCM chuffs"`
+        Out string `positional-arg-name:"output-port" description:"the output port for HTTP service"`
+        PlaylistPath string `positional-arg-name:"playlistpath" description:"path to the live playlist file (any file extension will be replaced with .m3u8); the playlist file will be created by this program and the audio files will be stored in the same directory as the playlist file.  An HTML file (index.html) that serves the playlist file may be placed in this directory; if there is none, a built-in player page is served instead."`
+    } `positional-args:"true" required:"yes"`
+    UseTcp bool `short:"t" long:"tcp" description:"expect a TCP connection rather than a UDP connection"`
+    UseBoth bool `short:"b" long:"udp-and-tcp" description:"listen for both UDP datagrams and a TCP connection on the input port, so that the client may use either"`
+    MaxConnections int `long:"max-connections" description:"the maximum number of TCP connections to have open on the input port at once, further connections being closed straight away; a new connection replaces the current one, which is counted against the limit unless the new connection is from the same IP address (the client reconnecting), so that with a limit of 1 a connection from elsewhere cannot take over the stream; 0 (the default) for no limit, any new connection then replacing the current one"`
+    ReconnectGrace time.Duration `long:"reconnect-grace" default:"5s" description:"how long a TCP connection may be dropped for before a new connection from the same source starts a new session, with a discontinuity in the stream, rather than carrying on where the last left off"`
+    DownmixMono bool `long:"downmix-mono" description:"accept stereo PCM input, averaging the two channels down to mono before encoding"`
+    UrtpVersion string `long:"urtp-version" choice:"1" choice:"2" choice:"auto" default:"2" description:"the version of URTP to accept, given by the sync byte that starts each datagram: 1 for the compact version (sync byte 0x5b), whose eight-byte header has a timestamp in milliseconds and no payload size, so can only be sent over UDP, 2 for the standard version (sync byte 0x5a), whose fourteen-byte header has a timestamp in microseconds and a payload size, or auto to accept either, datagram by datagram"`
+    UnknownCoding string `long:"unknown-coding" choice:"drop" choice:"conceal" default:"drop" description:"what to do with a datagram of an audio coding scheme this server has no decoder for, e.g. from a newer client: drop it, as not being URTP, or take it in as a gap in the audio, to be concealed; either way it is counted in /stats"`
+    PayloadLimits []string `long:"payload-limit" description:"the lengths the payload of a datagram of an audio coding scheme may have, as <scheme>:<min>:<max> in bytes (e.g. 1:33:660), replacing the defaults for the scheme: at least one sample for PCM and a pair of blocks for UNICAM, at most the largest datagram; may be given more than once; datagrams outside the limits never reach the decoder"`
+    ClearTsDir bool `short:"c" long:"clear" description:"clear the segment files from the live playlist directory before using it"`
+    OOSDir string `short:"o" long:"oosdir" description:"the path to a directory containing HTML and, optionally in the same directory, static playlist/audio files, to use when there is no live audio to stream (you must create these files yourself); if the directory does not exist or has no index.html, a built-in maintenance page is served instead"`
+    LogName string `short:"l" long:"logfile" description:"file for logging output (will be truncated if it already exists)"`
+    AccessLogName string `long:"access-log" description:"file for logging HTTP requests, separately from the logging output (will be appended to if it already exists)"`
+    AccessLogFormat string `long:"access-log-format" choice:"common" choice:"combined" choice:"json" default:"common" description:"the format of the HTTP access log: common or combined log format (each with the request duration in microseconds and the request ID, as returned in the X-Request-Id header, appended) or JSON"`
+    RawPcmName string `short:"r" long:"rawpcmfile" description:"file for 16 bit PCM output (will be truncated if it already exists)"`
+    WavName string `short:"w" long:"wav" description:"file for 16 bit PCM output with a WAV header, so that it can be played directly (will be truncated if it already exists)"`
+    WavSegmentDir string `long:"wav-segment-dir" description:"a directory in which to write the audio, losslessly, as Broadcast Wave (BWF) files of --wav-segment-duration each, as well as encoding it to MP3, for forensic capture; each file has a bext chunk giving the date and time (in UTC) that its first sample originated, derived from the URTP timestamps, and is named after that time; the files are never deleted"`
+    WavSegmentDuration time.Duration `long:"wav-segment-duration" default:"5s" description:"the duration of each file written to --wav-segment-dir, at least 20ms"`
+    BwfDescription string `long:"bwf-description" description:"the description to put in the bext chunk of each file written to --wav-segment-dir, up to 256 characters (default: the --title)"`
+    BwfOriginator string `long:"bwf-originator" default:"ioc-server" description:"the originator to put in the bext chunk of each file written to --wav-segment-dir, up to 32 characters"`
+    BwfOriginatorReference string `long:"bwf-originator-reference" description:"the originator reference to put in the bext chunk of each file written to --wav-segment-dir, up to 32 characters"`
+    BwfUrtpEpoch bool `long:"bwf-urtp-epoch" description:"take the URTP timestamps to be microseconds since the Unix epoch, i.e. the client's clock, when timing the files written to --wav-segment-dir, rather than anchoring the start of each timeline to the server's clock"`
+    MaxSegments int `short:"m" long:"max-segments" description:"the maximum number of segments to keep in the live playlist, irrespective of their age (0 for no limit)"`
+    AgingPauseMaxSegments int `long:"aging-pause-max-segments" default:"2000" description:"the most segments kept while their deletion is paused with POST /admin/pause-aging; beyond this the oldest are deleted anyway, so that a pause left on cannot fill the disk"`
+    ReadySegments int `long:"ready-segments" default:"3" description:"the number of segments there must be before the stream is first advertised as ready, i.e. before /readyz gives 200 and the home page redirects to the live stream rather than showing the out of service page, so that a client attaching at startup does not find too few segments and give up; 1 for as soon as there is one"`
+    PlaylistWindow time.Duration `long:"playlist-window" default:"2m" description:"how long a segment is listed in the live playlist"`
+    Playlists []string `long:"playlist" description:"an additional playlist over the same segments, as name:window[:max-segments[:start-offset]] (e.g. archive:2h or low-latency:30s:0:6s), served as <name>.m3u8 from the live playlist directory, each listing segments for its own window, capped at its own maximum number of segments (0 for no limit) and with its own #EXT-X-START offset (0 for none); may be given more than once, a segment file being kept until no playlist lists it"`
+    MasterPlaylist string `long:"master-playlist" description:"the name of a master playlist to write, served as <name>.m3u8 from the live playlist directory, listing the playlists as the audio renditions of a group (#EXT-X-MEDIA:TYPE=AUDIO) with a single variant stream which uses it, so that the stream can be combined with others in a larger HLS presentation (default: none)"`
+    AudioGroupId string `long:"audio-group-id" default:"audio" description:"the GROUP-ID of the audio renditions in the --master-playlist"`
+    AudioRenditions []string `long:"audio-rendition" description:"an audio rendition of the --master-playlist, as playlist:name[:language[:default|autoselect]] (e.g. live:English:en:default), where playlist is live or the name of a --playlist, name is what a player shows, language is an RFC 5646 language tag and default makes it the rendition a player picks (DEFAULT=YES, AUTOSELECT=YES) or autoselect one a player may pick to match its language (AUTOSELECT=YES); may be given more than once (default: the live playlist, named after the --title, as the default)"`
+    Retention time.Duration `long:"retention" default:"5m" description:"how long a segment is kept after it was created, so that it can still be fetched after it has left the playlist (never less than the longest playlist window)"`
+    SegmentRequestTimeout time.Duration `long:"segment-request-timeout" default:"1m" description:"how long a segment request may take to serve before it is cut off, so that a client that stalls part way through a transfer does not tie up the server; cut-offs are counted in /stats; segments served in chunks with --chunked-segments and /live.mp3 are not cut off (0 for no limit)"`
+    RetentionUntilFetched time.Duration `long:"retention-until-fetched" description:"if longer than --retention, a segment that has not been fetched at least once by the end of --retention is kept until it has been, or until it is this old, so that a laggy listener does not find it gone; --max-segments still applies (default: off)"`
+    Id3Timestamp string `long:"id3-timestamp" choice:"transport" choice:"epoch" choice:"none" default:"transport" description:"the timestamp to put in the ID3 tag at the start of each segment: transport for the HLS standard 90 kHz offset, epoch for the Unix time in milliseconds or none to omit the ID3 tag"`
+    Storage string `long:"storage" choice:"disk" choice:"s3" default:"disk" description:"where to keep the playlist and segments: on disk, in the live playlist directory, or in a bucket of an S3-compatible object store, to which requests for them are redirected"`
+    S3Endpoint string `long:"s3-endpoint" description:"the URL of the S3-compatible object store (e.g. https://s3.eu-west-2.amazonaws.com), required with --storage s3"`
+    S3Bucket string `long:"s3-bucket" description:"the bucket in which to keep the playlist and segments, required with --storage s3"`
+    S3Prefix string `long:"s3-prefix" description:"a prefix (e.g. live) for the keys of the playlist and segments in the bucket"`
+    S3Region string `long:"s3-region" default:"us-east-1" description:"the region of the object store, used in signing requests"`
+    S3AccessKey string `long:"s3-access-key" description:"the access key ID with which to sign requests to the object store, required with --storage s3"`
+    S3SecretKey string `long:"s3-secret-key" description:"the secret access key with which to sign requests to the object store, required with --storage s3"`
+    S3PublicUrl string `long:"s3-public-url" description:"the URL (e.g. that of a CDN) at which the contents of the bucket are served to players, if not the bucket itself"`
+    InMemorySegments bool `long:"in-memory-segments" description:"keep segments in memory rather than writing them to disk (the playlist file is still written to disk)"`
+    MaxMemorySegmentBytes int `long:"max-memory-segment-bytes" description:"with --in-memory-segments, the most bytes of segments to keep in memory before the oldest are dropped; 0 (the default) for twice what --retention (or --retention-until-fetched, or the longest playlist window, if longer) holds at the bitrate of the encoder"`
+    GapTag bool `long:"gap-tag" description:"mark segments made up mostly of gap-fill with #EXT-X-GAP, so that players skip them, rather than with a comment"`
+    FirstDatagram string `long:"first-datagram" choice:"pad" choice:"trim" default:"pad" description:"what to do with a first datagram (of the input or of a new input session), which sets the base of the timeline, if it does not carry a whole block of audio: pad it out to a block, so that the timeline starts at its sequence number, or trim it, so that the timeline starts with the first audio actually received, a first datagram with no audio being skipped"`
+    Conceal string `long:"conceal" choice:"repeat" choice:"silence" choice:"hold" choice:"interpolate" choice:"overlap-add" default:"repeat" description:"how to fill gaps in the incoming audio: repeat the previous block, silence, hold the last sample, interpolate across the gap or overlap-add the last pitch period"`
+    TargetLufs float64 `long:"target-lufs" description:"normalise the audio to this integrated loudness (EBU R128, e.g. -23), limiting the peaks; 0 (the default) for no loudness normalisation"`
+    DetectEndianness bool `long:"detect-endianness" description:"if, over the first few datagrams of PCM audio of a session, the samples look byte-swapped (i.e. sent little-endian, which sounds like loud static), swap them back from then on; without this it is only logged as a warning; a heuristic, which could be fooled by unusual audio"`
+    Dither bool `long:"dither" description:"add TPDF dither wherever the audio is requantised to 16 bits, i.e. after the gain of --target-lufs and when stereo input is averaged down to mono, rounding rather than truncating, so that low-level detail becomes noise rather than distortion (default: off)"`
+    MaxDatagramAge time.Duration `long:"max-datagram-age" description:"drop datagrams whose timestamp is further than this behind the playout position, e.g. the backlog of a reconnecting client (0, the default, to never drop them)"`
+    Preroll time.Duration `long:"preroll" description:"when a stream starts, put this much silence ahead of the audio (e.g. 15s) so that the first few segments exist straight away and players have a buffer (0, the default, for none)"`
+    CatchUpRate float64 `long:"catch-up-rate" description:"limit how much audio is encoded on each 20 ms tick to a block of real-time audio plus this fraction (e.g. 0.1 for 10%), so that after a burst of datagrams the output closes in on real time rather than putting more than real-time audio into a segment; pre-roll is drained at this rate too; 0 (the default) for no limit"`
+    MaxConcealed float64 `long:"max-concealed" description:"the fraction (e.g. 0.5) of the audio over --max-concealed-window which may be gap-fill before the stream is taken out of service (the playlist is ended and the OOS page shown) until the fraction has fallen to half that; 0 (the default) to never do so"`
+    MaxConcealedWindow time.Duration `long:"max-concealed-window" default:"30s" description:"the window over which --max-concealed is judged"`
+    Warmup bool `long:"warmup" description:"from startup until the first audio arrives, fill with silence in real time, so that the playlist has segments that players (and a CDN) can attach to and wait on rather than an empty playlist; the live audio follows on in the same timeline; cannot be used with --fallback-audio, which fills that time itself"`
+    FallbackAudio string `long:"fallback-audio" description:"an MP3 file (e.g. hold music or a station ident) to play on a loop, in place of the live audio, while there is no input"`
+    FillUnderrun bool `long:"fill-underrun" description:"if the input stalls, fill with silence so that the audio, and hence the segment durations and times, keep pace with real time; filling stops once the input has been absent for five seconds"`
+    SegmentDir string `long:"segment-dir" description:"a sub-directory of the live playlist directory (e.g. segments) in which to put the segment files, rather than alongside the playlist file"`
+    SegmentBaseUrl string `long:"segment-base-url" description:"a URL to put in front of the segment file names in the playlist: absolute (e.g. https://cdn.example.com/live, for a CDN that pulls from this server), rooted (e.g. /live) or relative to the playlist; segments requested under its path are served from the live playlist directory"`
+    BasePath string `long:"base-path" description:"the path (e.g. /radio) under which a reverse proxy makes this server available; redirects, the player page, preload hints and session URLs are given under it, and requests are accepted with or without it, so the proxy may strip it or not"`
+    TrustForwarded bool `long:"trust-forwarded" description:"generate redirects, the player page and session URLs as absolute URLs with the scheme and host given by a reverse proxy in the X-Forwarded-Proto and X-Forwarded-Host headers; only set this if all requests come through such a proxy"`
+    KeepLastGoodPlaylist bool `long:"keep-last-good-playlist" description:"while a playlist file cannot be written (the last one written always continues to be served, and the failures are counted in /stats), also keep the segments that it may list, rather than deleting them as they age, so that a filesystem hiccup does not break listeners"`
+    SegmentDateDirs bool `long:"segment-date-dirs" description:"put the segment files in a sub-directory per day (e.g. 2024-01-31, in UTC), within the segment directory if one is given"`
+    SegmentLevels bool `long:"segment-levels" description:"meter the RMS and peak level of the audio of each segment, in dBFS, as it is encoded, and serve those of the segments kept as JSON at /levels, for level monitoring"`
+    Checksums bool `long:"checksums" description:"calculate the SHA-256 checksum of each segment, write it to a sidecar file (the segment file name with .sha256 appended) and serve the checksums, as sidecars and as a JSON manifest at /manifest"`
+    Mp3LowpassHz int `long:"mp3-lowpass-hz" description:"the cut-off frequency of the MP3 encoder's lowpass filter, below half the sampling frequency (default: chosen by the encoder)"`
+    VerifySegments bool `long:"verify-segments" description:"before publishing each segment, check that its MP3 frames are all in sync and decode it, checking that it gives the number of samples its duration implies; a segment that fails is dropped, counted in /stats, and the next is marked as a discontinuity"`
+    ChunkedSegments bool `long:"chunked-segments" description:"serve the segment being encoded, with chunked transfer, as it is encoded, the response completing when the segment is published, for the lowest latency without LL-HLS; the playlist response hints at the segment with a preload Link header; cannot be used with --hls-key or --id3-timestamp epoch, since the segment must go out exactly as it will be written"`
+    DirectSegments bool `long:"direct-segments" description:"write the MP3 audio into each segment file, after its ID3 tag, as it is encoded, rather than keeping the whole segment in memory until it is finished, for very long segments or hosts short of memory; a segment that cannot be written is dropped rather than retried; cannot be used with --hls-key, --id3-timestamp epoch, --verify-segments, --chunked-segments, --growing-segments, --in-memory-segments or --storage s3, all of which need the whole segment in memory"`
+    GrowingSegments bool `long:"growing-segments" description:"serve the segment being encoded as it grows: a request for it gets what has been encoded so far and range requests fetch the tail as it grows, bytes once served never changing; a lighter-weight alternative to --chunked-segments, which it cannot be used with, and likewise cannot be used with --hls-key or --id3-timestamp epoch; the playlist response hints at the segment with a preload Link header"`
+    AdaptiveEffort bool `long:"adaptive-effort" description:"if the ticks of audio processing are persistently late, e.g. on a busy shared host, lower the effort (algorithm quality) of the MP3 encoder at the next segment, raising it again once they are back on time; the current effort is reported in /stats"`
+    Mp3BitReservoir bool `long:"mp3-bit-reservoir" description:"leave the MP3 encoder's bit reservoir enabled, for better quality; segments then depend on those before them, so the playlist no longer carries #EXT-X-INDEPENDENT-SEGMENTS, and they do not butt up together without gaps"`
+    Mp3AlgoQuality int `long:"mp3-algo-quality" default:"-1" description:"the MP3 encoder's algorithm quality, as for lame -q, from 0 (best, most CPU) to 9 (fastest, least CPU) at the same bitrate, e.g. 7 on constrained hardware; -1 (the default) leaves it to the encoder, which uses 3; --adaptive-effort lowers the effort from here"`
+    ItunesCompat bool `long:"itunes-compat" description:"encode the MP3 at 44.1 kHz, upsampled from the 16 kHz input by the encoder, as MPEG-1 frames, for Apple's tools (e.g. mediastreamvalidator) which expect it; the segments are larger for no more audio bandwidth and --id3-timestamp must be transport"`
+    Mp3HighpassHz int `long:"mp3-highpass-hz" description:"the cut-off frequency of the MP3 encoder's highpass filter, below the lowpass cut-off (default: none)"`
+    Title string `long:"title" default:"Internet of Chuffs" description:"the title to put in the MP3 tag of each segment and in the playlist"`
+    Artist string `long:"artist" description:"the artist to put in the MP3 tag of each segment"`
+    Genre string `long:"genre" description:"the genre to put in the MP3 tag of each segment, either a name (e.g. Speech) or an ID3v1 genre number"`
+    AdminToken string `long:"admin-token" description:"the bearer token which must be given to use the admin endpoints (POST /admin/mute, optionally with ?for=<duration>, POST /admin/unmute, POST /admin/pause-aging, optionally with ?for=<duration>, which stops segments being deleted, though they still leave the playlists, until POST /admin/resume-aging, POST /admin/reset-stats, which zeroes the cumulative statistics and responds with them as they were, GET /admin/bitrate, which reports the MP3 bitrate and those allowed, PUT /admin/bitrate?kbps=<bitrate>, which changes it from the next segment, marked as a discontinuity, a second change before then being refused, and, with --session-secret, POST /admin/session?path=<playlist URL path>, optionally with &for=<duration>, default 1h); errors from the admin endpoints are JSON, with a code, a message and the request ID; if not given the admin endpoints are disabled"`
+    HlsKey string `long:"hls-key" description:"a file containing a 16-byte AES-128 key (e.g. made with openssl rand 16) with which to encrypt each segment, as HLS allows; the key is served at /hls.key only to URLs carrying a session token, so --session-secret is required, /live.mp3 is not served and the monitor segments are encrypted too"`
+    SessionSecret string `long:"session-secret" description:"the secret with which to sign expiring session tokens; if given, the live playlist, its segments and their checksums, the manifest, the live MP3 stream and the monitor playlist and its segments are only served to URLs carrying a valid token (?expires=<Unix time>&token=<hex HMAC-SHA256 of the URL path and expiry>), as minted by /admin/session; with --storage s3 the segments themselves are served by the bucket, which must do its own access control"`
+    TlsMinVersion string `long:"tls-min-version" choice:"1.2" choice:"1.3" default:"1.2" description:"the minimum TLS version accepted by the HTTP service"`
+    TlsCipherSuites []string `long:"tls-cipher-suite" description:"a TLS 1.2 cipher suite to allow (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), in order of preference; may be given more than once, if not given Go's secure defaults are used"`
+    TlsCurves []string `long:"tls-curve" choice:"X25519" choice:"P-256" choice:"P-384" choice:"P-521" description:"a curve to allow for TLS key exchange, in order of preference; may be given more than once, if not given Go's defaults are used"`
+    UnicamDiagnostics bool `long:"unicam-diagnostics" description:"log, for each UNICAM-coded datagram, the number of blocks, the histogram of shift values and an estimate of the quantisation noise introduced by the coding, and serve the totals and the last five seconds' worth as JSON at /debug/unicam"`
+    PprofAddr string `long:"pprof-addr" description:"the address (e.g. localhost:6060) on which to serve Go's profiling data at /debug/pprof/, separately from the HTTP service; not served if not given"`
+    AllowOrigin []string `long:"allow-origin" description:"an origin (e.g. https://example.com) from which browsers may make cross-domain requests; may be given more than once, if not given any origin may"`
+    MaxRuntime time.Duration `long:"max-runtime" description:"stop after running for this long (e.g. 2h), shutting down just as on SIGTERM, for time-boxed events and end-to-end tests; the time at which it will stop is logged at startup (default: run until stopped)"`
+    ConfigFile string `long:"config" description:"an INI file of options, by long name (e.g. title = Chuffs), in an [Application Options] section; any option, the positional arguments included, may also be given in an environment variable named IOC_ followed by its long name in upper case with - replaced by _ (e.g. IOC_MAX_SEGMENTS, IOC_INPUT_PORT, IOC_PLAYLISTPATH or IOC_CONFIG), an option that may be given more than once as comma-separated values; the command line overrides the environment, which overrides the file, which overrides the defaults; on SIGHUP the file and environment are read again and the title, artist, genre, allow-source, allow-origin and admin-token options are applied without a restart, changes to any others being logged and ignored"`
+    AllowSource []string `long:"allow-source" description:"a CIDR network (e.g. 192.168.1.0/24 or 2001:db8::/32) from which input is accepted; may be given more than once, if not given input is accepted from anywhere"`
+}
+
 //--------------------------------------------------------------------
 // Constants
 //--------------------------------------------------------------------
@@ -44,19 +152,8 @@ const SEGMENT_EXTENSION string = ".ts"
 // Variables
 //--------------------------------------------------------------------
 
-// Command-line items
-var opts struct {
-    Required struct {
-        In string `positional-arg-name:"input-port" description:"the input port for incoming raw PCM chuffs"`
-        Out string `positional-arg-name:"output-port" description:"the output port for HTTP service"`
-        PlaylistPath string `positional-arg-name:"playlistpath" description:"path to the live playlist file (any file extension will be replaced with .m3u8); the playlist file will be created by this program and the audio files will be stored in the same directory as the playlist file.  THe HTML file that serves the playlist file should be placed in this directory."`
-    } `positional-args:"true" required:"yes"`
-    UseTcp bool `short:"t" long:"tcp" description:"expect a TCP connection rather than a UDP connection"`
-    ClearTsDir bool `short:"c" long:"clear" description:"clear the segment files from the live playlist directory before using it"`
-    OOSDir string `short:"o" long:"oosdir" description:"the path to a directory containing HTML and, optionally in the same directory, static playlist/audio files, to use when there is no live audio to stream (you must create these files yourself)"`
-    LogName string `short:"l" long:"logfile" description:"file for logging output (will be truncated if it already exists)"`
-    RawPcmName string `short:"r" long:"rawpcmfile" description:"file for 16 bit PCM output (will be truncated if it already exists)"`
-}
+// Command-line items, see Options
+var opts Options
 
 //--------------------------------------------------------------------
 // Functions
@@ -64,23 +161,353 @@ var opts struct {
 
 // Deal with command-line parameters
 func cli() {
-     _, err := flags.Parse(&opts)
+    err := parseOptions(&opts)
 
     if err != nil {
         os.Exit(-1)        
     }    
+    
+    err = setAllowedSources(opts.AllowSource)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid allowed source (%s).\n", err.Error())
+        os.Exit(-1)
+    }
+    setAllowedOrigins(opts.AllowOrigin)
+    
+    if opts.Storage == "s3" {
+        if (opts.S3Endpoint == "") || (opts.S3Bucket == "") || (opts.S3AccessKey == "") || (opts.S3SecretKey == "") {
+            fmt.Fprintf(os.Stderr, "S3 storage needs an endpoint, a bucket, an access key and a secret key.\n")
+            os.Exit(-1)
+        }
+        if opts.InMemorySegments {
+            fmt.Fprintf(os.Stderr, "Segments cannot be kept both in memory and in S3 storage.\n")
+            os.Exit(-1)
+        }
+    }
+    
+    if opts.MaxMemorySegmentBytes < 0 {
+        fmt.Fprintf(os.Stderr, "The most bytes of segments to keep in memory cannot be negative.\n")
+        os.Exit(-1)
+    }
+    
+    if (opts.HlsKey != "") && (opts.SessionSecret == "") {
+        fmt.Fprintf(os.Stderr, "Segments can only be encrypted if the key can be protected, with --session-secret.\n")
+        os.Exit(-1)
+    }
+    
+    if (opts.SessionSecret != "") && (opts.AdminToken == "") {
+        fmt.Fprintf(os.Stderr, "Session tokens can only be minted with --admin-token, so --session-secret needs it.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.CatchUpRate < 0 {
+        fmt.Fprintf(os.Stderr, "The catch-up rate cannot be negative.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.Warmup && (opts.FallbackAudio != "") {
+        fmt.Fprintf(os.Stderr, "Warm-up silence cannot be used with fallback audio.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.ChunkedSegments && ((opts.HlsKey != "") || (opts.Id3Timestamp == ID3_TIMESTAMP_EPOCH)) {
+        fmt.Fprintf(os.Stderr, "Chunked segments cannot be encrypted or carry an epoch timestamp.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.GrowingSegments && ((opts.HlsKey != "") || (opts.Id3Timestamp == ID3_TIMESTAMP_EPOCH)) {
+        fmt.Fprintf(os.Stderr, "Growing segments cannot be encrypted or carry an epoch timestamp.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.DirectSegments && ((opts.HlsKey != "") || (opts.Id3Timestamp == ID3_TIMESTAMP_EPOCH) || opts.VerifySegments ||
+                               opts.ChunkedSegments || opts.GrowingSegments || opts.InMemorySegments || (opts.Storage == "s3")) {
+        fmt.Fprintf(os.Stderr, "Segments can only be encoded straight into their files if they are not needed whole in memory (encrypted, carrying an epoch timestamp, verified, served as they are encoded, kept in memory or in S3 storage).\n")
+        os.Exit(-1)
+    }
+    
+    if opts.WavSegmentDir != "" {
+        if opts.WavSegmentDuration < time.Duration(BLOCK_DURATION_MS) * time.Millisecond {
+            fmt.Fprintf(os.Stderr, "The duration of the WAV segments must be at least %d ms.\n", BLOCK_DURATION_MS)
+            os.Exit(-1)
+        }
+        err = checkBwfMetadata(wavSegmentOptions())
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s.\n", err.Error())
+            os.Exit(-1)
+        }
+    }
+    
+    if opts.ReadySegments < 1 {
+        fmt.Fprintf(os.Stderr, "The number of segments before the stream is ready must be at least 1.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.AgingPauseMaxSegments < 1 {
+        fmt.Fprintf(os.Stderr, "The most segments kept while their deletion is paused must be at least 1.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.ItunesCompat && (opts.Id3Timestamp != ID3_TIMESTAMP_TRANSPORT) {
+        fmt.Fprintf(os.Stderr, "Segments for Apple's tools must carry the transport timestamp.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.GrowingSegments && opts.ChunkedSegments {
+        fmt.Fprintf(os.Stderr, "Segments can be served as they grow or in chunks, not both.\n")
+        os.Exit(-1)
+    }
+    
+    _, err = normaliseSegmentBaseUrl(opts.SegmentBaseUrl)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid segment base URL \"%s\" (%s).\n", opts.SegmentBaseUrl, err.Error())
+        os.Exit(-1)
+    }
+    
+    _, err = normaliseBasePath(opts.BasePath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid base path (%s).\n", err.Error())
+        os.Exit(-1)
+    }
+    
+    _, err = parsePayloadLimits(opts.PayloadLimits)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid payload limit (%s).\n", err.Error())
+        os.Exit(-1)
+    }
+    
+    playlistConfigs, err := parsePlaylistConfigs(opts.Playlists, liveName())
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid playlist (%s).\n", err.Error())
+        os.Exit(-1)
+    }
+    
+    if opts.MasterPlaylist != "" {
+        playlistNames := []string{liveName()}
+        for _, playlistConfig := range playlistConfigs {
+            playlistNames = append(playlistNames, playlistConfig.Name)
+        }
+        for _, name := range playlistNames {
+            if opts.MasterPlaylist == name {
+                fmt.Fprintf(os.Stderr, "Master playlist cannot have the same name as a playlist (\"%s\").\n", name)
+                os.Exit(-1)
+            }
+        }
+        if !isQuotableString(opts.AudioGroupId) || (opts.AudioGroupId == "") {
+            fmt.Fprintf(os.Stderr, "Invalid audio group ID \"%s\".\n", opts.AudioGroupId)
+            os.Exit(-1)
+        }
+        renditions, err := parseAudioRenditions(opts.AudioRenditions, liveName(), opts.Title)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Invalid audio rendition (%s).\n", err.Error())
+            os.Exit(-1)
+        }
+        err = checkMasterPlaylist(masterPlaylistContents(MasterPlaylistConfig{Name: opts.MasterPlaylist,
+                                                                              GroupId: opts.AudioGroupId,
+                                                                              Renditions: renditions},
+                                                         masterPlaylistBandwidth()), playlistNames)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Invalid master playlist (%s).\n", err.Error())
+            os.Exit(-1)
+        }
+    } else if len(opts.AudioRenditions) > 0 {
+        fmt.Fprintf(os.Stderr, "--audio-rendition needs --master-playlist.\n")
+        os.Exit(-1)
+    }
+    
+    if (opts.UrtpVersion == strconv.Itoa(URTP_VERSION_COMPACT)) && (opts.UseTcp || opts.UseBoth) {
+        fmt.Fprintf(os.Stderr, "URTP version %d has no payload size, so cannot be taken from TCP.\n", URTP_VERSION_COMPACT)
+        os.Exit(-1)
+    }
+    
+    if (opts.SegmentDir != "") && (filepath.IsAbs(opts.SegmentDir) || !filepath.IsLocal(opts.SegmentDir)) {
+        fmt.Fprintf(os.Stderr, "Segment directory must be a sub-directory of the live playlist directory.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.ReconnectGrace < 0 {
+        fmt.Fprintf(os.Stderr, "Reconnect grace cannot be negative.\n")
+        os.Exit(-1)
+    }
+    
+    if opts.MaxConnections < 0 {
+        fmt.Fprintf(os.Stderr, "Maximum number of TCP connections cannot be negative.\n")
+        os.Exit(-1)
+    }
+    
+    if (opts.MaxConcealed < 0) || (opts.MaxConcealed >= 1) || (opts.MaxConcealedWindow <= 0) {
+        fmt.Fprintf(os.Stderr, "Maximum concealed fraction must be from 0 to less than 1, over a window longer than zero.\n")
+        os.Exit(-1)
+    }
+    
+    if (opts.Mp3LowpassHz < 0) || (opts.Mp3LowpassHz >= SAMPLING_FREQUENCY / 2) {
+        fmt.Fprintf(os.Stderr, "MP3 lowpass cut-off must be below %d Hz, half the sampling frequency.\n", SAMPLING_FREQUENCY / 2)
+        os.Exit(-1)
+    }
+    if (opts.Mp3HighpassHz < 0) || (opts.Mp3HighpassHz >= SAMPLING_FREQUENCY / 2) ||
+       ((opts.Mp3LowpassHz > 0) && (opts.Mp3HighpassHz >= opts.Mp3LowpassHz)) {
+        fmt.Fprintf(os.Stderr, "MP3 highpass cut-off must be below %d Hz, half the sampling frequency, and below the lowpass cut-off.\n", SAMPLING_FREQUENCY / 2)
+        os.Exit(-1)
+    }
+    if (opts.Mp3AlgoQuality < MP3_QUALITY_LAME_DEFAULT) || (opts.Mp3AlgoQuality > 9) {
+        fmt.Fprintf(os.Stderr, "MP3 algorithm quality must be from 0 to 9, or %d to leave it to the encoder.\n", MP3_QUALITY_LAME_DEFAULT)
+        os.Exit(-1)
+    }
+    
+    // Rather than give the times in the playlist in the wrong time zone
+    err = loadPlaylistTimeZone()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Unable to load the time zone %s (%s); install the time zone database (e.g. the tzdata package) or build with -tags embed_tzdata.\n",
+                    PLAYLIST_TIME_ZONE, err.Error())
+        os.Exit(-1)
+    }
+}
+
+// Return the name of the live playlist, as additional playlists must
+// not take it
+func liveName() string {
+    return strings.TrimSuffix(filepath.Base(opts.Required.PlaylistPath), filepath.Ext(opts.Required.PlaylistPath))
+}
+
+// Delete the segment files (and their checksum sidecars) in a segment
+// directory and the directories below it, then any directories left empty
+func clearSegmentDir(dirName string) {
+    var dirNames []string
+
+    log.Printf("Clearing %s files from segment directory \"%s\".\n", SEGMENT_EXTENSION, dirName)
+    filepath.Walk(dirName, func(path string, info os.FileInfo, err error) error {
+        if err == nil {
+            if info.IsDir() {
+                dirNames = append(dirNames, path)
+            } else if strings.HasSuffix(path, SEGMENT_EXTENSION) || strings.HasSuffix(path, SEGMENT_EXTENSION + CHECKSUM_EXTENSION) {
+                err = os.Remove(path)
+                if err != nil {
+                    log.Printf("Unable to delete file \"%s\" (%s).\n", path, err.Error())
+                }
+            }
+        }
+        return nil
+    })
+    // Deepest first, leaving dirName itself
+    for x := len(dirNames) - 1; x > 0; x-- {
+        os.Remove(dirNames[x])
+    }
+}
+
+// Wait for the next tick of a ticker, returning the time of the tick
+// and false (stopping the ticker) if ctx is cancelled first
+func waitForTickTime(ctx context.Context, ticker *time.Ticker) (time.Time, bool) {
+    select {
+        case <-ctx.Done():
+            ticker.Stop()
+            return time.Time{}, false
+        case tickTime := <-ticker.C:
+            return tickTime, true
+    }
+}
+
+// Wait for the next tick of a ticker, returning false (and stopping
+// the ticker) if ctx is cancelled first
+func waitForTick(ctx context.Context, ticker *time.Ticker) bool {
+    _, ok := waitForTickTime(ctx, ticker)
+    return ok
+}
+
+// Return the configuration of the WAV segments, from the options
+func wavSegmentOptions() WavSegmentOptions {
+    description := opts.BwfDescription
+    if description == "" {
+        description = opts.Title
+    }
+    return WavSegmentOptions{Duration: opts.WavSegmentDuration, Description: description, Originator: opts.BwfOriginator,
+                             OriginatorReference: opts.BwfOriginatorReference, UrtpEpoch: opts.BwfUrtpEpoch}
+}
+
+// Run the server loop for incoming audio, on the transport(s) and with
+// the settings of the options, until ctx is cancelled
+func operateAudioInFromOptions(ctx context.Context) {
+    operateAudioIn(ctx, opts.Required.In, opts.UseTcp, opts.UseBoth, opts.DownmixMono,
+                   opts.MaxConnections, opts.ReconnectGrace, opts.UnicamDiagnostics,
+                   opts.UnknownCoding)
+}
+
+// Wait for the next command on a channel, returning false if ctx
+// is cancelled first or the channel is closed
+func waitForCommand(ctx context.Context, channel <-chan interface{}) (interface{}, bool) {
+    select {
+        case <-ctx.Done():
+            return nil, false
+        case cmd, ok := <-channel:
+            return cmd, ok
+    }
 }
 
 // Entry point
 func main() {
     var rawPcmHandle *os.File
+    var wavWriter *WavWriter
+    var pcmOutputs []io.Writer
+    var pcmOutput io.Writer
     var logHandle *os.File
+    var accessLogHandle *os.File
+    var accessLog io.Writer
     var err error
     var mp3Dir string
     var playlistPath string
 
     // Handle the command line
     cli()
+    mp3EncoderOptions := Mp3EncoderOptions{Metadata: Mp3Metadata{Title: opts.Title, Artist: opts.Artist, Genre: opts.Genre},
+                                           LowpassHz: opts.Mp3LowpassHz,
+                                           HighpassHz: opts.Mp3HighpassHz,
+                                           Quality: opts.Mp3AlgoQuality,
+                                           BitReservoir: opts.Mp3BitReservoir}
+    if opts.ItunesCompat {
+        mp3EncoderOptions.OutSampleRate = ITUNES_SAMPLE_RATE
+    }
+    tlsConfig, err := createTlsConfig(opts.TlsMinVersion, opts.TlsCipherSuites, opts.TlsCurves)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid TLS configuration (%s).\n", err.Error())
+        os.Exit(-1)
+    }
+    var fallbackAudio *FallbackAudio
+    if opts.FallbackAudio != "" {
+        fallbackAudio, err = loadFallbackAudio(opts.FallbackAudio)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Unable to load fallback audio \"%s\" (%s).\n", opts.FallbackAudio, err.Error())
+            os.Exit(-1)
+        }
+    }
+    // Already checked by cli()
+    segmentBaseUrl, _ := normaliseSegmentBaseUrl(opts.SegmentBaseUrl)
+    basePath, _ := normaliseBasePath(opts.BasePath)
+    playlistConfigs, _ := parsePlaylistConfigs(opts.Playlists, liveName())
+    var masterPlaylistConfig MasterPlaylistConfig
+    if opts.MasterPlaylist != "" {
+        renditions, _ := parseAudioRenditions(opts.AudioRenditions, liveName(), opts.Title)
+        masterPlaylistConfig = MasterPlaylistConfig{Name: opts.MasterPlaylist, GroupId: opts.AudioGroupId, Renditions: renditions}
+    }
+    var hlsKey []byte
+    if opts.HlsKey != "" {
+        hlsKey, err = loadHlsKey(opts.HlsKey)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Unable to load segment key \"%s\" (%s).\n", opts.HlsKey, err.Error())
+            os.Exit(-1)
+        }
+    }
+    var playlistStore FileStore = OsFileStore{}
+    var segmentStore FileStore = OsFileStore{}
+    if opts.Storage == "s3" {
+        playlistStore = newS3FileStore(opts.S3Endpoint, opts.S3Bucket, opts.S3Prefix, opts.S3Region,
+                                       opts.S3AccessKey, opts.S3SecretKey, opts.S3PublicUrl)
+        segmentStore = playlistStore
+    } else if opts.InMemorySegments {
+        segmentStore = MemoryFileStore{}
+    }
+    
+    // Everything stops when we're interrupted or terminated
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
     
     // Open the log and raw PCM files
     if opts.LogName != "" {
@@ -91,9 +518,44 @@ func main() {
             log.SetOutput(logHandle)
         }        
     }    
+    if (opts.AccessLogName != "") && (err == nil) {
+        accessLogHandle, err = os.OpenFile(opts.AccessLogName, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+        if err == nil {
+            defer accessLogHandle.Close()
+            accessLog = accessLogHandle
+        }
+    }
     if (opts.RawPcmName != "") && (err == nil) {
         log.Printf("Opening \"%s\" for raw PCM output.\n", opts.RawPcmName)        
         rawPcmHandle, err = os.Create(opts.RawPcmName);
+        if err == nil {
+            pcmOutputs = append(pcmOutputs, rawPcmHandle)
+        }
+    }
+    if (opts.WavName != "") && (err == nil) {
+        log.Printf("Opening \"%s\" for WAV output.\n", opts.WavName)        
+        wavWriter, err = createWavFile(opts.WavName);
+        if err == nil {
+            pcmOutputs = append(pcmOutputs, wavWriter)
+        }
+    }
+    if (opts.WavSegmentDir != "") && (err == nil) {
+        log.Printf("Writing WAV segments to \"%s\".\n", opts.WavSegmentDir)
+        wavSegmenter, err = createWavSegmenter(opts.WavSegmentDir, wavSegmentOptions())
+        if err == nil {
+            pcmOutputs = append(pcmOutputs, wavSegmenter)
+        }
+    }
+    if err == nil {
+        // Encrypted like the segments, if they are
+        monitor = createMonitor(hlsKey)
+        defer monitor.Close()
+        pcmOutputs = append(pcmOutputs, monitor)
+    }
+    if len(pcmOutputs) == 1 {
+        pcmOutput = pcmOutputs[0]
+    } else if len(pcmOutputs) > 1 {
+        pcmOutput = io.MultiWriter(pcmOutputs...)
     }
     
     // Get the directory in which to store MP3 files and the playlist file path
@@ -112,28 +574,139 @@ func main() {
                     if err1 != nil {
                         log.Printf("Unable to delete file \"%s\" (%s).\n", segmentFile, err1.Error())
                     }
+                    // Along with any checksum sidecar it may have
+                    os.Remove(segmentFile + CHECKSUM_EXTENSION)
                 }
             } else {
                 log.Printf("Unable to delete %s files (%s).\n", SEGMENT_EXTENSION, err1.Error())
             }
+            // And from the segment sub-directory and any per-day directories in it
+            if opts.SegmentDir != "" {
+                clearSegmentDir(filepath.Join(mp3Dir, opts.SegmentDir))
+            } else if opts.SegmentDateDirs {
+                dateDirs, _ := filepath.Glob(filepath.Join(mp3Dir, "[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]"))
+                for _, dateDir := range dateDirs {
+                    clearSegmentDir(dateDir)
+                    os.Remove(dateDir)
+                }
+            }
         }
     } 
     
     if err == nil {
         defer rawPcmHandle.Close()
+        if wavWriter != nil {
+            // This is what writes the final sizes into the WAV header
+            defer wavWriter.Close()
+        }
+        if wavSegmenter != nil {
+            // Likewise for the last WAV segment
+            defer wavSegmenter.Close()
+        }
+        
+        // Stop, just as if terminated, once the maximum runtime is up
+        ctx, release := limitRuntime(ctx, opts.MaxRuntime)
+        defer release()
+        
+        // Dither wherever the audio is requantised, if asked to
+        if opts.Dither {
+            ditherer = createDitherer(time.Now().UnixNano())
+        }
         
         // Run the audio processing loop
-        go operateAudioProcessing(rawPcmHandle, mp3Dir)
+        processingDone := operateAudioProcessing(ctx, pcmOutput, mp3Dir,
+                                                 AudioProcessingOptions{Id3TimestampMode: opts.Id3Timestamp,
+                                                                        SegmentStore: segmentStore,
+                                                                        Concealment: opts.Conceal,
+                                                                        FirstDatagram: opts.FirstDatagram,
+                                                                        TargetLufs: opts.TargetLufs,
+                                                                        MaxDatagramAge: opts.MaxDatagramAge,
+                                                                        Encoder: mp3EncoderOptions,
+                                                                        Preroll: opts.Preroll,
+                                                                        CatchUpRate: opts.CatchUpRate,
+                                                                        Checksums: opts.Checksums,
+                                                                        SegmentLevels: opts.SegmentLevels,
+                                                                        FillUnderrun: opts.FillUnderrun,
+                                                                        MaxConcealed: opts.MaxConcealed,
+                                                                        MaxConcealedWindow: opts.MaxConcealedWindow,
+                                                                        FallbackAudio: fallbackAudio,
+                                                                        HlsKey: hlsKey,
+                                                                        AdaptiveEffort: opts.AdaptiveEffort,
+                                                                        VerifySegments: opts.VerifySegments,
+                                                                        ChunkedSegments: opts.ChunkedSegments,
+                                                                        GrowingSegments: opts.GrowingSegments,
+                                                                        DirectSegments: opts.DirectSegments,
+                                                                        Warmup: opts.Warmup,
+                                                                        SegmentDir: opts.SegmentDir,
+                                                                        SegmentDateDirs: opts.SegmentDateDirs})
+        
+        // Already checked by cli()
+        payloadLimits, _ := parsePayloadLimits(opts.PayloadLimits)
+        for scheme, limits := range payloadLimits {
+            setPayloadLimits(scheme, limits)
+        }
+        
+        // Swap back byte-swapped PCM, if asked to, else just warn of it
+        endiannessDetector = createEndiannessDetector(opts.DetectEndianness)
+        
+        // Already checked by go-flags
+        setUrtpVersion(opts.UrtpVersion)
         
         // Run the server loop for incoming audio
-        go operateAudioIn(opts.Required.In, opts.UseTcp)
+        go operateAudioInFromOptions(ctx)
         
-        // Run the HTTP server for audio output (which should block)
-        operateAudioOut(opts.Required.Out, playlistPath, opts.OOSDir)
+        // Serve profiling data, if asked to
+        if opts.PprofAddr != "" {
+            go operatePprof(ctx, opts.PprofAddr)
+        }
+        
+        // Reload the configuration when asked to
+        go operateReload(ctx)
+        
+        // Run the HTTP server for audio output (which blocks until we're stopped)
+        operateAudioOut(ctx, opts.Required.Out, playlistPath, opts.OOSDir,
+                        AudioOutOptions{MaxSegments: opts.MaxSegments,
+                                        PlaylistStore: playlistStore,
+                                        SegmentStore: segmentStore,
+                                        UseGapTag: opts.GapTag,
+                                        IndependentSegments: !opts.Mp3BitReservoir,
+                                        SegmentBaseUrl: segmentBaseUrl,
+                                        PlaylistWindow: opts.PlaylistWindow,
+                                        Playlists: playlistConfigs,
+                                        MasterPlaylist: masterPlaylistConfig,
+                                        Retention: opts.Retention,
+                                        AgingPauseMaxSegments: opts.AgingPauseMaxSegments,
+                                        ReadySegments: opts.ReadySegments,
+                                        RetentionUntilFetched: opts.RetentionUntilFetched,
+                                        MaxMemorySegmentBytes: opts.MaxMemorySegmentBytes,
+                                        AccessLog: accessLog,
+                                        AccessLogFormat: opts.AccessLogFormat,
+                                        AdminToken: opts.AdminToken,
+                                        SessionSecret: opts.SessionSecret,
+                                        Checksums: opts.Checksums,
+                                        SegmentLevels: opts.SegmentLevels,
+                                        HlsKey: hlsKey,
+                                        UnicamDiagnostics: opts.UnicamDiagnostics,
+                                        BasePath: basePath,
+                                        TrustForwarded: opts.TrustForwarded,
+                                        GrowingSegments: opts.GrowingSegments,
+                                        SegmentRequestTimeout: opts.SegmentRequestTimeout,
+                                        KeepLastGoodPlaylist: opts.KeepLastGoodPlaylist,
+                                        TlsConfig: tlsConfig,
+                                        ProcessingDone: processingDone})
     } else {
         if (opts.RawPcmName != "") && (rawPcmHandle == nil) {
             fmt.Fprintf(os.Stderr, "Unable to open %s for raw PCM output (%s).\n", opts.RawPcmName, err.Error())
         }
+        if (opts.WavName != "") && (wavWriter == nil) {
+            fmt.Fprintf(os.Stderr, "Unable to open %s for WAV output (%s).\n", opts.WavName, err.Error())
+        }
+        if (opts.WavSegmentDir != "") && (wavSegmenter == nil) {
+            fmt.Fprintf(os.Stderr, "Unable to write WAV segments to %s (%s).\n", opts.WavSegmentDir, err.Error())
+        }
+        if (opts.AccessLogName != "") && (accessLogHandle == nil) {
+            fmt.Fprintf(os.Stderr, "Unable to open %s for HTTP access logging (%s).\n", opts.AccessLogName, err.Error())
+        }
         if (opts.LogName != "") && (logHandle == nil) {
             fmt.Fprintf(os.Stderr, "Unable to open %s for logging output (%s).\n", opts.LogName, err.Error())
         }
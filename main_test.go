@@ -0,0 +1,59 @@
+/* Tests of main.go for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Parse command lines giving each input transport, then start audio
+// input from the options as main() does, failing if the flags are not
+// parsed into the options or if the listeners that come up are not
+// those the flags ask for, UDP being the default
+func TestInputTransportFlags(t *testing.T) {
+    savedOpts := opts
+    restoreAudioInSettings(t)
+    t.Cleanup(func() {
+        opts = savedOpts
+    })
+
+    for _, test := range []struct{flags []string; useTcp bool; useBoth bool; tcp bool; udp bool}{
+                            {nil, false, false, false, true},
+                            {[]string{"--tcp"}, true, false, true, false},
+                            {[]string{"-t"}, true, false, true, false},
+                            {[]string{"--udp-and-tcp"}, false, true, true, true},
+                            {[]string{"-b"}, false, true, true, true}} {
+        port, err := freeInputPort()
+        if err != nil {
+            t.Fatal(err)
+        }
+        opts = Options{}
+        err = parseOptionArgs(&opts, append(test.flags, port, "8080", "/tmp/chuffs.m3u8"))
+        if err != nil {
+            t.Fatalf("%v: %s", test.flags, err.Error())
+        }
+        if (opts.Required.In != port) || (opts.UseTcp != test.useTcp) || (opts.UseBoth != test.useBoth) {
+            t.Fatalf("%v parsed to input port %s, TCP %v, UDP and TCP %v", test.flags, opts.Required.In, opts.UseTcp, opts.UseBoth)
+        }
+        err = checkInputListeners(operateAudioInFromOptions, port, test.tcp, test.udp)
+        if err != nil {
+            t.Fatalf("%v: %s", test.flags, err.Error())
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,378 @@
+/* The master playlist, with its audio renditions, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An audio rendition of the master playlist: one of the playlists,
+// listed in an #EXT-X-MEDIA:TYPE=AUDIO tag
+type AudioRendition struct {
+    // The name of the playlist, see PlaylistConfig
+    Playlist string
+    // What a player shows for the rendition
+    Name string
+    // The RFC 5646 language tag of the rendition, "" for none
+    Language string
+    // DEFAULT=YES, which requires AUTOSELECT=YES
+    Default bool
+    // AUTOSELECT=YES
+    Autoselect bool
+}
+
+// How the master playlist is made up
+type MasterPlaylistConfig struct {
+    // The name of the master playlist, its file being this with
+    // PLAYLIST_EXTENSION in the live playlist directory, "" for none
+    Name string
+    // The GROUP-ID of the audio renditions
+    GroupId string
+    Renditions []AudioRendition
+}
+
+// The master playlist, which lists the playlists as the audio
+// renditions of a group and has a single variant stream which uses it,
+// so that the stream can be the audio of a larger HLS presentation
+type MasterPlaylist struct {
+    MasterPlaylistConfig
+    fileName string
+    // The contents of the file as last written, nil if it has yet to
+    // be; protected by playlistAccess
+    written []byte
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The CODECS of the variant stream of the master playlist: MPEG-1/2
+// audio layer III, as RFC 6381 has it
+const MASTER_PLAYLIST_CODECS string = "mp4a.40.34"
+
+// The last field of an audio rendition, see parseAudioRendition(),
+// making it the default, which a player also selects automatically,
+// or just selected automatically
+const AUDIO_RENDITION_DEFAULT string = "default"
+const AUDIO_RENDITION_AUTOSELECT string = "autoselect"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The master playlist, nil if there isn't one; set up by
+// operateAudioOut() and protected by playlistAccess
+var masterPlaylist *MasterPlaylist
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return true if a string can go in a quoted-string attribute of a
+// playlist tag, which cannot contain a double quote, CR or LF
+func isQuotableString(value string) bool {
+    return !strings.ContainsAny(value, "\"\r\n")
+}
+
+// Parse an audio rendition, given as
+// playlist:name[:language[:default|autoselect]], e.g. live:English:en:default
+func parseAudioRendition(spec string) (AudioRendition, error) {
+    var rendition AudioRendition
+
+    fields := strings.Split(spec, ":")
+    if (len(fields) < 2) || (len(fields) > 4) {
+        return rendition, errors.New("must be playlist:name[:language[:" + AUDIO_RENDITION_DEFAULT + "|" +
+                                     AUDIO_RENDITION_AUTOSELECT + "]]")
+    }
+    rendition.Playlist = fields[0]
+    rendition.Name = fields[1]
+    if rendition.Name == "" {
+        return rendition, errors.New("the name cannot be empty")
+    }
+    if len(fields) > 2 {
+        rendition.Language = fields[2]
+    }
+    if !isQuotableString(rendition.Name) || !isQuotableString(rendition.Language) {
+        return rendition, errors.New("the name and language cannot contain a double quote")
+    }
+    if len(fields) > 3 {
+        switch fields[3] {
+            case AUDIO_RENDITION_DEFAULT:
+                rendition.Default = true
+                rendition.Autoselect = true
+            case AUDIO_RENDITION_AUTOSELECT:
+                rendition.Autoselect = true
+            default:
+                return rendition, errors.New(fmt.Sprintf("\"%s\" is neither %s nor %s", fields[3],
+                                                         AUDIO_RENDITION_DEFAULT, AUDIO_RENDITION_AUTOSELECT))
+        }
+    }
+
+    return rendition, nil
+}
+
+// Parse the audio renditions of the master playlist; with none, the
+// live playlist, named liveName, is the only one, called title, and is
+// the default
+func parseAudioRenditions(specs []string, liveName string, title string) ([]AudioRendition, error) {
+    var renditions []AudioRendition
+
+    if len(specs) == 0 {
+        return []AudioRendition{{Playlist: liveName, Name: title, Default: true, Autoselect: true}}, nil
+    }
+    for _, spec := range specs {
+        rendition, err := parseAudioRendition(spec)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("\"%s\": %s", spec, err.Error()))
+        }
+        renditions = append(renditions, rendition)
+    }
+
+    return renditions, nil
+}
+
+// Return YES or NO
+func yesOrNo(value bool) string {
+    if value {
+        return "YES"
+    }
+    return "NO"
+}
+
+// Return the contents of the master playlist, with a variant stream of
+// the given bandwidth, in bits/s, using the default rendition, or the
+// first if there is no default
+func masterPlaylistContents(config MasterPlaylistConfig, bandwidth int) []byte {
+    var playlist bytes.Buffer
+
+    fmt.Fprintf(&playlist, "#EXTM3U\r\n")
+    variant := config.Renditions[0]
+    for _, rendition := range config.Renditions {
+        fmt.Fprintf(&playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\"", config.GroupId, rendition.Name)
+        if rendition.Language != "" {
+            fmt.Fprintf(&playlist, ",LANGUAGE=\"%s\"", rendition.Language)
+        }
+        fmt.Fprintf(&playlist, ",DEFAULT=%s,AUTOSELECT=%s,URI=\"%s\"\r\n", yesOrNo(rendition.Default),
+                    yesOrNo(rendition.Autoselect), rendition.Playlist + PLAYLIST_EXTENSION)
+        if rendition.Default {
+            variant = rendition
+        }
+    }
+    fmt.Fprintf(&playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\",AUDIO=\"%s\"\r\n", bandwidth,
+                MASTER_PLAYLIST_CODECS, config.GroupId)
+    fmt.Fprintf(&playlist, "%s\r\n", variant.Playlist + PLAYLIST_EXTENSION)
+
+    return playlist.Bytes()
+}
+
+// Parse the attribute list of a playlist tag, returning the attributes
+// by name, the values of quoted strings with their quotes
+func parseAttributeList(list string) (map[string]string, error) {
+    attributes := make(map[string]string)
+    for list != "" {
+        equals := strings.Index(list, "=")
+        if equals <= 0 {
+            return nil, errors.New(fmt.Sprintf("attribute without a value in \"%s\"", list))
+        }
+        name := list[:equals]
+        list = list[equals + 1:]
+        end := strings.Index(list, ",")
+        if strings.HasPrefix(list, "\"") {
+            end = strings.Index(list[1:], "\"")
+            if end < 0 {
+                return nil, errors.New(fmt.Sprintf("unterminated quoted string for %s", name))
+            }
+            end += 2
+            if (end < len(list)) && (list[end] != ',') {
+                return nil, errors.New(fmt.Sprintf("quoted string for %s followed by \"%c\"", name, list[end]))
+            }
+        }
+        if end < 0 {
+            end = len(list)
+        }
+        if _, exists := attributes[name]; exists {
+            return nil, errors.New(fmt.Sprintf("%s given more than once", name))
+        }
+        attributes[name] = list[:end]
+        list = strings.TrimPrefix(list[end:], ",")
+    }
+
+    return attributes, nil
+}
+
+// Return the value of a quoted-string attribute, false if it is absent
+// or not quoted
+func quotedAttribute(attributes map[string]string, name string) (string, bool) {
+    value, present := attributes[name]
+    if !present || (len(value) < 2) || !strings.HasPrefix(value, "\"") || !strings.HasSuffix(value, "\"") {
+        return "", false
+    }
+    return value[1:len(value) - 1], true
+}
+
+// Check a master playlist against the rules of RFC 8216 for audio
+// renditions and the variant streams that use them: every #EXT-X-MEDIA
+// has TYPE, GROUP-ID and NAME, a NAME is unique within its group, a group
+// has at most one DEFAULT=YES, DEFAULT=YES comes with AUTOSELECT=YES,
+// the URI of a rendition is one of the given playlist names with
+// PLAYLIST_EXTENSION, and every #EXT-X-STREAM-INF has a BANDWIDTH, is
+// followed by a URI and uses an AUDIO group that exists
+func checkMasterPlaylist(contents []byte, playlistNames []string) error {
+    var audioGroups []string
+
+    uris := make(map[string]bool)
+    for _, name := range playlistNames {
+        uris[name + PLAYLIST_EXTENSION] = true
+    }
+    lines := strings.Split(strings.TrimRight(string(contents), "\r\n"), "\n")
+    for x := range lines {
+        lines[x] = strings.TrimRight(lines[x], "\r")
+    }
+    if lines[0] != "#EXTM3U" {
+        return errors.New("does not start with #EXTM3U")
+    }
+    names := make(map[string]map[string]bool)
+    defaults := make(map[string]int)
+    variants := 0
+    for x := 1; x < len(lines); x++ {
+        if strings.HasPrefix(lines[x], "#EXT-X-MEDIA:") {
+            attributes, err := parseAttributeList(strings.TrimPrefix(lines[x], "#EXT-X-MEDIA:"))
+            if err != nil {
+                return errors.New(fmt.Sprintf("line %d: %s", x + 1, err.Error()))
+            }
+            if attributes["TYPE"] != "AUDIO" {
+                return errors.New(fmt.Sprintf("line %d: TYPE is \"%s\", not AUDIO", x + 1, attributes["TYPE"]))
+            }
+            groupId, ok := quotedAttribute(attributes, "GROUP-ID")
+            name, named := quotedAttribute(attributes, "NAME")
+            if !ok || !named || (name == "") {
+                return errors.New(fmt.Sprintf("line %d: GROUP-ID and NAME must be given as quoted strings", x + 1))
+            }
+            if names[groupId] == nil {
+                names[groupId] = make(map[string]bool)
+                audioGroups = append(audioGroups, groupId)
+            }
+            if names[groupId][name] {
+                return errors.New(fmt.Sprintf("line %d: there is already a rendition called \"%s\" in group \"%s\"",
+                                              x + 1, name, groupId))
+            }
+            names[groupId][name] = true
+            for _, enumerated := range []string{"DEFAULT", "AUTOSELECT"} {
+                if value, present := attributes[enumerated]; present && (value != "YES") && (value != "NO") {
+                    return errors.New(fmt.Sprintf("line %d: %s must be YES or NO, not %s", x + 1, enumerated, value))
+                }
+            }
+            if attributes["DEFAULT"] == "YES" {
+                defaults[groupId]++
+                if defaults[groupId] > 1 {
+                    return errors.New(fmt.Sprintf("line %d: group \"%s\" has more than one DEFAULT=YES", x + 1, groupId))
+                }
+                if attributes["AUTOSELECT"] == "NO" {
+                    return errors.New(fmt.Sprintf("line %d: DEFAULT=YES but AUTOSELECT=NO", x + 1))
+                }
+            }
+            if _, present := attributes["LANGUAGE"]; present {
+                if _, ok = quotedAttribute(attributes, "LANGUAGE"); !ok {
+                    return errors.New(fmt.Sprintf("line %d: LANGUAGE must be a quoted string", x + 1))
+                }
+            }
+            if _, present := attributes["URI"]; present {
+                uri, ok := quotedAttribute(attributes, "URI")
+                if !ok || !uris[uri] {
+                    return errors.New(fmt.Sprintf("line %d: URI %s is not one of the playlists", x + 1, attributes["URI"]))
+                }
+            }
+        } else if strings.HasPrefix(lines[x], "#EXT-X-STREAM-INF:") {
+            attributes, err := parseAttributeList(strings.TrimPrefix(lines[x], "#EXT-X-STREAM-INF:"))
+            if err != nil {
+                return errors.New(fmt.Sprintf("line %d: %s", x + 1, err.Error()))
+            }
+            bandwidth, err := strconv.Atoi(attributes["BANDWIDTH"])
+            if (err != nil) || (bandwidth <= 0) {
+                return errors.New(fmt.Sprintf("line %d: BANDWIDTH must be a positive number", x + 1))
+            }
+            if _, present := attributes["AUDIO"]; present {
+                group, ok := quotedAttribute(attributes, "AUDIO")
+                if !ok || (names[group] == nil) {
+                    return errors.New(fmt.Sprintf("line %d: AUDIO %s is not a group of audio renditions", x + 1,
+                                                  attributes["AUDIO"]))
+                }
+            }
+            if (x + 1 >= len(lines)) || (lines[x + 1] == "") || strings.HasPrefix(lines[x + 1], "#") {
+                return errors.New(fmt.Sprintf("line %d: #EXT-X-STREAM-INF is not followed by a URI", x + 1))
+            }
+            x++
+            variants++
+        }
+    }
+    if variants == 0 {
+        return errors.New("there is no variant stream")
+    }
+    log.Printf("Master playlist has %d variant stream(s) and %d group(s) of audio renditions.\n", variants, len(audioGroups))
+
+    return nil
+}
+
+// Return the bandwidth to give the variant stream of the master
+// playlist, in bits/s: the bitrate of the MP3 encoder or, before there
+// is one, the most it might be
+func masterPlaylistBandwidth() int {
+    state := bitrateState()
+    bitrate := state.Bitrate
+    if bitrate == 0 {
+        bitrate = state.Allowed[len(state.Allowed) - 1]
+    }
+    return bitrate * 1000
+}
+
+// Create the master playlist, in the same directory as the live
+// playlist, at playlistPath
+func createMasterPlaylist(playlistPath string, config MasterPlaylistConfig) *MasterPlaylist {
+    return &MasterPlaylist{MasterPlaylistConfig: config,
+                           fileName: filepath.Join(filepath.Dir(playlistPath), config.Name + PLAYLIST_EXTENSION)}
+}
+
+// Write the master playlist, if there is one and it has changed (i.e.
+// the bitrate has), since it was last written
+func updateMasterPlaylist(store FileStore) {
+    playlistAccess.Lock()
+    defer playlistAccess.Unlock()
+    if masterPlaylist == nil {
+        return
+    }
+    contents := masterPlaylistContents(masterPlaylist.MasterPlaylistConfig, masterPlaylistBandwidth())
+    if bytes.Equal(contents, masterPlaylist.written) {
+        return
+    }
+    err := retryFileWrite(fmt.Sprintf("writing master playlist file \"%s\"", masterPlaylist.fileName), func() error {
+        return writeStoreFile(store, masterPlaylist.fileName, contents)
+    })
+    if err != nil {
+        log.Printf("Unable to write master playlist file \"%s\" (%s), will try again.\n", masterPlaylist.fileName, err.Error())
+        return
+    }
+    log.Printf("Updated master playlist file \"%s\".\n", masterPlaylist.fileName)
+    masterPlaylist.written = contents
+}
+
+/* End Of File */
@@ -0,0 +1,92 @@
+/* Tests of the master playlist, with its audio renditions, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "testing"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Write a master playlist with renditions from the command line, checking
+// it against the rendition rules, along with master playlists that break
+// them, and check that bad renditions are refused
+func TestMasterPlaylist(t *testing.T) {
+    var store OsFileStore
+
+    var err error
+    dirName := t.TempDir()
+    names := []string{"live", "archive"}
+    renditions, err := parseAudioRenditions([]string{"live:Live:en:" + AUDIO_RENDITION_AUTOSELECT,
+                                                     "archive:Archive::" + AUDIO_RENDITION_DEFAULT}, "live", "Chuffs")
+    if err != nil {
+        t.Fatal(err)
+    }
+    playlistAccess.Lock()
+    savedMasterPlaylist := masterPlaylist
+    masterPlaylist = createMasterPlaylist(filepath.Join(dirName, "live" + PLAYLIST_EXTENSION),
+                                          MasterPlaylistConfig{Name: "master", GroupId: "chuffs", Renditions: renditions})
+    playlistAccess.Unlock()
+    t.Cleanup(func() {
+        playlistAccess.Lock()
+        masterPlaylist = savedMasterPlaylist
+        playlistAccess.Unlock()
+    })
+    updateMasterPlaylist(store)
+    contents, err := readStoreFile(store, filepath.Join(dirName, "master" + PLAYLIST_EXTENSION))
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = checkMasterPlaylist(contents, names)
+    if err != nil {
+        t.Fatalf("%s in master playlist:\n%s", err.Error(), contents)
+    }
+    for _, expected := range []string{"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"chuffs\",NAME=\"Live\",LANGUAGE=\"en\",DEFAULT=NO,AUTOSELECT=YES,URI=\"live.m3u8\"\r\n",
+                                      "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"chuffs\",NAME=\"Archive\",DEFAULT=YES,AUTOSELECT=YES,URI=\"archive.m3u8\"\r\n",
+                                      ",CODECS=\"" + MASTER_PLAYLIST_CODECS + "\",AUDIO=\"chuffs\"\r\narchive.m3u8\r\n"} {
+        if !bytes.Contains(contents, []byte(expected)) {
+            t.Fatalf("master playlist does not contain %q:\n%s", expected, contents)
+        }
+    }
+    renditions, _ = parseAudioRenditions(nil, "live", "Chuffs")
+    if (len(renditions) != 1) || (renditions[0] != AudioRendition{Playlist: "live", Name: "Chuffs", Default: true, Autoselect: true}) {
+        t.Fatalf("with none given, the renditions are %+v", renditions)
+    }
+
+    stream := "#EXT-X-STREAM-INF:BANDWIDTH=32000,AUDIO=\"a\"\r\nlive.m3u8\r\n"
+    for _, bad := range []string{"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\",DEFAULT=YES\r\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"y\",DEFAULT=YES\r\n" + stream,
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\"\r\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\"\r\n" + stream,
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\",DEFAULT=YES,AUTOSELECT=NO\r\n" + stream,
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\"\r\n" + stream,
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=a,NAME=\"x\"\r\n" + stream,
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\",URI=\"other.m3u8\"\r\n" + stream,
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"b\",NAME=\"x\"\r\n" + stream,
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\"\r\n#EXT-X-STREAM-INF:AUDIO=\"a\"\r\nlive.m3u8\r\n",
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\"\r\n#EXT-X-STREAM-INF:BANDWIDTH=32000,AUDIO=\"a\"\r\n",
+                                 "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",NAME=\"x\"\r\n"} {
+        if checkMasterPlaylist([]byte("#EXTM3U\r\n" + bad), names) == nil {
+            t.Fatalf("master playlist passed the rendition rules:\n%s", bad)
+        }
+    }
+    for _, bad := range []string{"live", "live::", "live:x:en:maybe", "live:\"x\"", "live:x:en:default:more"} {
+        if _, err = parseAudioRendition(bad); err == nil {
+            t.Fatalf("audio rendition \"%s\" accepted", bad)
+        }
+    }
+}
+
+/* End Of File */
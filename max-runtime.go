@@ -0,0 +1,47 @@
+/* Stopping after a maximum runtime for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "errors"
+    "context"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a context which is cancelled, just as it would be by SIGTERM,
+// once maxRuntime is up, logging when that will be, along with the
+// function to call to release it; if maxRuntime is zero ctx is returned
+// as it is
+func limitRuntime(ctx context.Context, maxRuntime time.Duration) (context.Context, context.CancelFunc) {
+    if maxRuntime <= 0 {
+        return ctx, func() {}
+    }
+    limited, cancel := context.WithTimeout(ctx, maxRuntime)
+    stopTime, _ := limited.Deadline()
+    log.Printf("Will stop at %s, after the maximum runtime of %v.\n", stopTime.Format(time.RFC3339), maxRuntime)
+    go func() {
+        <-limited.Done()
+        if errors.Is(limited.Err(), context.DeadlineExceeded) {
+            log.Printf("Maximum runtime of %v reached, stopping.\n", maxRuntime)
+        }
+    }()
+
+    return limited, cancel
+}
+
+/* End Of File */
@@ -0,0 +1,184 @@
+/* Tests of stopping after a maximum runtime for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "time"
+    "bytes"
+    "context"
+    "testing"
+    "math/big"
+    "io/ioutil"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/pem"
+    "crypto/ecdsa"
+    "path/filepath"
+    "crypto/elliptic"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The maximum runtime given in TestMaxRuntime()
+const TEST_MAX_RUNTIME time.Duration = time.Millisecond * 100
+
+// The maximum runtime given in TestMaxRuntimeShutdown(), long enough for
+// some audio to be encoded
+const TEST_MAX_RUNTIME_SHUTDOWN time.Duration = time.Second * 2
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that a context with a maximum runtime is cancelled when the
+// runtime is up, and not before, and that one without is left alone
+func TestMaxRuntime(t *testing.T) {
+    start := time.Now()
+    ctx, cancel := limitRuntime(context.Background(), TEST_MAX_RUNTIME)
+    defer cancel()
+    select {
+        case <-ctx.Done():
+        case <-time.After(TEST_MAX_RUNTIME * 20):
+            t.Fatalf("not stopped %v after a maximum runtime of %v", time.Now().Sub(start),
+                     TEST_MAX_RUNTIME)
+    }
+    if time.Now().Sub(start) < TEST_MAX_RUNTIME {
+        t.Fatalf("stopped after %v, before the maximum runtime of %v", time.Now().Sub(start),
+                 TEST_MAX_RUNTIME)
+    }
+
+    unlimited, release := limitRuntime(context.Background(), 0)
+    defer release()
+    if unlimited.Done() != nil {
+        t.Fatal("context given a deadline with no maximum runtime")
+    }
+}
+
+// Write a self-signed certificate and its key into dir, as the
+// "cert.pem" and "privkey.pem" the HTTP server is started with
+func writeTestCertificate(dir string) error {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return err
+    }
+    template := x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+    certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+    if err != nil {
+        return err
+    }
+    keyBytes, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return err
+    }
+    err = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600)
+    if err != nil {
+        return err
+    }
+
+    return ioutil.WriteFile(filepath.Join(dir, "privkey.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+}
+
+// Run audio processing and output, as main() does, with a short maximum
+// runtime, failing if they do not both stop once it is up, if the
+// playlist is not then ended or if a segment it lists has been deleted
+func TestMaxRuntimeShutdown(t *testing.T) {
+    savedMediaChannel := MediaControlChannel
+    savedProcessChannel := ProcessDatagramsChannel
+    savedConcealer := concealer
+    savedFiller := underrunFiller
+    savedPlaylists := playlists
+    workingDir, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        MediaControlChannel = savedMediaChannel
+        ProcessDatagramsChannel = savedProcessChannel
+        concealer = savedConcealer
+        underrunFiller = savedFiller
+        playlists = savedPlaylists
+        pcmAudio.Reset()
+        os.Chdir(workingDir)
+    })
+    mp3Dir := t.TempDir()
+    playlistPath := filepath.Join(mp3Dir, "chuffs" + PLAYLIST_EXTENSION)
+    // The HTTP server looks for its certificate in the working directory
+    err = writeTestCertificate(mp3Dir)
+    if err == nil {
+        err = os.Chdir(mp3Dir)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    port, err := freeInputPort()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, release := limitRuntime(context.Background(), TEST_MAX_RUNTIME_SHUTDOWN)
+    defer release()
+    // Warm up with silence, so that there is audio for a last segment
+    processingDone := operateAudioProcessing(ctx, nil, mp3Dir,
+                                             AudioProcessingOptions{Id3TimestampMode: ID3_TIMESTAMP_NONE,
+                                                                    SegmentStore: OsFileStore{},
+                                                                    Concealment: CONCEAL_REPEAT,
+                                                                    FirstDatagram: FIRST_DATAGRAM_PAD,
+                                                                    Encoder: testMp3EncoderOptions(),
+                                                                    Warmup: true})
+    outDone := make(chan struct{})
+    go func() {
+        operateAudioOut(ctx, port, playlistPath, "",
+                        AudioOutOptions{PlaylistStore: OsFileStore{},
+                                        SegmentStore: OsFileStore{},
+                                        PlaylistWindow: time.Minute,
+                                        Retention: time.Minute,
+                                        ProcessingDone: processingDone})
+        close(outDone)
+    }()
+    select {
+        case <-outDone:
+        case <-time.After(TEST_MAX_RUNTIME_SHUTDOWN + HTTP_SHUTDOWN_TIMEOUT * 2):
+            t.Fatalf("audio output not stopped %v after a maximum runtime of %v", HTTP_SHUTDOWN_TIMEOUT * 2,
+                     TEST_MAX_RUNTIME_SHUTDOWN)
+    }
+    if ctx.Err() == nil {
+        t.Fatal("audio output stopped before the maximum runtime was up")
+    }
+    select {
+        case <-processingDone:
+        default:
+            t.Fatal("audio output stopped before audio processing had finished")
+    }
+
+    contents, err := ioutil.ReadFile(playlistPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.HasSuffix(bytes.TrimSpace(contents), []byte("#EXT-X-ENDLIST")) {
+        t.Fatalf("playlist not ended:\n%s", contents)
+    }
+    for _, line := range bytes.Split(contents, []byte("\n")) {
+        line = bytes.TrimSpace(line)
+        if (len(line) > 0) && (line[0] != '#') {
+            _, err = os.Stat(filepath.Join(mp3Dir, string(line)))
+            if err != nil {
+                t.Fatalf("segment \"%s\" listed in the ended playlist is gone (%s)", line, err.Error())
+            }
+        }
+    }
+}
+
+/* End Of File */
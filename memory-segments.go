@@ -0,0 +1,178 @@
+/* In-memory segment storage for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "bytes"
+    "net/http"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "container/list"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A segment being written to memory; it is added to the in-memory
+// segment store when it is closed
+type MemorySegment struct {
+    name string
+    data bytes.Buffer
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How many times what the retention window holds at the bitrate of the
+// encoder may be held in memory, when the limit is derived: segments
+// outlive the window until they are next aged and while they are being
+// served, and each carries an ID3 tag
+const MEMORY_SEGMENT_HEADROOM int = 2
+
+// The least number of bytes of segments held in memory when the limit
+// is derived, whatever the window and bitrate
+const MIN_MEMORY_SEGMENT_BYTES int = 1024 * 1024
+
+// The bitrate, in kbits/s, assumed when deriving the limit before the
+// encoder has reported one: the highest there is
+const MEMORY_SEGMENT_DEFAULT_BITRATE int = 320
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The segments held in memory, keyed by file name
+var memorySegments = make(map[string][]byte)
+
+// The names of the segments held in memory, oldest first
+var memorySegmentList = list.New()
+
+// The total size of the segments held in memory
+var memorySegmentBytes int
+
+// Mutex to manage access to the in-memory segments
+var memorySegmentAccess sync.Mutex
+
+// The most bytes of segments to hold in memory, 0 to derive it from
+// memorySegmentWindow and the bitrate of the encoder, which may change
+// while the server runs; both are protected by memorySegmentAccess
+var memorySegmentMaxBytes int
+
+// How long segments are kept for, see setMemorySegmentLimit()
+var memorySegmentWindow time.Duration
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Set the most bytes of segments to hold in memory: maxBytes, or if
+// that is 0 what the given window (i.e. how long segments are kept for)
+// holds at the bitrate of the encoder, with MEMORY_SEGMENT_HEADROOM;
+// returns the limit as it stands
+func setMemorySegmentLimit(window time.Duration, maxBytes int) int {
+    memorySegmentAccess.Lock()
+    defer memorySegmentAccess.Unlock()
+    memorySegmentWindow = window
+    memorySegmentMaxBytes = maxBytes
+    return memorySegmentLimit()
+}
+
+// Return the most bytes of segments to hold in memory, see
+// setMemorySegmentLimit(); memorySegmentAccess must be locked
+func memorySegmentLimit() int {
+    if memorySegmentMaxBytes > 0 {
+        return memorySegmentMaxBytes
+    }
+    bitrate := int(atomic.LoadInt64(&mp3EncoderBitrate))
+    if bitrate <= 0 {
+        bitrate = MEMORY_SEGMENT_DEFAULT_BITRATE
+    }
+    limit := int(memorySegmentWindow.Seconds() * float64(bitrate * 1000 / 8)) * MEMORY_SEGMENT_HEADROOM
+    if limit < MIN_MEMORY_SEGMENT_BYTES {
+        limit = MIN_MEMORY_SEGMENT_BYTES
+    }
+    return limit
+}
+
+// Write to an in-memory segment
+func (segment *MemorySegment) Write(data []byte) (int, error) {
+    return segment.data.Write(data)
+}
+
+// Return the name of an in-memory segment
+func (segment *MemorySegment) Name() string {
+    return segment.name
+}
+
+// Close an in-memory segment, adding it to the store and
+// dropping the oldest segments if there is too much in memory
+func (segment *MemorySegment) Close() error {
+    name := filepath.Base(segment.name)
+    memorySegmentAccess.Lock()
+    _, found := memorySegments[name]
+    if !found {
+        memorySegments[name] = segment.data.Bytes()
+        memorySegmentList.PushBack(name)
+        memorySegmentBytes += segment.data.Len()
+        limit := memorySegmentLimit()
+        for (memorySegmentBytes > limit) && (memorySegmentList.Len() > 1) {
+            oldest := memorySegmentList.Remove(memorySegmentList.Front()).(string)
+            memorySegmentBytes -= len(memorySegments[oldest])
+            delete(memorySegments, oldest)
+            log.Printf("Dropped in-memory segment \"%s\" as more than %d byte(s) are in use.\n", oldest, limit)
+        }
+    }
+    memorySegmentAccess.Unlock()
+    return nil
+}
+
+// Remove a segment from memory, returning true if it was there
+func removeMemorySegment(name string) bool {
+    memorySegmentAccess.Lock()
+    defer memorySegmentAccess.Unlock()
+    name = filepath.Base(name)
+    data, found := memorySegments[name]
+    if found {
+        for element := memorySegmentList.Front(); element != nil; element = element.Next() {
+            if element.Value.(string) == name {
+                memorySegmentList.Remove(element)
+                break
+            }
+        }
+        memorySegmentBytes -= len(data)
+        delete(memorySegments, name)
+    }
+    return found
+}
+
+// Serve a segment from memory
+func serveMemorySegment(out http.ResponseWriter, in *http.Request, name string) {
+    memorySegmentAccess.Lock()
+    data, found := memorySegments[filepath.Base(name)]
+    memorySegmentAccess.Unlock()
+    if found {
+        // The data of a stored segment is never modified, so it is safe to
+        // read it outside the lock
+        http.ServeContent(out, in, filepath.Base(name), time.Time{}, bytes.NewReader(data))
+    } else {
+        log.Printf("In-memory segment \"%s\" not found.\n", name)
+        http.NotFound(out, in)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,106 @@
+/* Tests of in-memory segment storage for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Empty the in-memory segments before a test and once it is done,
+// putting the limit and the bitrate of the encoder back
+func resetMemorySegments(t *testing.T) {
+    emptyMemorySegments := func() {
+        memorySegmentAccess.Lock()
+        memorySegments = make(map[string][]byte)
+        memorySegmentList.Init()
+        memorySegmentBytes = 0
+        memorySegmentAccess.Unlock()
+    }
+    savedWindow := memorySegmentWindow
+    savedMaxBytes := memorySegmentMaxBytes
+    savedBitrate := atomic.LoadInt64(&mp3EncoderBitrate)
+    emptyMemorySegments()
+    t.Cleanup(func() {
+        emptyMemorySegments()
+        setMemorySegmentLimit(savedWindow, savedMaxBytes)
+        atomic.StoreInt64(&mp3EncoderBitrate, savedBitrate)
+    })
+}
+
+// Derive the limit from windows and bitrates, failing if it is not what
+// the window holds at the bitrate with MEMORY_SEGMENT_HEADROOM, if it
+// does not follow a change of bitrate or if it is not overridden by a
+// given number of bytes
+func TestMemorySegmentLimit(t *testing.T) {
+    resetMemorySegments(t)
+
+    for _, test := range []struct{window time.Duration; bitrate int; limit int}{
+                            {time.Minute * 5, 64, 300 * 8000 * MEMORY_SEGMENT_HEADROOM},
+                            {time.Minute * 5, 0, 300 * MEMORY_SEGMENT_DEFAULT_BITRATE * 125 * MEMORY_SEGMENT_HEADROOM},
+                            {time.Hour, 16, 3600 * 2000 * MEMORY_SEGMENT_HEADROOM},
+                            {time.Second * 10, 8, MIN_MEMORY_SEGMENT_BYTES}} {
+        atomic.StoreInt64(&mp3EncoderBitrate, int64(test.bitrate))
+        if limit := setMemorySegmentLimit(test.window, 0); limit != test.limit {
+            t.Fatalf("limit %d for %v at %d kbits/s when %d was expected", limit, test.window, test.bitrate, test.limit)
+        }
+    }
+
+    setMemorySegmentLimit(time.Minute * 5, 0)
+    atomic.StoreInt64(&mp3EncoderBitrate, 128)
+    memorySegmentAccess.Lock()
+    limit := memorySegmentLimit()
+    memorySegmentAccess.Unlock()
+    if limit != 300 * 16000 * MEMORY_SEGMENT_HEADROOM {
+        t.Fatalf("limit %d after the bitrate changed to 128 kbits/s", limit)
+    }
+
+    if limit := setMemorySegmentLimit(time.Minute * 5, 12345); limit != 12345 {
+        t.Fatalf("limit %d when 12345 bytes were given", limit)
+    }
+}
+
+// Write more segments than the limit allows, failing if the oldest are
+// not dropped to keep within it or if the newest are not kept
+func TestMemorySegmentEviction(t *testing.T) {
+    resetMemorySegments(t)
+    store := MemoryFileStore{}
+    segmentSize := 10000
+    setMemorySegmentLimit(time.Minute, segmentSize * 3)
+
+    for x := 0; x < 5; x++ {
+        segment, err := store.Create(fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION))
+        if err != nil {
+            t.Fatal(err)
+        }
+        segment.Write(make([]byte, segmentSize))
+        segment.Close()
+    }
+    if (memorySegmentList.Len() != 3) || (memorySegmentBytes != segmentSize * 3) {
+        t.Fatalf("%d segment(s), %d byte(s), in memory when 3 were expected", memorySegmentList.Len(), memorySegmentBytes)
+    }
+    for x := 0; x < 5; x++ {
+        _, err := store.Open(fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION))
+        if (err == nil) != (x >= 2) {
+            t.Fatalf("segment %d kept %v", x, err == nil)
+        }
+    }
+}
+
+/* End Of File */
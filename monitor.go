@@ -0,0 +1,299 @@
+/* A low bitrate monitor stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "sync"
+    "time"
+    "bytes"
+    "strings"
+    "strconv"
+    "net/http"
+    "path/filepath"
+    "encoding/binary"
+    "github.com/u-blox/ioc-server/lame"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A segment of the monitor stream, kept in memory
+type MonitorSegment struct {
+    sequence uint64
+    audio []byte
+    duration time.Duration
+    // The IV the segment was encrypted with, nil if it was not
+    iv []byte
+}
+
+// Encodes the audio a second time, whatever the configuration of the
+// main MP3 encoder, at a fixed low bitrate, for operators to spot-check
+// from a phone; it takes the PCM that goes into the main encoder, as
+// one of the PCM outputs, and cuts it into short segments, kept in
+// memory, listed in a playlist at MONITOR_PLAYLIST_PATH with a window
+// short enough that a player starts close to the live edge
+type Monitor struct {
+    options Mp3EncoderOptions
+    mp3Writer *lame.LameWriter
+    mp3Audio bytes.Buffer
+    // The key with which to encrypt the segments, nil if they are not
+    key []byte
+    // The frames of the segment being put together, the start of a
+    // frame yet to be completed and the number of frames encoded
+    segment bytes.Buffer
+    segmentSamples int
+    sampleRate int
+    tail []byte
+    frames int
+    // The offset of the segment being put together from the first
+    offset time.Duration
+    segments []*MonitorSegment
+    nextSequence uint64
+    // Written to by audio processing, read by HTTP clients
+    access sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL path under which the monitor playlist and its segments are
+// served, and that of the playlist
+const MONITOR_PATH string = "/monitor/"
+const MONITOR_PLAYLIST_PATH string = MONITOR_PATH + "monitor" + PLAYLIST_EXTENSION
+
+// The bitrate, in kbits/s, and the LAME algorithm quality of the
+// monitor stream, chosen to be cheap to send and to encode
+const MONITOR_BITRATE int = 32
+const MONITOR_QUALITY int = 7
+
+// The duration of a monitor segment and the number of them listed in
+// the playlist, kept small for minimal latency
+const MONITOR_SEGMENT_DURATION time.Duration = time.Second
+const MONITOR_PLAYLIST_SEGMENTS int = 3
+
+// The number of monitor segments kept in memory, more than are listed
+// so that a player that has just fetched the playlist can still fetch
+// the segments after the window has moved on
+const MONITOR_SEGMENTS_KEPT int = MONITOR_PLAYLIST_SEGMENTS * 2
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The monitor, nil if there isn't one
+var monitor *Monitor
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a monitor, encrypting its segments with key if it is not nil
+func createMonitor(key []byte) *Monitor {
+    return &Monitor{options: Mp3EncoderOptions{Bitrate: MONITOR_BITRATE, Quality: MONITOR_QUALITY}, key: key}
+}
+
+// Return the IV of a monitor segment; the top bit of the first half is
+// set so that it is never one given to a segment of the main stream by
+// nextSegmentIv()
+func monitorSegmentIv(sequence uint64) []byte {
+    iv := make([]byte, HLS_KEY_SIZE)
+    binary.BigEndian.PutUint64(iv, hlsIvEpoch | (1 << 63))
+    binary.BigEndian.PutUint64(iv[8:], sequence)
+    return iv
+}
+
+// Encode PCM audio into the monitor segments.  Never fails, so that the
+// other PCM outputs are not held up
+func (monitor *Monitor) Write(pcm []byte) (int, error) {
+    monitor.access.Lock()
+    defer monitor.access.Unlock()
+    if monitor.mp3Writer == nil {
+        monitor.mp3Audio.Reset()
+        monitor.mp3Writer, _ = newMp3Writer(&monitor.mp3Audio, monitor.options)
+        if monitor.mp3Writer == nil {
+            return len(pcm), nil
+        }
+    }
+    _, err := monitor.mp3Writer.Write(pcm)
+    if err != nil {
+        log.Printf("Unable to encode the monitor stream (%s).\n", err.Error())
+    }
+    monitor.addMp3(monitor.mp3Audio.Bytes())
+    monitor.mp3Audio.Reset()
+
+    return len(pcm), nil
+}
+
+// Add encoded MP3 audio to the segment being put together, cutting it
+// once it is long enough; must be called with access locked
+func (monitor *Monitor) addMp3(data []byte) {
+    monitor.tail = append(monitor.tail, data...)
+    offset := 0
+    for offset + MP3_FRAME_HEADER_SIZE <= len(monitor.tail) {
+        header, ok := parseMp3FrameHeader(monitor.tail[offset:])
+        if !ok {
+            log.Printf("No MP3 frame header in the monitor stream after %d frame(s), dropping %d byte(s).\n",
+                       monitor.frames, len(monitor.tail) - offset)
+            offset = len(monitor.tail)
+            break
+        }
+        if offset + header.size > len(monitor.tail) {
+            // The rest of the frame is yet to come
+            break
+        }
+        // The encoder starts with a tag frame, which is not audio
+        if (monitor.frames > 0) || !mp3FrameIsTag(header, monitor.tail[offset:offset + header.size]) {
+            if monitor.segment.Len() == 0 {
+                writeTag(&monitor.segment, monitor.offset, time.Time{}, ID3_TIMESTAMP_TRANSPORT)
+            }
+            monitor.segment.Write(monitor.tail[offset:offset + header.size])
+            monitor.segmentSamples += header.samples
+            monitor.sampleRate = header.sampleRate
+            monitor.frames++
+            if time.Duration(monitor.segmentSamples) * time.Second / time.Duration(monitor.sampleRate) >= MONITOR_SEGMENT_DURATION {
+                monitor.cutSegment()
+            }
+        }
+        offset += header.size
+    }
+    monitor.tail = append(monitor.tail[:0], monitor.tail[offset:]...)
+}
+
+// Add the segment that has been put together to those kept, dropping
+// the oldest; must be called with access locked
+func (monitor *Monitor) cutSegment() {
+    segment := &MonitorSegment{sequence: monitor.nextSequence,
+                               audio: append([]byte(nil), monitor.segment.Bytes()...),
+                               duration: time.Duration(monitor.segmentSamples) * time.Second / time.Duration(monitor.sampleRate)}
+    monitor.segment.Reset()
+    monitor.segmentSamples = 0
+    monitor.offset += segment.duration
+    monitor.nextSequence++
+    if monitor.key != nil {
+        segment.iv = monitorSegmentIv(segment.sequence)
+        encrypted, err := encryptSegment(monitor.key, segment.iv, segment.audio)
+        if err != nil {
+            log.Printf("Unable to encrypt monitor segment %d (%s), dropping it.\n", segment.sequence, err.Error())
+            return
+        }
+        segment.audio = encrypted
+    }
+    monitor.segments = append(monitor.segments, segment)
+    if len(monitor.segments) > MONITOR_SEGMENTS_KEPT {
+        monitor.segments = monitor.segments[len(monitor.segments) - MONITOR_SEGMENTS_KEPT:]
+    }
+}
+
+// Return the monitor playlist, listing the newest segments
+func (monitor *Monitor) Playlist() []byte {
+    var playlist bytes.Buffer
+    var segmentData bytes.Buffer
+    var maxSegmentDuration time.Duration = MONITOR_SEGMENT_DURATION
+    var mediaSequenceNumber uint64
+
+    monitor.access.Lock()
+    window := monitor.segments
+    if len(window) > MONITOR_PLAYLIST_SEGMENTS {
+        window = window[len(window) - MONITOR_PLAYLIST_SEGMENTS:]
+    }
+    if len(window) > 0 {
+        mediaSequenceNumber = window[0].sequence
+    }
+    for _, segment := range window {
+        if segment.iv != nil {
+            fmt.Fprintf(&segmentData, "%s\r\n", hlsKeyTag(segment.iv))
+        }
+        fmt.Fprintf(&segmentData, "#EXTINF:%f,\r\n", float32(segment.duration) / float32(time.Second))
+        fmt.Fprintf(&segmentData, "%d%s\r\n", segment.sequence, SEGMENT_EXTENSION)
+        if maxSegmentDuration < segment.duration {
+            maxSegmentDuration = segment.duration
+        }
+    }
+    monitor.access.Unlock()
+
+    fmt.Fprintf(&playlist, "#EXTM3U\r\n")
+    fmt.Fprintf(&playlist, "#EXT-X-VERSION:3\r\n")
+    fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\r\n", int(math.Ceil(float64(maxSegmentDuration) / float64(time.Second))))
+    fmt.Fprintf(&playlist, "#EXT-X-MEDIA-SEQUENCE:%d\r\n", mediaSequenceNumber)
+    segmentData.WriteTo(&playlist)
+
+    return playlist.Bytes()
+}
+
+// Return the audio of a monitor segment, nil if it is not kept
+func (monitor *Monitor) Segment(sequence uint64) []byte {
+    monitor.access.Lock()
+    defer monitor.access.Unlock()
+    for _, segment := range monitor.segments {
+        if segment.sequence == sequence {
+            return segment.audio
+        }
+    }
+    return nil
+}
+
+// Close the encoder of the monitor, if it is open
+func (monitor *Monitor) Close() {
+    monitor.access.Lock()
+    defer monitor.access.Unlock()
+    if monitor.mp3Writer != nil {
+        monitor.mp3Writer.Close()
+        monitor.mp3Writer = nil
+    }
+}
+
+// Handle a request for the monitor playlist or one of its segments; if
+// sessionSecret is not empty they are only served to requests carrying a
+// valid session token, with tokens added to the playlist
+func monitorHandler(out http.ResponseWriter, in *http.Request, monitor *Monitor, sessionSecret string) {
+    var expires time.Time
+    var ok bool
+
+    if sessionSecret != "" {
+        expires, ok = checkSessionToken(out, in, sessionSecret)
+        if !ok {
+            return
+        }
+    }
+    if in.URL.Path == MONITOR_PLAYLIST_PATH {
+        log.Printf("Monitor playlist requested by %s.\n", in.RemoteAddr)
+        playlist := monitor.Playlist()
+        if sessionSecret != "" {
+            playlist = addSessionTokens(playlist, sessionSecret, in.URL.Path, expires)
+        }
+        out.Header().Set("Content-Type","application/x-mpegurl")
+        out.Header().Set("Cache-Control","no-cache")
+        out.Write(playlist)
+        return
+    }
+    name := strings.TrimPrefix(in.URL.Path, MONITOR_PATH)
+    if filepath.Ext(name) == SEGMENT_EXTENSION {
+        sequence, err := strconv.ParseUint(strings.TrimSuffix(name, SEGMENT_EXTENSION), 10, 64)
+        if err == nil {
+            if audio := monitor.Segment(sequence); audio != nil {
+                out.Header().Set("Content-Type","audio/mpeg")
+                out.Header().Set("Cache-Control","no-cache")
+                out.Write(audio)
+                return
+            }
+        }
+    }
+    http.NotFound(out, in)
+}
+
+/* End Of File */
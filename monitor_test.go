@@ -0,0 +1,152 @@
+/* Tests of a low bitrate monitor stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "bytes"
+    "testing"
+    "strings"
+    "crypto/aes"
+    "crypto/cipher"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the given number of hand-made MP3 frames, MPEG-2 layer III,
+// 32 kbits/s, 16 kHz, mono, 36 ms each, preceded by a tag frame as
+// the encoder would start with
+func testMonitorMp3(frames int) []byte {
+    frame := make([]byte, 144)
+    copy(frame, []byte{0xFF, 0xF3, 0x48, 0xC0})
+    tag := append([]byte(nil), frame...)
+    copy(tag[MP3_FRAME_HEADER_SIZE + 9:], []byte("Info"))
+    return append(tag, bytes.Repeat(frame, frames)...)
+}
+
+// Feed the monitor two seconds of audio, failing if it does not cut it
+// into a segment of mono MP3 at MONITOR_BITRATE, whatever the options of
+// the main encoder, at least MONITOR_SEGMENT_DURATION long
+func TestMonitor(t *testing.T) {
+    testMonitor := createMonitor(nil)
+    defer testMonitor.Close()
+    pcm := make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)
+    for x := 0; x < 2000 / BLOCK_DURATION_MS; x++ {
+        testMonitor.Write(pcm)
+    }
+    segment := testMonitor.Segment(0)
+    if segment == nil {
+        t.Fatal("no monitor segment after two seconds of audio")
+    }
+    duration, _, err := mp3AudioDuration(segment)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if duration < MONITOR_SEGMENT_DURATION {
+        t.Fatalf("monitor segment %v long, shorter than %v", duration, MONITOR_SEGMENT_DURATION)
+    }
+    // Skip the ID3 tag, the size of which is coded 7 bits per byte
+    offset := 0
+    for _, x := range segment[6:MP3_ID3_HEADER_LEN] {
+        offset = (offset << 7) + int(x & 0x7f)
+    }
+    header, ok := parseMp3FrameHeader(segment[offset + MP3_ID3_HEADER_LEN:])
+    if !ok || (header.bitrate != MONITOR_BITRATE) || !header.mono {
+        t.Fatalf("monitor stream %d kbits/s, mono %t (frame found %t), not %d kbits/s mono",
+                 header.bitrate, header.mono, ok, MONITOR_BITRATE)
+    }
+}
+
+// Feed the monitor hand-made frames in awkward pieces, failing if the
+// playlist does not list just the newest MONITOR_PLAYLIST_SEGMENTS, if
+// those no longer kept are served, or if, with a session secret, the
+// playlist is served without a token or its segment URIs lack one
+func TestMonitorPlaylist(t *testing.T) {
+    secret := "monitor secret"
+    testMonitor := createMonitor(nil)
+    // 28 frames of 36 ms make the first segment of a second or more
+    numSegments := MONITOR_SEGMENTS_KEPT + 2
+    mp3 := testMonitorMp3(28 * numSegments)
+    for offset := 0; offset < len(mp3); offset += 100 {
+        end := offset + 100
+        if end > len(mp3) {
+            end = len(mp3)
+        }
+        testMonitor.addMp3(mp3[offset:end])
+    }
+
+    response := httptest.NewRecorder()
+    monitorHandler(response, httptest.NewRequest("GET", MONITOR_PLAYLIST_PATH, nil), testMonitor, "")
+    playlist := response.Body.String()
+    firstListed := numSegments - MONITOR_PLAYLIST_SEGMENTS
+    if !strings.Contains(playlist, fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\r\n", firstListed)) ||
+       (strings.Count(playlist, "#EXTINF:") != MONITOR_PLAYLIST_SEGMENTS) ||
+       !strings.Contains(playlist, fmt.Sprintf("\r\n%d%s\r\n", numSegments - 1, SEGMENT_EXTENSION)) {
+        t.Fatalf("monitor playlist \"%s\" does not list segments %d to %d", playlist, firstListed, numSegments - 1)
+    }
+    for sequence := 0; sequence < numSegments; sequence++ {
+        response = httptest.NewRecorder()
+        monitorHandler(response, httptest.NewRequest("GET", fmt.Sprintf("%s%d%s", MONITOR_PATH, sequence, SEGMENT_EXTENSION), nil),
+                       testMonitor, "")
+        kept := sequence >= numSegments - MONITOR_SEGMENTS_KEPT
+        if (response.Code == 200) != kept {
+            t.Fatalf("monitor segment %d gave %d when kept is %t", sequence, response.Code, kept)
+        }
+        if kept && !bytes.HasPrefix(response.Body.Bytes(), []byte("ID3")) {
+            t.Fatalf("monitor segment %d does not start with an ID3 tag", sequence)
+        }
+    }
+
+    response = httptest.NewRecorder()
+    monitorHandler(response, httptest.NewRequest("GET", MONITOR_PLAYLIST_PATH, nil), testMonitor, secret)
+    if response.Code != 403 {
+        t.Fatalf("monitor playlist without a token gave %d", response.Code)
+    }
+    expires := time.Now().Add(time.Minute)
+    response = httptest.NewRecorder()
+    monitorHandler(response, httptest.NewRequest("GET", MONITOR_PLAYLIST_PATH + "?" + sessionQuery(secret, MONITOR_PLAYLIST_PATH, expires), nil),
+                   testMonitor, secret)
+    segmentPath := fmt.Sprintf("%s%d%s", MONITOR_PATH, numSegments - 1, SEGMENT_EXTENSION)
+    if !strings.Contains(response.Body.String(), fmt.Sprintf("%d%s?%s\r\n", numSegments - 1, SEGMENT_EXTENSION,
+                                                             sessionQuery(secret, segmentPath, expires))) {
+        t.Fatalf("monitor playlist \"%s\" lacks a token for \"%s\"", response.Body.String(), segmentPath)
+    }
+}
+
+// Feed a monitor with a key hand-made frames, failing if its segments
+// are not listed with the key or do not decrypt to the audio
+func TestMonitorEncryption(t *testing.T) {
+    testMonitor := createMonitor(testHlsKey)
+    testMonitor.addMp3(testMonitorMp3(28))
+    iv := monitorSegmentIv(0)
+    if !strings.Contains(string(testMonitor.Playlist()), hlsKeyTag(iv) + "\r\n") {
+        t.Fatalf("monitor playlist \"%s\" lacks the key", testMonitor.Playlist())
+    }
+    encrypted := testMonitor.Segment(0)
+    if (encrypted == nil) || (len(encrypted) % aes.BlockSize != 0) {
+        t.Fatalf("monitor segment of %d byte(s) is not a whole number of blocks", len(encrypted))
+    }
+    block, _ := aes.NewCipher(testHlsKey)
+    decrypted := make([]byte, len(encrypted))
+    cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+    duration, frames, err := mp3AudioDuration(decrypted[:len(decrypted) - int(decrypted[len(decrypted) - 1])])
+    if (err != nil) || (frames != 28) {
+        t.Fatalf("decrypted monitor segment of %d frame(s), %v long (%v), when 28 were expected", frames, duration, err)
+    }
+}
+
+/* End Of File */
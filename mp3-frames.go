@@ -0,0 +1,237 @@
+/* Reading back of MP3 frame headers for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "bytes"
+    "errors"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// What matters of an MPEG audio layer III frame header
+type Mp3FrameHeader struct {
+    // The bit rate in kbits/s and the sample rate in Hz
+    bitrate int
+    sampleRate int
+    // The number of samples the frame holds and its size in bytes,
+    // including the header
+    samples int
+    size int
+    // True for MPEG-1, otherwise MPEG-2 or 2.5
+    mpeg1 bool
+    mono bool
+}
+
+// Counts the frames of MP3 audio written to it a piece at a time, e.g.
+// as it comes out of the encoder, for the exact duration of audio that
+// is not kept; as for mp3AudioDuration() it must be nothing but whole
+// frames, though they may be split across writes
+type Mp3FrameCounter struct {
+    // The start of a frame split across writes
+    tail []byte
+    samples int
+    sampleRate int
+    frames int
+    // The first thing found wrong with the audio
+    err error
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The size of an MP3 frame header
+const MP3_FRAME_HEADER_SIZE int = 4
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The layer III bit rates, in kbits/s, of MPEG-1 and of MPEG-2/2.5,
+// indexed by the bit rate index (0 being "free format", not supported)
+var mp3BitratesMpeg1 = [...]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+var mp3BitratesMpeg2 = [...]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+
+// The MPEG-1 sample rates, indexed by the sample rate index; MPEG-2
+// halves them and MPEG-2.5 quarters them
+var mp3SampleRatesMpeg1 = [...]int{44100, 48000, 32000}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Parse the MPEG audio layer III frame header at the start of data,
+// returning false if there isn't one
+func parseMp3FrameHeader(data []byte) (Mp3FrameHeader, bool) {
+    var header Mp3FrameHeader
+
+    if (len(data) < MP3_FRAME_HEADER_SIZE) || (data[0] != 0xFF) || (data[1] & 0xE0 != 0xE0) {
+        return header, false
+    }
+    version := (data[1] >> 3) & 0x03
+    layer := (data[1] >> 1) & 0x03
+    bitrateIndex := int(data[2] >> 4)
+    sampleRateIndex := int((data[2] >> 2) & 0x03)
+    // Version 1 is reserved and layer 1 means layer III
+    if (version == 1) || (layer != 1) || (bitrateIndex == 0) || (bitrateIndex >= len(mp3BitratesMpeg1)) ||
+       (sampleRateIndex >= len(mp3SampleRatesMpeg1)) {
+        return header, false
+    }
+    header.mpeg1 = version == 3
+    header.mono = (data[3] >> 6) == 3
+    header.sampleRate = mp3SampleRatesMpeg1[sampleRateIndex]
+    if header.mpeg1 {
+        header.bitrate = mp3BitratesMpeg1[bitrateIndex]
+        header.samples = 1152
+    } else {
+        header.bitrate = mp3BitratesMpeg2[bitrateIndex]
+        header.samples = 576
+        header.sampleRate /= 2
+        if version == 0 {
+            header.sampleRate /= 2
+        }
+    }
+    header.size = header.samples / 8 * header.bitrate * 1000 / header.sampleRate + int((data[2] >> 1) & 0x01)
+
+    return header, true
+}
+
+// Return true if the frame is a Xing or Info tag, as LAME may write at
+// the start of a file, which holds no audio
+func mp3FrameIsTag(header Mp3FrameHeader, frame []byte) bool {
+    // The tag follows the side information, the size of which depends
+    // on the version and the number of channels
+    offset := MP3_FRAME_HEADER_SIZE
+    if header.mpeg1 {
+        if header.mono {
+            offset += 17
+        } else {
+            offset += 32
+        }
+    } else {
+        if header.mono {
+            offset += 9
+        } else {
+            offset += 17
+        }
+    }
+    if offset + 4 > len(frame) {
+        return false
+    }
+    tag := string(frame[offset:offset + 4])
+
+    return (tag == "Xing") || (tag == "Info")
+}
+
+// Read back the frame headers of some MP3 audio, e.g. a finished segment,
+// returning the exact duration of the audio and the number of frames; an
+// ID3 tag at the start is skipped but otherwise the audio must be nothing
+// but whole frames, all at the same sample rate
+func mp3AudioDuration(audio []byte) (time.Duration, int, error) {
+    var samples int
+    var sampleRate int
+    var frames int
+
+    offset := 0
+    if (len(audio) >= MP3_ID3_HEADER_LEN) && bytes.Equal(audio[:3], []byte("ID3")) {
+        // The size of an ID3 tag is coded 7 bits per byte
+        for _, x := range audio[6:MP3_ID3_HEADER_LEN] {
+            offset = (offset << 7) + int(x & 0x7f)
+        }
+        offset += MP3_ID3_HEADER_LEN
+    }
+    for offset < len(audio) {
+        header, ok := parseMp3FrameHeader(audio[offset:])
+        if !ok {
+            return 0, frames, errors.New(fmt.Sprintf("no MP3 frame header at offset %d", offset))
+        }
+        if offset + header.size > len(audio) {
+            return 0, frames, errors.New(fmt.Sprintf("MP3 frame at offset %d is %d byte(s) long but only %d byte(s) remain",
+                                                     offset, header.size, len(audio) - offset))
+        }
+        if (sampleRate != 0) && (header.sampleRate != sampleRate) {
+            return 0, frames, errors.New(fmt.Sprintf("MP3 frame at offset %d has a sample rate of %d Hz after frames at %d Hz",
+                                                     offset, header.sampleRate, sampleRate))
+        }
+        if (frames > 0) || !mp3FrameIsTag(header, audio[offset:offset + header.size]) {
+            sampleRate = header.sampleRate
+            samples += header.samples
+            frames++
+        }
+        offset += header.size
+    }
+    if frames == 0 {
+        return 0, 0, nil
+    }
+
+    return time.Duration(samples) * time.Second / time.Duration(sampleRate), frames, nil
+}
+
+// Count the frames in more MP3 audio; this never fails, anything wrong
+// with the audio being returned by Duration()
+func (counter *Mp3FrameCounter) Write(data []byte) (int, error) {
+    if counter.err != nil {
+        return len(data), nil
+    }
+    counter.tail = append(counter.tail, data...)
+    offset := 0
+    for offset + MP3_FRAME_HEADER_SIZE <= len(counter.tail) {
+        header, ok := parseMp3FrameHeader(counter.tail[offset:])
+        if !ok {
+            counter.err = errors.New(fmt.Sprintf("no MP3 frame header after %d frame(s)", counter.frames))
+            break
+        }
+        if offset + header.size > len(counter.tail) {
+            // The rest of the frame is yet to come
+            break
+        }
+        if (counter.sampleRate != 0) && (header.sampleRate != counter.sampleRate) {
+            counter.err = errors.New(fmt.Sprintf("MP3 frame %d has a sample rate of %d Hz after frames at %d Hz",
+                                                 counter.frames, header.sampleRate, counter.sampleRate))
+            break
+        }
+        if (counter.frames > 0) || !mp3FrameIsTag(header, counter.tail[offset:offset + header.size]) {
+            counter.sampleRate = header.sampleRate
+            counter.samples += header.samples
+            counter.frames++
+        }
+        offset += header.size
+    }
+    counter.tail = append(counter.tail[:0], counter.tail[offset:]...)
+
+    return len(data), nil
+}
+
+// Return the exact duration of the audio counted and the number of
+// frames, as mp3AudioDuration() would for the audio all in one piece
+func (counter *Mp3FrameCounter) Duration() (time.Duration, int, error) {
+    if counter.err != nil {
+        return 0, counter.frames, counter.err
+    }
+    if len(counter.tail) > 0 {
+        return 0, counter.frames, errors.New(fmt.Sprintf("%d byte(s) of an incomplete MP3 frame after %d frame(s)",
+                                                         len(counter.tail), counter.frames))
+    }
+    if counter.frames == 0 {
+        return 0, 0, nil
+    }
+
+    return time.Duration(counter.samples) * time.Second / time.Duration(counter.sampleRate), counter.frames, nil
+}
+
+/* End Of File */
@@ -0,0 +1,119 @@
+/* Tests of reading back of MP3 frame headers for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "bytes"
+    "testing"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The maximum amount by which the duration of the frames read back from
+// a segment may fall short of what was fed to the encoder, in frames,
+// in TestMp3Durations()
+const MP3_EXACT_DURATION_MAX_LAG_FRAMES int = 4
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check the frame header parser against hand-made frames, then encode a
+// segment's worth of audio and check that the exact duration read back
+// from its frames is a whole number of frames, no longer than the
+// estimate from the number of samples fed to the encoder and short of
+// it by no more than the audio the encoder may be holding on to
+func TestMp3Durations(t *testing.T) {
+    encoderOptions := testMp3EncoderOptions()
+    var audio []byte
+    var mp3Audio bytes.Buffer
+
+    // MPEG-2 layer III, 32 kbits/s, 16 kHz, mono: 144 bytes, 145 padded
+    frame := make([]byte, 144)
+    copy(frame, []byte{0xFF, 0xF3, 0x48, 0xC0})
+    padded := make([]byte, 145)
+    copy(padded, []byte{0xFF, 0xF3, 0x4A, 0xC0})
+    tag := append([]byte(nil), frame...)
+    copy(tag[MP3_FRAME_HEADER_SIZE + 9:], []byte("Info"))
+    audio = append(audio, tag...)
+    audio = append(audio, frame...)
+    audio = append(audio, padded...)
+    audio = append(audio, frame...)
+    duration, frames, err := mp3AudioDuration(audio)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if (frames != 3) || (duration != 3 * 576 * time.Second / 16000) {
+        t.Fatalf("hand-made frames read back as %d frame(s), %v", frames, duration)
+    }
+    _, _, err = mp3AudioDuration(audio[:len(audio) - 1])
+    if err == nil {
+        t.Fatal("truncated frame not spotted")
+    }
+    // The same, a few bytes at a time, as they might come out of the encoder
+    var counter Mp3FrameCounter
+    for offset := 0; offset < len(audio); offset += 100 {
+        end := offset + 100
+        if end > len(audio) {
+            end = len(audio)
+        }
+        counter.Write(audio[offset:end])
+    }
+    countedDuration, countedFrames, err := counter.Duration()
+    if (err != nil) || (countedFrames != frames) || (countedDuration != duration) {
+        t.Fatalf("hand-made frames counted in pieces as %d frame(s), %v (%v)", countedFrames,
+                 countedDuration, err)
+    }
+    counter.Write(frame[:10])
+    _, _, err = counter.Duration()
+    if err == nil {
+        t.Fatal("incomplete frame not spotted by the counter")
+    }
+
+    mp3Writer, samplesPerFrame := createMp3Writer(&mp3Audio, encoderOptions)
+    if mp3Writer == nil {
+        t.Fatal("unable to create MP3 writer")
+    }
+    defer mp3Writer.Close()
+    numSamples := MAX_MP3_FILE_SAMPLES / samplesPerFrame * samplesPerFrame
+    pcm := make([]byte, numSamples * URTP_SAMPLE_SIZE)
+    for x := 0; x < numSamples; x++ {
+        binary.LittleEndian.PutUint16(pcm[x * URTP_SAMPLE_SIZE:], uint16(x * 256))
+    }
+    _, err = mp3Writer.Write(pcm)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sampleRate := mp3SampleRate(encoderOptions)
+    estimate := time.Duration(numSamples) * time.Second / time.Duration(SAMPLING_FREQUENCY)
+    duration, frames, err = mp3AudioDuration(mp3Audio.Bytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    log.Printf("Test: %d sample(s) encoded, estimated duration %v, %d frame(s) read back, exact duration %v.\n",
+               numSamples, estimate, frames, duration)
+    if duration != mp3FramesDurationAt(frames, samplesPerFrame, sampleRate) {
+        t.Fatalf("%d frame(s) read back as %v when they should be %v", frames, duration,
+                 mp3FramesDurationAt(frames, samplesPerFrame, sampleRate))
+    }
+    if (duration > estimate) || (estimate - duration > mp3FramesDurationAt(MP3_EXACT_DURATION_MAX_LAG_FRAMES, samplesPerFrame, sampleRate)) {
+        t.Fatalf("exact duration %v is too far from the estimate of %v", duration, estimate)
+    }
+}
+
+/* End Of File */
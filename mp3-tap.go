@@ -0,0 +1,162 @@
+/* Fan-out of the encoded MP3 stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "io"
+    "log"
+    "sync"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Fans the continuous encoded MP3 stream, as it comes out of the
+// encoder, out to any number of sinks (e.g. the clients of LIVE_MP3_PATH,
+// an archive file or an Icecast source connection); the encoder is never
+// held up by a sink: each has a queue and is dropped if it lets it fill
+type Mp3Tap struct {
+    sinks map[*Mp3TapSink]bool
+    access sync.Mutex
+}
+
+// A sink of the MP3 tap: the chunks of MP3 arrive on data, which is
+// closed when the sink is dropped or removed
+type Mp3TapSink struct {
+    name string
+    data chan []byte
+    // Closed once the writer of a sink added with AddWriter() is done
+    // with, nil otherwise
+    done chan struct{}
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The tap on the output of the MP3 encoder
+var mp3Tap = newMp3Tap()
+
+// The number of sinks dropped for falling behind or failing, accessed
+// atomically
+var numMp3TapSinksDropped int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create an MP3 tap with no sinks
+func newMp3Tap() *Mp3Tap {
+    return &Mp3Tap{sinks: make(map[*Mp3TapSink]bool)}
+}
+
+// Add a sink which takes the chunks of MP3 from its data channel; it may
+// fall up to queueLength chunks behind before it is dropped
+func (tap *Mp3Tap) Subscribe(name string, queueLength int) *Mp3TapSink {
+    sink := &Mp3TapSink{name: name, data: make(chan []byte, queueLength)}
+    tap.access.Lock()
+    tap.sinks[sink] = true
+    tap.access.Unlock()
+    return sink
+}
+
+// Add a sink which writes the chunks of MP3 to writer, from a goroutine
+// of its own; it is dropped if writer returns an error or falls more than
+// queueLength chunks behind, writer is then no longer written to
+func (tap *Mp3Tap) AddWriter(name string, writer io.Writer, queueLength int) *Mp3TapSink {
+    sink := tap.Subscribe(name, queueLength)
+    sink.done = make(chan struct{})
+    go func() {
+        defer close(sink.done)
+        for chunk := range sink.data {
+            _, err := writer.Write(chunk)
+            if err != nil {
+                log.Printf("MP3 tap sink \"%s\" failed (%s), dropping it.\n", name, err.Error())
+                tap.drop(sink)
+                return
+            }
+        }
+    }()
+    return sink
+}
+
+// Remove a sink, closing its data channel
+func (tap *Mp3Tap) Unsubscribe(sink *Mp3TapSink) {
+    tap.access.Lock()
+    if tap.sinks[sink] {
+        delete(tap.sinks, sink)
+        close(sink.data)
+    }
+    tap.access.Unlock()
+}
+
+// Drop a sink that has fallen behind or failed, counting it
+func (tap *Mp3Tap) drop(sink *Mp3TapSink) {
+    tap.access.Lock()
+    if tap.sinks[sink] {
+        delete(tap.sinks, sink)
+        close(sink.data)
+        atomic.AddInt64(&numMp3TapSinksDropped, 1)
+    }
+    tap.access.Unlock()
+}
+
+// Wait until the writer of a sink added with AddWriter() is done with,
+// which is once the sink has been dropped or removed
+func (sink *Mp3TapSink) Wait() {
+    if sink.done != nil {
+        <-sink.done
+    }
+}
+
+// Send newly encoded MP3 to all of the sinks, dropping any that has
+// fallen too far behind; the caller's buffer may be re-used, so each
+// sink is given the same copy
+func (tap *Mp3Tap) Write(data []byte) (int, error) {
+    tap.access.Lock()
+    defer tap.access.Unlock()
+    if (len(data) == 0) || (len(tap.sinks) == 0) {
+        return len(data), nil
+    }
+    chunk := append([]byte(nil), data...)
+    for sink := range tap.sinks {
+        select {
+            case sink.data <- chunk:
+            default:
+                dropped := atomic.AddInt64(&numMp3TapSinksDropped, 1)
+                log.Printf("MP3 tap sink \"%s\" has fallen more than %d chunk(s) behind, dropping it (%d sink(s) dropped so far).\n",
+                           sink.name, cap(sink.data), dropped)
+                delete(tap.sinks, sink)
+                close(sink.data)
+        }
+    }
+    return len(data), nil
+}
+
+// Return the number of sinks of the given name
+func (tap *Mp3Tap) Count(name string) int {
+    var count int
+
+    tap.access.Lock()
+    defer tap.access.Unlock()
+    for sink := range tap.sinks {
+        if sink.name == name {
+            count++
+        }
+    }
+    return count
+}
+
+/* End Of File */
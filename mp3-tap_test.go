@@ -0,0 +1,80 @@
+/* Tests of fan-out of the encoded MP3 stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "bytes"
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A writer which always fails
+type FailingWriter struct{}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Fail to write anything
+func (FailingWriter) Write(data []byte) (int, error) {
+    return 0, errors.New("simulated sink failure")
+}
+
+// Feed a tap with a sink that keeps up, one that never reads and one
+// whose writer fails, checking that the first gets the whole stream and
+// the others are dropped, without holding up the writes to the tap
+func TestMp3Tap(t *testing.T) {
+    var written bytes.Buffer
+    var stream []byte
+
+    tap := newMp3Tap()
+    dropped := atomic.LoadInt64(&numMp3TapSinksDropped)
+    fast := tap.AddWriter("fast", &written, 10)
+    slow := tap.Subscribe("slow", 2)
+    failing := tap.AddWriter("failing", FailingWriter{}, 10)
+    chunk := make([]byte, 100)
+    for x := 0; x < 3; x++ {
+        for y := range chunk {
+            chunk[y] = byte(x)
+        }
+        stream = append(stream, chunk...)
+        // The chunk is re-used, as the encoder's buffer is
+        tap.Write(chunk)
+    }
+    failing.Wait()
+    tap.Unsubscribe(fast)
+    fast.Wait()
+    if !bytes.Equal(written.Bytes(), stream) {
+        t.Fatalf("sink that kept up was given %d byte(s) of a stream of %d", written.Len(), len(stream))
+    }
+    queued := 0
+    for range slow.data {
+        queued++
+    }
+    if queued != 2 {
+        t.Fatalf("sink that fell behind was given %d chunk(s) when it had room for 2", queued)
+    }
+    if (tap.Count("fast") + tap.Count("slow") + tap.Count("failing") != 0) ||
+       (atomic.LoadInt64(&numMp3TapSinksDropped) - dropped != 2) {
+        t.Fatalf("%d sink(s) dropped, %d left, when 2 should have been dropped and none left",
+                 atomic.LoadInt64(&numMp3TapSinksDropped) - dropped,
+                 tap.Count("fast") + tap.Count("slow") + tap.Count("failing"))
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,176 @@
+/* Muting of the audio for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+    "strings"
+    "net/http"
+    "crypto/subtle"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The mute state, as served by the admin endpoints
+type MuteState struct {
+    Muted bool `json:"muted"`
+    // When the audio will be unmuted automatically, absent if it won't be
+    Until string `json:"until,omitempty"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL paths of the admin endpoints, all under ADMIN_PATH
+const ADMIN_PATH string = "/admin/"
+const ADMIN_MUTE_PATH string = "/admin/mute"
+const ADMIN_UNMUTE_PATH string = "/admin/unmute"
+
+// The query parameter of ADMIN_MUTE_PATH giving the time after which
+// the audio is unmuted automatically, e.g. ?for=30s
+const ADMIN_MUTE_FOR_PARAMETER string = "for"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Whether the audio is muted and, if non-zero, when it will be unmuted
+var muted bool
+var muteUntil time.Time
+var muteAccess sync.Mutex
+
+// The bearer token required by the admin endpoints
+var adminToken string
+var adminTokenAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Mute the audio, unmuting it automatically after duration if that is non-zero
+func mute(duration time.Duration) {
+    muteAccess.Lock()
+    defer muteAccess.Unlock()
+    muted = true
+    muteUntil = time.Time{}
+    if duration > 0 {
+        muteUntil = time.Now().Add(duration)
+        log.Printf("Audio MUTED for %v.\n", duration)
+    } else {
+        log.Printf("Audio MUTED.\n")
+    }
+}
+
+// Unmute the audio
+func unmute() {
+    muteAccess.Lock()
+    defer muteAccess.Unlock()
+    if muted {
+        log.Printf("Audio unmuted.\n")
+    }
+    muted = false
+    muteUntil = time.Time{}
+}
+
+// Return the mute state, unmuting the audio if the time has come
+func muteState() MuteState {
+    var state MuteState
+
+    muteAccess.Lock()
+    defer muteAccess.Unlock()
+    if muted && !muteUntil.IsZero() && !time.Now().Before(muteUntil) {
+        log.Printf("Audio unmuted automatically.\n")
+        muted = false
+        muteUntil = time.Time{}
+    }
+    state.Muted = muted
+    if muted && !muteUntil.IsZero() {
+        state.Until = muteUntil.UTC().Format(time.RFC3339)
+    }
+
+    return state
+}
+
+// Return true if the audio is muted
+func isMuted() bool {
+    return muteState().Muted
+}
+
+// Set the bearer token required by the admin endpoints, which must not be empty
+func setAdminToken(token string) {
+    adminTokenAccess.Lock()
+    defer adminTokenAccess.Unlock()
+    adminToken = token
+}
+
+// Return true if a request carries the admin token as a bearer token;
+// if it does not, respond with an error
+func checkAdminToken(out http.ResponseWriter, in *http.Request) bool {
+    adminTokenAccess.Lock()
+    expected := adminToken
+    adminTokenAccess.Unlock()
+    token := strings.TrimPrefix(in.Header.Get("Authorization"), "Bearer ")
+    if (expected == "") || (subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1) {
+        log.Printf("Refused unauthorised admin request for \"%s\" from %s.\n", in.URL.Path, in.RemoteAddr)
+        out.Header().Set("WWW-Authenticate", "Bearer")
+        apiError(out, in, http.StatusUnauthorized, API_ERROR_UNAUTHORISED, "missing or incorrect admin token")
+        return false
+    }
+
+    return true
+}
+
+// Handle POST requests to ADMIN_MUTE_PATH and ADMIN_UNMUTE_PATH,
+// responding with the resulting MuteState
+func muteHandler(out http.ResponseWriter, in *http.Request) {
+    var duration time.Duration
+    var err error
+
+    if in.Method != "POST" {
+        apiMethodNotAllowed(out, in, "POST")
+        return
+    }
+    if !checkAdminToken(out, in) {
+        return
+    }
+    if in.URL.Path == ADMIN_MUTE_PATH {
+        value := in.URL.Query().Get(ADMIN_MUTE_FOR_PARAMETER)
+        if value != "" {
+            duration, err = time.ParseDuration(value)
+            if (err != nil) || (duration <= 0) {
+                apiError(out, in, http.StatusBadRequest, API_ERROR_BAD_REQUEST, "invalid \"" + ADMIN_MUTE_FOR_PARAMETER + "\" duration")
+                return
+            }
+        }
+        log.Printf("Mute requested by %s.\n", in.RemoteAddr)
+        mute(duration)
+    } else {
+        log.Printf("Unmute requested by %s.\n", in.RemoteAddr)
+        unmute()
+    }
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    state := muteState()
+    err = json.NewEncoder(out).Encode(&state)
+    if err != nil {
+        log.Printf("Unable to serve mute state (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
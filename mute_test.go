@@ -0,0 +1,68 @@
+/* Tests of muting for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Feed datagrams through processDatagram() while muted, failing if the
+// silence written for a gap in the sequence numbers is not what would
+// be concealed were the audio not muted, in particular for a repeated
+// or a restarted sequence number, where there should be no gap at all
+func TestMutedGap(t *testing.T) {
+    savedConcealer := concealer
+    savedFiller := underrunFiller
+    concealer = RepeatConcealer{}
+    underrunFiller = nil
+    t.Cleanup(func() {
+        concealer = savedConcealer
+        underrunFiller = savedFiller
+        unmute()
+        resetTimeline()
+        pcmAudio.Reset()
+        concealedSamples = 0
+    })
+    full := make([]int16, SAMPLES_PER_BLOCK)
+    for _, test := range []struct{name string; sequenceNumber uint16; samples int}{
+                            {"next", 11, SAMPLES_PER_BLOCK},
+                            {"skipped", 13, SAMPLES_PER_BLOCK * 4},
+                            {"repeated", 10, SAMPLES_PER_BLOCK},
+                            {"restarted", 2, SAMPLES_PER_BLOCK}} {
+        var samples [2]int
+        for x, muteIt := range []bool{false, true} {
+            ring := createDatagramRing(NUM_PROCESSED_DATAGRAMS)
+            unmute()
+            resetTimeline()
+            first := &UrtpDatagram{SequenceNumber: 10, Timestamp: 1000, Audio: &full}
+            processDatagram(first, ring, nil)
+            ring.Push(first)
+            if muteIt {
+                mute(0)
+            }
+            pcmAudio.Reset()
+            processDatagram(&UrtpDatagram{SequenceNumber: test.sequenceNumber, Timestamp: 21000, Audio: &full}, ring, nil)
+            samples[x] = pcmAudio.Len() / URTP_SAMPLE_SIZE
+        }
+        if (samples[0] != test.samples) || (samples[1] != test.samples) {
+            t.Fatalf("%s: %d sample(s) buffered unmuted and %d muted when %d were expected",
+                     test.name, samples[0], samples[1], test.samples)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,87 @@
+/* Out of service handling for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "log"
+    "errors"
+    "strconv"
+    "net/http"
+    "io/ioutil"
+    "html/template"
+    "path/filepath"
+    _ "embed"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How often, in seconds, the maintenance page checks whether the live
+// audio is back, also given to players in Retry-After
+const MAINTENANCE_RETRY_SECONDS int = 30
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// A minimal maintenance page, served while out of service when the
+// OOS directory the operator gave can't be used
+//go:embed maintenance.html
+var maintenanceHtml string
+
+// The template made from maintenanceHtml
+var maintenanceTemplate = template.Must(template.New("maintenance").Parse(maintenanceHtml))
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that an OOS directory can be served: that it exists, is a
+// directory, can be read and has an index.html in it
+func checkOosDir(oOSDir string) error {
+    info, err := os.Stat(oOSDir)
+    if err != nil {
+        return err
+    }
+    if !info.IsDir() {
+        return errors.New("not a directory")
+    }
+    _, err = ioutil.ReadDir(oOSDir)
+    if err != nil {
+        return err
+    }
+    handle, err := os.Open(filepath.Join(oOSDir, "index.html"))
+    if err != nil {
+        return errors.New("no readable index.html")
+    }
+    handle.Close()
+
+    return nil
+}
+
+// Serve the embedded maintenance page, as service is unavailable
+func maintenanceHandler(out http.ResponseWriter, in *http.Request) {
+    log.Printf("Home handler was asked for \"%s\" while out of service, serving embedded maintenance page...\n", in.URL.Path)
+    out.Header().Set("Content-Type", "text/html; charset=utf-8")
+    out.Header().Set("Cache-Control","no-cache")
+    out.Header().Set("Retry-After", strconv.Itoa(MAINTENANCE_RETRY_SECONDS))
+    out.WriteHeader(http.StatusServiceUnavailable)
+    err := maintenanceTemplate.Execute(out, struct{ RetrySeconds int }{MAINTENANCE_RETRY_SECONDS})
+    if err != nil {
+        log.Printf("Unable to serve embedded maintenance page (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
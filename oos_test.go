@@ -0,0 +1,58 @@
+/* Tests of out of service handling for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+    "net/http"
+    "io/ioutil"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that missing, empty and unreadable OOS directories are refused
+// and a proper one accepted, then that the maintenance page is served
+func TestOosDir(t *testing.T) {
+    var err error
+    dirName := t.TempDir()
+    if checkOosDir(filepath.Join(dirName, "missing")) == nil {
+        t.Fatal("missing OOS directory accepted")
+    }
+    if checkOosDir(dirName) == nil {
+        t.Fatal("OOS directory without an index.html accepted")
+    }
+    err = ioutil.WriteFile(filepath.Join(dirName, "index.html"), []byte("<html></html>"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if checkOosDir(filepath.Join(dirName, "index.html")) == nil {
+        t.Fatal("OOS \"directory\" which is a file accepted")
+    }
+    err = checkOosDir(dirName)
+    if err != nil {
+        t.Fatalf("good OOS directory refused (%s)", err.Error())
+    }
+
+    response := httptest.NewRecorder()
+    maintenanceHandler(response, httptest.NewRequest("GET", "/", nil))
+    if (response.Code != http.StatusServiceUnavailable) || (response.Header().Get("Retry-After") == "") ||
+       (response.Body.Len() == 0) {
+        t.Fatalf("maintenance page served with status %d, %d byte(s)", response.Code, response.Body.Len())
+    }
+}
+
+/* End Of File */
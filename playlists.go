@@ -0,0 +1,176 @@
+/* Multiple playlists over one set of segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// How a playlist lists the segments, e.g. a short window for low latency
+// or a long one for an archive
+type PlaylistConfig struct {
+    // The name of the playlist, its file being this with PLAYLIST_EXTENSION
+    // in the live playlist directory
+    Name string
+    // How long a segment is listed
+    Window time.Duration
+    // If greater than zero, the number of segments listed is capped at this,
+    // irrespective of their age
+    MaxSegments int
+    // How far back from the newest segment a player should start, given
+    // in #EXT-X-START, 0 for wherever the player chooses
+    StartOffset time.Duration
+}
+
+// A playlist over the segments of mp3FileList; every playlist lists every
+// new segment and then retires it according to its own PlaylistConfig
+type Playlist struct {
+    PlaylistConfig
+    fileName string
+    // The index of the playlist in playlists and in Mp3AudioFile.listed
+    index int
+    mediaSequenceNumber int
+    // The number of discontinuities that have left the playlist
+    discontinuitySequenceNumber int
+    // The URI of the newest segment in the playlist file, "" if there is
+    // none, and the contents of the playlist file as last written, which
+    // are replaced rather than modified; protected by playlistAccess
+    newestSegmentUri string
+    snapshot []byte
+    // True if the last write of the playlist file failed, so that the
+    // snapshot is out of date; protected by playlistAccess
+    stale bool
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The playlists, the live playlist first; set up by operateAudioOut()
+// and protected by playlistAccess
+var playlists []*Playlist
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Parse the configuration of an additional playlist, given as
+// name:window[:max-segments[:start-offset]], e.g. archive:2h or
+// low-latency:30s:0:6s
+func parsePlaylistConfig(spec string) (PlaylistConfig, error) {
+    var config PlaylistConfig
+    var err error
+
+    fields := strings.Split(spec, ":")
+    if (len(fields) < 2) || (len(fields) > 4) {
+        return config, errors.New("must be name:window[:max-segments[:start-offset]]")
+    }
+    config.Name = fields[0]
+    if (config.Name == "") || strings.ContainsAny(config.Name, "/\\") || (config.Name == ".") || (config.Name == "..") {
+        return config, errors.New(fmt.Sprintf("\"%s\" is not a valid playlist name", config.Name))
+    }
+    config.Window, err = time.ParseDuration(fields[1])
+    if (err == nil) && (config.Window <= 0) {
+        err = errors.New("window must be longer than zero")
+    }
+    if (err == nil) && (len(fields) > 2) {
+        config.MaxSegments, err = strconv.Atoi(fields[2])
+        if (err == nil) && (config.MaxSegments < 0) {
+            err = errors.New("maximum number of segments cannot be negative")
+        }
+    }
+    if (err == nil) && (len(fields) > 3) {
+        config.StartOffset, err = time.ParseDuration(fields[3])
+        if (err == nil) && ((config.StartOffset < 0) || (config.StartOffset > config.Window)) {
+            err = errors.New("start offset must be from zero to the window")
+        }
+    }
+
+    return config, err
+}
+
+// Parse the configurations of the additional playlists, checking that
+// their names are different from each other and from that of the live
+// playlist, liveName
+func parsePlaylistConfigs(specs []string, liveName string) ([]PlaylistConfig, error) {
+    var configs []PlaylistConfig
+
+    names := map[string]bool{liveName: true}
+    for _, spec := range specs {
+        config, err := parsePlaylistConfig(spec)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("\"%s\": %s", spec, err.Error()))
+        }
+        if names[config.Name] {
+            return nil, errors.New(fmt.Sprintf("\"%s\": there is already a playlist called \"%s\"", spec, config.Name))
+        }
+        names[config.Name] = true
+        configs = append(configs, config)
+    }
+
+    return configs, nil
+}
+
+// Create the playlists: the live playlist, at playlistPath, then the
+// additional ones in the same directory
+func createPlaylists(playlistPath string, live PlaylistConfig, additional []PlaylistConfig) []*Playlist {
+    var created []*Playlist
+
+    live.Name = strings.TrimSuffix(filepath.Base(playlistPath), PLAYLIST_EXTENSION)
+    created = append(created, &Playlist{PlaylistConfig: live, fileName: playlistPath})
+    for _, config := range additional {
+        created = append(created, &Playlist{PlaylistConfig: config,
+                                            fileName: filepath.Join(filepath.Dir(playlistPath), config.Name + PLAYLIST_EXTENSION),
+                                            index: len(created)})
+    }
+
+    return created
+}
+
+// Return the longest window of the playlists
+func longestPlaylistWindow() time.Duration {
+    var longest time.Duration
+
+    for _, playlist := range playlists {
+        if playlist.Window > longest {
+            longest = playlist.Window
+        }
+    }
+    return longest
+}
+
+// Return the playlist served at the given URL path, nil if there is none
+func playlistServedAt(urlPath string) *Playlist {
+    for _, playlist := range playlists {
+        if playlistUrl(playlist.fileName) == urlPath {
+            return playlist
+        }
+    }
+    return nil
+}
+
+// Return true if an MP3 file is listed in the given playlist
+func (mp3AudioFile *Mp3AudioFile) listedIn(playlist *Playlist) bool {
+    return (playlist.index < len(mp3AudioFile.listed)) && mp3AudioFile.listed[playlist.index]
+}
+
+/* End Of File */
@@ -0,0 +1,117 @@
+/* Tests of multiple playlists over one set of segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "bytes"
+    "errors"
+    "testing"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Age segments through a short live playlist and a long archive playlist,
+// failing if either lists the wrong segments or a segment is
+// deleted while a playlist still lists it
+func TestPlaylists(t *testing.T) {
+    var store OsFileStore
+    var fileNames []string
+
+    var err error
+    dirName := t.TempDir()
+    options := AudioOutOptions{PlaylistStore: store, SegmentStore: store, PlaylistWindow: time.Second * 20,
+                               Retention: time.Minute * 2}
+    playlistAccess.Lock()
+    playlists = createPlaylists(filepath.Join(dirName, "live" + PLAYLIST_EXTENSION),
+                                PlaylistConfig{Window: options.PlaylistWindow},
+                                []PlaylistConfig{{Name: "archive", Window: time.Minute * 2}})
+    playlistAccess.Unlock()
+    mp3FileList.Init()
+    t.Cleanup(func() {
+        mp3FileList.Init()
+    })
+
+    // Segments 90, 30 and 5 seconds old
+    for x, age := range []time.Duration{time.Second * 90, time.Second * 30, time.Second * 5} {
+        fileName := fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION)
+        err = writeStoreFile(store, filepath.Join(dirName, fileName), []byte("MP3"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        fileNames = append(fileNames, fileName)
+        addMp3File(&Mp3AudioFile{fileName: fileName, timestamp: time.Now().Add(-age), duration: time.Second * 5},
+                   options, false)
+    }
+    check := func(playlist *Playlist, mediaSequenceNumber int, listed []string) error {
+        contents, err := readStoreFile(store, playlist.fileName)
+        if err != nil {
+            return err
+        }
+        for _, fileName := range listed {
+            if !bytes.Contains(contents, []byte("\r\n" + fileName + "\r\n")) {
+                return errors.New(fmt.Sprintf("playlist \"%s\" does not list \"%s\":\n%s", playlist.Name, fileName, contents))
+            }
+        }
+        if (bytes.Count(contents, []byte("#EXTINF")) != len(listed)) ||
+           !bytes.Contains(contents, []byte(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\r\n", mediaSequenceNumber))) {
+            return errors.New(fmt.Sprintf("playlist \"%s\" should list %d segment(s) from %d:\n%s", playlist.Name,
+                                          len(listed), mediaSequenceNumber, contents))
+        }
+        return nil
+    }
+    exists := func(fileName string) bool {
+        _, err := os.Stat(filepath.Join(dirName, fileName))
+        return err == nil
+    }
+
+    ageMp3Files(dirName, options, false)
+    err = check(playlists[0], 2, fileNames[2:])
+    if err == nil {
+        err = check(playlists[1], 0, fileNames)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Shorten the archive and the retention: the oldest segment is now
+    // listed nowhere and can go, the next is still in the archive
+    playlists[1].Window = time.Minute
+    options.Retention = time.Minute
+    ageMp3Files(dirName, options, false)
+    err = check(playlists[1], 1, fileNames[1:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if exists(fileNames[0]) || !exists(fileNames[1]) || !exists(fileNames[2]) {
+        t.Fatalf("only \"%s\" should have been deleted", fileNames[0])
+    }
+    // Segments are only advertised as independent if they are
+    for _, independent := range []bool{false, true} {
+        options.IndependentSegments = independent
+        updatePlaylistFiles(options, false)
+        contents, err := readStoreFile(store, playlists[0].fileName)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if bytes.Contains(contents, []byte("#EXT-X-INDEPENDENT-SEGMENTS\r\n")) != independent {
+            t.Fatalf("independent segments %t but the playlist is:\n%s", independent, contents)
+        }
+    }
+}
+
+/* End Of File */
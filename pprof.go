@@ -0,0 +1,51 @@
+/* Profiling endpoint for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "context"
+    "net/http"
+    "net/http/pprof"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Serve Go's profiling endpoints under /debug/pprof/ on addr, kept
+// apart from the public HTTP server, until ctx is cancelled
+func operatePprof(ctx context.Context, addr string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+    server := &http.Server{Addr: addr, Handler: mux}
+    go func() {
+        <-ctx.Done()
+        server.Close()
+    }()
+
+    fmt.Printf("Serving profiling data at http://%s/debug/pprof/.\n", addr)
+    err := server.ListenAndServe()
+    if (err != nil) && (err != http.ErrServerClosed) {
+        log.Printf("Profiling server on \"%s\" stopped (%s).\n", addr, err.Error())
+        fmt.Printf("Unable to serve profiling data on \"%s\" (%s).\n", addr, err.Error())
+    }
+}
+
+/* End Of File */
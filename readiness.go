@@ -0,0 +1,100 @@
+/* Readiness of the stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "strconv"
+    "net/http"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL path at which the readiness of the stream is served, 200
+// once it is in service, 503 before then and while it is out of service
+const READYZ_PATH string = "/readyz"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The number of segments there must be before the stream is first
+// advertised as ready, and the number there have been so far, accessed
+// atomically
+var readySegments int64
+var numSegmentsSinceStart int64
+
+// True, accessed atomically, while the stream is advertised as ready
+var streamReady int32
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Set the number of segments there must be before the stream is first
+// advertised as ready and start counting them again
+func setReadySegments(segments int) {
+    atomic.StoreInt64(&readySegments, int64(segments))
+    atomic.StoreInt64(&numSegmentsSinceStart, 0)
+    atomic.StoreInt32(&streamReady, 0)
+}
+
+// Count a new segment, returning true if there are now enough for the
+// stream to be advertised as ready
+func countSegmentTowardsReady() bool {
+    segments := atomic.AddInt64(&numSegmentsSinceStart, 1)
+    if segments == atomic.LoadInt64(&readySegments) {
+        log.Printf("%d segment(s) now exist, the stream is ready.\n", segments)
+    }
+    return segments >= atomic.LoadInt64(&readySegments)
+}
+
+// Record whether the stream is being advertised as ready
+func setStreamReady(ready bool) {
+    var value int32
+
+    if ready {
+        value = 1
+    }
+    atomic.StoreInt32(&streamReady, value)
+}
+
+// Return true if the stream is being advertised as ready, i.e. is in
+// service
+func isStreamReady() bool {
+    return atomic.LoadInt32(&streamReady) != 0
+}
+
+// Serve the readiness of the stream, for a load balancer or orchestrator
+func readyzHandler(out http.ResponseWriter, in *http.Request) {
+    out.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    out.Header().Set("Cache-Control","no-cache")
+    if isStreamReady() {
+        fmt.Fprintf(out, "ready\n")
+        return
+    }
+    out.Header().Set("Retry-After", strconv.Itoa(MAINTENANCE_RETRY_SECONDS))
+    out.WriteHeader(http.StatusServiceUnavailable)
+    segments := atomic.LoadInt64(&numSegmentsSinceStart)
+    if segments < atomic.LoadInt64(&readySegments) {
+        fmt.Fprintf(out, "not ready, %d of %d segment(s)\n", segments, atomic.LoadInt64(&readySegments))
+    } else {
+        fmt.Fprintf(out, "out of service\n")
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,58 @@
+/* Tests of readiness of the stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Count segments up to the number needed, checking that the stream is
+// not advertised as ready until there are enough, then that it stops
+// being ready while out of service
+func TestReadiness(t *testing.T) {
+    ready := func() int {
+        response := httptest.NewRecorder()
+        readyzHandler(response, httptest.NewRequest("GET", READYZ_PATH, nil))
+        return response.Code
+    }
+
+    setReadySegments(3)
+    t.Cleanup(func() {
+        setReadySegments(0)
+    })
+    if ready() != http.StatusServiceUnavailable {
+        t.Fatal("stream ready before there were any segments")
+    }
+    for x := 1; x <= 3; x++ {
+        enough := countSegmentTowardsReady()
+        setStreamReady(enough)
+        if enough != (x == 3) {
+            t.Fatalf("%d segment(s) taken to be enough (%t) when 3 are needed", x, enough)
+        }
+        if (ready() == http.StatusOK) != enough {
+            t.Fatalf("readiness served as %d after %d segment(s)", ready(), x)
+        }
+    }
+    setStreamReady(false)
+    if ready() != http.StatusServiceUnavailable {
+        t.Fatal("stream ready while out of service")
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,161 @@
+/* Reloading of configuration for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "os"
+    "context"
+    "fmt"
+    "reflect"
+    "syscall"
+    "os/signal"
+    "github.com/jessevdk/go-flags"
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The options, by long name, which may be changed without a restart;
+// all of them are applied by applyReloadedOptions()
+var reloadableOptions = map[string]bool{"title": true, "artist": true, "genre": true,
+                                        "allow-source": true, "allow-origin": true, "admin-token": true}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Parse the options from the configuration file, if there is one, the
+// environment (see envOptionArgs()) and then the command line, each
+// taking precedence over the one before
+func parseOptions(options *Options) error {
+    return parseOptionArgs(options, os.Args[1:])
+}
+
+// Parse the options as parseOptions() does, from the given command line
+func parseOptionArgs(options *Options, args []string) error {
+    parser := createOptionsParser(options)
+    _, err := parser.ParseArgs(args)
+    if err != nil {
+        return err
+    }
+    configFile := options.ConfigFile
+    if configFile == "" {
+        configFile = os.Getenv(envOptionName("config"))
+    }
+    envArgs, err := envOptionArgs(parser)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+        return err
+    }
+    if (configFile != "") || (len(envArgs) > 0) {
+        // Start again, with the configuration file giving the defaults
+        // for the environment and the command line
+        *options = Options{}
+        parser = createOptionsParser(options)
+        if configFile != "" {
+            iniParser := flags.NewIniParser(parser)
+            iniParser.ParseAsDefaults = true
+            err = iniParser.ParseFile(configFile)
+        }
+        if err == nil {
+            _, err = parser.ParseArgs(append(envArgs, args...))
+        }
+    }
+    if err == nil {
+        err = fillEnvPositionalArgs(options)
+    }
+
+    return err
+}
+
+// Return the long name of an option
+func optionName(field reflect.StructField) string {
+    name := field.Tag.Get("long")
+    if name == "" {
+        name = field.Name
+    }
+    return name
+}
+
+// Apply the reloadable options, returning false if any is invalid,
+// in which case none are applied
+func applyReloadedOptions(newOpts *Options) bool {
+    if (opts.AdminToken != "") != (newOpts.AdminToken != "") {
+        log.Printf("The admin endpoints cannot be enabled or disabled without a restart.\n")
+        return false
+    }
+    err := setAllowedSources(newOpts.AllowSource)
+    if err != nil {
+        log.Printf("Invalid allowed source (%s).\n", err.Error())
+        return false
+    }
+    setAllowedOrigins(newOpts.AllowOrigin)
+    setNowPlaying(Mp3Metadata{Title: newOpts.Title, Artist: newOpts.Artist, Genre: newOpts.Genre})
+    if newOpts.AdminToken != "" {
+        setAdminToken(newOpts.AdminToken)
+    }
+
+    return true
+}
+
+// Read the configuration file and command line again, applying the
+// options that may be changed without a restart and logging (but
+// otherwise ignoring) changes to those that may not
+func reloadOptions() {
+    var newOpts Options
+
+    log.Printf("Reloading the configuration.\n")
+    err := parseOptions(&newOpts)
+    if err != nil {
+        log.Printf("Unable to reload the configuration (%s), keeping the current one.\n", err.Error())
+        return
+    }
+    current := reflect.ValueOf(&opts).Elem()
+    reloaded := reflect.ValueOf(&newOpts).Elem()
+    for x := 0; x < current.NumField(); x++ {
+        name := optionName(current.Type().Field(x))
+        if !reflect.DeepEqual(current.Field(x).Interface(), reloaded.Field(x).Interface()) {
+            if reloadableOptions[name] {
+                log.Printf("Option %s changed.\n", name)
+            } else {
+                log.Printf("Option %s cannot be changed without a restart, ignoring the change.\n", name)
+                reloaded.Field(x).Set(current.Field(x))
+            }
+        }
+    }
+    if applyReloadedOptions(&newOpts) {
+        opts = newOpts
+        log.Printf("Configuration reloaded.\n")
+    } else {
+        log.Printf("Configuration not reloaded, keeping the current one.\n")
+    }
+}
+
+// Reload the configuration on SIGHUP until ctx is cancelled
+func operateReload(ctx context.Context) {
+    channel := make(chan os.Signal, 1)
+    signal.Notify(channel, syscall.SIGHUP)
+    defer signal.Stop(channel)
+    for {
+        select {
+            case <-channel:
+                reloadOptions()
+            case <-ctx.Done():
+                return
+        }
+    }
+}
+
+/* End Of File */
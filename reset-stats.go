@@ -0,0 +1,99 @@
+/* Resetting of the statistics of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "net/http"
+    "sync/atomic"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL path of the admin endpoint that resets the statistics
+const ADMIN_RESET_STATS_PATH string = "/admin/reset-stats"
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Zero the cumulative counters, returning the statistics as they were
+// at the moment each was zeroed; each counter is swapped for zero
+// atomically so an increment made concurrently is counted either
+// before or after the reset, never lost.  Live state (the sources,
+// mute, the open TCP connections and their own statistics, the
+// concealment breaker window) is not touched and the peak of TCP
+// connections starts again from the number open now
+func resetStats() Stats {
+    var stats Stats
+
+    stats.EncoderErrors = atomic.SwapInt64(&numEncoderErrors, 0)
+    stats.StaleDatagrams = atomic.SwapInt64(&numStaleDatagrams, 0)
+    stats.FileWriteFailures = atomic.SwapInt64(&numFileWriteFailures, 0)
+    worst := atomic.SwapInt64(&tickLatencyWorst, 0)
+    ticks := atomic.SwapInt64(&numTicks, 0)
+    total := atomic.SwapInt64(&tickLatencyTotal, 0)
+    stats.TickLatencyWorstMs = float64(worst) / float64(time.Millisecond)
+    if ticks > 0 {
+        stats.TickLatencyAverageMs = float64(total / ticks) / float64(time.Millisecond)
+    }
+    stats.TcpConnections = atomic.LoadInt64(&numTcpConnections)
+    stats.TcpConnectionsPeak = atomic.SwapInt64(&peakTcpConnections, stats.TcpConnections)
+    stats.TcpConnectionsRejected = atomic.SwapInt64(&numRejectedTcpConnections, 0)
+    stats.EncoderEffort = encoderEffortState()
+    stats.EncoderEffort.Reductions = atomic.SwapInt64(&numEncoderEffortReductions, 0)
+    stats.Heartbeats = atomic.SwapInt64(&numHeartbeats, 0)
+    stats.TcpReassemblyResets = atomic.SwapInt64(&numTcpReassemblyResets, 0)
+    stats.PlaylistWriteFailures = atomic.SwapInt64(&numPlaylistWriteFailures, 0)
+    stats.SegmentsExpiredUnfetched = atomic.SwapInt64(&numSegmentsExpiredUnfetched, 0)
+    stats.TcpResyncs = atomic.SwapInt64(&numTcpResyncs, 0)
+    stats.TcpResyncBytesDiscarded = atomic.SwapInt64(&numTcpResyncBytesDiscarded, 0)
+    stats.TcpPartialDatagrams = atomic.SwapInt64(&numTcpPartialDatagrams, 0)
+    stats.TcpConnectionsByAddress = tcpConnectionStats()
+    stats.SegmentRequestsTimedOut = atomic.SwapInt64(&numSegmentRequestsTimedOut, 0)
+    stats.SegmentsFailedVerification = atomic.SwapInt64(&numSegmentsFailedVerification, 0)
+    stats.FormatMismatches = atomic.SwapInt64(&numFormatMismatches, 0)
+    stats.Mp3TapSinksDropped = atomic.SwapInt64(&numMp3TapSinksDropped, 0)
+    stats.Mp3FrameAnomalies = atomic.SwapInt64(&numMp3FrameAnomalies, 0)
+    stats.UnknownCodingSchemes = atomic.SwapInt64(&numUnknownCodingSchemes, 0)
+    stats.UdpDatagramsRejected = udpDatagramsRejected(true)
+    atomic.StoreInt64(&numRejectedSources, 0)
+
+    return stats
+}
+
+// Handle POST requests to ADMIN_RESET_STATS_PATH, responding with the
+// statistics as they were just before they were reset
+func resetStatsHandler(out http.ResponseWriter, in *http.Request) {
+    if in.Method != "POST" {
+        apiMethodNotAllowed(out, in, "POST")
+        return
+    }
+    if !checkAdminToken(out, in) {
+        return
+    }
+    log.Printf("Statistics reset requested by %s.\n", in.RemoteAddr)
+    stats := resetStats()
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    err := json.NewEncoder(out).Encode(&stats)
+    if err != nil {
+        log.Printf("Unable to serve statistics (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
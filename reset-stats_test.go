@@ -0,0 +1,76 @@
+/* Tests of reset-stats.go for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "sync"
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of goroutines, and the number of increments each makes,
+// in TestStatsReset()
+const TEST_STATS_WRITERS int = 8
+
+const TEST_STATS_INCREMENTS int = 100000
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Reset the statistics repeatedly while goroutines increment the
+// counters, failing if the counts returned by the resets
+// plus what is left afterwards do not add up to every increment made
+func TestStatsReset(t *testing.T) {
+    var waitGroup sync.WaitGroup
+    var counted int64
+    var reset Stats
+
+    resetStats()
+    for x := 0; x < TEST_STATS_WRITERS; x++ {
+        waitGroup.Add(1)
+        go func() {
+            defer waitGroup.Done()
+            for y := 0; y < TEST_STATS_INCREMENTS; y++ {
+                atomic.AddInt64(&numEncoderErrors, 1)
+                atomic.AddInt64(&numStaleDatagrams, 1)
+            }
+        }()
+    }
+    done := make(chan struct{})
+    go func() {
+        waitGroup.Wait()
+        close(done)
+    }()
+    for running := true; running; {
+        select {
+            case <-done:
+                running = false
+            default:
+                reset = resetStats()
+                counted += reset.EncoderErrors + reset.StaleDatagrams
+        }
+    }
+    reset = resetStats()
+    counted += reset.EncoderErrors + reset.StaleDatagrams
+    expected := int64(TEST_STATS_WRITERS * TEST_STATS_INCREMENTS * 2)
+    if counted != expected {
+        t.Fatalf("resets counted %d increment(s) when %d were made", counted, expected)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,70 @@
+/* Retrying of filesystem writes for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of times a filesystem write is attempted before giving up
+const FILE_WRITE_ATTEMPTS int = 4
+
+// The wait before the first retry of a filesystem write, doubling for
+// each retry after that
+const FILE_WRITE_BACKOFF time.Duration = time.Millisecond * 10
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The total number of filesystem writes given up on, accessed atomically
+var numFileWriteFailures int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Perform a filesystem write, retrying it with backoff if it fails, up
+// to FILE_WRITE_ATTEMPTS times in all; write must be safe to repeat
+// and description says what it is for logging
+func retryFileWrite(description string, write func() error) error {
+    var err error
+
+    backoff := FILE_WRITE_BACKOFF
+    for attempt := 1; attempt <= FILE_WRITE_ATTEMPTS; attempt++ {
+        err = write()
+        if err == nil {
+            if attempt > 1 {
+                log.Printf("Succeeded in %s at attempt %d.\n", description, attempt)
+            }
+            return nil
+        }
+        if attempt < FILE_WRITE_ATTEMPTS {
+            log.Printf("Failed %s (%s), retrying in %v.\n", description, err.Error(), backoff)
+            time.Sleep(backoff)
+            backoff *= 2
+        }
+    }
+    atomic.AddInt64(&numFileWriteFailures, 1)
+    log.Printf("Gave up %s after %d attempts (%s).\n", description, FILE_WRITE_ATTEMPTS, err.Error())
+
+    return err
+}
+
+/* End Of File */
@@ -0,0 +1,52 @@
+/* Tests of retrying of filesystem writes for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that retryFileWrite() recovers from a write which fails a few
+// times and gives up on one which always fails
+func TestRetry(t *testing.T) {
+    var attempts int
+
+    err := retryFileWrite("testing a recovering write", func() error {
+        attempts++
+        if attempts < FILE_WRITE_ATTEMPTS {
+            return errors.New("simulated failure")
+        }
+        return nil
+    })
+    if (err != nil) || (attempts != FILE_WRITE_ATTEMPTS) {
+        t.Fatalf("a write that succeeds at attempt %d was not retried correctly", FILE_WRITE_ATTEMPTS)
+    }
+
+    attempts = 0
+    failures := atomic.LoadInt64(&numFileWriteFailures)
+    err = retryFileWrite("testing a failing write", func() error {
+        attempts++
+        return errors.New("simulated failure")
+    })
+    if (err == nil) || (attempts != FILE_WRITE_ATTEMPTS) || (atomic.LoadInt64(&numFileWriteFailures) != failures + 1) {
+        t.Fatal("a write that always fails was not given up on correctly")
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,316 @@
+/* S3-compatible storage of the playlist and segments for the Internet
+ * of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "io"
+    "time"
+    "bytes"
+    "sort"
+    "errors"
+    "strings"
+    "net/http"
+    "encoding/xml"
+    "path/filepath"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A FileStore in a bucket of an S3-compatible object store, addressed
+// path-style (endpoint/bucket/key) so that it works with MinIO and the
+// like as well as with AWS; requests are signed with AWS Signature V4
+type S3FileStore struct {
+    endpoint string
+    bucket string
+    prefix string
+    region string
+    accessKey string
+    secretKey string
+    publicUrl string
+    client *http.Client
+}
+
+// The response body of a copy within the bucket: the root element is
+// CopyObjectResult if the copy succeeded, Error if it did not, in which
+// case there is a code and a message
+type S3CopyResponse struct {
+    XMLName xml.Name
+    Code string `xml:"Code"`
+    Message string `xml:"Message"`
+}
+
+// A file being written to an S3FileStore, uploaded when it is closed
+type S3Object struct {
+    store *S3FileStore
+    name string
+    data bytes.Buffer
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How long to wait for a request to the object store
+const S3_REQUEST_TIMEOUT time.Duration = time.Second * 10
+
+// Appended to the key of the playlist while it is being uploaded
+const S3_UPLOAD_SUFFIX string = ".upload"
+
+// The signing algorithm
+const S3_SIGNING_ALGORITHM string = "AWS4-HMAC-SHA256"
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create an S3FileStore; if publicUrl is given (e.g. that of a CDN in
+// front of the bucket) requests for files are redirected there, else
+// they are redirected to the bucket itself
+func newS3FileStore(endpoint string, bucket string, prefix string, region string,
+                    accessKey string, secretKey string, publicUrl string) *S3FileStore {
+    return &S3FileStore{endpoint: strings.TrimSuffix(endpoint, "/"),
+                        bucket: bucket,
+                        prefix: strings.Trim(prefix, "/"),
+                        region: region,
+                        accessKey: accessKey,
+                        secretKey: secretKey,
+                        publicUrl: strings.TrimSuffix(publicUrl, "/"),
+                        client: &http.Client{Timeout: S3_REQUEST_TIMEOUT}}
+}
+
+// URI-encode a string as AWS Signature V4 requires, leaving slashes
+// alone if they are path separators
+func s3UriEncode(value string, isPath bool) string {
+    var encoded strings.Builder
+
+    for _, character := range []byte(value) {
+        if ((character >= 'A') && (character <= 'Z')) || ((character >= 'a') && (character <= 'z')) ||
+           ((character >= '0') && (character <= '9')) ||
+           (character == '-') || (character == '_') || (character == '.') || (character == '~') ||
+           (isPath && (character == '/')) {
+            encoded.WriteByte(character)
+        } else {
+            fmt.Fprintf(&encoded, "%%%02X", character)
+        }
+    }
+
+    return encoded.String()
+}
+
+// Return the HMAC-SHA256 of some data
+func s3Hmac(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+// Return the object key of a file name
+func (store *S3FileStore) key(name string) string {
+    key := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+    if store.prefix != "" {
+        key = store.prefix + "/" + key
+    }
+    return key
+}
+
+// Sign a request to the object store
+func (store *S3FileStore) sign(request *http.Request, payloadHash string, now time.Time) {
+    var names []string
+    var canonicalHeaders strings.Builder
+
+    amzDate := now.UTC().Format("20060102T150405Z")
+    date := amzDate[:8]
+    request.Header.Set("x-amz-date", amzDate)
+    request.Header.Set("x-amz-content-sha256", payloadHash)
+
+    // Sign the host and all of the x-amz- headers
+    headers := map[string]string{"host": request.URL.Host}
+    for name, values := range request.Header {
+        name = strings.ToLower(name)
+        if strings.HasPrefix(name, "x-amz-") {
+            headers[name] = strings.TrimSpace(strings.Join(values, ","))
+        }
+    }
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{request.Method, request.URL.EscapedPath(), request.URL.RawQuery,
+                                              canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+    canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+    scope := date + "/" + store.region + "/s3/aws4_request"
+    stringToSign := strings.Join([]string{S3_SIGNING_ALGORITHM, amzDate, scope,
+                                          hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+    signingKey := s3Hmac(s3Hmac(s3Hmac(s3Hmac([]byte("AWS4" + store.secretKey), date), store.region), "s3"), "aws4_request")
+    signature := hex.EncodeToString(s3Hmac(signingKey, stringToSign))
+    request.Header.Set("Authorization", S3_SIGNING_ALGORITHM + " Credential=" + store.accessKey + "/" + scope +
+                                        ", SignedHeaders=" + signedHeaders + ", Signature=" + signature)
+}
+
+// Make a request of the object store, returning an error if it fails;
+// the caller must close the body of the response
+func (store *S3FileStore) request(method string, key string, body []byte, header http.Header) (*http.Response, error) {
+    request, err := http.NewRequest(method, store.endpoint + "/" + s3UriEncode(store.bucket + "/" + key, true), bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    for name, values := range header {
+        request.Header[name] = values
+    }
+    payloadHash := sha256.Sum256(body)
+    store.sign(request, hex.EncodeToString(payloadHash[:]), time.Now())
+    response, err := store.client.Do(request)
+    if err != nil {
+        return nil, err
+    }
+    if response.StatusCode >= 300 {
+        response.Body.Close()
+        return nil, errors.New(fmt.Sprintf("%s of \"%s\" failed: %s", method, key, response.Status))
+    }
+
+    return response, nil
+}
+
+// Make a request of the object store which has no useful response body
+func (store *S3FileStore) requestOnly(method string, key string, body []byte, header http.Header) error {
+    response, err := store.request(method, key, body, header)
+    if err == nil {
+        io.Copy(io.Discard, response.Body)
+        response.Body.Close()
+    }
+    return err
+}
+
+// Copy a file within the bucket; the object store may respond 200 OK and
+// only then find that the copy has failed, so it has only succeeded if
+// the response body is a CopyObjectResult
+func (store *S3FileStore) copy(fromKey string, toKey string) error {
+    var copyResponse S3CopyResponse
+
+    header := http.Header{}
+    header.Set("x-amz-copy-source", "/" + s3UriEncode(store.bucket + "/" + fromKey, true))
+    header.Set("x-amz-metadata-directive", "COPY")
+    response, err := store.request(http.MethodPut, toKey, nil, header)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+    body, err := io.ReadAll(response.Body)
+    if err == nil {
+        err = xml.Unmarshal(body, &copyResponse)
+    }
+    if err != nil {
+        return errors.New(fmt.Sprintf("copy of \"%s\" to \"%s\" gave no readable response (%s)", fromKey, toKey, err.Error()))
+    }
+    if copyResponse.XMLName.Local == "Error" {
+        return errors.New(fmt.Sprintf("copy of \"%s\" to \"%s\" failed: %s (%s)", fromKey, toKey,
+                                      copyResponse.Code, copyResponse.Message))
+    }
+    if copyResponse.XMLName.Local != "CopyObjectResult" {
+        return errors.New(fmt.Sprintf("copy of \"%s\" to \"%s\" gave an unexpected response, <%s>", fromKey, toKey,
+                                      copyResponse.XMLName.Local))
+    }
+
+    return nil
+}
+
+// Upload a file; the playlist is uploaded under a temporary key and then
+// copied into place, so that it is replaced in one go, the temporary
+// copy only being deleted once the copy is known to have succeeded
+func (store *S3FileStore) upload(name string, data []byte) error {
+    key := store.key(name)
+    header := http.Header{}
+    if filepath.Ext(name) == SEGMENT_EXTENSION {
+        header.Set("Content-Type", "audio/mpeg")
+    } else if filepath.Ext(name) == PLAYLIST_EXTENSION {
+        header.Set("Content-Type", "application/x-mpegurl")
+        header.Set("Cache-Control", "no-cache")
+        err := store.requestOnly(http.MethodPut, key + S3_UPLOAD_SUFFIX, data, header)
+        if err != nil {
+            return err
+        }
+        err = store.copy(key + S3_UPLOAD_SUFFIX, key)
+        if err == nil {
+            store.requestOnly(http.MethodDelete, key + S3_UPLOAD_SUFFIX, nil, nil)
+        }
+        return err
+    }
+
+    return store.requestOnly(http.MethodPut, key, data, header)
+}
+
+// Create a file in the bucket; it is uploaded when it is closed
+func (store *S3FileStore) Create(name string) (StoreFile, error) {
+    return &S3Object{store: store, name: name}, nil
+}
+
+// Open a file in the bucket
+func (store *S3FileStore) Open(name string) (io.ReadCloser, error) {
+    response, err := store.request(http.MethodGet, store.key(name), nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    return response.Body, nil
+}
+
+// Remove a file from the bucket
+func (store *S3FileStore) Remove(name string) error {
+    return store.requestOnly(http.MethodDelete, store.key(name), nil, nil)
+}
+
+// Redirect a request for a file to the bucket, or the CDN in front of it
+func (store *S3FileStore) ServeContent(out http.ResponseWriter, in *http.Request, name string) {
+    var location string
+
+    if store.publicUrl != "" {
+        location = store.publicUrl + "/" + s3UriEncode(store.key(name), true)
+    } else {
+        location = store.endpoint + "/" + s3UriEncode(store.bucket + "/" + store.key(name), true)
+    }
+    http.Redirect(out, in, location, http.StatusFound)
+}
+
+// Write to a file being uploaded to the bucket
+func (object *S3Object) Write(data []byte) (int, error) {
+    return object.data.Write(data)
+}
+
+// Return the name of a file being uploaded to the bucket
+func (object *S3Object) Name() string {
+    return object.name
+}
+
+// Close a file, uploading it to the bucket; if the upload fails the file
+// may be closed again to retry it
+func (object *S3Object) Close() error {
+    err := object.store.upload(object.name, object.data.Bytes())
+    if err != nil {
+        log.Printf("Unable to upload \"%s\" (%s).\n", object.name, err.Error())
+    }
+    return err
+}
+
+/* End Of File */
@@ -0,0 +1,85 @@
+/* Tests of the S3 file store for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "io"
+    "sync"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Upload a playlist to an object store that responds 200 OK to the copy
+// into place but reports in the body that it failed, then to one where
+// it succeeds, failing if the failure is not returned, if the temporary
+// copy is deleted after the failed copy or if it is not deleted after
+// the successful one
+func TestS3CopyFailure(t *testing.T) {
+    var access sync.Mutex
+    var copyBody string
+    var deleted []string
+
+    server := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, in *http.Request) {
+        io.Copy(io.Discard, in.Body)
+        access.Lock()
+        defer access.Unlock()
+        if in.Method == http.MethodDelete {
+            deleted = append(deleted, in.URL.Path)
+        } else if (in.Method == http.MethodPut) && (in.Header.Get("x-amz-copy-source") != "") {
+            io.WriteString(out, copyBody)
+        }
+    }))
+    defer server.Close()
+    store := newS3FileStore(server.URL, "bucket", "", "us-east-1", "access", "secret", "")
+    uploadPath := "/bucket/chuffs" + PLAYLIST_EXTENSION + S3_UPLOAD_SUFFIX
+
+    for _, test := range []struct{body string; succeeds bool}{
+                            {"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>InternalError</Code>" +
+                             "<Message>We encountered an internal error. Please try again.</Message></Error>", false},
+                            {"", false},
+                            {"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<CopyObjectResult><LastModified>" +
+                             "2009-10-12T17:50:30.000Z</LastModified><ETag>\"9b2cf535f27731c974343645a3985328\"</ETag>" +
+                             "</CopyObjectResult>", true}} {
+        access.Lock()
+        copyBody = test.body
+        deleted = nil
+        access.Unlock()
+        err := store.upload("chuffs" + PLAYLIST_EXTENSION, []byte("#EXTM3U\r\n"))
+        access.Lock()
+        deletedPaths := deleted
+        access.Unlock()
+        wasDeleted := (len(deletedPaths) == 1) && (deletedPaths[0] == uploadPath)
+        if test.succeeds {
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !wasDeleted {
+                t.Fatalf("temporary copy not deleted after a successful copy (deleted %v)", deletedPaths)
+            }
+        } else {
+            if err == nil {
+                t.Fatalf("copy responding %q not reported as failed", test.body)
+            }
+            if len(deletedPaths) > 0 {
+                t.Fatalf("%v deleted after a failed copy", deletedPaths)
+            }
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,169 @@
+/* Segment file handle cache for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "os"
+    "io"
+    "time"
+    "net/http"
+    "path/filepath"
+    "sync"
+    "container/list"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An open segment file in the cache
+type CachedSegment struct {
+    path string
+    handle *os.File
+    users int
+    evicted bool
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The most segment file handles to keep open, however long the window
+// of the playlists, so that an archive playlist can't use up the file
+// descriptors of the server
+const SEGMENT_CACHE_MAX_SIZE int = 256
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The cached segments, most recently used at the front
+var segmentCacheList = list.New()
+
+// The cached segments keyed by path
+var segmentCache = make(map[string]*list.Element)
+
+// Mutex to manage access to the segment cache
+var segmentCacheAccess sync.Mutex
+
+// The number of segment file handles to keep open, see
+// setSegmentCacheSize(); segmentCacheAccess must be locked
+var segmentCacheSize int = int(MP3_USABLE_AGE / MAX_MP3_FILE_DURATION) + 1
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Close a segment's file handle if it is no longer in the cache
+// and no-one is using it; segmentCacheAccess must be locked
+func closeCachedSegment(segment *CachedSegment) {
+    if segment.evicted && (segment.users == 0) {
+        segment.handle.Close()
+    }
+}
+
+// Remove a segment from the cache; segmentCacheAccess must be locked
+func evictCachedSegment(element *list.Element) {
+    segment := element.Value.(*CachedSegment)
+    segmentCacheList.Remove(element)
+    delete(segmentCache, segment.path)
+    segment.evicted = true
+    closeCachedSegment(segment)
+}
+
+// Size the cache to hold every segment of a window, plus the one
+// being written, up to SEGMENT_CACHE_MAX_SIZE, evicting the least
+// recently used segments if it is now too full; returns the size
+func setSegmentCacheSize(window time.Duration) int {
+    size := int(window / MAX_MP3_FILE_DURATION) + 1
+    if size > SEGMENT_CACHE_MAX_SIZE {
+        size = SEGMENT_CACHE_MAX_SIZE
+    }
+    segmentCacheAccess.Lock()
+    segmentCacheSize = size
+    for segmentCacheList.Len() > segmentCacheSize {
+        evictCachedSegment(segmentCacheList.Back())
+    }
+    segmentCacheAccess.Unlock()
+
+    return size
+}
+
+// Get a segment from the cache, opening it if necessary;
+// releaseCachedSegment() must be called when done with it
+func getCachedSegment(path string) (*CachedSegment, error) {
+    var segment *CachedSegment
+
+    path = filepath.Clean(path)
+    segmentCacheAccess.Lock()
+    defer segmentCacheAccess.Unlock()
+    element, found := segmentCache[path]
+    if found {
+        segmentCacheList.MoveToFront(element)
+        segment = element.Value.(*CachedSegment)
+    } else {
+        handle, err := os.Open(path)
+        if err != nil {
+            return nil, err
+        }
+        segment = &CachedSegment{path: path, handle: handle}
+        segmentCache[path] = segmentCacheList.PushFront(segment)
+        for segmentCacheList.Len() > segmentCacheSize {
+            evictCachedSegment(segmentCacheList.Back())
+        }
+    }
+    segment.users++
+
+    return segment, nil
+}
+
+// Release a segment obtained with getCachedSegment()
+func releaseCachedSegment(segment *CachedSegment) {
+    segmentCacheAccess.Lock()
+    segment.users--
+    closeCachedSegment(segment)
+    segmentCacheAccess.Unlock()
+}
+
+// Drop a segment from the cache, e.g. because it is about to be deleted
+func uncacheSegment(path string) {
+    segmentCacheAccess.Lock()
+    element, found := segmentCache[filepath.Clean(path)]
+    if found {
+        evictCachedSegment(element)
+    }
+    segmentCacheAccess.Unlock()
+}
+
+// Serve a segment file from the cache; the file is stat'ed on each
+// request as a client may ask for a segment that is still being written
+func serveCachedSegment(out http.ResponseWriter, in *http.Request, path string) {
+    segment, err := getCachedSegment(path)
+    if err != nil {
+        log.Printf("Unable to open segment file \"%s\" (%s).\n", path, err.Error())
+        http.NotFound(out, in)
+        return
+    }
+    defer releaseCachedSegment(segment)
+    info, err := segment.handle.Stat()
+    if err != nil {
+        log.Printf("Unable to stat segment file \"%s\" (%s).\n", path, err.Error())
+        http.Error(out, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+        return
+    }
+    // A SectionReader uses ReadAt(), so concurrent requests don't fight over the file offset
+    http.ServeContent(out, in, filepath.Base(path), info.ModTime(), io.NewSectionReader(segment.handle, 0, info.Size()))
+}
+
+/* End Of File */
@@ -0,0 +1,129 @@
+/* Tests of the segment file handle cache for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "testing"
+    "net/http"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Write the given number of segment files to a directory, returning
+// their paths
+func writeCacheTestSegments(directory string, number int) ([]string, error) {
+    paths := make([]string, number)
+    for x := range paths {
+        paths[x] = filepath.Join(directory, fmt.Sprintf("%d%s", x, SEGMENT_EXTENSION))
+        err := os.WriteFile(paths[x], make([]byte, 10000), 0644)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return paths, nil
+}
+
+// Empty the segment cache of segments opened before a test, and of
+// those it opens once it is done, putting the size of the cache back
+func resetSegmentCache(t testing.TB) {
+    emptySegmentCache := func() {
+        segmentCacheAccess.Lock()
+        for segmentCacheList.Len() > 0 {
+            evictCachedSegment(segmentCacheList.Back())
+        }
+        segmentCacheAccess.Unlock()
+    }
+    savedSize := segmentCacheSize
+    emptySegmentCache()
+    t.Cleanup(func() {
+        emptySegmentCache()
+        segmentCacheAccess.Lock()
+        segmentCacheSize = savedSize
+        segmentCacheAccess.Unlock()
+    })
+}
+
+// Size the cache from windows short and long, failing if it does not
+// cover the window, up to SEGMENT_CACHE_MAX_SIZE, then fill it and
+// shrink it, failing if it holds more than it should
+func TestSegmentCacheSize(t *testing.T) {
+    resetSegmentCache(t)
+
+    for _, test := range []struct{window time.Duration; size int}{
+                            {MP3_USABLE_AGE, int(MP3_USABLE_AGE / MAX_MP3_FILE_DURATION) + 1},
+                            {time.Minute * 10, int(time.Minute * 10 / MAX_MP3_FILE_DURATION) + 1},
+                            {time.Hour * 2, SEGMENT_CACHE_MAX_SIZE}} {
+        if size := setSegmentCacheSize(test.window); size != test.size {
+            t.Fatalf("cache sized at %d for a window of %v when %d was expected", size, test.window, test.size)
+        }
+    }
+
+    paths, err := writeCacheTestSegments(t.TempDir(), 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setSegmentCacheSize(time.Hour)
+    for _, path := range paths {
+        segment, err := getCachedSegment(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        releaseCachedSegment(segment)
+    }
+    if segmentCacheList.Len() != len(paths) {
+        t.Fatalf("cache holds %d segment(s) when %d were opened", segmentCacheList.Len(), len(paths))
+    }
+    if size := setSegmentCacheSize(MAX_MP3_FILE_DURATION * 3); segmentCacheList.Len() != size {
+        t.Fatalf("cache holds %d segment(s) after shrinking it to %d", segmentCacheList.Len(), size)
+    }
+    if _, found := segmentCache[paths[len(paths) - 1]]; !found {
+        t.Fatal("most recently used segment evicted")
+    }
+}
+
+// Benchmark serving the segments of a playlist window from the cache,
+// as many clients fetching at once do, reporting requests per second
+func BenchmarkServeCachedSegment(b *testing.B) {
+    resetSegmentCache(b)
+    discardLogging(b)
+    size := setSegmentCacheSize(MP3_USABLE_AGE)
+    paths, err := writeCacheTestSegments(b.TempDir(), size)
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    start := time.Now()
+    b.RunParallel(func(pb *testing.PB) {
+        for x := 0; pb.Next(); x++ {
+            path := paths[x % len(paths)]
+            response := httptest.NewRecorder()
+            serveCachedSegment(response, httptest.NewRequest("GET", "/" + filepath.Base(path), nil), path)
+            if response.Code != http.StatusOK {
+                b.Errorf("serving \"%s\" gave status %d", path, response.Code)
+                return
+            }
+        }
+    })
+    b.ReportMetric(float64(b.N) / time.Since(start).Seconds(), "req/s")
+}
+
+/* End Of File */
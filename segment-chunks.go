@@ -0,0 +1,283 @@
+/* Chunked delivery of the segment being encoded for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+    "bytes"
+    "strings"
+    "net/http"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A segment that is being encoded, or is waiting to be written out,
+// the bytes of which are sent to its clients as they are encoded
+type ChunkedSegment struct {
+    // The file name the segment will be published under, as given in
+    // Mp3AudioFile, "" until the segment writer has opened the file
+    fileName string
+    // The segment so far, ID3 tag and all, exactly as it will be written
+    data []byte
+    // Incremented each time the segment is started again, see
+    // growingSegmentHandler()
+    generation int
+    subscribers map[*ChunkedSegmentSubscriber]bool
+}
+
+// A client of a chunked segment; the channel is closed when the segment
+// is published, in which case complete is true, or when it is abandoned
+// or the client falls too far behind
+type ChunkedSegmentSubscriber struct {
+    data chan []byte
+    complete bool
+    segment *ChunkedSegment
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of chunks of encoded MP3 that may be queued for a client of
+// a chunked segment before it is dropped; a chunk is encoded every
+// BLOCK_DURATION_MS so this is around five seconds
+const CHUNKED_SEGMENT_QUEUE_LENGTH int = 5000 / BLOCK_DURATION_MS
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The segments that can be served in chunks, by the sequence number given
+// to them by operateAudioProcessing(): the one being encoded and any
+// waiting to be written out
+var chunkedSegments = make(map[int]*ChunkedSegment)
+
+// Mutex to manage access to the chunked segments
+var chunkedSegmentAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the chunked segment with the given sequence number, creating
+// it if there isn't one; chunkedSegmentAccess must be locked
+func chunkedSegment(sequence int) *ChunkedSegment {
+    segment := chunkedSegments[sequence]
+    if segment == nil {
+        segment = &ChunkedSegment{subscribers: make(map[*ChunkedSegmentSubscriber]bool)}
+        chunkedSegments[sequence] = segment
+    }
+    return segment
+}
+
+// Let the clients of a chunked segment go, complete or not;
+// chunkedSegmentAccess must be locked
+func releaseChunkedSubscribers(segment *ChunkedSegment, complete bool) {
+    for subscriber := range segment.subscribers {
+        subscriber.complete = complete
+        close(subscriber.data)
+    }
+    segment.subscribers = make(map[*ChunkedSegmentSubscriber]bool)
+}
+
+// Return the ID3 tag that writeSegment() will put at the start of a
+// segment at the given offset from the start of the stream
+func chunkedSegmentTag(offset time.Duration, mode string) []byte {
+    var tag bytes.Buffer
+
+    // Only the transport timestamp is known before the segment ends
+    err := writeTag(&tag, offset, time.Time{}, mode)
+    if err != nil {
+        log.Printf("Unable to make the ID3 tag of a chunked segment (%s).\n", err.Error())
+    }
+    return tag.Bytes()
+}
+
+// Start, or start again, the chunked segment with the given sequence
+// number, with the given ID3 tag; any clients of what was there before
+// are dropped, since they will not get what is published
+func startChunkedSegment(sequence int, tag []byte) {
+    chunkedSegmentAccess.Lock()
+    segment := chunkedSegment(sequence)
+    releaseChunkedSubscribers(segment, false)
+    segment.data = append([]byte(nil), tag...)
+    segment.generation++
+    chunkedSegmentAccess.Unlock()
+}
+
+// Add newly encoded MP3 to the chunked segment with the given sequence
+// number, sending it to the clients of the segment and dropping any
+// client that has fallen too far behind
+func appendChunkedSegment(sequence int, data []byte) {
+    chunkedSegmentAccess.Lock()
+    defer chunkedSegmentAccess.Unlock()
+    if len(data) == 0 {
+        return
+    }
+    segment := chunkedSegment(sequence)
+    // The caller's buffer will be re-used, so each client gets the same copy
+    chunk := append([]byte(nil), data...)
+    segment.data = append(segment.data, chunk...)
+    for subscriber := range segment.subscribers {
+        select {
+            case subscriber.data <- chunk:
+            default:
+                log.Printf("Chunked segment client has fallen more than %d chunk(s) behind, dropping it.\n", CHUNKED_SEGMENT_QUEUE_LENGTH)
+                delete(segment.subscribers, subscriber)
+                close(subscriber.data)
+        }
+    }
+}
+
+// Give the chunked segment with the given sequence number the file
+// name it will be published under
+func nameChunkedSegment(sequence int, fileName string) {
+    chunkedSegmentAccess.Lock()
+    chunkedSegment(sequence).fileName = fileName
+    chunkedSegmentAccess.Unlock()
+}
+
+// Finish with the chunked segment with the given sequence number, now
+// that it has been written out, its clients being complete if it was
+// published; from now on it is served like any other segment
+func endChunkedSegment(sequence int, published bool) {
+    chunkedSegmentAccess.Lock()
+    segment := chunkedSegments[sequence]
+    if segment != nil {
+        releaseChunkedSubscribers(segment, published)
+        delete(chunkedSegments, sequence)
+    }
+    chunkedSegmentAccess.Unlock()
+}
+
+// Return the file name of the newest chunked segment that has one,
+// "" if there is none
+func chunkedSegmentFileName() string {
+    var fileName string
+
+    chunkedSegmentAccess.Lock()
+    newest := -1
+    for sequence, segment := range chunkedSegments {
+        if (segment.fileName != "") && (sequence > newest) {
+            newest = sequence
+            fileName = segment.fileName
+        }
+    }
+    chunkedSegmentAccess.Unlock()
+    return fileName
+}
+
+// Return the sequence number of the chunked segment served at the given
+// URL path and the segment, nil if no chunked segment is served there;
+// chunkedSegmentAccess must be locked
+func chunkedSegmentAt(urlPath string) (int, *ChunkedSegment) {
+    for sequence, segment := range chunkedSegments {
+        if (segment.fileName != "") && strings.HasSuffix(urlPath, "/" + filepath.ToSlash(segment.fileName)) {
+            return sequence, segment
+        }
+    }
+    return 0, nil
+}
+
+// Add a client to the chunked segment served at the given URL path,
+// returning it and what there is of the segment so far, or nil if no
+// chunked segment is served there
+func subscribeChunkedSegment(urlPath string) (*ChunkedSegmentSubscriber, []byte) {
+    chunkedSegmentAccess.Lock()
+    defer chunkedSegmentAccess.Unlock()
+    _, segment := chunkedSegmentAt(urlPath)
+    if segment == nil {
+        return nil, nil
+    }
+    subscriber := &ChunkedSegmentSubscriber{data: make(chan []byte, CHUNKED_SEGMENT_QUEUE_LENGTH),
+                                            segment: segment}
+    segment.subscribers[subscriber] = true
+    return subscriber, append([]byte(nil), segment.data...)
+}
+
+// Remove a client from its chunked segment
+func unsubscribeChunkedSegment(subscriber *ChunkedSegmentSubscriber) {
+    chunkedSegmentAccess.Lock()
+    if subscriber.segment.subscribers[subscriber] {
+        delete(subscriber.segment.subscribers, subscriber)
+        close(subscriber.data)
+    }
+    chunkedSegmentAccess.Unlock()
+}
+
+// Return the number of clients of the chunked segments
+func numChunkedSegmentSubscribers() int {
+    var number int
+
+    chunkedSegmentAccess.Lock()
+    for _, segment := range chunkedSegments {
+        number += len(segment.subscribers)
+    }
+    chunkedSegmentAccess.Unlock()
+    return number
+}
+
+// If the request is for a chunked segment, serve it with chunked transfer
+// as it is encoded, returning true; the response ends when the segment is
+// published, or is broken off if it is not, so that a partial segment is
+// never taken for a whole one; returns false if the request is not for a
+// chunked segment, which is then served like any other
+func chunkedSegmentHandler(out http.ResponseWriter, in *http.Request) bool {
+    subscriber, data := subscribeChunkedSegment(in.URL.Path)
+    if subscriber == nil {
+        return false
+    }
+    defer unsubscribeChunkedSegment(subscriber)
+    log.Printf("Serving segment \"%s\" to %s in chunks as it is encoded.\n", in.URL.Path, in.RemoteAddr)
+    controller := http.NewResponseController(out)
+    // The segment may take longer to encode than a write is allowed
+    err := controller.SetWriteDeadline(time.Time{})
+    if err != nil {
+        log.Printf("Unable to remove the write deadline for a chunked segment (%s).\n", err.Error())
+    }
+    // No Content-Length, so the response is sent with chunked transfer
+    out.Header().Set("Content-Type","audio/mpeg")
+    out.Header().Set("Cache-Control","no-cache")
+    out.WriteHeader(http.StatusOK)
+    for {
+        _, err = out.Write(data)
+        if err == nil {
+            err = controller.Flush()
+        }
+        if err != nil {
+            log.Printf("Chunked segment \"%s\" to %s ended (%s).\n", in.URL.Path, in.RemoteAddr, err.Error())
+            return true
+        }
+        select {
+            case chunk, ok := <-subscriber.data:
+                if !ok {
+                    if subscriber.complete {
+                        return true
+                    }
+                    log.Printf("Chunked segment \"%s\" to %s was abandoned, breaking off the response.\n", in.URL.Path, in.RemoteAddr)
+                    panic(http.ErrAbortHandler)
+                }
+                data = chunk
+            case <-in.Context().Done():
+                log.Printf("Chunked segment \"%s\" to %s ended by the client.\n", in.URL.Path, in.RemoteAddr)
+                return true
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,122 @@
+/* Tests of chunked delivery of the segment being encoded for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "testing"
+    "net/http"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Serve chunked segments to clients that join part way through, checking
+// that one that is published gets the whole segment and that one that is
+// started again is broken off, then check that other segments are left
+// to be served normally
+func TestChunkedSegments(t *testing.T) {
+    // Serve a request in the background, returning what it got
+    type result struct {
+        served bool
+        aborted bool
+        response *httptest.ResponseRecorder
+    }
+    serve := func(urlPath string) chan result {
+        done := make(chan result, 1)
+        go func() {
+            var res result
+            res.response = httptest.NewRecorder()
+            defer func() {
+                res.aborted = recover() == http.ErrAbortHandler
+                done <- res
+            }()
+            res.served = chunkedSegmentHandler(res.response, httptest.NewRequest("GET", urlPath, nil))
+        }()
+        return done
+    }
+    waitForSubscribers := func(number int) error {
+        for x := 0; numChunkedSegmentSubscribers() != number; x++ {
+            if x >= 100 {
+                return errors.New(fmt.Sprintf("%d chunked segment client(s) when %d were expected",
+                                              numChunkedSegmentSubscribers(), number))
+            }
+            time.Sleep(time.Millisecond * 10)
+        }
+        return nil
+    }
+
+    chunkedSegmentAccess.Lock()
+    chunkedSegments = make(map[int]*ChunkedSegment)
+    chunkedSegmentAccess.Unlock()
+    t.Cleanup(func() {
+        chunkedSegmentAccess.Lock()
+        chunkedSegments = make(map[int]*ChunkedSegment)
+        chunkedSegmentAccess.Unlock()
+    })
+
+    // A segment that is published
+    startChunkedSegment(0, []byte("ID3"))
+    nameChunkedSegment(0, filepath.Join("segments", "0.ts"))
+    appendChunkedSegment(0, []byte("one"))
+    if chunkedSegmentFileName() != filepath.Join("segments", "0.ts") {
+        t.Fatalf("chunked segment is \"%s\"", chunkedSegmentFileName())
+    }
+    done := serve("/hls/segments/0.ts")
+    err := waitForSubscribers(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    appendChunkedSegment(0, []byte("two"))
+    endChunkedSegment(0, true)
+    res := <-done
+    if !res.served || res.aborted || (res.response.Code != http.StatusOK) ||
+       (res.response.Header().Get("Content-Length") != "") || (res.response.Body.String() != "ID3onetwo") {
+        t.Fatalf("published chunked segment served as %d \"%s\" (aborted %t)", res.response.Code,
+                 res.response.Body.String(), res.aborted)
+    }
+
+    // A segment that is started again
+    startChunkedSegment(1, []byte("ID3"))
+    nameChunkedSegment(1, "1.ts")
+    done = serve("/hls/1.ts")
+    err = waitForSubscribers(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    startChunkedSegment(1, []byte("ID3"))
+    res = <-done
+    if !res.aborted {
+        t.Fatal("chunked segment that was started again was not broken off")
+    }
+
+    // Neither the finished segment nor an unnamed one are served in chunks
+    startChunkedSegment(2, nil)
+    for _, urlPath := range []string{"/hls/segments/0.ts", "/hls/.ts"} {
+        if chunkedSegmentHandler(httptest.NewRecorder(), httptest.NewRequest("GET", urlPath, nil)) {
+            t.Fatalf("\"%s\" served as a chunked segment", urlPath)
+        }
+    }
+
+    err = waitForSubscribers(0)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,69 @@
+/* Segment timing for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Gives segments their times: the wall-clock time is read once, when
+// the stream starts, and from then on segment times are that plus the
+// duration of the audio, so that they always go forwards however the
+// wall clock is adjusted (e.g. stepped by NTP); a monotonic clock is
+// used only to notice the audio falling behind real time, e.g. across
+// a stall in the input, when the times are moved forwards to catch up
+type SegmentClock struct {
+    // The wall-clock time at the start of the stream, zero until then
+    base time.Time
+    // The monotonic clock at the start of the stream
+    baseMonotonic time.Duration
+    // The duration of the audio since the start of the stream
+    audio time.Duration
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How far the audio may fall behind real time before the segment times
+// are moved forwards to catch up
+const SEGMENT_CLOCK_TOLERANCE time.Duration = time.Second
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the end time of a segment of the given duration, given the
+// wall clock and the monotonic clock now and the duration of the audio
+// still waiting to be encoded
+func (clock *SegmentClock) End(now time.Time, monotonic time.Duration, duration time.Duration, backlog time.Duration) time.Time {
+    if clock.base.IsZero() {
+        clock.base = now.Add(-backlog - duration)
+        clock.baseMonotonic = monotonic - backlog - duration
+    }
+    clock.audio += duration
+    lag := monotonic - clock.baseMonotonic - backlog - clock.audio
+    if lag > SEGMENT_CLOCK_TOLERANCE {
+        log.Printf("Audio is %v behind real time, moving segment times forward.\n", lag)
+        clock.audio += lag
+    }
+
+    return clock.base.Add(clock.audio)
+}
+
+/* End Of File */
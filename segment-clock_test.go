@@ -0,0 +1,62 @@
+/* Tests of segment timing for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The wall-clock step simulated by TestSegmentClock()
+const TEST_CLOCK_STEP time.Duration = -time.Hour
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Simulate a step backwards in the wall clock part way through a stream,
+// failing if the segment times don't keep going forwards by
+// the segment duration, then simulate a stall, failing if
+// the segment times don't catch up with it
+func TestSegmentClock(t *testing.T) {
+    var clock SegmentClock
+    var previous time.Time
+
+    duration := time.Duration(MAX_MP3_FILE_SAMPLES) * time.Second / time.Duration(SAMPLING_FREQUENCY)
+    now := time.Now()
+    for segment := 0; segment < 10; segment++ {
+        monotonic := time.Duration(segment + 1) * duration
+        if segment == 5 {
+            now = now.Add(TEST_CLOCK_STEP)
+        }
+        end := clock.End(now.Add(duration), monotonic, duration, 0)
+        if !previous.IsZero() && (end.Sub(previous) != duration) {
+            t.Fatalf("segment %d ends %v after the previous one, expected %v",
+                     segment, end.Sub(previous), duration)
+        }
+        previous = end
+        now = now.Add(duration)
+    }
+    stall := SEGMENT_CLOCK_TOLERANCE * 10
+    end := clock.End(now.Add(stall + duration), time.Duration(11) * duration + stall, duration, 0)
+    if end.Sub(previous) != duration + stall {
+        t.Fatalf("segment after a stall of %v ends %v after the previous one, expected %v",
+                 stall, end.Sub(previous), duration + stall)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,210 @@
+/* Cutting of MP3 segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Decides where segments are cut, so that each is a whole number of MP3
+// frames long and has an exact duration; any samples encoded beyond the
+// cut are counted in the next segment, so the durations of the segments
+// always add up to the duration of the audio
+type SegmentCutter struct {
+    samplesPerFrame int
+    // The sample rate of the MP3, which the encoder may have resampled
+    // the input to
+    sampleRate int
+    // Lengths are counted in units of which both a sample of the input
+    // and a frame of the MP3 are a whole number, since when the encoder
+    // resamples (e.g. 16 kHz to 44.1 kHz) a frame need not be a whole
+    // number of input samples: an input sample is sampleUnits long and a
+    // frame frameUnits long; without resampling both are in samples
+    sampleUnits int
+    frameUnits int
+    // The units encoded into the current segment
+    units int
+}
+
+// The offset of the segments from the start of the stream, added up in
+// whole MP3 frames: the duration of a segment is only exact to the
+// nanosecond below (e.g. a 1152 sample frame at 44.1 kHz is 26.1224...
+// ms), so adding up the durations of the segments would fall further
+// behind with every one, whereas this is never more than a nanosecond out
+type StreamOffset struct {
+    offset time.Duration
+    // What is left over, in nanoseconds times sampleRate
+    remainder int64
+    sampleRate int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The most that the number of frames read back from a segment may
+// differ from the number cut before it is an anomaly: the frames held
+// back by the encoder's delay account for a couple
+const MP3_FRAME_ANOMALY_LIMIT int = 4
+
+// A segment whose frames differ from the number cut by more than this
+// fraction of them is taken to come from a faulty (e.g. misconfigured)
+// encoder, which is re-created
+const MP3_FRAME_FAULT_RATIO float64 = 0.5
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The number of segments whose frames were anomalous, see
+// checkSegmentFrames(), accessed atomically
+var numMp3FrameAnomalies int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the exact duration of a number of MP3 frames
+func mp3FramesDuration(frames int, samplesPerFrame int) time.Duration {
+    return mp3FramesDurationAt(frames, samplesPerFrame, SAMPLING_FREQUENCY)
+}
+
+// Return the exact duration of a number of MP3 frames at the given
+// sample rate, to the nanosecond below
+func mp3FramesDurationAt(frames int, samplesPerFrame int, sampleRate int) time.Duration {
+    return time.Duration(frames * samplesPerFrame) * time.Second / time.Duration(sampleRate)
+}
+
+// Return the greatest common divisor of two numbers
+func greatestCommonDivisor(a int, b int) int {
+    for b != 0 {
+        a, b = b, a % b
+    }
+    return a
+}
+
+// Start again, e.g. with a new encoder, which puts out frames of the
+// given number of samples at the given sample rate
+func (cutter *SegmentCutter) Reset(samplesPerFrame int, sampleRate int) {
+    divisor := greatestCommonDivisor(sampleRate, SAMPLING_FREQUENCY)
+    cutter.samplesPerFrame = samplesPerFrame
+    cutter.sampleRate = sampleRate
+    cutter.sampleUnits = sampleRate / divisor
+    cutter.frameUnits = samplesPerFrame * (SAMPLING_FREQUENCY / divisor)
+    cutter.units = 0
+}
+
+// Return the number of frames in a segment
+func (cutter *SegmentCutter) FramesPerSegment() int {
+    return MAX_MP3_FILE_SAMPLES * cutter.sampleUnits / cutter.frameUnits
+}
+
+// Return the number of samples to encode before the segment is cut
+func (cutter *SegmentCutter) Wanted() int {
+    remaining := cutter.FramesPerSegment() * cutter.frameUnits - cutter.units
+    // Enough to reach the cut, even if that is part way through a sample
+    return (remaining + cutter.sampleUnits - 1) / cutter.sampleUnits
+}
+
+// Return the number of samples encoded into the current segment
+func (cutter *SegmentCutter) Samples() int {
+    return cutter.units / cutter.sampleUnits
+}
+
+// Count samples which have been encoded; if the segment is now complete
+// return true with the number of frames in it and their duration
+func (cutter *SegmentCutter) Add(samples int) (int, time.Duration, bool) {
+    cutter.units += samples * cutter.sampleUnits
+    if cutter.Wanted() > 0 {
+        return 0, 0, false
+    }
+    frames, duration := cutter.Cut()
+
+    return frames, duration, true
+}
+
+// Cut the segment where it is, e.g. short when the stream is stopping,
+// returning the number of whole frames in it and their duration; what
+// is left over goes into the next segment
+func (cutter *SegmentCutter) Cut() (int, time.Duration) {
+    frames := cutter.units / cutter.frameUnits
+    cutter.units -= frames * cutter.frameUnits
+
+    return frames, mp3FramesDurationAt(frames, cutter.samplesPerFrame, cutter.sampleRate)
+}
+
+// Add a segment of the given number of frames, of the given number of
+// samples at the given sample rate, returning the offset of the end of
+// the segment from the start of the stream
+func (stream *StreamOffset) Add(frames int, samplesPerFrame int, sampleRate int) time.Duration {
+    if sampleRate != stream.sampleRate {
+        // Less than a nanosecond, in units that no longer apply
+        stream.remainder = 0
+        stream.sampleRate = sampleRate
+    }
+    total := int64(frames * samplesPerFrame) * int64(time.Second) + stream.remainder
+    stream.offset += time.Duration(total / int64(sampleRate))
+    stream.remainder = total % int64(sampleRate)
+
+    return stream.offset
+}
+
+// Move on by audio which was thrown away rather than cut into a
+// segment, returning the new offset from the start of the stream
+func (stream *StreamOffset) Skip(duration time.Duration) time.Duration {
+    stream.offset += duration
+    return stream.offset
+}
+
+// Start the segment being cut again, with a new encoder that puts out
+// frames of the given number of samples at the given sample rate; what
+// had been encoded into it is thrown away and the stream moves on by
+// that, so that the segments that follow keep their place in time.
+// Returns the offset of the segment from the start of the stream
+func restartSegment(cutter *SegmentCutter, stream *StreamOffset, samplesPerFrame int, sampleRate int) time.Duration {
+    discarded := time.Duration(cutter.units) * time.Second / time.Duration(cutter.sampleUnits * SAMPLING_FREQUENCY)
+    cutter.Reset(samplesPerFrame, sampleRate)
+
+    return stream.Skip(discarded)
+}
+
+// Check the number of frames read back from a segment against the number
+// cut, counting and logging an anomaly, which would skew the timing of
+// the stream; returns true if it is so far out that the encoder is faulty
+func checkSegmentFrames(cutFrames int, actualFrames int) bool {
+    difference := actualFrames - cutFrames
+    if difference < 0 {
+        difference = -difference
+    }
+    if difference <= MP3_FRAME_ANOMALY_LIMIT {
+        return false
+    }
+    anomalies := atomic.AddInt64(&numMp3FrameAnomalies, 1)
+    fault := float64(difference) > float64(cutFrames) * MP3_FRAME_FAULT_RATIO
+    if fault {
+        log.Printf("ERROR: segment has %d MP3 frame(s) where %d were cut, the encoder is faulty (%d anomalous segment(s) so far).\n",
+                   actualFrames, cutFrames, anomalies)
+    } else {
+        log.Printf("WARNING: segment has %d MP3 frame(s) where %d were cut (%d anomalous segment(s) so far).\n",
+                   actualFrames, cutFrames, anomalies)
+    }
+    return fault
+}
+
+/* End Of File */
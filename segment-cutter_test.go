@@ -0,0 +1,256 @@
+/* Tests of cutting of MP3 segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "errors"
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The length of the run simulated by TestSegmentDrift() and how far
+// the segments may be from the audio at the end of it: the rounding down
+// of the offset and of the audio not yet cut
+const TEST_DRIFT_RUN time.Duration = time.Hour * 24
+
+const TEST_DRIFT_TOLERANCE time.Duration = time.Nanosecond * 2
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The sizes of the chunks of audio fed to the SegmentCutter by
+// TestSegmentCutter(), deliberately not multiples of a frame
+var testChunkSizes = []int{SAMPLES_PER_BLOCK, SAMPLES_PER_BLOCK * 3, 7, SAMPLES_PER_BLOCK, 1001}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Feed chunks of audio of awkward sizes through a SegmentCutter set up
+// for the given frame size and sample rate, returning an error if a
+// segment is not a whole number of frames or if the segments drift from
+// the audio
+func checkSegmentCutter(samplesPerFrame int, sampleRate int) error {
+    var cutter SegmentCutter
+    var total int
+    var totalFrames int
+
+    cutter.Reset(samplesPerFrame, sampleRate)
+    // The frames that fit into MAX_MP3_FILE_DURATION
+    expected := int(MAX_MP3_FILE_DURATION / time.Second) * sampleRate / samplesPerFrame
+    for x := 0; x < 1000; x++ {
+        samples := testChunkSizes[x % len(testChunkSizes)]
+        // Never more than is wanted, just as encodeOutput() reads
+        if samples > cutter.Wanted() {
+            samples = cutter.Wanted()
+        }
+        total += samples
+        frames, duration, done := cutter.Add(samples)
+        if done {
+            if frames != expected {
+                return errors.New(fmt.Sprintf("segment of %d frame(s) when %d were expected", frames, expected))
+            }
+            if duration != mp3FramesDurationAt(frames, samplesPerFrame, sampleRate) {
+                return errors.New(fmt.Sprintf("segment of %v is not a whole number of frames", duration))
+            }
+            totalFrames += frames
+        }
+    }
+    // What was cut and what is left over must add up to the audio exactly
+    if totalFrames * cutter.frameUnits + cutter.units != total * cutter.sampleUnits {
+        return errors.New(fmt.Sprintf("segments add up to %d frame(s) plus %d sample(s) uncut for %d sample(s) of audio",
+                                      totalFrames, cutter.Samples(), total))
+    }
+
+    return nil
+}
+
+// Simulate a long run of blocks of audio, one per tick of audio
+// processing, through a SegmentCutter and StreamOffset set up for the
+// given frame size and sample rate, returning an error if the offset of
+// the segments plus the audio not yet cut, each rounded down to the
+// nanosecond, drift from the audio by more than that rounding
+func checkSegmentDrift(samplesPerFrame int, sampleRate int, run time.Duration) error {
+    var cutter SegmentCutter
+    var stream StreamOffset
+    var offset time.Duration
+    var total int64
+
+    cutter.Reset(samplesPerFrame, sampleRate)
+    ticks := int(run / (time.Duration(BLOCK_DURATION_MS) * time.Millisecond))
+    for x := 0; x < ticks; x++ {
+        block := SAMPLES_PER_BLOCK
+        for block > 0 {
+            samples := block
+            if samples > cutter.Wanted() {
+                samples = cutter.Wanted()
+            }
+            block -= samples
+            total += int64(samples)
+            frames, _, done := cutter.Add(samples)
+            if done {
+                offset = stream.Add(frames, samplesPerFrame, sampleRate)
+            }
+        }
+    }
+    // The audio, with 16 kHz input, is a whole number of nanoseconds
+    audio := time.Duration(total) * time.Second / time.Duration(SAMPLING_FREQUENCY)
+    uncut := time.Duration(cutter.units) * time.Second / time.Duration(cutter.sampleUnits * SAMPLING_FREQUENCY)
+    drift := audio - offset - uncut
+    log.Printf("Test: after %v of %d sample frames at %d Hz the segments are %v out.\n", run, samplesPerFrame, sampleRate, drift)
+    if (drift < 0) || (drift >= TEST_DRIFT_TOLERANCE) {
+        return errors.New(fmt.Sprintf("after %v of %d sample frames at %d Hz the segment offset is %v, %v out from the audio",
+                                      run, samplesPerFrame, sampleRate, offset, drift))
+    }
+
+    return nil
+}
+
+// Run a day of audio through the segment accounting, with the frames of
+// the 16 kHz MP3 and of the 44.1 kHz MP3 for Apple's tools, checking
+// that the segments do not drift from the audio
+func TestSegmentDrift(t *testing.T) {
+    for _, test := range []struct{samplesPerFrame int; sampleRate int}{{576, SAMPLING_FREQUENCY}, {1152, ITUNES_SAMPLE_RATE}} {
+        err := checkSegmentDrift(test.samplesPerFrame, test.sampleRate, TEST_DRIFT_RUN)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// Check the SegmentCutter with the frame size and sample rate of the MP3
+// encoder, then check the checking of the frames read back from a segment
+func TestSegmentCutter(t *testing.T) {
+    encoderOptions := testMp3EncoderOptions()
+    var mp3Audio bytes.Buffer
+
+    mp3Writer, samplesPerFrame := createMp3Writer(&mp3Audio, encoderOptions)
+    if mp3Writer == nil {
+        t.Fatal("unable to create MP3 writer")
+    }
+    mp3Writer.Close()
+    err := checkSegmentCutter(samplesPerFrame, mp3SampleRate(encoderOptions))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // An encoder putting out a frame or two fewer is normal, a few more
+    // is an anomaly and an absurd number a fault
+    frames := MAX_MP3_FILE_SAMPLES / samplesPerFrame
+    anomalies := atomic.LoadInt64(&numMp3FrameAnomalies)
+    for _, test := range []struct{actual int; anomaly bool; fault bool}{
+                            {frames, false, false},
+                            {frames - 2, false, false},
+                            {frames + MP3_FRAME_ANOMALY_LIMIT + 1, true, false},
+                            {frames * 100, true, true},
+                            {0, true, true}} {
+        counted := atomic.LoadInt64(&numMp3FrameAnomalies)
+        fault := checkSegmentFrames(frames, test.actual)
+        if (fault != test.fault) || ((atomic.LoadInt64(&numMp3FrameAnomalies) != counted) != test.anomaly) {
+            t.Fatalf("%d frame(s) read back where %d were cut: fault %t, anomaly counted %t",
+                     test.actual, frames, fault, atomic.LoadInt64(&numMp3FrameAnomalies) != counted)
+        }
+    }
+    if atomic.LoadInt64(&numMp3FrameAnomalies) - anomalies != 3 {
+        t.Fatal("anomalous segments not all counted")
+    }
+}
+
+// Cut a segment short, as happens when the stream stops, failing if it
+// does not have the whole frames added so far or if what is left over
+// is not kept for the next segment
+func TestSegmentCutterCut(t *testing.T) {
+    var cutter SegmentCutter
+
+    cutter.Reset(576, 16000)
+    if _, _, done := cutter.Add(1000); done {
+        t.Fatal("segment of 1000 sample(s) cut")
+    }
+    if frames, duration := cutter.Cut(); (frames != 1) || (duration != 36 * time.Millisecond) {
+        t.Fatalf("segment of 1000 sample(s) cut short at %d frame(s), %v", frames, duration)
+    }
+    if cutter.Samples() != 424 {
+        t.Fatalf("%d sample(s) left over from 1000 when 424 were expected", cutter.Samples())
+    }
+    if frames, duration := cutter.Cut(); (frames != 0) || (duration != 0) || (cutter.Samples() != 424) {
+        t.Fatalf("less than a frame cut short at %d frame(s), %v, leaving %d sample(s)", frames, duration, cutter.Samples())
+    }
+}
+
+// Cut segments from blocks of audio, with the frames of the 16 kHz MP3
+// and of the 44.1 kHz MP3 for Apple's tools, starting the segment being
+// cut again now and then, as re-creating the encoder (e.g. for a change
+// of bitrate) does, both between segments and part way through one,
+// failing if the offset of the segment started again is not that of
+// the audio, since otherwise the offsets would jump back
+func TestSegmentRestart(t *testing.T) {
+    for _, test := range []struct{samplesPerFrame int; sampleRate int}{{576, SAMPLING_FREQUENCY}, {1152, ITUNES_SAMPLE_RATE}} {
+        var cutter SegmentCutter
+        var stream StreamOffset
+        var total int64
+        var restarts int
+
+        cutter.Reset(test.samplesPerFrame, test.sampleRate)
+        for x := 1; x <= 10000; x++ {
+            samples := SAMPLES_PER_BLOCK
+            if samples > cutter.Wanted() {
+                samples = cutter.Wanted()
+            }
+            total += int64(samples)
+            frames, _, done := cutter.Add(samples)
+            if done {
+                stream.Add(frames, test.samplesPerFrame, test.sampleRate)
+            }
+            if (done && (x % 3 == 0)) || (x % 777 == 0) {
+                restarts++
+                offset := restartSegment(&cutter, &stream, test.samplesPerFrame, test.sampleRate)
+                audio := time.Duration(total) * time.Second / time.Duration(SAMPLING_FREQUENCY)
+                if (audio - offset < 0) || (audio - offset >= TEST_DRIFT_TOLERANCE * time.Duration(restarts)) {
+                    t.Fatalf("%d sample frames at %d Hz: segment started again at %v after %v of audio",
+                             test.samplesPerFrame, test.sampleRate, offset, audio)
+                }
+                if cutter.Samples() != 0 {
+                    t.Fatalf("%d sample(s) left in a segment started again", cutter.Samples())
+                }
+            }
+        }
+        if restarts < 20 {
+            t.Fatalf("segment only started again %d time(s)", restarts)
+        }
+    }
+}
+
+// Skip audio thrown away between two segments, failing if the offset
+// of the stream does not move on by it
+func TestStreamOffsetSkip(t *testing.T) {
+    var stream StreamOffset
+
+    stream.Add(10, 576, 16000)
+    if offset := stream.Skip(time.Second); offset != 1360 * time.Millisecond {
+        t.Fatalf("offset after skipping a second is %v", offset)
+    }
+    if offset := stream.Add(10, 576, 16000); offset != 1720 * time.Millisecond {
+        t.Fatalf("offset after the segment that follows is %v", offset)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,107 @@
+/* Cutting off stalled segment transfers for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "log"
+    "time"
+    "errors"
+    "context"
+    "net/http"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A ResponseWriter that captures the first error in writing a response,
+// so that a response cut off at its deadline can be told apart
+type DeadlineResponseWriter struct {
+    http.ResponseWriter
+    err error
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// How long a segment request may take to serve, 0 for no limit
+var segmentRequestTimeout time.Duration
+
+// The number of segment requests cut off at segmentRequestTimeout,
+// accessed atomically
+var numSegmentRequestsTimedOut int64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Capture the first error
+func (out *DeadlineResponseWriter) Write(data []byte) (int, error) {
+    n, err := out.ResponseWriter.Write(data)
+    if (err != nil) && (out.err == nil) {
+        out.err = err
+    }
+    return n, err
+}
+
+// Flush the response, capturing the first error
+func (out *DeadlineResponseWriter) FlushError() error {
+    err := http.NewResponseController(out.ResponseWriter).Flush()
+    if (err != nil) && (err != http.ErrNotSupported) && (out.err == nil) {
+        out.err = err
+    }
+    return err
+}
+
+// Let http.ResponseController reach the underlying ResponseWriter
+func (out *DeadlineResponseWriter) Unwrap() http.ResponseWriter {
+    return out.ResponseWriter
+}
+
+// Give a segment request segmentRequestTimeout to be served, returning
+// the ResponseWriter and request to serve it with and a function to call
+// once it has been served.  Both the request's context and writing the
+// response are given the deadline, so a client that stalls part way
+// through a transfer is cut off and the goroutine serving it freed;
+// responses that are meant to go on (e.g. chunked segments, LIVE_MP3_PATH)
+// must not be given one
+func limitSegmentRequest(out http.ResponseWriter, in *http.Request) (http.ResponseWriter, *http.Request, func()) {
+    if segmentRequestTimeout <= 0 {
+        return out, in, func() {}
+    }
+    deadline := time.Now().Add(segmentRequestTimeout)
+    ctx, cancel := context.WithDeadline(in.Context(), deadline)
+    limited := &DeadlineResponseWriter{ResponseWriter: out}
+    controller := http.NewResponseController(limited)
+    err := controller.SetWriteDeadline(deadline)
+    if (err != nil) && (err != http.ErrNotSupported) {
+        log.Printf("Unable to set a write deadline for \"%s\" (%s).\n", in.URL.Path, err.Error())
+    }
+    return limited, in.WithContext(ctx), func() {
+        // Push out the end of the response while the deadline still holds,
+        // then lift it, since the connection may be kept alive for more
+        controller.Flush()
+        controller.SetWriteDeadline(time.Time{})
+        cancel()
+        if errors.Is(limited.err, os.ErrDeadlineExceeded) {
+            timedOut := atomic.AddInt64(&numSegmentRequestsTimedOut, 1)
+            log.Printf("Serving \"%s\" to %s took longer than %s, cut off (%d such request(s) so far).\n",
+                       in.URL.Path, in.RemoteAddr, segmentRequestTimeout.String(), timedOut)
+        }
+    }
+}
+
+/* End Of File */
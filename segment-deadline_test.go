@@ -0,0 +1,112 @@
+/* Tests of cutting off stalled segment transfers for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "io"
+    "fmt"
+    "net"
+    "time"
+    "bytes"
+    "testing"
+    "net/http"
+    "io/ioutil"
+    "sync/atomic"
+    "path/filepath"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The deadline given to a segment request in TestSegmentDeadline()
+const TEST_SEGMENT_DEADLINE time.Duration = time.Millisecond * 200
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Fetch a large segment with a client that stops reading part way
+// through, checking that the transfer is cut off at the deadline, the
+// request being counted as it finishes, then that a client that reads
+// it all gets the whole segment
+func TestSegmentDeadline(t *testing.T) {
+    var err error
+    dirName := t.TempDir()
+    // Big enough not to fit in the socket buffers
+    segment := bytes.Repeat([]byte("MP3 "), 4 * 1024 * 1024)
+    filePath := filepath.Join(dirName, "0" + SEGMENT_EXTENSION)
+    err = ioutil.WriteFile(filePath, segment, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        uncacheSegment(filePath)
+    })
+    var store OsFileStore
+    savedTimeout := segmentRequestTimeout
+    segmentRequestTimeout = TEST_SEGMENT_DEADLINE
+    t.Cleanup(func() {
+        segmentRequestTimeout = savedTimeout
+    })
+    server := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, in *http.Request) {
+        streamHandler(out, in, store, store, "")
+    }))
+    defer server.Close()
+
+    timedOut := atomic.LoadInt64(&numSegmentRequestsTimedOut)
+    connection, err := net.Dial("tcp", server.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer connection.Close()
+    tcpConnection, isTcp := connection.(*net.TCPConn)
+    if isTcp {
+        tcpConnection.SetReadBuffer(4096)
+    }
+    start := time.Now()
+    _, err = fmt.Fprintf(connection, "GET %s HTTP/1.1\r\nHost: localhost\r\n\r\n", filePath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Read a little, then stall
+    _, err = io.ReadFull(connection, make([]byte, 1024))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for atomic.LoadInt64(&numSegmentRequestsTimedOut) == timedOut {
+        if time.Now().Sub(start) > TEST_SEGMENT_DEADLINE * 20 {
+            t.Fatalf("stalled transfer not cut off after %s", time.Now().Sub(start).String())
+        }
+        time.Sleep(time.Millisecond * 10)
+    }
+    if time.Now().Sub(start) < TEST_SEGMENT_DEADLINE {
+        t.Fatalf("stalled transfer cut off after %s, before the deadline", time.Now().Sub(start).String())
+    }
+
+    response, err := http.Get(server.URL + filePath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer response.Body.Close()
+    body, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(body, segment) {
+        t.Fatalf("%d byte(s) of a %d byte segment received by a client that kept up", len(body), len(segment))
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,147 @@
+/* Levels of the audio of each segment for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "sync"
+    "net/http"
+    "path/filepath"
+    "container/list"
+    "encoding/json"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Running totals of the audio fed to the encoder for a segment, from
+// which its levels are worked out without going over it again
+type LevelMeter struct {
+    sumOfSquares float64
+    samples int
+    peak int
+}
+
+// The levels of a segment, as listed at LEVELS_PATH
+type SegmentLevel struct {
+    Name string `json:"name"`
+    RmsDbfs float64 `json:"rmsDbfs"`
+    PeakDbfs float64 `json:"peakDbfs"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URL path at which the levels of the segments are served
+const LEVELS_PATH string = "/levels"
+
+// The level given to silence, which would otherwise be minus infinity
+// (which JSON cannot carry); about that of one least significant bit
+// of 16-bit audio, less a margin
+const LEVEL_FLOOR_DBFS float64 = -100
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The levels of the segments, oldest first
+var segmentLevelList = list.New()
+
+// Mutex to manage access to the segment levels
+var segmentLevelAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Add 16-bit little-endian PCM, as fed to the encoder, to the totals
+func (meter *LevelMeter) Add(pcm []byte) {
+    for x := 0; x + URTP_SAMPLE_SIZE <= len(pcm); x += URTP_SAMPLE_SIZE {
+        sample := int(int16(binary.LittleEndian.Uint16(pcm[x:])))
+        meter.sumOfSquares += float64(sample * sample)
+        if sample < 0 {
+            sample = -sample
+        }
+        if sample > meter.peak {
+            meter.peak = sample
+        }
+    }
+    meter.samples += len(pcm) / URTP_SAMPLE_SIZE
+}
+
+// Return a level relative to full scale in dB, no lower than LEVEL_FLOOR_DBFS
+func levelDbfs(level float64) float64 {
+    if level <= 0 {
+        return LEVEL_FLOOR_DBFS
+    }
+    return math.Max(20 * math.Log10(level / -math.MinInt16), LEVEL_FLOOR_DBFS)
+}
+
+// Return the levels of the audio added so far, with no name, and start
+// again; nil if there was no audio
+func (meter *LevelMeter) Segment() *SegmentLevel {
+    var level *SegmentLevel
+
+    if meter.samples > 0 {
+        level = &SegmentLevel{RmsDbfs: levelDbfs(math.Sqrt(meter.sumOfSquares / float64(meter.samples))),
+                              PeakDbfs: levelDbfs(float64(meter.peak))}
+    }
+    *meter = LevelMeter{}
+    return level
+}
+
+// Add the levels of a segment
+func addSegmentLevel(name string, level SegmentLevel) {
+    segmentLevelAccess.Lock()
+    defer segmentLevelAccess.Unlock()
+    level.Name = filepath.Base(name)
+    segmentLevelList.PushBack(&level)
+}
+
+// Remove the levels of a segment
+func removeSegmentLevel(name string) {
+    segmentLevelAccess.Lock()
+    defer segmentLevelAccess.Unlock()
+    name = filepath.Base(name)
+    for element := segmentLevelList.Front(); element != nil; element = element.Next() {
+        if element.Value.(*SegmentLevel).Name == name {
+            segmentLevelList.Remove(element)
+            break
+        }
+    }
+}
+
+// Serve the levels of the segments
+func levelsHandler(out http.ResponseWriter, in *http.Request) {
+    var levels []SegmentLevel
+
+    log.Printf("Levels handler was asked for \"%s\"...\n", in.URL.Path)
+    segmentLevelAccess.Lock()
+    levels = make([]SegmentLevel, 0, segmentLevelList.Len())
+    for element := segmentLevelList.Front(); element != nil; element = element.Next() {
+        levels = append(levels, *element.Value.(*SegmentLevel))
+    }
+    segmentLevelAccess.Unlock()
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    err := json.NewEncoder(out).Encode(levels)
+    if err != nil {
+        log.Printf("Unable to serve levels (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
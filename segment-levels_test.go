@@ -0,0 +1,90 @@
+/* Tests of levels of the audio of each segment for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+    "testing"
+    "encoding/json"
+    "path/filepath"
+    "encoding/binary"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Meter a full-scale square wave, a sine wave at half scale and silence,
+// checking their levels against what they should be, then check that
+// the served levels follow the segments as they come and go
+func TestSegmentLevels(t *testing.T) {
+    var meter LevelMeter
+    var levels []SegmentLevel
+
+    segmentLevelAccess.Lock()
+    segmentLevelList.Init()
+    segmentLevelAccess.Unlock()
+    t.Cleanup(func() {
+        segmentLevelAccess.Lock()
+        segmentLevelList.Init()
+        segmentLevelAccess.Unlock()
+    })
+    pcm := make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)
+    for x := 0; x < SAMPLES_PER_BLOCK; x++ {
+        sample := int16(math.MaxInt16)
+        if x % 2 == 1 {
+            sample = math.MinInt16
+        }
+        binary.LittleEndian.PutUint16(pcm[x * URTP_SAMPLE_SIZE:], uint16(sample))
+    }
+    meter.Add(pcm)
+    square := meter.Segment()
+    // 1 kHz, a whole number of cycles in the block
+    for x := 0; x < SAMPLES_PER_BLOCK; x++ {
+        sample := int16(-math.MinInt16 / 2 * math.Sin(2 * math.Pi * 1000 * float64(x) / float64(SAMPLING_FREQUENCY)))
+        binary.LittleEndian.PutUint16(pcm[x * URTP_SAMPLE_SIZE:], uint16(sample))
+    }
+    meter.Add(pcm[:len(pcm) / 2])
+    meter.Add(pcm[len(pcm) / 2:])
+    sine := meter.Segment()
+    meter.Add(make([]byte, len(pcm)))
+    silence := meter.Segment()
+    for _, test := range []struct{name string; level *SegmentLevel; rms float64; peak float64}{
+                           {"square", square, 0, 0},
+                           {"sine", sine, -6.02 - 3.01, -6.02},
+                           {"silence", silence, LEVEL_FLOOR_DBFS, LEVEL_FLOOR_DBFS}} {
+        if (test.level == nil) || (math.Abs(test.level.RmsDbfs - test.rms) > 0.1) || (math.Abs(test.level.PeakDbfs - test.peak) > 0.1) {
+            t.Fatalf("%s metered as %+v when it should be %.2f dBFS RMS, %.2f dBFS peak",
+                     test.name, test.level, test.rms, test.peak)
+        }
+    }
+    if meter.Segment() != nil {
+        t.Fatal("levels given for a segment with no audio")
+    }
+
+    addSegmentLevel(filepath.Join("segments", "a.ts"), *square)
+    addSegmentLevel("b.ts", *sine)
+    removeSegmentLevel("a.ts")
+    response := httptest.NewRecorder()
+    levelsHandler(response, httptest.NewRequest("GET", LEVELS_PATH, nil))
+    err := json.Unmarshal(response.Body.Bytes(), &levels)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if (len(levels) != 1) || (levels[0].Name != "b.ts") || (levels[0].RmsDbfs != sine.RmsDbfs) {
+        t.Fatalf("levels served as %s", response.Body.String())
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,125 @@
+/* Segment URIs in the playlist for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "path"
+    "errors"
+    "strings"
+    "net/url"
+    "net/http"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check and normalise the URL which is put in front of the segment
+// file names in the playlist, giving it a trailing slash; it may be
+// absolute (e.g. https://cdn.example.com/live), rooted (e.g. /live) or
+// relative to the playlist (e.g. media); "" is left as it is
+func normaliseSegmentBaseUrl(baseUrl string) (string, error) {
+    if baseUrl == "" {
+        return baseUrl, nil
+    }
+    parsed, err := url.Parse(baseUrl)
+    if err != nil {
+        return "", err
+    }
+    if (parsed.RawQuery != "") || (parsed.Fragment != "") {
+        return "", errors.New("must not have a query or fragment")
+    }
+    if parsed.IsAbs() && ((parsed.Scheme != "http") && (parsed.Scheme != "https") || (parsed.Host == "")) {
+        return "", errors.New("must be an http or https URL with a host")
+    }
+    if !strings.HasSuffix(baseUrl, "/") {
+        baseUrl += "/"
+    }
+
+    return baseUrl, nil
+}
+
+// Return the URI of a segment in the playlist, given the normalised
+// segment base URL and the file name of the segment relative to the
+// playlist directory
+func segmentUri(baseUrl string, fileName string) string {
+    return baseUrl + fileName
+}
+
+// Return the URL path of a segment URI as it would be requested by a
+// player that fetched the playlist at playlistPath
+func segmentRequestPath(playlistPath string, uri string) string {
+    base := url.URL{Path: playlistPath}
+    reference, err := url.Parse(uri)
+    if err != nil {
+        return path.Join(path.Dir(playlistPath), uri)
+    }
+    return base.ResolveReference(reference).Path
+}
+
+// Return the URL path under which segments are requested when they
+// are given a base URL, or "" if that is the playlist directory, mp3Dir,
+// anyway and so needs no special handling
+func segmentBasePath(playlistPath string, mp3Dir string, baseUrl string) string {
+    if baseUrl == "" {
+        return ""
+    }
+    basePath := segmentRequestPath(playlistPath, baseUrl)
+    if !strings.HasSuffix(basePath, "/") {
+        basePath += "/"
+    }
+    if basePath == strings.TrimSuffix(mp3Dir, "/") + "/" {
+        return ""
+    }
+    return basePath
+}
+
+// Map the URL path of a segment requested under basePath, as returned
+// by segmentBasePath(), to the URL path at which it is served from the
+// playlist directory, mp3Dir; returns false if the request is not
+// under basePath
+func segmentPathFromBase(basePath string, mp3Dir string, requestPath string) (string, bool) {
+    if !strings.HasPrefix(requestPath, basePath) {
+        return "", false
+    }
+    name := path.Clean("/" + strings.TrimPrefix(requestPath, basePath))
+    return path.Join(mp3Dir, name), true
+}
+
+// Handle a request for a segment under basePath, as returned by
+// segmentBasePath(), e.g. one pulled through a CDN, serving it from the
+// playlist directory, mp3Dir; any session token is checked against the
+// URL path as requested
+func segmentBaseHandler(out http.ResponseWriter, in *http.Request, basePath string, mp3Dir string,
+                        segmentStore FileStore, sessionSecret string) {
+    servedPath, ok := segmentPathFromBase(basePath, mp3Dir, in.URL.Path)
+    if !ok || (path.Ext(servedPath) != SEGMENT_EXTENSION) {
+        http.NotFound(out, in)
+        return
+    }
+    if sessionSecret != "" {
+        _, ok = checkSessionToken(out, in, sessionSecret)
+        if !ok {
+            return
+        }
+    }
+    log.Printf("Segment \"%s\" requested under base \"%s\", serving \"%s\".\n", in.URL.Path, basePath, servedPath)
+    mapped := *in
+    mappedUrl := *in.URL
+    mappedUrl.Path = servedPath
+    mapped.URL = &mappedUrl
+    streamHandler(out, &mapped, nil, segmentStore, "")
+}
+
+/* End Of File */
@@ -0,0 +1,96 @@
+/* Tests of segment URIs in the playlist for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "path"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A case checked by TestSegmentUris()
+type SegmentUriTest struct {
+    baseUrl string
+    // The URI of segments/x.ts in the playlist /hls/chuffs.m3u8
+    uri string
+    // The URL path at which the segment is then requested, which should
+    // be served as /hls/segments/x.ts
+    requestPath string
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The cases checked by TestSegmentUris(): relative, absolute and
+// CDN-prefixed, with and without a trailing slash
+var segmentUriTests = []SegmentUriTest {
+    {"", "segments/x.ts", "/hls/segments/x.ts"},
+    {"media", "media/segments/x.ts", "/hls/media/segments/x.ts"},
+    {"/media/", "/media/segments/x.ts", "/media/segments/x.ts"},
+    {"/hls", "/hls/segments/x.ts", "/hls/segments/x.ts"},
+    {"https://cdn.example.com", "https://cdn.example.com/segments/x.ts", "/segments/x.ts"},
+    {"https://cdn.example.com/live", "https://cdn.example.com/live/segments/x.ts", "/live/segments/x.ts"},
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check the segment URIs that are written to the playlist for relative,
+// absolute and CDN-prefixed base URLs, and that a segment requested at
+// such a URI maps back to the file that should be served
+func TestSegmentUris(t *testing.T) {
+    const playlistPath string = "/hls/chuffs.m3u8"
+    const mp3Dir string = "/hls"
+    const fileName string = "segments/x.ts"
+
+    for _, test := range segmentUriTests {
+        baseUrl, err := normaliseSegmentBaseUrl(test.baseUrl)
+        if err != nil {
+            t.Fatalf("base URL \"%s\" rejected (%s)", test.baseUrl, err.Error())
+        }
+        uri := segmentUri(baseUrl, fileName)
+        if uri != test.uri {
+            t.Fatalf("base URL \"%s\" gave URI \"%s\" when \"%s\" was expected", test.baseUrl, uri, test.uri)
+        }
+        requestPath := segmentRequestPath(playlistPath, uri)
+        if requestPath != test.requestPath {
+            t.Fatalf("URI \"%s\" is requested at \"%s\" when \"%s\" was expected", uri, requestPath, test.requestPath)
+        }
+        servedPath := requestPath
+        basePath := segmentBasePath(playlistPath, mp3Dir, baseUrl)
+        if basePath != "" {
+            var ok bool
+            servedPath, ok = segmentPathFromBase(basePath, mp3Dir, requestPath)
+            if !ok {
+                t.Fatalf("request for \"%s\" is not under \"%s\"", requestPath, basePath)
+            }
+        }
+        if servedPath != path.Join(mp3Dir, fileName) {
+            t.Fatalf("base URL \"%s\": request for \"%s\" served from \"%s\" when \"%s\" was expected",
+                     test.baseUrl, requestPath, servedPath, path.Join(mp3Dir, fileName))
+        }
+    }
+    for _, baseUrl := range []string{"ftp://cdn.example.com/", "https:///live", "/live?x=1"} {
+        _, err := normaliseSegmentBaseUrl(baseUrl)
+        if err == nil {
+            t.Fatalf("invalid base URL \"%s\" accepted", baseUrl)
+        }
+    }
+}
+
+/* End Of File */
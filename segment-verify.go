@@ -0,0 +1,78 @@
+/* Verification of MP3 segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "github.com/u-blox/ioc-server/lame"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How far the number of samples decoded from a segment may be from the
+// number its duration implies, that of the largest MP3 frame, since the
+// decoder may hold back the start of the first frame
+const SEGMENT_VERIFY_TOLERANCE_SAMPLES int = 1152
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The number of segments which failed verification, accessed atomically
+var numSegmentsFailedVerification int64
+
+// True if a segment has failed verification since the last segment was
+// published, so the next must be marked as a discontinuity; only touched
+// by the segment writer
+var segmentVerifyDiscontinuity bool
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that the MP3 audio of a segment is playable: nothing but whole
+// frames, with no loss of frame sync, which decode to the given sample
+// rate and to the number of samples the duration of the segment implies;
+// returns an error describing the first problem found
+func verifySegment(audio []byte, duration time.Duration, sampleRate int) error {
+    _, frames, err := mp3AudioDuration(audio)
+    if err != nil {
+        return err
+    }
+    if frames == 0 {
+        return errors.New("no MP3 frames")
+    }
+    decoded, err := lame.Decode(audio)
+    if err != nil {
+        return err
+    }
+    if decoded.SampleRate != sampleRate {
+        return errors.New(fmt.Sprintf("decodes at %d Hz, not %d Hz", decoded.SampleRate, sampleRate))
+    }
+    expected := int(duration * time.Duration(sampleRate) / time.Second)
+    difference := len(decoded.Left) - expected
+    // The tolerance is in samples at SAMPLING_FREQUENCY
+    tolerance := SEGMENT_VERIFY_TOLERANCE_SAMPLES * sampleRate / SAMPLING_FREQUENCY
+    if (difference > tolerance) || (difference < -tolerance) {
+        return errors.New(fmt.Sprintf("%d frame(s) decode to %d sample(s) when %d were expected", frames,
+                                      len(decoded.Left), expected))
+    }
+
+    return nil
+}
+
+/* End Of File */
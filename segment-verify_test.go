@@ -0,0 +1,71 @@
+/* Tests of verification of MP3 segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "time"
+    "bytes"
+    "testing"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Encode a segment and check that it verifies, then check that the same
+// segment with a frame header broken, cut short or claiming the wrong
+// duration does not
+func TestSegmentVerification(t *testing.T) {
+    encoderOptions := testMp3EncoderOptions()
+    var mp3Audio bytes.Buffer
+
+    mp3Writer, samplesPerFrame := createMp3Writer(&mp3Audio, encoderOptions)
+    if mp3Writer == nil {
+        t.Fatal("unable to create MP3 writer")
+    }
+    defer mp3Writer.Close()
+    numSamples := MAX_MP3_FILE_SAMPLES / samplesPerFrame * samplesPerFrame
+    pcm := make([]byte, numSamples * URTP_SAMPLE_SIZE)
+    for x := 0; x < numSamples; x++ {
+        binary.LittleEndian.PutUint16(pcm[x * URTP_SAMPLE_SIZE:], uint16(x * 256))
+    }
+    _, err := mp3Writer.Write(pcm)
+    if err != nil {
+        t.Fatal(err)
+    }
+    segment := mp3Audio.Bytes()
+    duration, frames, err := mp3AudioDuration(segment)
+    if (err != nil) || (frames < 2) {
+        t.Fatalf("encoded segment unreadable (%d frame(s), %v)", frames, err)
+    }
+    err = verifySegment(segment, duration, mp3SampleRate(encoderOptions))
+    if err != nil {
+        t.Fatalf("good segment failed verification (%s)", err.Error())
+    }
+
+    // Break the sync of the second frame
+    header, _ := parseMp3FrameHeader(segment)
+    broken := append([]byte(nil), segment...)
+    broken[header.size] = 0
+    for _, bad := range []struct{name string; audio []byte; duration time.Duration}{
+                           {"lost frame sync", broken, duration},
+                           {"cut short", segment[:len(segment) - 1], duration},
+                           {"wrong duration", segment, duration * 2}} {
+        if verifySegment(bad.audio, bad.duration, mp3SampleRate(encoderOptions)) == nil {
+            t.Fatalf("segment %s passed verification", bad.name)
+        }
+    }
+}
+
+/* End Of File */
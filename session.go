@@ -0,0 +1,209 @@
+/* Expiring session tokens for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "bytes"
+    "strconv"
+    "strings"
+    "net/url"
+    "net/http"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A session URL, as served by ADMIN_SESSION_PATH
+type SessionUrl struct {
+    Url string `json:"url"`
+    Expires string `json:"expires"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The query parameters of a session URL: the Unix time at which it
+// expires and the token, the hex HMAC-SHA256 of the URL path and the
+// expiry time
+const SESSION_EXPIRES_PARAMETER string = "expires"
+const SESSION_TOKEN_PARAMETER string = "token"
+
+// The URL path of the admin endpoint that mints session URLs
+const ADMIN_SESSION_PATH string = "/admin/session"
+
+// The query parameters of ADMIN_SESSION_PATH: the URL path of the
+// playlist, e.g. ?path=/hls/chuffs.m3u8, or of another protected
+// endpoint, e.g. ?path=/live.mp3, and how long the session lasts,
+// e.g. &for=2h
+const ADMIN_SESSION_PATH_PARAMETER string = "path"
+const ADMIN_SESSION_FOR_PARAMETER string = "for"
+
+// How long a session lasts if ADMIN_SESSION_FOR_PARAMETER isn't given
+const DEFAULT_SESSION_LIFETIME time.Duration = time.Hour
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the token for a URL path that expires at the given time
+func mintSessionToken(secret string, urlPath string, expires time.Time) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(urlPath + "\n" + strconv.FormatInt(expires.Unix(), 10)))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return the query string that gives access to a URL path until the given time
+func sessionQuery(secret string, urlPath string, expires time.Time) string {
+    query := url.Values{}
+    query.Set(SESSION_EXPIRES_PARAMETER, strconv.FormatInt(expires.Unix(), 10))
+    query.Set(SESSION_TOKEN_PARAMETER, mintSessionToken(secret, urlPath, expires))
+    return query.Encode()
+}
+
+// Return the expiry time of a request if it carries a valid, unexpired
+// session token; if it does not, respond with 403 Forbidden
+func checkSessionToken(out http.ResponseWriter, in *http.Request, secret string) (time.Time, bool) {
+    var expires time.Time
+
+    query := in.URL.Query()
+    seconds, err := strconv.ParseInt(query.Get(SESSION_EXPIRES_PARAMETER), 10, 64)
+    if err == nil {
+        expires = time.Unix(seconds, 0)
+        if !time.Now().Before(expires) {
+            log.Printf("Refused request for \"%s\" from %s, session expired at %s.\n", in.URL.Path, in.RemoteAddr,
+                       expires.UTC().Format(time.RFC3339))
+            http.Error(out, "Session expired", http.StatusForbidden)
+            return expires, false
+        }
+        token, err1 := hex.DecodeString(query.Get(SESSION_TOKEN_PARAMETER))
+        expected, _ := hex.DecodeString(mintSessionToken(secret, in.URL.Path, expires))
+        if (err1 == nil) && hmac.Equal(token, expected) {
+            return expires, true
+        }
+    }
+    log.Printf("Refused request for \"%s\" from %s, invalid session token.\n", in.URL.Path, in.RemoteAddr)
+    http.Error(out, "Forbidden", http.StatusForbidden)
+
+    return expires, false
+}
+
+// Return true if a request may be served: always if there is no
+// session secret, otherwise only if it carries a valid session token,
+// responding with 403 Forbidden if it does not
+func sessionAllowed(out http.ResponseWriter, in *http.Request, secret string) bool {
+    if secret == "" {
+        return true
+    }
+    _, ok := checkSessionToken(out, in, secret)
+    return ok
+}
+
+// Return a playlist, served at playlistPath, with a token added to the
+// URI of each segment, of the key of encrypted segments and of the
+// audio renditions of a master playlist, that expires with the session
+func addSessionTokens(playlist []byte, secret string, playlistPath string, expires time.Time) []byte {
+    var tokenised bytes.Buffer
+
+    for _, line := range strings.SplitAfter(string(playlist), "\n") {
+        uri := strings.TrimRight(line, "\r\n")
+        keyUri := "URI=\"" + HLS_KEY_PATH + "\""
+        if strings.HasPrefix(uri, "#EXT-X-KEY:") && strings.Contains(uri, keyUri) {
+            tokenised.WriteString(strings.Replace(line, keyUri, "URI=\"" + HLS_KEY_PATH + "?" +
+                                                 sessionQuery(secret, HLS_KEY_PATH, expires) + "\"", 1))
+        } else if start := strings.Index(uri, "URI=\""); strings.HasPrefix(uri, "#EXT-X-MEDIA:") && (start >= 0) {
+            start += len("URI=\"")
+            end := start + strings.Index(uri[start:], "\"")
+            if end < start {
+                end = len(uri)
+            }
+            tokenised.WriteString(uri[:end] + "?" + sessionQuery(secret, segmentRequestPath(playlistPath, uri[start:end]), expires))
+            tokenised.WriteString(line[end:])
+        } else if (uri != "") && !strings.HasPrefix(uri, "#") {
+            tokenised.WriteString(uri + "?" + sessionQuery(secret, segmentRequestPath(playlistPath, uri), expires))
+            tokenised.WriteString(line[len(uri):])
+        } else {
+            tokenised.WriteString(line)
+        }
+    }
+
+    return tokenised.Bytes()
+}
+
+// Serve a playlist with session tokens added to its segment URIs, given
+// the expiry time of the session; if playlist is nil it is read from store
+func serveSessionPlaylist(out http.ResponseWriter, in *http.Request, store FileStore, secret string, expires time.Time, playlist []byte) {
+    var err error
+
+    if playlist == nil {
+        playlist, err = readStoreFile(store, in.URL.Path)
+        if err != nil {
+            log.Printf("Unable to read playlist \"%s\" (%s).\n", in.URL.Path, err.Error())
+            http.NotFound(out, in)
+            return
+        }
+    }
+    http.ServeContent(out, in, in.URL.Path, time.Time{},
+                      bytes.NewReader(addSessionTokens(playlist, secret, in.URL.Path, expires)))
+}
+
+// Handle POST requests to ADMIN_SESSION_PATH, responding with a
+// SessionUrl for the given playlist
+func sessionHandler(out http.ResponseWriter, in *http.Request, secret string) {
+    var sessionUrl SessionUrl
+    var lifetime time.Duration = DEFAULT_SESSION_LIFETIME
+    var err error
+
+    if in.Method != "POST" {
+        apiMethodNotAllowed(out, in, "POST")
+        return
+    }
+    if !checkAdminToken(out, in) {
+        return
+    }
+    playlistPath := in.URL.Query().Get(ADMIN_SESSION_PATH_PARAMETER)
+    if !strings.HasPrefix(playlistPath, "/") {
+        apiError(out, in, http.StatusBadRequest, API_ERROR_BAD_REQUEST, "missing or relative \"" + ADMIN_SESSION_PATH_PARAMETER + "\"")
+        return
+    }
+    value := in.URL.Query().Get(ADMIN_SESSION_FOR_PARAMETER)
+    if value != "" {
+        lifetime, err = time.ParseDuration(value)
+        if (err != nil) || (lifetime <= 0) {
+            apiError(out, in, http.StatusBadRequest, API_ERROR_BAD_REQUEST, "invalid \"" + ADMIN_SESSION_FOR_PARAMETER + "\" duration")
+            return
+        }
+    }
+    // The playlist may be given at the URL that clients use for it; the
+    // token is for the path that the server sees
+    playlistPath = internalPath(playlistPath)
+    expires := time.Now().Add(lifetime)
+    sessionUrl.Url = externalUrl(in, playlistPath) + "?" + sessionQuery(secret, playlistPath, expires)
+    sessionUrl.Expires = expires.UTC().Format(time.RFC3339)
+    log.Printf("Session for \"%s\" until %s requested by %s.\n", playlistPath, sessionUrl.Expires, in.RemoteAddr)
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    err = json.NewEncoder(out).Encode(&sessionUrl)
+    if err != nil {
+        log.Printf("Unable to serve session URL (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
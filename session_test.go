@@ -0,0 +1,68 @@
+/* Tests of session tokens for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Ask for a checksum sidecar, the manifest and the live MP3 stream
+// with a session secret set, failing if any is served without a valid
+// token or refused with one, then check that nothing is refused
+// without a session secret
+func TestSessionGating(t *testing.T) {
+    secret := "test"
+    expires := time.Now().Add(time.Hour)
+    sidecarPath := "/hls/1" + SEGMENT_EXTENSION + CHECKSUM_EXTENSION
+
+    response := httptest.NewRecorder()
+    streamHandler(response, httptest.NewRequest("GET", sidecarPath, nil), OsFileStore{}, OsFileStore{}, secret)
+    if response.Code != http.StatusForbidden {
+        t.Fatalf("checksum sidecar without a token gave status %d", response.Code)
+    }
+    response = httptest.NewRecorder()
+    streamHandler(response, httptest.NewRequest("GET", sidecarPath + "?" + sessionQuery(secret, sidecarPath, expires), nil),
+                  OsFileStore{}, OsFileStore{}, secret)
+    if response.Code == http.StatusForbidden {
+        t.Fatal("checksum sidecar with a valid token refused")
+    }
+    for _, urlPath := range []string{MANIFEST_PATH, LIVE_MP3_PATH, MONITOR_PATH} {
+        response = httptest.NewRecorder()
+        if sessionAllowed(response, httptest.NewRequest("GET", urlPath, nil), secret) ||
+           (response.Code != http.StatusForbidden) {
+            t.Fatalf("%s allowed without a token", urlPath)
+        }
+        // A token for another path is no good
+        response = httptest.NewRecorder()
+        if sessionAllowed(response, httptest.NewRequest("GET", urlPath + "?" + sessionQuery(secret, sidecarPath, expires), nil), secret) {
+            t.Fatalf("%s allowed with the token for %s", urlPath, sidecarPath)
+        }
+        response = httptest.NewRecorder()
+        if !sessionAllowed(response, httptest.NewRequest("GET", urlPath + "?" + sessionQuery(secret, urlPath, expires), nil), secret) {
+            t.Fatalf("%s refused with a valid token", urlPath)
+        }
+        response = httptest.NewRecorder()
+        if !sessionAllowed(response, httptest.NewRequest("GET", urlPath, nil), "") {
+            t.Fatalf("%s refused with no session secret", urlPath)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,147 @@
+/* The MP3 encoder of the stream, and its recovery from errors, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "io"
+    "log"
+    "bytes"
+    "sync/atomic"
+    "github.com/u-blox/ioc-server/lame"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An MP3 writer as the stream uses it: a LameMp3Writer, other than in
+// tests
+type Mp3Writer interface {
+    Write(p []byte) (int, error)
+    // Free the encoder, throwing away whatever it has yet to put out
+    Free()
+    // Return the format of the audio the encoder has been set up for
+    Format() AudioFormat
+}
+
+// An MP3 writer made by createMp3Writer()
+type LameMp3Writer struct {
+    *lame.LameWriter
+}
+
+// The MP3 encoder of the stream which, when it has failed
+// MAX_CONSECUTIVE_ENCODER_ERRORS times in a row, is to be re-created
+// rather than left to put out broken MP3
+type StreamEncoder struct {
+    writer Mp3Writer
+    samplesPerFrame int
+    consecutiveErrors int
+    // True once the encoder has been re-created, until taken by the
+    // segment it breaks
+    discontinuity bool
+    // Create a writer with the given options, nil if it cannot be
+    create func(options Mp3EncoderOptions) (Mp3Writer, int)
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of consecutive encoding errors after which the MP3
+// encoder is re-created
+const MAX_CONSECUTIVE_ENCODER_ERRORS int = 3
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Free the encoder of a LameMp3Writer
+func (writer LameMp3Writer) Free() {
+    writer.Encoder.Close()
+}
+
+// Return the format of the audio a LameMp3Writer has been set up for
+func (writer LameMp3Writer) Format() AudioFormat {
+    return encoderAudioFormat(writer.LameWriter)
+}
+
+// Create the encoder of the stream, without a writer until Create() is
+// called, writing its MP3 into mp3Audio
+func createStreamEncoder(mp3Audio *bytes.Buffer) *StreamEncoder {
+    encoder := new(StreamEncoder)
+    encoder.create = func(options Mp3EncoderOptions) (Mp3Writer, int) {
+        mp3Writer, samplesPerFrame := createMp3Writer(mp3Audio, options)
+        if mp3Writer == nil {
+            return nil, 0
+        }
+        return LameMp3Writer{mp3Writer}, samplesPerFrame
+    }
+    return encoder
+}
+
+// Create the writer with the given options, what is playing now going
+// into its metadata; any writer there was is freed, which is a
+// discontinuity.  Returns false if the writer cannot be created
+func (encoder *StreamEncoder) Create(options Mp3EncoderOptions) bool {
+    if encoder.writer != nil {
+        encoder.writer.Free()
+        encoder.discontinuity = true
+    }
+    options.Metadata = nowPlayingMetadata()
+    encoder.writer, encoder.samplesPerFrame = encoder.create(options)
+    encoder.consecutiveErrors = 0
+
+    return encoder.writer != nil
+}
+
+// Encode up to numSamples into the output stream with encodeOutput(),
+// counting any error.  Returns the number of samples encoded and true
+// once there have been MAX_CONSECUTIVE_ENCODER_ERRORS in a row, in
+// which case the writer must be re-created with Create(), since what it
+// puts out can no longer be trusted, and whatever it had put out into
+// the segment being cut thrown away
+func (encoder *StreamEncoder) Encode(pcmHandle io.Writer, numSamples int, meter *LevelMeter) (int, bool) {
+    samples, err := encodeOutput(encoder.writer, pcmHandle, numSamples, meter)
+    if err == nil {
+        encoder.consecutiveErrors = 0
+        return samples, false
+    }
+    atomic.AddInt64(&numEncoderErrors, 1)
+    encoder.consecutiveErrors++
+    if encoder.consecutiveErrors < MAX_CONSECUTIVE_ENCODER_ERRORS {
+        return samples, false
+    }
+    log.Printf("%d consecutive MP3 encoding errors.\n", encoder.consecutiveErrors)
+
+    return 0, true
+}
+
+// Return the writer
+func (encoder *StreamEncoder) Writer() Mp3Writer {
+    return encoder.writer
+}
+
+// Return the number of samples in each MP3 frame the writer puts out
+func (encoder *StreamEncoder) SamplesPerFrame() int {
+    return encoder.samplesPerFrame
+}
+
+// Return true if the encoder has been re-created since this was last
+// called, so that the segment now being cut is a discontinuity
+func (encoder *StreamEncoder) TakeDiscontinuity() bool {
+    discontinuity := encoder.discontinuity
+    encoder.discontinuity = false
+    return discontinuity
+}
+
+/* End Of File */
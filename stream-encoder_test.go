@@ -0,0 +1,122 @@
+/* Tests of the MP3 encoder of the stream for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "testing"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An MP3 writer which fails the given number of writes, then takes
+// whatever it is given
+type TestMp3Writer struct {
+    failures int
+    written int
+    freed bool
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Write, or fail to
+func (writer *TestMp3Writer) Write(p []byte) (int, error) {
+    if writer.failures > 0 {
+        writer.failures--
+        return 0, errors.New("simulated encoder failure")
+    }
+    writer.written += len(p)
+    return len(p), nil
+}
+
+// Free the writer
+func (writer *TestMp3Writer) Free() {
+    writer.freed = true
+}
+
+// Return the format of the audio of the stream
+func (writer *TestMp3Writer) Format() AudioFormat {
+    return AudioFormat{SAMPLING_FREQUENCY, 1}
+}
+
+// Encode with a writer that keeps failing, failing if the errors are
+// not counted, if the writer is not found faulty after
+// MAX_CONSECUTIVE_ENCODER_ERRORS of them, if re-creating it then does
+// not free it, if the segment being cut then is not a discontinuity or
+// if the new writer is not encoded with
+func TestStreamEncoderRecovery(t *testing.T) {
+    var writers []*TestMp3Writer
+    errorsBefore := atomic.LoadInt64(&numEncoderErrors)
+    normaliser := loudnessNormaliser
+    loudnessNormaliser = nil
+    t.Cleanup(func() {
+        pcmAudio.Reset()
+        loudnessNormaliser = normaliser
+        atomic.StoreInt64(&numEncoderErrors, errorsBefore)
+    })
+
+    // The first writer fails for ever, the next never does
+    encoder := &StreamEncoder{create: func(options Mp3EncoderOptions) (Mp3Writer, int) {
+        writer := new(TestMp3Writer)
+        if len(writers) == 0 {
+            writer.failures = MAX_CONSECUTIVE_ENCODER_ERRORS * 2
+        }
+        writers = append(writers, writer)
+        return writer, 576
+    }}
+    if !encoder.Create(Mp3EncoderOptions{}) {
+        t.Fatal("unable to create the writer")
+    }
+    if encoder.TakeDiscontinuity() {
+        t.Fatal("creating the first writer is a discontinuity")
+    }
+    for x := 1; x <= MAX_CONSECUTIVE_ENCODER_ERRORS; x++ {
+        pcmAudio.Write(make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+        samples, faulty := encoder.Encode(nil, SAMPLES_PER_BLOCK, nil)
+        if samples != 0 {
+            t.Fatalf("failing writer encoded %d sample(s)", samples)
+        }
+        if counted := atomic.LoadInt64(&numEncoderErrors) - errorsBefore; counted != int64(x) {
+            t.Fatalf("%d encoder error(s) counted after %d", counted, x)
+        }
+        if faulty != (x == MAX_CONSECUTIVE_ENCODER_ERRORS) {
+            t.Fatalf("writer found faulty %v after %d error(s)", faulty, x)
+        }
+    }
+    if !encoder.Create(Mp3EncoderOptions{}) {
+        t.Fatal("unable to re-create the writer")
+    }
+    if (len(writers) != 2) || !writers[0].freed || writers[1].freed {
+        t.Fatalf("%d writer(s) created, the first freed %v", len(writers), writers[0].freed)
+    }
+    if !encoder.TakeDiscontinuity() {
+        t.Fatal("segment being cut when the writer was re-created is not a discontinuity")
+    }
+    if encoder.TakeDiscontinuity() {
+        t.Fatal("segment after that is a discontinuity too")
+    }
+
+    // On with the new writer
+    pcmAudio.Write(make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE))
+    samples, faulty := encoder.Encode(nil, SAMPLES_PER_BLOCK, nil)
+    if (samples != SAMPLES_PER_BLOCK) || faulty || (writers[1].written != SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE) {
+        t.Fatalf("new writer encoded %d sample(s) (faulty %v)", samples, faulty)
+    }
+}
+
+/* End Of File */
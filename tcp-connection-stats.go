@@ -0,0 +1,121 @@
+/* Per-connection statistics of the TCP server for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "net"
+    "sync"
+    "time"
+    "sync/atomic"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The counters of a TCP connection, kept by its UrtpReassembler; the
+// counts are accessed atomically, since they are added to as the
+// connection is served but read under tcpConnectionStatsAccess
+type TcpConnectionCounters struct {
+    opened time.Time
+    bytesReceived int64
+    datagramsParsed int64
+    resyncs int64
+    // In Unix nanoseconds
+    lastActivity int64
+}
+
+// The statistics of an open TCP connection, as served in the statistics
+// keyed by its remote address
+type TcpConnectionStats struct {
+    Opened string `json:"opened"`
+    BytesReceived int64 `json:"bytesReceived"`
+    DatagramsParsed int64 `json:"datagramsParsed"`
+    Resyncs int64 `json:"resyncs"`
+    LastActivity string `json:"lastActivity"`
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The reassembler, which keeps the counters, of each open TCP
+// connection; a connection's is removed when it closes, so connections
+// that come and go leave nothing behind
+var tcpConnectionReassemblers = make(map[net.Conn]*UrtpReassembler)
+var tcpConnectionStatsAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Start serving the statistics of a newly opened TCP connection, as
+// kept by its reassembler
+func tcpConnectionStatsOpened(reassembler *UrtpReassembler) {
+    tcpConnectionStatsAccess.Lock()
+    tcpConnectionReassemblers[reassembler.connection] = reassembler
+    tcpConnectionStatsAccess.Unlock()
+}
+
+// Stop serving the statistics of a TCP connection that has closed,
+// logging a summary of what it sent, so that one bad client among
+// several can be picked out
+func tcpConnectionStatsClosed(reassembler *UrtpReassembler) {
+    tcpConnectionStatsAccess.Lock()
+    delete(tcpConnectionReassemblers, reassembler.connection)
+    tcpConnectionStatsAccess.Unlock()
+    counters := &reassembler.counters
+    log.Printf("TCP connection from %s closed after %v: %d byte(s) received, %d datagram(s) parsed, %d resync(s).\n",
+               reassembler.source().String(), time.Now().Sub(counters.opened).Round(time.Millisecond),
+               atomic.LoadInt64(&counters.bytesReceived), atomic.LoadInt64(&counters.datagramsParsed),
+               atomic.LoadInt64(&counters.resyncs))
+}
+
+// Count bytes received on a TCP connection
+func (counters *TcpConnectionCounters) Received(numBytes int) {
+    atomic.AddInt64(&counters.bytesReceived, int64(numBytes))
+    atomic.StoreInt64(&counters.lastActivity, time.Now().UnixNano())
+}
+
+// Count a datagram parsed from the stream of a TCP connection
+func (counters *TcpConnectionCounters) Parsed() {
+    atomic.AddInt64(&counters.datagramsParsed, 1)
+}
+
+// Count a loss of sync with the stream of a TCP connection
+func (counters *TcpConnectionCounters) Resynced() {
+    atomic.AddInt64(&counters.resyncs, 1)
+}
+
+// Return the statistics of the open TCP connections, keyed by remote
+// address
+func tcpConnectionStats() map[string]TcpConnectionStats {
+    stats := make(map[string]TcpConnectionStats)
+
+    tcpConnectionStatsAccess.Lock()
+    defer tcpConnectionStatsAccess.Unlock()
+    for connection, reassembler := range tcpConnectionReassemblers {
+        counters := &reassembler.counters
+        stats[connection.RemoteAddr().String()] = TcpConnectionStats{
+            Opened: counters.opened.UTC().Format(time.RFC3339),
+            BytesReceived: atomic.LoadInt64(&counters.bytesReceived),
+            DatagramsParsed: atomic.LoadInt64(&counters.datagramsParsed),
+            Resyncs: atomic.LoadInt64(&counters.resyncs),
+            LastActivity: time.Unix(0, atomic.LoadInt64(&counters.lastActivity)).UTC().Format(time.RFC3339Nano)}
+    }
+
+    return stats
+}
+
+/* End Of File */
@@ -0,0 +1,112 @@
+/* Tests of per-connection statistics of the TCP server for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "errors"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Connect two clients over loopback TCP, one sending good datagrams and
+// one with a stray byte, the second replacing the first, checking that
+// each connection's statistics are its own, keyed by remote address, and
+// that they go once the connections close
+func TestTcpConnectionStats(t *testing.T) {
+    heartbeat := makeUrtpDatagram(URTP_HEARTBEAT, 1, nil)
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    t.Cleanup(func() {
+        startUrtpStream(nil)
+    })
+    // Connect a client and serve it as tcpServer() would
+    connect := func() (net.Conn, error) {
+        client, err := net.Dial("tcp", listener.Addr().String())
+        if err != nil {
+            return nil, err
+        }
+        server, err := listener.Accept()
+        if err != nil {
+            client.Close()
+            return nil, err
+        }
+        tcpConnectionOpened()
+        startUrtpStream(server)
+        go serveTcpConnection(server)
+        return client, nil
+    }
+    // Wait for the statistics of a client's connection to be as given,
+    // nil meaning for them to be gone
+    await := func(client net.Conn, expected *TcpConnectionStats) error {
+        var stats TcpConnectionStats
+        var exists bool
+        for start := time.Now(); time.Now().Sub(start) < time.Second * 5; time.Sleep(time.Millisecond * 10) {
+            stats, exists = tcpConnectionStats()[client.LocalAddr().String()]
+            if (expected == nil) && !exists {
+                return nil
+            }
+            if (expected != nil) && exists && (stats.BytesReceived == expected.BytesReceived) &&
+               (stats.DatagramsParsed == expected.DatagramsParsed) && (stats.Resyncs == expected.Resyncs) {
+                return nil
+            }
+        }
+        return errors.New(fmt.Sprintf("statistics of connection from %s are %+v (present %t) when %+v was expected",
+                                      client.LocalAddr().String(), stats, exists, expected))
+    }
+
+    good, err := connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer good.Close()
+    good.Write(append(append([]byte(nil), heartbeat...), heartbeat...))
+    err = await(good, &TcpConnectionStats{BytesReceived: int64(len(heartbeat) * 2), DatagramsParsed: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    bad, err := connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer bad.Close()
+    bad.Write(append([]byte{^SYNC_BYTE}, heartbeat...))
+    err = await(bad, &TcpConnectionStats{BytesReceived: int64(len(heartbeat) + 1), DatagramsParsed: 1, Resyncs: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The replaced connection is still open, and still counted
+    err = await(good, &TcpConnectionStats{BytesReceived: int64(len(heartbeat) * 2), DatagramsParsed: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    good.Close()
+    bad.Close()
+    for _, client := range []net.Conn{good, bad} {
+        err = await(client, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,65 @@
+/* The time zone of the playlist for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The time zone in which #EXT-X-PROGRAM-DATE-TIME is given
+const PLAYLIST_TIME_ZONE string = "Europe/London"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// PLAYLIST_TIME_ZONE, once loaded by loadPlaylistTimeZone(); until then,
+// or if it could not be loaded, times are given in UTC
+var playlistLocation *time.Location
+
+// How a time zone is loaded, replaced in TestTimeZone()
+var loadLocation = time.LoadLocation
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Load PLAYLIST_TIME_ZONE, returning an error if it cannot be, e.g.
+// on a host without the time zone database, in which case times
+// continue to be given in UTC
+func loadPlaylistTimeZone() error {
+    location, err := loadLocation(PLAYLIST_TIME_ZONE)
+    if err != nil {
+        playlistLocation = nil
+        return err
+    }
+    playlistLocation = location
+    return nil
+}
+
+// Return a time string in ISO8601 format in the UK timezone, or in UTC
+// if that has not been loaded, the offset always being that of the
+// time zone the time is actually given in
+func ukTimeIso8601(timestamp time.Time) string {
+    location := playlistLocation
+    if location == nil {
+        location = time.UTC
+    }
+    return timestamp.In(location).Format("2006-01-02T15:04:05.000-07:00")
+}
+
+/* End Of File */
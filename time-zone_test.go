@@ -0,0 +1,56 @@
+/* Tests of the time zone of the playlist for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "time"
+    "errors"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Format a summer time in the UK time zone with the time zone database
+// unavailable, checking that loading it fails and that the time is given
+// in UTC, with an offset to match, then with the database available if
+// the host has it (or it is embedded), checking that the time is given
+// in British Summer Time
+func TestTimeZone(t *testing.T) {
+    summer := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+    savedLocation := playlistLocation
+    t.Cleanup(func() {
+        loadLocation = time.LoadLocation
+        playlistLocation = savedLocation
+    })
+
+    loadLocation = func(name string) (*time.Location, error) {
+        return nil, errors.New("unknown time zone " + name)
+    }
+    if loadPlaylistTimeZone() == nil {
+        t.Fatal("time zone loaded without a time zone database")
+    }
+    if formatted := ukTimeIso8601(summer); formatted != "2024-07-01T12:00:00.000+00:00" {
+        t.Fatalf("without a time zone database, %v given as %s rather than in UTC", summer, formatted)
+    }
+
+    loadLocation = time.LoadLocation
+    if loadPlaylistTimeZone() == nil {
+        if formatted := ukTimeIso8601(summer); formatted != "2024-07-01T13:00:00.000+01:00" {
+            t.Fatalf("%v given as %s rather than in British Summer Time", summer, formatted)
+        }
+    }
+}
+
+/* End Of File */
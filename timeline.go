@@ -0,0 +1,82 @@
+/* The base of the timeline of the input for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The datagram at which the timeline of the input (or of an input
+// session) starts; every datagram after it is placed by its sequence
+// number relative to this one, and there is nothing before it for a gap
+// to be concealed from
+type TimelineBase struct {
+    established bool
+    SequenceNumber uint16
+    Timestamp uint64
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// What to do with a first datagram which does not carry a whole block
+// of audio: pad it out to a block, so that the timeline starts at its
+// sequence number, or trim it, so that the timeline starts with the
+// first audio actually received (a first datagram with no audio at all
+// being skipped)
+const FIRST_DATAGRAM_PAD string = "pad"
+const FIRST_DATAGRAM_TRIM string = "trim"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The base of the timeline; only accessed by audio processing
+var timelineBase TimelineBase
+
+// True if the first datagram is trimmed, see FIRST_DATAGRAM_TRIM
+var trimFirstDatagram bool
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Start the timeline again, e.g. for a new input session
+func resetTimeline() {
+    timelineBase = TimelineBase{}
+}
+
+// Called with each datagram before it is processed; returns true if it
+// is the first of the timeline, setting the base from it, false if the
+// timeline is already established or the datagram does not start it
+func startTimeline(datagram *UrtpDatagram) bool {
+    if timelineBase.established {
+        return false
+    }
+    if trimFirstDatagram && (datagram.Audio == nil) {
+        log.Printf("First datagram, sequence number %d, has no audio, the timeline will start with the first that has.\n",
+                   datagram.SequenceNumber)
+        return false
+    }
+    timelineBase = TimelineBase{established: true, SequenceNumber: datagram.SequenceNumber, Timestamp: datagram.Timestamp}
+    log.Printf("Timeline starts at sequence number %d, timestamp %6.3f ms.\n",
+               datagram.SequenceNumber, float64(datagram.Timestamp) / 1000)
+    return true
+}
+
+/* End Of File */
@@ -0,0 +1,66 @@
+/* Tests of the base of the timeline of the input for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Feed a first datagram with a short block, and one with no audio at
+// all, through processDatagram(), checking how much audio goes into the
+// buffer and where the timeline starts when the first datagram is
+// padded and when it is trimmed
+func TestFirstDatagram(t *testing.T) {
+    savedConcealer := concealer
+    savedFiller := underrunFiller
+    concealer = RepeatConcealer{}
+    underrunFiller = nil
+    t.Cleanup(func() {
+        concealer = savedConcealer
+        underrunFiller = savedFiller
+        trimFirstDatagram = false
+        resetTimeline()
+        pcmAudio.Reset()
+        concealedSamples = 0
+    })
+    short := make([]int16, SAMPLES_PER_BLOCK / 2)
+    for x, test := range []struct{trim bool; first *[]int16; samples int; base uint16}{
+                            // Padded, both take a whole block from the first
+                            {false, &short, SAMPLES_PER_BLOCK * 2, 10},
+                            {false, nil, SAMPLES_PER_BLOCK * 2, 10},
+                            // Trimmed, the short block is taken as it is and the
+                            // datagram with no audio doesn't count
+                            {true, &short, SAMPLES_PER_BLOCK / 2 + SAMPLES_PER_BLOCK, 10},
+                            {true, nil, SAMPLES_PER_BLOCK, 11}} {
+        ring := createDatagramRing(NUM_PROCESSED_DATAGRAMS)
+        trimFirstDatagram = test.trim
+        resetTimeline()
+        pcmAudio.Reset()
+        full := make([]int16, SAMPLES_PER_BLOCK)
+        for _, datagram := range []*UrtpDatagram{{SequenceNumber: 10, Timestamp: 1000, Audio: test.first},
+                                                 {SequenceNumber: 11, Timestamp: 21000, Audio: &full}} {
+            processDatagram(datagram, ring, nil)
+            ring.Push(datagram)
+        }
+        if (pcmAudio.Len() != test.samples * URTP_SAMPLE_SIZE) || !timelineBase.established || (timelineBase.SequenceNumber != test.base) {
+            t.Fatalf("case %d: %d sample(s) buffered and timeline base %+v when %d and sequence number %d were expected",
+                     x, pcmAudio.Len() / URTP_SAMPLE_SIZE, timelineBase, test.samples, test.base)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,112 @@
+/* TLS configuration for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "errors"
+    "strings"
+    "crypto/tls"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The minimum TLS versions that may be chosen
+const TLS_VERSION_1_2 string = "1.2"
+const TLS_VERSION_1_3 string = "1.3"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The curves that may be chosen, by name
+var tlsCurves = map[string]tls.CurveID{
+    "X25519": tls.X25519,
+    "P-256": tls.CurveP256,
+    "P-384": tls.CurveP384,
+    "P-521": tls.CurveP521,
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the TLS cipher suite with the given name, nil if there is
+// no such suite or it is insecure
+func tlsCipherSuite(name string) *tls.CipherSuite {
+    for _, suite := range tls.CipherSuites() {
+        if suite.Name == name {
+            return suite
+        }
+    }
+    return nil
+}
+
+// Create the TLS configuration of the HTTP server; cipherSuites and
+// curves are lists of names, in order of preference, and may be empty
+// to use Go's defaults (the cipher suites of TLS 1.3 are not configurable)
+func createTlsConfig(minVersion string, cipherSuites []string, curves []string) (*tls.Config, error) {
+    config := &tls.Config{}
+
+    switch minVersion {
+        case TLS_VERSION_1_2:
+            config.MinVersion = tls.VersionTLS12
+        case TLS_VERSION_1_3:
+            config.MinVersion = tls.VersionTLS13
+        default:
+            return nil, errors.New(fmt.Sprintf("unsupported minimum TLS version \"%s\"", minVersion))
+    }
+    for _, name := range cipherSuites {
+        suite := tlsCipherSuite(strings.TrimSpace(name))
+        if suite == nil {
+            return nil, errors.New(fmt.Sprintf("unknown or insecure cipher suite \"%s\"", name))
+        }
+        config.CipherSuites = append(config.CipherSuites, suite.ID)
+    }
+    for _, name := range curves {
+        curve, found := tlsCurves[strings.TrimSpace(name)]
+        if !found {
+            return nil, errors.New(fmt.Sprintf("unknown curve \"%s\"", name))
+        }
+        config.CurvePreferences = append(config.CurvePreferences, curve)
+    }
+
+    return config, nil
+}
+
+// Log a TLS configuration
+func logTlsConfig(config *tls.Config) {
+    var suites []string
+    var curves []string
+
+    for _, id := range config.CipherSuites {
+        suites = append(suites, tls.CipherSuiteName(id))
+    }
+    if len(suites) == 0 {
+        suites = append(suites, "default")
+    }
+    for _, id := range config.CurvePreferences {
+        curves = append(curves, id.String())
+    }
+    if len(curves) == 0 {
+        curves = append(curves, "default")
+    }
+    log.Printf("TLS: minimum version %s, cipher suites %s, curves %s.\n", tls.VersionName(config.MinVersion),
+               strings.Join(suites, ", "), strings.Join(curves, ", "))
+    fmt.Printf("TLS minimum version is %s.\n", tls.VersionName(config.MinVersion))
+}
+
+/* End Of File */
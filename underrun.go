@@ -0,0 +1,89 @@
+/* Handling of audio buffer underruns for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Fills stalls in the input with silence so that the audio keeps pace
+// with real time; when the input resumes, a gap in its sequence numbers
+// covering the stall is not filled a second time
+type UnderrunFiller struct {
+    // When the audio buffer was first found empty, zero if it is not
+    since time.Time
+    // The samples of silence written since then
+    filled int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How long the audio buffer may be empty before it is filled; this
+// allows for jitter in the arrival of datagrams
+const UNDERRUN_TOLERANCE time.Duration = time.Millisecond * 60
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Called on each tick of audio processing, with whether the audio buffer
+// is empty, returning the silence (if any) to be written to it
+func (filler *UnderrunFiller) Tick(now time.Time, empty bool) []byte {
+    if !empty {
+        filler.since = time.Time{}
+        filler.filled = 0
+        return nil
+    }
+    if filler.since.IsZero() {
+        filler.since = now
+        return nil
+    }
+    stall := now.Sub(filler.since)
+    if stall < UNDERRUN_TOLERANCE {
+        return nil
+    }
+    samples := int(stall * time.Duration(SAMPLING_FREQUENCY) / time.Second) - filler.filled
+    if samples <= 0 {
+        return nil
+    }
+    if filler.filled == 0 {
+        log.Printf("Audio buffer has been empty for %v, filling with silence.\n", stall)
+    }
+    filler.filled += samples
+
+    return make([]byte, samples * URTP_SAMPLE_SIZE)
+}
+
+// Called with a gap in the sequence numbers of the input, returning
+// the number of samples of it that have not already been filled
+func (filler *UnderrunFiller) Absorb(gapSamples int) int {
+    absorbed := filler.filled
+    if absorbed > gapSamples {
+        absorbed = gapSamples
+    }
+    filler.filled -= absorbed
+    if absorbed > 0 {
+        log.Printf("%d sample(s) of a gap of %d were already filled during a stall.\n", absorbed, gapSamples)
+    }
+
+    return gapSamples - absorbed
+}
+
+/* End Of File */
@@ -0,0 +1,53 @@
+/* Tests of handling of audio buffer underruns for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The stall simulated by TestUnderrun()
+const TEST_STALL time.Duration = time.Millisecond * 200
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Simulate a stall in the input of TEST_STALL, failing
+// if the silence written and the gap left to fill afterwards don't add
+// up to the stall, to within a block
+func TestUnderrun(t *testing.T) {
+    var filler UnderrunFiller
+    var filled int
+
+    start := time.Now()
+    for tick := time.Duration(0); tick <= TEST_STALL; tick += time.Duration(BLOCK_DURATION_MS) * time.Millisecond {
+        filled += len(filler.Tick(start.Add(tick), true)) / URTP_SAMPLE_SIZE
+    }
+    stallSamples := int(TEST_STALL * time.Duration(SAMPLING_FREQUENCY) / time.Second)
+    if (filled < stallSamples - SAMPLES_PER_BLOCK) || (filled > stallSamples + SAMPLES_PER_BLOCK) {
+        t.Fatalf("%d sample(s) of silence written for a stall of %d sample(s)", filled, stallSamples)
+    }
+    remaining := filler.Absorb(stallSamples)
+    if filled + remaining != stallSamples {
+        t.Fatalf("%d sample(s) of silence written and %d left to fill for a stall of %d sample(s)",
+                 filled, remaining, stallSamples)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,164 @@
+/* UNICAM decode diagnostics for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "sync"
+    "net/http"
+    "encoding/json"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// What decodeUnicam() found in a datagram, for tuning the UNICAM
+// encoder of the client
+type UnicamDiagnostics struct {
+    SequenceNumber uint16 `json:"sequenceNumber"`
+    SampleSizeBits int `json:"sampleSizeBits"`
+    Blocks int `json:"blocks"`
+    // The number of blocks with each shift value
+    ShiftHistogram [UNICAM_NUM_SHIFT_VALUES]int `json:"shiftHistogram"`
+    // The power of the decoded audio and an estimate of that of the
+    // quantisation noise introduced by the coding, relative to full scale
+    SignalDbfs float64 `json:"signalDbfs"`
+    QuantisationNoiseDbfs float64 `json:"quantisationNoiseDbfs"`
+    // The signal to quantisation noise ratio
+    SnrDb float64 `json:"snrDb"`
+}
+
+// The UNICAM diagnostics served at UNICAM_DIAGNOSTICS_PATH: the totals
+// since the server started and the most recent datagrams, oldest first
+type UnicamDiagnosticsReport struct {
+    Datagrams int64 `json:"datagrams"`
+    Blocks int64 `json:"blocks"`
+    ShiftHistogram [UNICAM_NUM_SHIFT_VALUES]int64 `json:"shiftHistogram"`
+    Recent []UnicamDiagnostics `json:"recent"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of possible shift values, coded in four bits
+const UNICAM_NUM_SHIFT_VALUES int = 1 << UNICAM_CODED_SHIFT_SIZE_BITS
+
+// The URL path at which UNICAM diagnostics are served
+const UNICAM_DIAGNOSTICS_PATH string = "/debug/unicam"
+
+// The number of recent datagrams served at UNICAM_DIAGNOSTICS_PATH (five
+// seconds' worth)
+const UNICAM_DIAGNOSTICS_HISTORY int = 5000 / BLOCK_DURATION_MS
+
+// The floor put under powers expressed in dB, so that silence is not
+// minus infinity (which JSON can't represent)
+const UNICAM_DIAGNOSTICS_FLOOR_DB float64 = -150
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// True if UNICAM diagnostics are being collected
+var unicamDiagnosticsEnabled bool
+
+// The UNICAM diagnostics collected so far; the most recent datagrams
+// are kept in a circular buffer, unicamDiagnosticsNext being the
+// index of where the next will go
+var unicamDiagnostics UnicamDiagnosticsReport
+var unicamDiagnosticsRecent = make([]UnicamDiagnostics, 0, UNICAM_DIAGNOSTICS_HISTORY)
+var unicamDiagnosticsNext int
+var unicamDiagnosticsAccess sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a power, relative to the square of full scale, in dB
+func powerDbfs(power float64) float64 {
+    if power <= 0 {
+        return UNICAM_DIAGNOSTICS_FLOOR_DB
+    }
+    return math.Max(10 * math.Log10(power / (float64(math.MaxInt16) * float64(math.MaxInt16))), UNICAM_DIAGNOSTICS_FLOOR_DB)
+}
+
+// Work out the signal and quantisation noise powers from the decoded
+// audio and the shift histogram: a block coded with a shift of n has
+// lost its bottom n bits, which for a uniform quantiser with a step
+// of 2^n is noise with a power of 2^2n / 12
+func (diagnostics *UnicamDiagnostics) complete(audio []int16) {
+    var signal float64
+    var noise float64
+
+    for _, sample := range audio {
+        signal += float64(sample) * float64(sample)
+    }
+    if len(audio) > 0 {
+        signal /= float64(len(audio))
+    }
+    for shift, blocks := range diagnostics.ShiftHistogram {
+        step := math.Ldexp(1, shift)
+        noise += float64(blocks) * step * step / 12
+    }
+    if diagnostics.Blocks > 0 {
+        noise /= float64(diagnostics.Blocks)
+    }
+    diagnostics.SignalDbfs = powerDbfs(signal)
+    diagnostics.QuantisationNoiseDbfs = powerDbfs(noise)
+    diagnostics.SnrDb = diagnostics.SignalDbfs - diagnostics.QuantisationNoiseDbfs
+}
+
+// Record the diagnostics of a datagram, logging a summary of them
+func recordUnicamDiagnostics(diagnostics *UnicamDiagnostics) {
+    log.Printf("UNICAM diagnostics: sequence number %d, %d-bit, %d block(s), shifts %v, signal %.1f dBFS, quantisation noise %.1f dBFS, SNR %.1f dB.\n",
+               diagnostics.SequenceNumber, diagnostics.SampleSizeBits, diagnostics.Blocks, diagnostics.ShiftHistogram,
+               diagnostics.SignalDbfs, diagnostics.QuantisationNoiseDbfs, diagnostics.SnrDb)
+    unicamDiagnosticsAccess.Lock()
+    unicamDiagnostics.Datagrams++
+    unicamDiagnostics.Blocks += int64(diagnostics.Blocks)
+    for shift, blocks := range diagnostics.ShiftHistogram {
+        unicamDiagnostics.ShiftHistogram[shift] += int64(blocks)
+    }
+    if len(unicamDiagnosticsRecent) < cap(unicamDiagnosticsRecent) {
+        unicamDiagnosticsRecent = append(unicamDiagnosticsRecent, *diagnostics)
+    } else {
+        unicamDiagnosticsRecent[unicamDiagnosticsNext] = *diagnostics
+    }
+    unicamDiagnosticsNext = (unicamDiagnosticsNext + 1) % cap(unicamDiagnosticsRecent)
+    unicamDiagnosticsAccess.Unlock()
+}
+
+// Handle a request for the UNICAM diagnostics
+func unicamDiagnosticsHandler(out http.ResponseWriter, in *http.Request) {
+    log.Printf("UNICAM diagnostics handler was asked for \"%s\"...\n", in.URL.Path)
+    unicamDiagnosticsAccess.Lock()
+    report := unicamDiagnostics
+    report.Recent = make([]UnicamDiagnostics, 0, len(unicamDiagnosticsRecent))
+    if len(unicamDiagnosticsRecent) == cap(unicamDiagnosticsRecent) {
+        report.Recent = append(report.Recent, unicamDiagnosticsRecent[unicamDiagnosticsNext:]...)
+        report.Recent = append(report.Recent, unicamDiagnosticsRecent[:unicamDiagnosticsNext]...)
+    } else {
+        report.Recent = append(report.Recent, unicamDiagnosticsRecent...)
+    }
+    unicamDiagnosticsAccess.Unlock()
+    out.Header().Set("Content-Type", "application/json")
+    out.Header().Set("Cache-Control","no-cache")
+    err := json.NewEncoder(out).Encode(&report)
+    if err != nil {
+        log.Printf("Unable to serve UNICAM diagnostics (%s).\n", err.Error())
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,146 @@
+/* URTP protocol versions for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "strconv"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The layout of the header of a version of URTP, the version being
+// given by the sync byte that starts it.  Every version has the sync
+// byte, then the audio coding scheme, then a two-byte sequence number,
+// then a big-endian timestamp; what follows that differs
+type UrtpLayout struct {
+    Version int
+    SyncByte byte
+    HeaderSize int
+    // The size of the timestamp, in bytes, and how many microseconds
+    // each count of it is
+    TimestampSize int
+    TimestampUnit uint64
+    // The offset of the two-byte payload size, 0 if the header has
+    // none, the payload then being the rest of the datagram, so that
+    // datagrams of that version can only be taken from UDP
+    PayloadSizeOffset int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The versions of URTP: the compact version, with an eight-byte
+// header giving the timestamp in milliseconds and no payload size,
+// and the standard version, with the fourteen-byte header of
+// URTP_HEADER_SIZE, giving the timestamp in microseconds
+const URTP_VERSION_COMPACT int = 1
+const URTP_VERSION_STANDARD int = 2
+
+// The sync byte and header size of the compact version of URTP; the
+// sync byte of the standard version is SYNC_BYTE
+const URTP_COMPACT_SYNC_BYTE byte = 0x5b
+const URTP_COMPACT_HEADER_SIZE int = 8
+
+// Accept every version of URTP, working out which each datagram is
+// from its sync byte
+const URTP_VERSION_AUTO string = "auto"
+
+// The offsets of the audio coding scheme, sequence number and
+// timestamp, which are the same in every version
+const URTP_AUDIO_CODING_OFFSET int = 1
+const URTP_SEQUENCE_NUMBER_OFFSET int = 2
+const URTP_TIMESTAMP_OFFSET int = URTP_SEQUENCE_NUMBER_OFFSET + URTP_SEQUENCE_NUMBER_SIZE
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The layouts of the versions of URTP
+var urtpLayouts = []UrtpLayout{{Version: URTP_VERSION_COMPACT,
+                                 SyncByte: URTP_COMPACT_SYNC_BYTE,
+                                 HeaderSize: URTP_COMPACT_HEADER_SIZE,
+                                 TimestampSize: 4,
+                                 TimestampUnit: uint64(time.Millisecond / time.Microsecond)},
+                                {Version: URTP_VERSION_STANDARD,
+                                 SyncByte: SYNC_BYTE,
+                                 HeaderSize: URTP_HEADER_SIZE,
+                                 TimestampSize: URTP_TIMESTAMP_SIZE,
+                                 TimestampUnit: 1,
+                                 PayloadSizeOffset: URTP_NUM_BYTES_AUDIO_OFFSET}}
+
+// The versions of URTP accepted, by version; set by setUrtpVersion()
+// before the input servers are started
+var urtpVersionsAccepted = map[int]bool{URTP_VERSION_STANDARD: true}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Set the version of URTP to accept, as a version number or
+// URTP_VERSION_AUTO for all of them
+func setUrtpVersion(version string) error {
+    accepted := make(map[int]bool)
+    for _, layout := range urtpLayouts {
+        if (version == URTP_VERSION_AUTO) || (version == strconv.Itoa(layout.Version)) {
+            accepted[layout.Version] = true
+        }
+    }
+    if len(accepted) == 0 {
+        return errors.New(fmt.Sprintf("\"%s\" is not a URTP version, nor %s", version, URTP_VERSION_AUTO))
+    }
+    urtpVersionsAccepted = accepted
+
+    return nil
+}
+
+// Return true if a version of URTP is accepted
+func urtpVersionAccepted(version int) bool {
+    return urtpVersionsAccepted[version]
+}
+
+// Return the layout of the version of URTP that a sync byte starts,
+// nil if it is not the sync byte of a version that is accepted
+func urtpLayoutOf(syncByte byte) *UrtpLayout {
+    for x := range urtpLayouts {
+        if (urtpLayouts[x].SyncByte == syncByte) && urtpVersionAccepted(urtpLayouts[x].Version) {
+            return &urtpLayouts[x]
+        }
+    }
+    return nil
+}
+
+// Return the timestamp of a datagram in microseconds
+func (layout *UrtpLayout) Timestamp(datagram []byte) uint64 {
+    var timestamp uint64
+    for _, item := range datagram[URTP_TIMESTAMP_OFFSET:URTP_TIMESTAMP_OFFSET + layout.TimestampSize] {
+        timestamp = (timestamp << 8) + uint64(item)
+    }
+    return timestamp * layout.TimestampUnit
+}
+
+// Return the size of the payload of a datagram, which for a version
+// with no payload size in its header is whatever follows the header
+func (layout *UrtpLayout) PayloadSize(datagram []byte) int {
+    if layout.PayloadSizeOffset == 0 {
+        return len(datagram) - layout.HeaderSize
+    }
+    return (int(datagram[layout.PayloadSizeOffset]) << 8) + int(datagram[layout.PayloadSizeOffset + 1])
+}
+
+/* End Of File */
@@ -0,0 +1,111 @@
+/* Tests of URTP protocol versions for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "net"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a compact URTP datagram with the given coding scheme, sequence
+// number, timestamp in milliseconds and payload
+func makeCompactUrtpDatagram(scheme byte, sequenceNumber uint16, timestamp uint32, payload []byte) []byte {
+    datagram := []byte{URTP_COMPACT_SYNC_BYTE, scheme, byte(sequenceNumber >> 8), byte(sequenceNumber),
+                       byte(timestamp >> 24), byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp)}
+    return append(datagram, payload...)
+}
+
+// Receive a datagram of each version of URTP over UDP, accepting each
+// version on its own and then both, checking that only those of an
+// accepted version are let through and that the sequence number,
+// timestamp and audio of those are read from the right places; a
+// compact heartbeat must have nothing after its header and a compact
+// datagram of audio must have a payload that fits its coding scheme
+func TestUrtpVersions(t *testing.T) {
+    source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5065}
+    channel := make(chan interface{}, 10)
+    savedChannel := ProcessDatagramsChannel
+    savedAccepted := urtpVersionsAccepted
+    ProcessDatagramsChannel = channel
+    t.Cleanup(func() {
+        ProcessDatagramsChannel = savedChannel
+        urtpVersionsAccepted = savedAccepted
+    })
+    payload := make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE)
+    standard := makeUrtpDatagram(PCM_SIGNED_16_BIT, 1234, payload)
+    // 1 second in microseconds
+    standard[URTP_TIMESTAMP_OFFSET + URTP_TIMESTAMP_SIZE - 3] = 0x0f
+    standard[URTP_TIMESTAMP_OFFSET + URTP_TIMESTAMP_SIZE - 2] = 0x42
+    standard[URTP_TIMESTAMP_OFFSET + URTP_TIMESTAMP_SIZE - 1] = 0x40
+    compact := makeCompactUrtpDatagram(PCM_SIGNED_16_BIT, 1234, 1000, payload)
+
+    for _, test := range []struct{version string; standard bool; compact bool}{{"2", true, false},
+                                                                                {"1", false, true},
+                                                                                {URTP_VERSION_AUTO, true, true}} {
+        err := setUrtpVersion(test.version)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, datagram := range []struct{bytes []byte; accepted bool}{{standard, test.standard}, {compact, test.compact}} {
+            fault := verifyUrtpHeader(datagram.bytes)
+            if (fault == URTP_HEADER_OK) != datagram.accepted {
+                t.Fatalf("with version %s accepted, datagram starting 0x%x found to be %s",
+                         test.version, datagram.bytes[0], fault.String())
+            }
+            if (fault != URTP_HEADER_BAD_SYNC) && !datagram.accepted {
+                t.Fatalf("with version %s accepted, datagram starting 0x%x found to be %s, not %s",
+                         test.version, datagram.bytes[0], fault.String(), URTP_HEADER_BAD_SYNC.String())
+            }
+            handleUdpDatagram(datagram.bytes, source)
+            select {
+                case item := <-channel:
+                    urtpDatagram := item.(*UrtpDatagram)
+                    if !datagram.accepted {
+                        t.Fatalf("with version %s accepted, datagram starting 0x%x let through",
+                                 test.version, datagram.bytes[0])
+                    }
+                    if (urtpDatagram.SequenceNumber != 1234) || (urtpDatagram.Timestamp != 1000000) ||
+                       (urtpDatagram.Audio == nil) || (len(*urtpDatagram.Audio) != SAMPLES_PER_BLOCK) {
+                        t.Fatalf("datagram starting 0x%x read as sequence number %d, timestamp %d us, audio %v",
+                                 datagram.bytes[0], urtpDatagram.SequenceNumber, urtpDatagram.Timestamp,
+                                 urtpDatagram.Audio != nil)
+                    }
+                default:
+                    if datagram.accepted {
+                        t.Fatalf("with version %s accepted, datagram starting 0x%x not let through",
+                                 test.version, datagram.bytes[0])
+                    }
+            }
+        }
+    }
+
+    for _, test := range []struct{datagram []byte; fault UrtpHeaderFault}{
+                            {makeCompactUrtpDatagram(URTP_HEARTBEAT, 1, 0, nil), URTP_HEADER_OK},
+                            {makeCompactUrtpDatagram(URTP_HEARTBEAT, 1, 0, nil)[:URTP_COMPACT_HEADER_SIZE - 1], URTP_HEADER_TOO_SHORT},
+                            {makeCompactUrtpDatagram(URTP_HEARTBEAT, 1, 0, []byte{0, 0}), URTP_HEADER_HEARTBEAT_PAYLOAD},
+                            {makeCompactUrtpDatagram(PCM_SIGNED_16_BIT, 1, 0, nil), URTP_HEADER_UNDERSIZED_PAYLOAD}} {
+        fault := verifyUrtpHeader(test.datagram)
+        if fault != test.fault {
+            t.Fatalf("compact header %x found to be %s when it is %s", test.datagram, fault.String(), test.fault.String())
+        }
+    }
+    if setUrtpVersion("3") == nil {
+        t.Fatal("URTP version 3 accepted")
+    }
+}
+
+/* End Of File */
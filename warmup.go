@@ -0,0 +1,53 @@
+/* Warming up the stream before any audio has arrived, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Fills with silence, in real time, from startup until the first audio
+// arrives, so that there are segments for players (and a CDN) to attach
+// to rather than an empty playlist; the live audio follows on in the
+// same timeline, so there is no discontinuity
+type WarmupFiller struct {
+    filler UnderrunFiller
+    // True once the live audio has begun
+    live bool
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Called on each tick of audio processing, with whether live audio has
+// begun, returning the silence (if any) to be written to the audio buffer
+func (warmup *WarmupFiller) Tick(now time.Time, live bool) []byte {
+    if warmup.live {
+        return nil
+    }
+    if live {
+        log.Printf("Live audio has begun, warm-up is over.\n")
+        warmup.live = true
+        return nil
+    }
+    // The underrun filler keeps pace with real time from the first tick
+    return warmup.filler.Tick(now, true)
+}
+
+/* End Of File */
@@ -0,0 +1,82 @@
+/* Tests of warming up the stream before any audio has arrived, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "bytes"
+    "testing"
+    "path/filepath"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Run the warm-up filler through a period before any audio arrives,
+// checking that it keeps pace with real time and stops for good once
+// the live audio has begun, then check that the playlist players attach
+// to before the first segment is well formed
+func TestWarmup(t *testing.T) {
+    var warmup WarmupFiller
+    var filled int
+
+    start := time.Now()
+    tick := time.Duration(0)
+    for ; tick <= TEST_STALL; tick += time.Duration(BLOCK_DURATION_MS) * time.Millisecond {
+        filled += len(warmup.Tick(start.Add(tick), false)) / URTP_SAMPLE_SIZE
+    }
+    warmupSamples := int(TEST_STALL * time.Duration(SAMPLING_FREQUENCY) / time.Second)
+    if (filled < warmupSamples - SAMPLES_PER_BLOCK) || (filled > warmupSamples + SAMPLES_PER_BLOCK) {
+        t.Fatalf("%d sample(s) of warm-up silence written over %d sample(s)", filled, warmupSamples)
+    }
+    if warmup.Tick(start.Add(tick), true) != nil {
+        t.Fatal("warm-up silence written once live audio had begun")
+    }
+    // Not even if the input then stalls, that is for the underrun filler
+    tick += TEST_STALL
+    if warmup.Tick(start.Add(tick), false) != nil {
+        t.Fatal("warm-up silence written after live audio had begun")
+    }
+
+    var err error
+    dirName := t.TempDir()
+    var store OsFileStore
+    playlistAccess.Lock()
+    savedPlaylists := playlists
+    playlists = createPlaylists(filepath.Join(dirName, "live" + PLAYLIST_EXTENSION), PlaylistConfig{Window: time.Minute}, nil)
+    playlistAccess.Unlock()
+    mp3FileList.Init()
+    t.Cleanup(func() {
+        playlistAccess.Lock()
+        playlists = savedPlaylists
+        playlistAccess.Unlock()
+    })
+    if !updatePlaylistFile(store, playlists[0], false, true, false, "") {
+        t.Fatal("unable to write the empty playlist")
+    }
+    contents, err := readStoreFile(store, playlists[0].fileName)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A live playlist must start with #EXTM3U and give a target duration,
+    // and must not be ended, else players give up on it
+    targetDuration := fmt.Sprintf("#EXT-X-TARGETDURATION:%d\r\n", int(MAX_MP3_FILE_DURATION / time.Second))
+    if !bytes.HasPrefix(contents, []byte("#EXTM3U\r\n")) || !bytes.Contains(contents, []byte(targetDuration)) ||
+       !bytes.Contains(contents, []byte("#EXT-X-MEDIA-SEQUENCE:0\r\n")) || bytes.Contains(contents, []byte("#EXT-X-ENDLIST")) {
+        t.Fatalf("empty playlist is not well formed:\n%s", contents)
+    }
+}
+
+/* End Of File */
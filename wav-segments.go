@@ -0,0 +1,331 @@
+/* Timestamped WAV segments, for forensic capture, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "errors"
+    "path/filepath"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The configuration of the WAV segments
+type WavSegmentOptions struct {
+    // The duration of each segment, rounded down to whole samples
+    Duration time.Duration
+    // What goes in the bext chunk of each segment
+    Description string
+    Originator string
+    OriginatorReference string
+    // If true the URTP timestamp is taken to be microseconds since the
+    // Unix epoch, else it is anchored to the server's clock at the
+    // start of the timeline
+    UrtpEpoch bool
+}
+
+// Where a URTP timestamp falls in the stream of samples written to the
+// WAV segments, and the time it stands for
+type WavAnchor struct {
+    position int64
+    timestamp uint64
+    time time.Time
+}
+
+// A writer of 16-bit mono PCM into a directory of fixed-duration
+// Broadcast Wave (BWF) files, each with a bext chunk giving the time at
+// which its first sample originated, derived from the URTP timestamps;
+// the sizes in the header of a segment are only correct once it has
+// been finished, which Close() does for the last one
+type WavSegmenter struct {
+    dir string
+    options WavSegmentOptions
+    segmentSamples int
+    handle *os.File
+    // The offset of the data size field in the header of the open segment
+    dataSizeOffset int64
+    dataBytes uint32
+    sequence int
+    // The samples written since the segmenter was created
+    samplesWritten int64
+    // The newest anchor at or before samplesWritten, then any after it
+    anchors []WavAnchor
+    // The base of the current timeline on the server's clock
+    timelineTime time.Time
+    timelineTimestamp uint64
+    access sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The file extension of WAV segments
+const WAV_SEGMENT_EXTENSION string = ".wav"
+
+// The format of the origination time in the name of a WAV segment
+const WAV_SEGMENT_TIME_FORMAT string = "20060102T150405.000Z"
+
+// The sizes of the fixed part of a bext chunk (EBU Tech 3285, version 1)
+// and of its text fields
+const BEXT_FIXED_SIZE int = 602
+const BEXT_DESCRIPTION_SIZE int = 256
+const BEXT_ORIGINATOR_SIZE int = 32
+const BEXT_ORIGINATOR_REFERENCE_SIZE int = 32
+
+// The offsets of the fields of a bext chunk, from the start of its data
+const BEXT_ORIGINATOR_OFFSET int = 256
+const BEXT_ORIGINATOR_REFERENCE_OFFSET int = 288
+const BEXT_ORIGINATION_DATE_OFFSET int = 320
+const BEXT_ORIGINATION_TIME_OFFSET int = 330
+const BEXT_TIME_REFERENCE_OFFSET int = 338
+const BEXT_VERSION_OFFSET int = 346
+const BEXT_CODING_HISTORY_OFFSET int = BEXT_FIXED_SIZE
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The WAV segmenter, nil if there are no WAV segments
+var wavSegmenter *WavSegmenter
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that the BWF metadata fits its fields in the bext chunk
+func checkBwfMetadata(options WavSegmentOptions) error {
+    if len(options.Description) > BEXT_DESCRIPTION_SIZE {
+        return errors.New(fmt.Sprintf("BWF description is %d byte(s) long, longer than %d", len(options.Description), BEXT_DESCRIPTION_SIZE))
+    }
+    if len(options.Originator) > BEXT_ORIGINATOR_SIZE {
+        return errors.New(fmt.Sprintf("BWF originator is %d byte(s) long, longer than %d", len(options.Originator), BEXT_ORIGINATOR_SIZE))
+    }
+    if len(options.OriginatorReference) > BEXT_ORIGINATOR_REFERENCE_SIZE {
+        return errors.New(fmt.Sprintf("BWF originator reference is %d byte(s) long, longer than %d",
+                                      len(options.OriginatorReference), BEXT_ORIGINATOR_REFERENCE_SIZE))
+    }
+    return nil
+}
+
+// Create the bext chunk, header included, of a segment whose first
+// sample originated at the given time; the date and time are in UTC and
+// the time reference is the number of samples since midnight UTC; the
+// coding history records the URTP timestamp the time was derived from,
+// or that there was none
+func bextChunk(options WavSegmentOptions, origination time.Time, timestamp uint64, timestamped bool) []byte {
+    var history string
+
+    origination = origination.UTC()
+    midnight := time.Date(origination.Year(), origination.Month(), origination.Day(), 0, 0, 0, 0, time.UTC)
+    history = fmt.Sprintf("A=PCM,F=%d,W=%d,M=mono,T=URTP timestamp %d us\r\n", SAMPLING_FREQUENCY, URTP_SAMPLE_SIZE * 8, timestamp)
+    if !timestamped {
+        history = fmt.Sprintf("A=PCM,F=%d,W=%d,M=mono,T=no URTP timestamp, server clock\r\n", SAMPLING_FREQUENCY, URTP_SAMPLE_SIZE * 8)
+    }
+    size := BEXT_FIXED_SIZE + len(history)
+    chunk := make([]byte, 8 + size + size % 2)
+    copy(chunk[0:], "bext")
+    binary.LittleEndian.PutUint32(chunk[4:], uint32(size))
+    data := chunk[8:]
+    copy(data[0:BEXT_DESCRIPTION_SIZE], options.Description)
+    copy(data[BEXT_ORIGINATOR_OFFSET:BEXT_ORIGINATOR_OFFSET + BEXT_ORIGINATOR_SIZE], options.Originator)
+    copy(data[BEXT_ORIGINATOR_REFERENCE_OFFSET:BEXT_ORIGINATOR_REFERENCE_OFFSET + BEXT_ORIGINATOR_REFERENCE_SIZE],
+         options.OriginatorReference)
+    copy(data[BEXT_ORIGINATION_DATE_OFFSET:], origination.Format("2006-01-02"))
+    copy(data[BEXT_ORIGINATION_TIME_OFFSET:], origination.Format("15:04:05"))
+    binary.LittleEndian.PutUint64(data[BEXT_TIME_REFERENCE_OFFSET:],
+                                  uint64(origination.Sub(midnight) * time.Duration(SAMPLING_FREQUENCY) / time.Second))
+    binary.LittleEndian.PutUint16(data[BEXT_VERSION_OFFSET:], 1)
+    copy(data[BEXT_CODING_HISTORY_OFFSET:], history)
+
+    return chunk
+}
+
+// Create the header of a WAV segment with the given bext chunk for the
+// given number of bytes of audio data, returning it and the offset of
+// the data size field in it
+func wavSegmentHeader(bext []byte, dataBytes uint32) ([]byte, int64) {
+    canonical := wavHeader(dataBytes)
+    header := append(append(append([]byte(nil), canonical[:12]...), bext...), canonical[12:]...)
+    binary.LittleEndian.PutUint32(header[WAV_RIFF_SIZE_OFFSET:], uint32(len(header) - 8) + dataBytes)
+
+    return header, int64(len(bext)) + WAV_DATA_SIZE_OFFSET
+}
+
+// Create a writer of WAV segments into the given directory, creating
+// the directory if need be
+func createWavSegmenter(dir string, options WavSegmentOptions) (*WavSegmenter, error) {
+    err := os.MkdirAll(dir, os.ModePerm)
+    if err != nil {
+        return nil, err
+    }
+    segmentSamples := int(options.Duration * time.Duration(SAMPLING_FREQUENCY) / time.Second)
+    if segmentSamples <= 0 {
+        return nil, errors.New(fmt.Sprintf("WAV segment duration %v is too short", options.Duration))
+    }
+
+    return &WavSegmenter{dir: dir, options: options, segmentSamples: segmentSamples}, nil
+}
+
+// Note that the audio of a datagram with the given URTP timestamp is
+// about to be added to the pending samples not yet written; first is true
+// if the datagram starts a timeline.  Anchors no longer needed to time a
+// segment are dropped
+func (segmenter *WavSegmenter) Anchor(timestamp uint64, first bool, pendingSamples int) {
+    var anchor WavAnchor
+
+    segmenter.access.Lock()
+    defer segmenter.access.Unlock()
+    if first || segmenter.timelineTime.IsZero() {
+        segmenter.timelineTime = time.Now()
+        segmenter.timelineTimestamp = timestamp
+    }
+    anchor.position = segmenter.samplesWritten + int64(pendingSamples)
+    anchor.timestamp = timestamp
+    if segmenter.options.UrtpEpoch {
+        anchor.time = time.Unix(0, int64(timestamp) * int64(time.Microsecond))
+    } else {
+        anchor.time = segmenter.timelineTime.Add(time.Duration(int64(timestamp - segmenter.timelineTimestamp)) * time.Microsecond)
+    }
+    segmenter.anchors = append(segmenter.anchors, anchor)
+    for (len(segmenter.anchors) > 1) && (segmenter.anchors[1].position <= segmenter.samplesWritten) {
+        segmenter.anchors = segmenter.anchors[1:]
+    }
+}
+
+// Return the time at which the sample at the given position in the
+// stream originated, with the URTP timestamp it stands for, extrapolated
+// from the newest anchor at or before it (or the first after it, for the
+// samples that came before any audio, e.g. pre-roll); if there is no
+// anchor the server's clock is used and false is returned.  Must be
+// called with the lock held
+func (segmenter *WavSegmenter) origination(position int64) (time.Time, uint64, bool) {
+    if len(segmenter.anchors) == 0 {
+        return time.Now(), 0, false
+    }
+    for (len(segmenter.anchors) > 1) && (segmenter.anchors[1].position <= position) {
+        segmenter.anchors = segmenter.anchors[1:]
+    }
+    anchor := segmenter.anchors[0]
+    offset := time.Duration(position - anchor.position) * time.Second / time.Duration(SAMPLING_FREQUENCY)
+    return anchor.time.Add(offset), anchor.timestamp + uint64(int64(offset / time.Microsecond)), true
+}
+
+// Start the next segment, named after the time its first sample
+// originated.  Must be called with the lock held
+func (segmenter *WavSegmenter) start() error {
+    origination, timestamp, timestamped := segmenter.origination(segmenter.samplesWritten)
+    fileName := filepath.Join(segmenter.dir, fmt.Sprintf("%s-%d%s", origination.UTC().Format(WAV_SEGMENT_TIME_FORMAT),
+                                                         segmenter.sequence, WAV_SEGMENT_EXTENSION))
+    segmenter.sequence++
+    header, dataSizeOffset := wavSegmentHeader(bextChunk(segmenter.options, origination, timestamp, timestamped), 0)
+    handle, err := os.Create(fileName)
+    if err != nil {
+        return err
+    }
+    _, err = handle.Write(header)
+    if err != nil {
+        handle.Close()
+        os.Remove(fileName)
+        return err
+    }
+    segmenter.handle = handle
+    segmenter.dataSizeOffset = dataSizeOffset
+    segmenter.dataBytes = 0
+    if !timestamped {
+        log.Printf("No URTP timestamp yet, WAV segment \"%s\" is timed by the server's clock.\n", fileName)
+    }
+
+    return nil
+}
+
+// Finish the open segment, writing the final sizes into its header.
+// Must be called with the lock held
+func (segmenter *WavSegmenter) finish() error {
+    if segmenter.handle == nil {
+        return nil
+    }
+    handle := segmenter.handle
+    segmenter.handle = nil
+    size := make([]byte, 4)
+    binary.LittleEndian.PutUint32(size, uint32(segmenter.dataSizeOffset + 4 - 8) + segmenter.dataBytes)
+    _, err := handle.WriteAt(size, WAV_RIFF_SIZE_OFFSET)
+    if err == nil {
+        binary.LittleEndian.PutUint32(size, segmenter.dataBytes)
+        _, err = handle.WriteAt(size, segmenter.dataSizeOffset)
+    }
+    err1 := handle.Close()
+    if err == nil {
+        err = err1
+    }
+    if err == nil {
+        log.Printf("Closed WAV segment \"%s\", %d sample(s).\n", handle.Name(), segmenter.dataBytes / uint32(URTP_SAMPLE_SIZE))
+    } else {
+        log.Printf("Unable to finish WAV segment \"%s\" (%s).\n", handle.Name(), err.Error())
+    }
+
+    return err
+}
+
+// Write 16-bit little-endian PCM into the WAV segments, starting and
+// finishing segments as it fills them.  Audio that cannot be written is
+// lost but is still counted, so that the segments after it keep to the
+// cadence, and it is never reported as an error, since that would hold
+// up the other PCM outputs
+func (segmenter *WavSegmenter) Write(data []byte) (int, error) {
+    segmenter.access.Lock()
+    defer segmenter.access.Unlock()
+    for offset := 0; offset < len(data); {
+        if segmenter.handle == nil {
+            err := segmenter.start()
+            if err != nil {
+                log.Printf("Unable to start a WAV segment in \"%s\" (%s), its audio will be lost.\n", segmenter.dir, err.Error())
+            }
+        }
+        length := segmenter.segmentSamples * URTP_SAMPLE_SIZE - int(segmenter.dataBytes)
+        if length > len(data) - offset {
+            length = len(data) - offset
+        }
+        if segmenter.handle != nil {
+            _, err := segmenter.handle.Write(data[offset:offset + length])
+            if err != nil {
+                log.Printf("Unable to write to WAV segment \"%s\" (%s).\n", segmenter.handle.Name(), err.Error())
+            }
+        }
+        segmenter.dataBytes += uint32(length)
+        segmenter.samplesWritten += int64(length / URTP_SAMPLE_SIZE)
+        offset += length
+        if int(segmenter.dataBytes) >= segmenter.segmentSamples * URTP_SAMPLE_SIZE {
+            segmenter.finish()
+            segmenter.dataBytes = 0
+        }
+    }
+
+    return len(data), nil
+}
+
+// Finish the segment being written, if there is one
+func (segmenter *WavSegmenter) Close() error {
+    segmenter.access.Lock()
+    defer segmenter.access.Unlock()
+    return segmenter.finish()
+}
+
+/* End Of File */
@@ -0,0 +1,106 @@
+/* Tests of timestamped WAV segments, for forensic capture, for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "bytes"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Write two and a half segments' worth of audio, anchored part way into
+// the first segment to a URTP timestamp taken as Unix time, checking
+// that the segments are cut at the right samples, that the sizes in
+// their headers are right once finished and that their bext chunks give
+// the times that their first samples originated
+func TestWavSegments(t *testing.T) {
+    var err error
+    dirName := t.TempDir()
+    options := WavSegmentOptions{Duration: time.Second, Description: "Test", Originator: "ioc-server",
+                                 OriginatorReference: "chuffs", UrtpEpoch: true}
+    err = checkBwfMetadata(options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    segmenter, err := createWavSegmenter(dirName, options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The first sample written is at noon, the datagram a tenth of a
+    // second in
+    base := time.Date(2024, time.January, 31, 12, 0, 0, 0, time.UTC)
+    segmenter.Anchor(uint64(base.Add(time.Millisecond * 100).UnixNano() / int64(time.Microsecond)), true,
+                     SAMPLING_FREQUENCY / 10)
+    audio := make([]byte, SAMPLING_FREQUENCY * 5 / 2 * URTP_SAMPLE_SIZE)
+    for x := 0; x < len(audio) / URTP_SAMPLE_SIZE; x++ {
+        binary.LittleEndian.PutUint16(audio[x * URTP_SAMPLE_SIZE:], uint16(x))
+    }
+    for offset := 0; offset < len(audio); offset += 1000 {
+        end := offset + 1000
+        if end > len(audio) {
+            end = len(audio)
+        }
+        segmenter.Write(audio[offset:end])
+    }
+    err = segmenter.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    fileNames, err := filepath.Glob(filepath.Join(dirName, "*" + WAV_SEGMENT_EXTENSION))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(fileNames) != 3 {
+        t.Fatalf("%d WAV segment(s) written when 3 were expected", len(fileNames))
+    }
+    position := 0
+    for x, expectedSamples := range []int{SAMPLING_FREQUENCY, SAMPLING_FREQUENCY, SAMPLING_FREQUENCY / 2} {
+        origination := base.Add(time.Second * time.Duration(x))
+        fileName := filepath.Join(dirName, fmt.Sprintf("%s-%d%s", origination.Format(WAV_SEGMENT_TIME_FORMAT), x, WAV_SEGMENT_EXTENSION))
+        contents, err := ioutil.ReadFile(fileName)
+        if err != nil {
+            t.Fatal(err)
+        }
+        expectedBext := bextChunk(options, origination, uint64(origination.UnixNano() / int64(time.Microsecond)), true)
+        expectedHeader, _ := wavSegmentHeader(expectedBext, uint32(expectedSamples * URTP_SAMPLE_SIZE))
+        if !bytes.HasPrefix(contents, expectedHeader) {
+            t.Fatalf("WAV segment \"%s\" does not have the expected header", fileName)
+        }
+        bext := contents[12 + 8:]
+        if (string(bext[BEXT_ORIGINATION_DATE_OFFSET:BEXT_ORIGINATION_TIME_OFFSET]) != "2024-01-31") ||
+           (string(bext[BEXT_ORIGINATION_TIME_OFFSET:BEXT_TIME_REFERENCE_OFFSET]) != origination.Format("15:04:05")) ||
+           (binary.LittleEndian.Uint64(bext[BEXT_TIME_REFERENCE_OFFSET:]) != uint64((12 * 3600 + x) * SAMPLING_FREQUENCY)) {
+            t.Fatalf("bext chunk of WAV segment \"%s\" gives %s %s, time reference %d",
+                     fileName, bext[BEXT_ORIGINATION_DATE_OFFSET:BEXT_ORIGINATION_TIME_OFFSET],
+                     bext[BEXT_ORIGINATION_TIME_OFFSET:BEXT_TIME_REFERENCE_OFFSET],
+                     binary.LittleEndian.Uint64(bext[BEXT_TIME_REFERENCE_OFFSET:]))
+        }
+        if (int(binary.LittleEndian.Uint32(contents[WAV_RIFF_SIZE_OFFSET:])) != len(contents) - 8) ||
+           !bytes.Equal(contents[len(expectedHeader):], audio[position:position + expectedSamples * URTP_SAMPLE_SIZE]) {
+            t.Fatalf("WAV segment \"%s\" of %d byte(s) does not hold the expected %d sample(s)",
+                     fileName, len(contents), expectedSamples)
+        }
+        position += expectedSamples * URTP_SAMPLE_SIZE
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,109 @@
+/* WAV file output for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "sync"
+    "encoding/binary"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A writer of 16-bit mono PCM to a RIFF/WAVE file; the sizes in the
+// header are only correct once the file has been closed
+type WavWriter struct {
+    handle *os.File
+    dataBytes uint32
+    access sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The size of a canonical WAV header
+const WAV_HEADER_SIZE int = 44
+
+// The offsets of the size fields in a WAV header
+const WAV_RIFF_SIZE_OFFSET int64 = 4
+const WAV_DATA_SIZE_OFFSET int64 = 40
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create the WAV header for the given number of bytes of audio data
+func wavHeader(dataBytes uint32) []byte {
+    header := make([]byte, WAV_HEADER_SIZE)
+
+    copy(header[0:], "RIFF")
+    binary.LittleEndian.PutUint32(header[WAV_RIFF_SIZE_OFFSET:], uint32(WAV_HEADER_SIZE - 8) + dataBytes)
+    copy(header[8:], "WAVE")
+    copy(header[12:], "fmt ")
+    binary.LittleEndian.PutUint32(header[16:], 16) // Size of the fmt chunk
+    binary.LittleEndian.PutUint16(header[20:], 1)  // PCM
+    binary.LittleEndian.PutUint16(header[22:], 1)  // Mono
+    binary.LittleEndian.PutUint32(header[24:], uint32(SAMPLING_FREQUENCY))
+    binary.LittleEndian.PutUint32(header[28:], uint32(SAMPLING_FREQUENCY * URTP_SAMPLE_SIZE)) // Byte rate
+    binary.LittleEndian.PutUint16(header[32:], uint16(URTP_SAMPLE_SIZE)) // Block align
+    binary.LittleEndian.PutUint16(header[34:], uint16(URTP_SAMPLE_SIZE * 8)) // Bits per sample
+    copy(header[36:], "data")
+    binary.LittleEndian.PutUint32(header[WAV_DATA_SIZE_OFFSET:], dataBytes)
+
+    return header
+}
+
+// Create a WAV file (truncating it if it already exists)
+func createWavFile(fileName string) (*WavWriter, error) {
+    handle, err := os.Create(fileName)
+    if err == nil {
+        _, err = handle.Write(wavHeader(0))
+        if err == nil {
+            return &WavWriter{handle: handle}, nil
+        }
+        handle.Close()
+    }
+
+    return nil, err
+}
+
+// Write 16-bit little-endian PCM to a WAV file
+func (wav *WavWriter) Write(data []byte) (int, error) {
+    wav.access.Lock()
+    defer wav.access.Unlock()
+    n, err := wav.handle.Write(data)
+    wav.dataBytes += uint32(n)
+    return n, err
+}
+
+// Close a WAV file, writing the final sizes into the header
+func (wav *WavWriter) Close() error {
+    wav.access.Lock()
+    defer wav.access.Unlock()
+    header := wavHeader(wav.dataBytes)
+    _, err := wav.handle.WriteAt(header[WAV_RIFF_SIZE_OFFSET:WAV_RIFF_SIZE_OFFSET + 4], WAV_RIFF_SIZE_OFFSET)
+    if err == nil {
+        _, err = wav.handle.WriteAt(header[WAV_DATA_SIZE_OFFSET:], WAV_DATA_SIZE_OFFSET)
+    }
+    err1 := wav.handle.Close()
+    if err == nil {
+        err = err1
+    }
+
+    return err
+}
+
+/* End Of File */